@@ -9,18 +9,29 @@ import (
 	"time"
 
 	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsapplicationautoscaling"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsdynamodb"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsec2"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsecrassets"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsecs"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsecspatterns"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awskms"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awslogs"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awss3"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awssecretsmanager"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awssqs"
 
 	"github.com/aws/constructs-go/constructs/v10"
 	"github.com/aws/jsii-runtime-go"
 )
 
+// maxReceiveCount is how many times a message of the queue is received
+// before it is dead-lettered. The consumer fails workflow steps for good one
+// attempt earlier, so that their workflow is compensated.
+const maxReceiveCount = 10
+
 type InfrastructureStackProps struct {
 	awscdk.StackProps
 }
@@ -41,15 +52,146 @@ func SimpleIngestionPipelineStack(scope constructs.Construct, id string, props *
 
 	epoch := fmt.Sprintf("%d", time.Now().Unix())
 
-	queue := awssqs.NewQueue(stack, jsii.String("IngestionSQS"), &awssqs.QueueProps{
+	// Deploy with `-c fifo=true` for a FIFO queue, which delivers the
+	// messages of a group in order. The services notice the .fifo suffix of
+	// the queue URL on their own.
+	fifo := fmt.Sprint(stack.Node().TryGetContext(jsii.String("fifo"))) == "true"
+	deadLetterQueueProps := &awssqs.QueueProps{
+		QueueName:       jsii.String("ingestion-sqs-dlq"),
+		RetentionPeriod: awscdk.Duration_Days(jsii.Number[float64](14)),
+	}
+	queueProps := &awssqs.QueueProps{
 		QueueName:         jsii.String("ingestion-sqs"),
 		VisibilityTimeout: awscdk.Duration_Seconds(jsii.Number[float64](300)),
-	})
+	}
+	if fifo {
+		deadLetterQueueProps.QueueName = jsii.String("ingestion-sqs-dlq.fifo")
+		deadLetterQueueProps.Fifo = jsii.Bool(true)
+		queueProps.QueueName = jsii.String("ingestion-sqs.fifo")
+		queueProps.Fifo = jsii.Bool(true)
+		// The supplier sends the payload ID as the deduplication ID
+		queueProps.ContentBasedDeduplication = jsii.Bool(false)
+	}
+	queueProps.DeadLetterQueue = &awssqs.DeadLetterQueue{
+		Queue:           awssqs.NewQueue(stack, jsii.String("IngestionDLQ"), deadLetterQueueProps),
+		MaxReceiveCount: jsii.Number[float64](maxReceiveCount),
+	}
+	queue := awssqs.NewQueue(stack, jsii.String("IngestionSQS"), queueProps)
 
 	stack.ExportValue(queue.QueueUrl(), &awscdk.ExportValueOptions{
 		Name: jsii.String("QueueURL"),
 	})
 
+	// Message bodies too large for SQS are offloaded here, see lib/claimcheck.
+	// They are kept for as long as their messages, which may be delivered
+	// again after they were processed.
+	claimCheckBucket := awss3.NewBucket(stack, jsii.String("ClaimCheckBucket"), &awss3.BucketProps{
+		BlockPublicAccess: awss3.BlockPublicAccess_BLOCK_ALL(),
+		Encryption:        awss3.BucketEncryption_S3_MANAGED,
+		EnforceSSL:        jsii.Bool(true),
+		RemovalPolicy:     awscdk.RemovalPolicy_DESTROY,
+		AutoDeleteObjects: jsii.Bool(true),
+		LifecycleRules: &[]*awss3.LifecycleRule{
+			{
+				Expiration: awscdk.Duration_Days(jsii.Number[float64](14)),
+			},
+		},
+	})
+	claimCheckBucketURL := jsii.String(fmt.Sprintf("s3://%s?region=%s&awssdk=v2", *claimCheckBucket.BucketName(), *stack.Region()))
+
+	// Long tasks checkpoint here to resume once redelivered, see
+	// lib/checkpoint. The consumer deletes them once their task succeeds.
+	checkpointBucket := awss3.NewBucket(stack, jsii.String("CheckpointBucket"), &awss3.BucketProps{
+		BlockPublicAccess: awss3.BlockPublicAccess_BLOCK_ALL(),
+		Encryption:        awss3.BucketEncryption_S3_MANAGED,
+		EnforceSSL:        jsii.Bool(true),
+		RemovalPolicy:     awscdk.RemovalPolicy_DESTROY,
+		AutoDeleteObjects: jsii.Bool(true),
+		LifecycleRules: &[]*awss3.LifecycleRule{
+			{
+				Expiration: awscdk.Duration_Days(jsii.Number[float64](14)),
+			},
+		},
+	})
+	checkpointBucketURL := jsii.String(fmt.Sprintf("s3://%s?region=%s&awssdk=v2", *checkpointBucket.BucketName(), *stack.Region()))
+
+	// Tasks and the messages enqueueing them are written together, see
+	// lib/outbox. Sent messages expire, tasks are kept.
+	outboxTable := awsdynamodb.NewTable(stack, jsii.String("OutboxTable"), &awsdynamodb.TableProps{
+		PartitionKey: &awsdynamodb.Attribute{
+			Name: jsii.String("pk"),
+			Type: awsdynamodb.AttributeType_STRING,
+		},
+		BillingMode:         awsdynamodb.BillingMode_PAY_PER_REQUEST,
+		TimeToLiveAttribute: jsii.String("expires_at"),
+		RemovalPolicy:       awscdk.RemovalPolicy_DESTROY,
+	})
+	outboxTable.AddGlobalSecondaryIndex(&awsdynamodb.GlobalSecondaryIndexProps{
+		IndexName: jsii.String("due-index"),
+		PartitionKey: &awsdynamodb.Attribute{
+			Name: jsii.String("due"),
+			Type: awsdynamodb.AttributeType_STRING,
+		},
+		SortKey: &awsdynamodb.Attribute{
+			Name: jsii.String("next_attempt_at"),
+			Type: awsdynamodb.AttributeType_NUMBER,
+		},
+	})
+	outboxURL := jsii.String(fmt.Sprintf("dynamodb://%s?region=%s", *outboxTable.TableName(), *stack.Region()))
+
+	// The steps of workflows, see lib/workflow. Partitioned by the task the
+	// workflow started with, so a workflow is read with a single query.
+	workflowTable := awsdynamodb.NewTable(stack, jsii.String("WorkflowTable"), &awsdynamodb.TableProps{
+		PartitionKey: &awsdynamodb.Attribute{
+			Name: jsii.String("pk"),
+			Type: awsdynamodb.AttributeType_STRING,
+		},
+		SortKey: &awsdynamodb.Attribute{
+			Name: jsii.String("sk"),
+			Type: awsdynamodb.AttributeType_STRING,
+		},
+		BillingMode:   awsdynamodb.BillingMode_PAY_PER_REQUEST,
+		RemovalPolicy: awscdk.RemovalPolicy_DESTROY,
+	})
+	workflowURL := jsii.String(fmt.Sprintf("dynamodb://%s?region=%s", *workflowTable.TableName(), *stack.Region()))
+
+	// Wraps the data key of every message, see lib/encryption. The supplier
+	// may only generate data keys, the consumer decrypts them and generates
+	// its own for the tasks its handlers return.
+	argumentsKey := awskms.NewKey(stack, jsii.String("ArgumentsEncryptionKey"), &awskms.KeyProps{
+		Description:       jsii.String("Encrypts the data keys of task arguments"),
+		EnableKeyRotation: jsii.Bool(true),
+		RemovalPolicy:     awscdk.RemovalPolicy_DESTROY,
+	})
+
+	// Services resolve secret references (secretsmanager://name, ssm://path)
+	// themselves, see lib/secrets. Everything they may read lives under this
+	// prefix so that new secrets don't require new grants.
+	secretsPrefix := "simple-ingestion-pipeline"
+	secretReadStatements := []awsiam.PolicyStatement{
+		awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+			Effect:  awsiam.Effect_ALLOW,
+			Actions: jsii.Strings("secretsmanager:GetSecretValue"),
+			Resources: jsii.Strings(
+				fmt.Sprintf("arn:aws:secretsmanager:%s:%s:secret:%s/*", *stack.Region(), *stack.Account(), secretsPrefix),
+			),
+		}),
+		awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+			Effect:  awsiam.Effect_ALLOW,
+			Actions: jsii.Strings("ssm:GetParameter"),
+			Resources: jsii.Strings(
+				fmt.Sprintf("arn:aws:ssm:%s:%s:parameter/%s/*", *stack.Region(), *stack.Account(), secretsPrefix),
+			),
+		}),
+	}
+	adminTokenSecret := awssecretsmanager.NewSecret(stack, jsii.String("WorkConsumerAdminToken"), &awssecretsmanager.SecretProps{
+		SecretName: jsii.String(secretsPrefix + "/admin-token"),
+		GenerateSecretString: &awssecretsmanager.SecretStringGenerator{
+			ExcludePunctuation: jsii.Bool(true),
+			PasswordLength:     jsii.Number(48),
+		},
+	})
+
 	// Work Supplying Function
 	lambdaPrincipal := awsiam.NewServicePrincipal(jsii.String("lambda.amazonaws.com"), &awsiam.ServicePrincipalOpts{})
 	workSupplierRole := awsiam.NewRole(stack, jsii.String("WorkSupplierRole"), &awsiam.RoleProps{
@@ -68,6 +210,13 @@ func SimpleIngestionPipelineStack(scope constructs.Construct, id string, props *
 		),
 	}))
 	queue.GrantSendMessages(workSupplierRole)
+	claimCheckBucket.GrantPut(workSupplierRole, nil)
+	argumentsKey.Grant(workSupplierRole, jsii.String("kms:GenerateDataKey"))
+	outboxTable.GrantReadWriteData(workSupplierRole)
+	workflowTable.GrantReadData(workSupplierRole)
+	for _, statement := range secretReadStatements {
+		workSupplierRole.AddToPolicy(statement)
+	}
 	// policyStatement := awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
 	// 	Actions:   jsii.Strings("sqs:SendMessage"),
 	// 	Resources: jsii.Strings(*queue.QueueArn()),
@@ -94,7 +243,16 @@ func SimpleIngestionPipelineStack(scope constructs.Construct, id string, props *
 	workSupplierFunction := awslambda.NewDockerImageFunction(stack, jsii.String("WorkSupplierDockerImageFunction"), &awslambda.DockerImageFunctionProps{
 		FunctionName: jsii.String("WorkSupplier"),
 		Environment: &map[string]*string{
-			"QUEUE_URL": queue.QueueUrl(),
+			"QUEUE_URL":              queue.QueueUrl(),
+			"CLAIM_CHECK_BUCKET_URL": claimCheckBucketURL,
+			"ENCRYPTION_KMS_KEY_ID":  argumentsKey.KeyArn(),
+			"OUTBOX_URL":             outboxURL,
+			"WORKFLOW_URL":           workflowURL,
+			// Frozen between invocations, the outbox is relayed by the
+			// OutboxRelayTask instead
+			"OUTBOX_RELAY_LOOP": jsii.String("false"),
+			// The lambda-web-adapter polls this before forwarding invocations
+			"AWS_LWA_READINESS_CHECK_PATH": jsii.String("/healthz"),
 		},
 		Code:         workSupplierDockerImage,
 		Role:         workSupplierRole,
@@ -136,6 +294,19 @@ func SimpleIngestionPipelineStack(scope constructs.Construct, id string, props *
 		AssumedBy: ecsTaskPrincipal,
 	})
 	queue.GrantConsumeMessages(workConsumerTaskRole)
+	claimCheckBucket.GrantRead(workConsumerTaskRole, nil)
+	claimCheckBucket.GrantDelete(workConsumerTaskRole, nil)
+	checkpointBucket.GrantReadWrite(workConsumerTaskRole, nil)
+	argumentsKey.GrantDecrypt(workConsumerTaskRole)
+	// Handlers return tasks, which the consumer enqueues like the supplier
+	queue.GrantSendMessages(workConsumerTaskRole)
+	claimCheckBucket.GrantPut(workConsumerTaskRole, nil)
+	argumentsKey.Grant(workConsumerTaskRole, jsii.String("kms:GenerateDataKey"))
+	workflowTable.GrantReadWriteData(workConsumerTaskRole)
+	for _, statement := range secretReadStatements {
+		workConsumerTaskRole.AddToPolicy(statement)
+	}
+	adminTokenSecret.GrantRead(workConsumerTaskRole, nil)
 	fargateCluster := awsecs.NewCluster(stack, jsii.String("SimpleIngestionPipelineCluster"), &awsecs.ClusterProps{
 		ClusterName: jsii.String("SimpleIngestionPipelineCluster"),
 		Vpc:         mainVPC,
@@ -150,7 +321,25 @@ func SimpleIngestionPipelineStack(scope constructs.Construct, id string, props *
 	taskDefinition.AddContainer(jsii.String("WorkConsumerTaskContainer"), &awsecs.ContainerDefinitionOptions{
 		Image: workConsumerDockerImage,
 		Environment: &map[string]*string{
-			"QUEUE_URL": queue.QueueUrl(),
+			"QUEUE_URL":              queue.QueueUrl(),
+			"CLAIM_CHECK_BUCKET_URL": claimCheckBucketURL,
+			"CHECKPOINT_BUCKET_URL":  checkpointBucketURL,
+			"WORKFLOW_URL":           workflowURL,
+			"WORKFLOW_QUEUE_URL":     queue.QueueUrl(),
+			"WORKFLOW_MAX_ATTEMPTS":  jsii.String(fmt.Sprint(maxReceiveCount - 1)),
+			"ENCRYPTION_KMS_KEY_ID":  argumentsKey.KeyArn(),
+			"ADMIN_ADDR":             jsii.String(":8081"),
+			"ADMIN_TOKEN":            jsii.String("secretsmanager://" + secretsPrefix + "/admin-token"),
+			// Received batches can hold several messages of a group
+			"PRESERVE_ORDER": jsii.String(fmt.Sprint(fifo)),
+		},
+		// Liveness only, an unreachable queue should not cause ECS to cycle tasks
+		HealthCheck: &awsecs.HealthCheck{
+			Command:     jsii.Strings("CMD", "/opt/main/main.run", "healthcheck", "/healthz"),
+			Interval:    awscdk.Duration_Seconds(jsii.Number[float64](30)),
+			Timeout:     awscdk.Duration_Seconds(jsii.Number[float64](5)),
+			Retries:     jsii.Number(3),
+			StartPeriod: awscdk.Duration_Seconds(jsii.Number[float64](15)),
 		},
 		Logging: awsecs.NewAwsLogDriver(&awsecs.AwsLogDriverProps{
 			StreamPrefix: jsii.String("TaskContainerInstance"),
@@ -166,6 +355,48 @@ func SimpleIngestionPipelineStack(scope constructs.Construct, id string, props *
 		TaskDefinition: taskDefinition,
 		DesiredCount:   jsii.Number(1),
 	})
+	// Relays the messages the supplier could not send right away, as it is
+	// frozen between invocations and can't do it in a loop of its own
+	outboxRelayDockerImage := awsecs.AssetImage_FromDockerImageAsset(awsecrassets.NewDockerImageAsset(stack,
+		jsii.String("OutboxRelayDockerImageAsset"),
+		&awsecrassets.DockerImageAssetProps{
+			Directory: jsii.String(".."),
+			AssetName: jsii.String("OutboxRelayContainerImage"),
+			Target:    jsii.String("main-vanilla"),
+			Platform:  awsecrassets.Platform_LINUX_AMD64(),
+			ExtraHash: jsii.String(epoch),
+			Invalidation: &awsecrassets.DockerImageAssetInvalidationOptions{
+				ExtraHash: jsii.Bool(true),
+			},
+			BuildArgs: &map[string]*string{
+				"TARGET_PACKAGE": jsii.String("work-supplier"),
+				"WIRE_TAGS":      jsii.String("aws"),
+			},
+		}))
+	outboxRelayTask := awsecspatterns.NewScheduledFargateTask(stack, jsii.String("OutboxRelayTask"), &awsecspatterns.ScheduledFargateTaskProps{
+		Cluster:  fargateCluster,
+		Schedule: awsapplicationautoscaling.Schedule_Rate(awscdk.Duration_Minutes(jsii.Number[float64](1))),
+		SubnetSelection: &awsec2.SubnetSelection{
+			SubnetType: awsec2.SubnetType_PRIVATE_WITH_EGRESS,
+		},
+		ScheduledFargateTaskImageOptions: &awsecspatterns.ScheduledFargateTaskImageOptions{
+			Image:   outboxRelayDockerImage,
+			Command: jsii.Strings("relay"),
+			Environment: &map[string]*string{
+				"QUEUE_URL":  queue.QueueUrl(),
+				"OUTBOX_URL": outboxURL,
+			},
+			Cpu:            jsii.Number[float64](256),
+			MemoryLimitMiB: jsii.Number[float64](512),
+			LogDriver: awsecs.NewAwsLogDriver(&awsecs.AwsLogDriverProps{
+				StreamPrefix: jsii.String("OutboxRelay"),
+				Mode:         awsecs.AwsLogDriverMode_NON_BLOCKING,
+				LogRetention: awslogs.RetentionDays_FIVE_DAYS,
+			}),
+		},
+	})
+	queue.GrantSendMessages(outboxRelayTask.TaskDefinition().TaskRole())
+	outboxTable.GrantReadWriteData(outboxRelayTask.TaskDefinition().TaskRole())
 	// consumerService.AutoScaleTaskCount(&awsapplicationautoscaling.EnableScalingProps{
 	// 	MinCapacity: jsii.Number(0),
 	// 	MaxCapacity: jsii.Number(1),
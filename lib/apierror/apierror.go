@@ -0,0 +1,189 @@
+// Package apierror renders errors to clients as RFC 7807 problem details.
+// Every problem carries a stable code clients can branch on, and the ID of
+// the request so that it can be found in the logs. What caused an error is
+// logged, never written to the client.
+package apierror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog"
+)
+
+// ContentType of problem details.
+const ContentType = "application/problem+json"
+
+// Code identifies the kind of error. Codes are part of the API and never
+// change once published.
+type Code string
+
+const (
+	CodeInvalidArgument  Code = "invalid_argument"
+	CodePayloadTooLarge  Code = "payload_too_large"
+	CodeNotFound         Code = "not_found"
+	CodeMethodNotAllowed Code = "method_not_allowed"
+	CodeUnavailable      Code = "unavailable"
+	CodeDependencyFailed Code = "dependency_failed"
+	CodeInternal         Code = "internal"
+)
+
+// Error is an error meant for the client. Detail is shown to the client,
+// Err only to the logs.
+type Error struct {
+	Status int
+	Code   Code
+	Detail string
+	// RetryAfter is sent as the Retry-After header when positive.
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %s", e.Code, e.Detail, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Detail)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func InvalidArgument(detail string) *Error {
+	return &Error{Status: http.StatusBadRequest, Code: CodeInvalidArgument, Detail: detail}
+}
+
+func PayloadTooLarge(detail string) *Error {
+	return &Error{Status: http.StatusRequestEntityTooLarge, Code: CodePayloadTooLarge, Detail: detail}
+}
+
+func ResourceNotFound(detail string) *Error {
+	return &Error{Status: http.StatusNotFound, Code: CodeNotFound, Detail: detail}
+}
+
+// Unavailable is a dependency that is expected to recover, so the client
+// should try again after retryAfter.
+func Unavailable(detail string, retryAfter time.Duration, err error) *Error {
+	return &Error{Status: http.StatusServiceUnavailable, Code: CodeUnavailable, Detail: detail, RetryAfter: retryAfter, Err: err}
+}
+
+func DependencyFailed(detail string, err error) *Error {
+	return &Error{Status: http.StatusFailedDependency, Code: CodeDependencyFailed, Detail: detail, Err: err}
+}
+
+func Internal(err error) *Error {
+	return &Error{Status: http.StatusInternalServerError, Code: CodeInternal, Detail: "an internal error occurred", Err: err}
+}
+
+// From returns err as an *Error, errors other than *Error are internal.
+func From(err error) *Error {
+	apiErr := &Error{}
+	if !errors.As(err, &apiErr) {
+		apiErr = Internal(err)
+	}
+	return apiErr
+}
+
+func logError(ctx context.Context, apiErr *Error) {
+	log := zerolog.Ctx(ctx)
+	if apiErr.Status >= 500 || apiErr.Err != nil {
+		log.Error().Err(apiErr.Err).Str("code", string(apiErr.Code)).Int("status", apiErr.Status).Msg(apiErr.Detail)
+	} else {
+		log.Info().Str("code", string(apiErr.Code)).Int("status", apiErr.Status).Msg(apiErr.Detail)
+	}
+}
+
+// retryAfterSeconds is rounded up, a Retry-After of 0 would invite clients
+// straight back.
+func (e *Error) retryAfterSeconds() string {
+	return strconv.Itoa(int((e.RetryAfter + time.Second - 1) / time.Second))
+}
+
+// Problem is the body of an error response, as described by RFC 7807.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      Code   `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Write responds to r with err. Errors other than *Error are internal.
+func Write(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr := From(err)
+	logError(r.Context(), apiErr)
+	problem := Problem{
+		Type:      "urn:problem-type:" + string(apiErr.Code),
+		Title:     http.StatusText(apiErr.Status),
+		Status:    apiErr.Status,
+		Detail:    apiErr.Detail,
+		Instance:  r.URL.Path,
+		Code:      apiErr.Code,
+		RequestID: middleware.GetReqID(r.Context()),
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	if apiErr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", apiErr.retryAfterSeconds())
+	}
+	w.WriteHeader(apiErr.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// RequestIDHeader echoes the ID of the request in responses, the header
+// middleware.RequestID takes it from when clients give one.
+const RequestIDHeader = "X-Request-Id"
+
+// EchoRequestID echoes the ID given to the request by middleware.RequestID
+// in the response, and adds it to the logger of the request.
+func EchoRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if requestID := middleware.GetReqID(ctx); requestID != "" {
+			w.Header().Set(RequestIDHeader, requestID)
+			ctx = zerolog.Ctx(ctx).With().Str("request_id", requestID).Logger().WithContext(ctx)
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Recoverer responds with an internal error when a handler panics, logging
+// the panic and its stack trace.
+func Recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			} else if recovered == http.ErrAbortHandler {
+				// Deliberately aborting the response, see http.ErrAbortHandler
+				panic(recovered)
+			}
+			zerolog.Ctx(r.Context()).Error().Interface("panic", recovered).Bytes("stack", debug.Stack()).Msg("recovered from a panic")
+			Write(w, r, Internal(fmt.Errorf("panic: %v", recovered)))
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// NotFound responds to requests for routes that don't exist.
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	Write(w, r, ResourceNotFound("no such route"))
+}
+
+// MethodNotAllowed responds to requests with a method the route doesn't
+// accept.
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	Write(w, r, &Error{Status: http.StatusMethodNotAllowed, Code: CodeMethodNotAllowed, Detail: fmt.Sprintf("%s is not allowed on this route", r.Method)})
+}
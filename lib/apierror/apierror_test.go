@@ -0,0 +1,95 @@
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRouter() *chi.Mux {
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID, EchoRequestID, Recoverer)
+	r.NotFound(NotFound)
+	r.MethodNotAllowed(MethodNotAllowed)
+	r.Get("/invalid", func(w http.ResponseWriter, r *http.Request) {
+		Write(w, r, InvalidArgument("name is required"))
+	})
+	r.Get("/unavailable", func(w http.ResponseWriter, r *http.Request) {
+		Write(w, r, Unavailable("try again later", time.Millisecond*1500, errors.New("dial tcp 10.0.0.1:5672: connection refused")))
+	})
+	r.Get("/wrapped", func(w http.ResponseWriter, r *http.Request) {
+		Write(w, r, fmt.Errorf("handling: %w", DependencyFailed("could not enqueue the task", errors.New("broker internals"))))
+	})
+	r.Get("/plain", func(w http.ResponseWriter, r *http.Request) {
+		Write(w, r, errors.New("secret internals"))
+	})
+	r.Get("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("secret internals")
+	})
+	return r
+}
+
+func serve(t *testing.T, method, path string) (*httptest.ResponseRecorder, Problem) {
+	request := httptest.NewRequest(method, path, nil)
+	request.Header.Set(RequestIDHeader, "test-request")
+	recorder := httptest.NewRecorder()
+	testRouter().ServeHTTP(recorder, request)
+	assert.Equal(t, ContentType, recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "test-request", recorder.Header().Get(RequestIDHeader))
+	assert.NotContains(t, recorder.Body.String(), "internals")
+	problem := Problem{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &problem))
+	assert.Equal(t, recorder.Code, problem.Status)
+	assert.Equal(t, "test-request", problem.RequestID)
+	assert.Equal(t, path, problem.Instance)
+	return recorder, problem
+}
+
+func TestWrite(t *testing.T) {
+	cases := []struct {
+		path   string
+		method string
+		status int
+		code   Code
+	}{
+		{"/invalid", http.MethodGet, http.StatusBadRequest, CodeInvalidArgument},
+		{"/unavailable", http.MethodGet, http.StatusServiceUnavailable, CodeUnavailable},
+		{"/wrapped", http.MethodGet, http.StatusFailedDependency, CodeDependencyFailed},
+		{"/plain", http.MethodGet, http.StatusInternalServerError, CodeInternal},
+		{"/panic", http.MethodGet, http.StatusInternalServerError, CodeInternal},
+		{"/missing", http.MethodGet, http.StatusNotFound, CodeNotFound},
+		{"/invalid", http.MethodPost, http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+	}
+	for _, c := range cases {
+		t.Run(c.method+c.path, func(t *testing.T) {
+			recorder, problem := serve(t, c.method, c.path)
+			assert.Equal(t, c.status, recorder.Code)
+			assert.Equal(t, c.code, problem.Code)
+			assert.Equal(t, "urn:problem-type:"+string(c.code), problem.Type)
+			assert.Equal(t, http.StatusText(c.status), problem.Title)
+		})
+	}
+}
+
+func TestRetryAfterRoundsUp(t *testing.T) {
+	recorder, _ := serve(t, http.MethodGet, "/unavailable")
+	assert.Equal(t, "2", recorder.Header().Get("Retry-After"))
+}
+
+func TestErrorUnwraps(t *testing.T) {
+	cause := errors.New("cause")
+	err := fmt.Errorf("wrapped: %w", DependencyFailed("detail", cause))
+	assert.ErrorIs(t, err, cause)
+	apiErr := &Error{}
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, CodeDependencyFailed, apiErr.Code)
+}
@@ -0,0 +1,119 @@
+package apierror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// RequestIDMetadata is the gRPC metadata key of the ID of the request,
+// echoed in the response header.
+const RequestIDMetadata = "x-request-id"
+
+// RetryAfterMetadata is the gRPC trailer key holding how many seconds to
+// wait before trying again, as Retry-After does over HTTP.
+const RetryAfterMetadata = "retry-after"
+
+var grpcCodes = map[Code]codes.Code{
+	CodeInvalidArgument:  codes.InvalidArgument,
+	CodePayloadTooLarge:  codes.ResourceExhausted,
+	CodeNotFound:         codes.NotFound,
+	CodeMethodNotAllowed: codes.Unimplemented,
+	CodeUnavailable:      codes.Unavailable,
+	CodeDependencyFailed: codes.Internal,
+	CodeInternal:         codes.Internal,
+}
+
+// GRPCStatus lets gRPC send the error with the code matching its Code.
+func (e *Error) GRPCStatus() *status.Status {
+	code, ok := grpcCodes[e.Code]
+	if !ok {
+		code = codes.Unknown
+	}
+	return status.New(code, e.Detail)
+}
+
+// UnaryServerInterceptor is the gRPC counterpart of the HTTP middleware:
+// it tags the request with an ID, recovers from panics and turns errors
+// into statuses without their causes.
+func UnaryServerInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (response any, err error) {
+	ctx = withRequestID(ctx, info.FullMethod)
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = recoveredError(ctx, recovered)
+		}
+		err = toStatus(ctx, err)
+	}()
+	return handler(ctx, req)
+}
+
+// StreamServerInterceptor is UnaryServerInterceptor for streams.
+func StreamServerInterceptor(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	ctx := withRequestID(stream.Context(), info.FullMethod)
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = recoveredError(ctx, recovered)
+		}
+		err = toStatus(ctx, err)
+	}()
+	return handler(srv, &contextStream{ServerStream: stream, ctx: ctx})
+}
+
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// withRequestID takes the ID of the request from its metadata, or makes one
+// up, and adds it to the logger of the request.
+func withRequestID(ctx context.Context, method string) context.Context {
+	requestID := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(RequestIDMetadata)) > 0 {
+		requestID = md.Get(RequestIDMetadata)[0]
+	}
+	if requestID == "" {
+		requestID = uuid.NewString()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(RequestIDMetadata, requestID))
+	return zerolog.Ctx(ctx).With().Str("request_id", requestID).Str("method", method).Logger().WithContext(ctx)
+}
+
+func recoveredError(ctx context.Context, recovered any) error {
+	zerolog.Ctx(ctx).Error().Interface("panic", recovered).Bytes("stack", debug.Stack()).Msg("recovered from a panic")
+	return Internal(fmt.Errorf("panic: %v", recovered))
+}
+
+func toStatus(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	apiErr := &Error{}
+	if !errors.As(err, &apiErr) {
+		if _, isStatus := status.FromError(err); isStatus {
+			// Already meant for the client, such as the errors of gRPC itself
+			return err
+		} else if errors.Is(err, context.Canceled) {
+			return status.FromContextError(context.Canceled).Err()
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			return status.FromContextError(context.DeadlineExceeded).Err()
+		}
+		apiErr = Internal(err)
+	}
+	logError(ctx, apiErr)
+	if apiErr.RetryAfter > 0 {
+		grpc.SetTrailer(ctx, metadata.Pairs(RetryAfterMetadata, apiErr.retryAfterSeconds()))
+	}
+	return apiErr.GRPCStatus().Err()
+}
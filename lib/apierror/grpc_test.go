@@ -0,0 +1,49 @@
+package apierror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func intercept(handler grpc.UnaryHandler) error {
+	_, err := UnaryServerInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/test/Method"}, handler)
+	return err
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	for name, c := range map[string]struct {
+		err    error
+		code   codes.Code
+		detail string
+	}{
+		"invalid":   {InvalidArgument("name is required"), codes.InvalidArgument, "name is required"},
+		"too large": {PayloadTooLarge("too large"), codes.ResourceExhausted, "too large"},
+		"wrapped":   {fmt.Errorf("handling: %w", DependencyFailed("could not enqueue the task", errors.New("broker internals"))), codes.Internal, "could not enqueue the task"},
+		"plain":     {errors.New("secret internals"), codes.Internal, "an internal error occurred"},
+		"status":    {status.Error(codes.PermissionDenied, "nope"), codes.PermissionDenied, "nope"},
+		"canceled":  {fmt.Errorf("waiting: %w", context.Canceled), codes.Canceled, context.Canceled.Error()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := intercept(func(ctx context.Context, req any) (any, error) {
+				return nil, c.err
+			})
+			assert.Equal(t, c.code, status.Code(err))
+			assert.Equal(t, c.detail, status.Convert(err).Message())
+		})
+	}
+}
+
+func TestUnaryServerInterceptorRecovers(t *testing.T) {
+	err := intercept(func(ctx context.Context, req any) (any, error) {
+		panic("secret internals")
+	})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.NotContains(t, err.Error(), "secret")
+}
@@ -0,0 +1,94 @@
+// Package checkpoint keeps what long tasks have done so far, keyed by the ID
+// of their task, so that a task that was interrupted and redelivered can
+// resume where it left off rather than start over.
+//
+// The bucket is any gocloud.dev/blob URL, like the claim check bucket:
+// s3://bucket?region=... when deployed, file:///path locally, or mem:// in
+// tests. Checkpoints are deleted once their task succeeds, the lifecycle
+// rules of the bucket should expire those of tasks that never do.
+package checkpoint
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/google/wire"
+	"gocloud.dev/blob"
+	_ "gocloud.dev/blob/fileblob"
+	_ "gocloud.dev/blob/memblob"
+	_ "gocloud.dev/blob/s3blob"
+	"gocloud.dev/gcerrors"
+)
+
+const keyPrefix = "checkpoints/"
+
+// Config is embedded into the configuration of each service.
+type Config struct {
+	CheckpointBucketURL string `env:"CHECKPOINT_BUCKET_URL" desc:"gocloud blob URL of the bucket the checkpoints of long tasks are kept in, e.g. s3://bucket?region=us-east-1 or file:///var/lib/checkpoints. Checkpoints are discarded when empty, so interrupted tasks start over"`
+}
+
+// ProviderSet provides the Store of CHECKPOINT_BUCKET_URL.
+var ProviderSet = wire.NewSet(OpenStore)
+
+// Store keeps the latest checkpoint of every task. A Store without a bucket
+// discards them.
+type Store struct {
+	bucket *blob.Bucket
+}
+
+// OpenStore opens the configured bucket, the returned function closes it.
+func OpenStore(ctx context.Context, cfg Config) (*Store, func(), error) {
+	if cfg.CheckpointBucketURL == "" {
+		return &Store{}, func() {}, nil
+	}
+	bucket, err := blob.OpenBucket(ctx, cfg.CheckpointBucketURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open checkpoint bucket: %w", err)
+	}
+	return NewStore(bucket), func() { bucket.Close() }, nil
+}
+
+func NewStore(bucket *blob.Bucket) *Store {
+	return &Store{bucket: bucket}
+}
+
+func key(taskID uuid.UUID) string {
+	return keyPrefix + taskID.String()
+}
+
+// Load returns the latest checkpoint of the task, nil when it has none.
+func (s *Store) Load(ctx context.Context, taskID uuid.UUID) ([]byte, error) {
+	if s.bucket == nil {
+		return nil, nil
+	}
+	data, err := s.bucket.ReadAll(ctx, key(taskID))
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not load checkpoint of task %s: %w", taskID, err)
+	}
+	return data, nil
+}
+
+// Save replaces the checkpoint of the task.
+func (s *Store) Save(ctx context.Context, taskID uuid.UUID, data []byte) error {
+	if s.bucket == nil {
+		return nil
+	}
+	if err := s.bucket.WriteAll(ctx, key(taskID), data, nil); err != nil {
+		return fmt.Errorf("could not save checkpoint of task %s: %w", taskID, err)
+	}
+	return nil
+}
+
+// Delete removes the checkpoint of the task, if it has one.
+func (s *Store) Delete(ctx context.Context, taskID uuid.UUID) error {
+	if s.bucket == nil {
+		return nil
+	}
+	if err := s.bucket.Delete(ctx, key(taskID)); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		return fmt.Errorf("could not delete checkpoint of task %s: %w", taskID, err)
+	}
+	return nil
+}
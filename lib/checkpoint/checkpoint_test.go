@@ -0,0 +1,45 @@
+package checkpoint
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob/memblob"
+)
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewStore(memblob.OpenBucket(nil))
+	taskID := uuid.New()
+
+	data, err := store.Load(ctx, taskID)
+	require.NoError(t, err)
+	assert.Nil(t, data, "tasks have no checkpoint until they save one")
+
+	require.NoError(t, store.Save(ctx, taskID, []byte("first")))
+	require.NoError(t, store.Save(ctx, taskID, []byte("second")))
+	data, err = store.Load(ctx, taskID)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("second"), data)
+
+	require.NoError(t, store.Delete(ctx, taskID))
+	data, err = store.Load(ctx, taskID)
+	require.NoError(t, err)
+	assert.Nil(t, data)
+	assert.NoError(t, store.Delete(ctx, taskID), "deleting twice is harmless")
+}
+
+func TestStoreWithoutBucket(t *testing.T) {
+	ctx := context.Background()
+	store, closeStore, err := OpenStore(ctx, Config{})
+	require.NoError(t, err)
+	defer closeStore()
+	taskID := uuid.New()
+	require.NoError(t, store.Save(ctx, taskID, []byte("discarded")))
+	data, err := store.Load(ctx, taskID)
+	require.NoError(t, err)
+	assert.Nil(t, data)
+}
@@ -0,0 +1,137 @@
+// Package claimcheck keeps message bodies that are too large for the broker
+// in blob storage, sending a reference (the claim check) in their place.
+//
+// The bucket is any gocloud.dev/blob URL: s3://bucket?region=... when
+// deployed, file:///path on a volume shared by both services locally, or
+// mem:// in tests.
+package claimcheck
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/google/wire"
+	"github.com/rs/zerolog"
+	"gocloud.dev/blob"
+	_ "gocloud.dev/blob/fileblob"
+	_ "gocloud.dev/blob/memblob"
+	_ "gocloud.dev/blob/s3blob"
+	"gocloud.dev/pubsub"
+)
+
+const (
+	// KeyMetadata holds the key of the offloaded body within the bucket.
+	KeyMetadata = "claim-check-key"
+	// ChecksumMetadata holds the hex encoded SHA-256 of the offloaded body.
+	ChecksumMetadata = "claim-check-sha256"
+	keyPrefix        = "claim-checks/"
+)
+
+var ErrNotConfigured = errors.New("message body was offloaded, but no claim check bucket is configured")
+
+type ChecksumMismatchErr struct {
+	Key      string
+	Expected string
+	Actual   string
+}
+
+func (cme ChecksumMismatchErr) Error() string {
+	return fmt.Sprintf("claim check %s has checksum %s, expected %s", cme.Key, cme.Actual, cme.Expected)
+}
+
+// Config is embedded into the configuration of each service.
+type Config struct {
+	ClaimCheckBucketURL string `env:"CLAIM_CHECK_BUCKET_URL" desc:"gocloud blob URL of the bucket oversized message bodies are offloaded to, e.g. s3://bucket?region=us-east-1 or file:///var/lib/claim-checks. Offloading is disabled when empty"`
+	// SQS allows 256 KiB including metadata, leave plenty of room for it
+	ClaimCheckThreshold int `env:"CLAIM_CHECK_THRESHOLD" default:"204800" desc:"Message bodies larger than this many bytes are offloaded to the bucket"`
+}
+
+func (c Config) Validate() []error {
+	if c.ClaimCheckThreshold < 1 {
+		return []error{fmt.Errorf("CLAIM_CHECK_THRESHOLD must be at least 1, got %d", c.ClaimCheckThreshold)}
+	}
+	return nil
+}
+
+// ProviderSet provides the Store of CLAIM_CHECK_BUCKET_URL.
+var ProviderSet = wire.NewSet(OpenStore)
+
+// Store offloads and retrieves message bodies. A Store without a bucket
+// leaves every message untouched.
+type Store struct {
+	bucket    *blob.Bucket
+	threshold int
+}
+
+// OpenStore opens the configured bucket, the returned function closes it.
+func OpenStore(ctx context.Context, cfg Config) (*Store, func(), error) {
+	if cfg.ClaimCheckBucketURL == "" {
+		return &Store{}, func() {}, nil
+	}
+	bucket, err := blob.OpenBucket(ctx, cfg.ClaimCheckBucketURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open claim check bucket: %w", err)
+	}
+	return NewStore(bucket, cfg.ClaimCheckThreshold), func() { bucket.Close() }, nil
+}
+
+func NewStore(bucket *blob.Bucket, threshold int) *Store {
+	return &Store{
+		bucket:    bucket,
+		threshold: threshold,
+	}
+}
+
+// IsClaimCheck reports whether the body of message was offloaded.
+func IsClaimCheck(message *pubsub.Message) bool {
+	_, isPresent := message.Metadata[KeyMetadata]
+	return isPresent
+}
+
+// Offload moves the body of message to the bucket when it exceeds the
+// threshold, leaving the reference in its metadata.
+func (s *Store) Offload(ctx context.Context, message *pubsub.Message) error {
+	if s.bucket == nil || len(message.Body) <= s.threshold {
+		return nil
+	}
+	key := keyPrefix + uuid.NewString()
+	checksum := sha256.Sum256(message.Body)
+	if err := s.bucket.WriteAll(ctx, key, message.Body, nil); err != nil {
+		return fmt.Errorf("could not offload message body: %w", err)
+	}
+	zerolog.Ctx(ctx).Debug().Str("claim_check_key", key).Int("size", len(message.Body)).Msg("offloaded message body")
+	if message.Metadata == nil {
+		message.Metadata = map[string]string{}
+	}
+	message.Metadata[KeyMetadata] = key
+	message.Metadata[ChecksumMetadata] = hex.EncodeToString(checksum[:])
+	// Some brokers refuse empty bodies
+	message.Body = []byte(key)
+	return nil
+}
+
+// Body returns the body of message, fetching and verifying it first when it
+// was offloaded. Offloaded bodies are never deleted, as the message may be
+// delivered again after it was acknowledged; the lifecycle rules of the
+// bucket expire them instead.
+func (s *Store) Body(ctx context.Context, message *pubsub.Message) ([]byte, error) {
+	if !IsClaimCheck(message) {
+		return message.Body, nil
+	} else if s.bucket == nil {
+		return nil, ErrNotConfigured
+	}
+	key := message.Metadata[KeyMetadata]
+	body, err := s.bucket.ReadAll(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch offloaded message body %s: %w", key, err)
+	}
+	checksum := sha256.Sum256(body)
+	if actual := hex.EncodeToString(checksum[:]); actual != message.Metadata[ChecksumMetadata] {
+		return nil, ChecksumMismatchErr{Key: key, Expected: message.Metadata[ChecksumMetadata], Actual: actual}
+	}
+	return body, nil
+}
@@ -0,0 +1,51 @@
+package claimcheck
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob/memblob"
+	"gocloud.dev/pubsub"
+)
+
+func TestOffloadRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	bucket := memblob.OpenBucket(nil)
+	store := NewStore(bucket, 16)
+
+	small := &pubsub.Message{Body: []byte("small")}
+	require.NoError(t, store.Offload(ctx, small))
+	assert.False(t, IsClaimCheck(small), "bodies within the threshold are sent as-is")
+
+	original := bytes.Repeat([]byte("large"), 100)
+	message := &pubsub.Message{Body: bytes.Clone(original)}
+	require.NoError(t, store.Offload(ctx, message))
+	require.True(t, IsClaimCheck(message))
+	assert.Less(t, len(message.Body), len(original))
+
+	body, err := store.Body(ctx, message)
+	require.NoError(t, err)
+	assert.Equal(t, original, body)
+
+	body, err = store.Body(ctx, message)
+	require.NoError(t, err, "duplicate deliveries still find the body")
+	assert.Equal(t, original, body)
+}
+
+func TestBodyVerifiesChecksum(t *testing.T) {
+	ctx := context.Background()
+	bucket := memblob.OpenBucket(nil)
+	store := NewStore(bucket, 1)
+	message := &pubsub.Message{Body: []byte("the original body")}
+	require.NoError(t, store.Offload(ctx, message))
+	require.NoError(t, bucket.WriteAll(ctx, message.Metadata[KeyMetadata], []byte("tampered"), nil))
+
+	_, err := store.Body(ctx, message)
+	assert.ErrorAs(t, err, &ChecksumMismatchErr{})
+
+	_, err = (&Store{}).Body(ctx, message)
+	assert.ErrorIs(t, err, ErrNotConfigured)
+}
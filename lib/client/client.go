@@ -0,0 +1,295 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ProblemError is an error reported by the supplier.
+type ProblemError struct {
+	StatusCode int
+	Problem    Problem
+	// RetryAfter is how long the supplier asked to wait before trying again.
+	RetryAfter time.Duration
+}
+
+func (e *ProblemError) Error() string {
+	if e.Problem.Detail != nil {
+		return fmt.Sprintf("supplier responded %d %s: %s", e.StatusCode, e.Problem.Code, *e.Problem.Detail)
+	}
+	return fmt.Sprintf("supplier responded %d %s", e.StatusCode, e.Problem.Code)
+}
+
+// Supplier submits tasks to the work-supplier and polls their status. Tasks
+// are only submitted again when the supplier reported it didn't accept them,
+// so a retry never enqueues a task twice.
+type Supplier struct {
+	api           *ClientWithResponses
+	clientOptions []ClientOption
+	maxAttempts   int
+	retryBackoff  time.Duration
+	maxBackoff    time.Duration
+}
+
+type SupplierOption func(*Supplier)
+
+// WithRetries makes up to maxAttempts attempts at every call, waiting backoff
+// before the first retry and doubling it up to maxBackoff. A Retry-After
+// given by the supplier is waited instead, also up to maxBackoff.
+func WithRetries(maxAttempts int, backoff, maxBackoff time.Duration) SupplierOption {
+	return func(s *Supplier) {
+		s.maxAttempts = maxAttempts
+		s.retryBackoff = backoff
+		s.maxBackoff = maxBackoff
+	}
+}
+
+// WithClientOptions configures the generated client, e.g. WithHTTPClient.
+func WithClientOptions(opts ...ClientOption) SupplierOption {
+	return func(s *Supplier) {
+		s.clientOptions = append(s.clientOptions, opts...)
+	}
+}
+
+// NewSupplier returns a client of the supplier at server, such as
+// http://localhost:8080. By default every call is attempted 3 times.
+func NewSupplier(server string, opts ...SupplierOption) (*Supplier, error) {
+	s := &Supplier{
+		maxAttempts:  3,
+		retryBackoff: time.Millisecond * 500,
+		maxBackoff:   time.Second * 30,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	api, err := NewClientWithResponses(server, s.clientOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create supplier client: %w", err)
+	}
+	s.api = api
+	return s, nil
+}
+
+// Submit enqueues the task called name with arguments, which are serialized
+// to JSON unless nil. Tasks given the same non-empty orderingKey are
+// processed in the order they were submitted.
+func (s *Supplier) Submit(ctx context.Context, name string, arguments any, orderingKey string) (*SubmittedTask, error) {
+	params := &SubmitTaskParams{}
+	if orderingKey != "" {
+		params.OrderingKey = &orderingKey
+	}
+	return s.submit(ctx, name, arguments, params)
+}
+
+// SubmitBefore enqueues the task like Submit, for it to be handled before
+// deadline. The consumer gives up on the task once it passed, along with the
+// tasks it returns.
+func (s *Supplier) SubmitBefore(ctx context.Context, name string, arguments any, orderingKey string, deadline time.Time) (*SubmittedTask, error) {
+	params := &SubmitTaskParams{Deadline: &deadline}
+	if orderingKey != "" {
+		params.OrderingKey = &orderingKey
+	}
+	return s.submit(ctx, name, arguments, params)
+}
+
+func (s *Supplier) submit(ctx context.Context, name string, arguments any, params *SubmitTaskParams) (*SubmittedTask, error) {
+	body := []byte{}
+	if arguments != nil {
+		var err error
+		if body, err = json.Marshal(arguments); err != nil {
+			return nil, fmt.Errorf("could not serialize arguments: %w", err)
+		}
+	}
+	var submitted *SubmittedTask
+	err := s.retry(ctx, isRejected, func() error {
+		response, err := s.api.SubmitTaskWithBodyWithResponse(ctx, name, params, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		} else if response.JSON200 != nil {
+			submitted = response.JSON200
+			return nil
+		} else if response.JSON202 != nil {
+			submitted = response.JSON202
+			return nil
+		}
+		return problemError(response.HTTPResponse, response.Body)
+	})
+	return submitted, err
+}
+
+// Status returns the status of the task with the given ID. It fails with a
+// not_found ProblemError when the supplier has no outbox to keep statuses.
+func (s *Supplier) Status(ctx context.Context, id uuid.UUID) (*TaskStatus, error) {
+	var status *TaskStatus
+	err := s.retry(ctx, isTransient, func() error {
+		response, err := s.api.GetTaskStatusWithResponse(ctx, id)
+		if err != nil {
+			return err
+		} else if response.JSON200 != nil {
+			status = response.JSON200
+			return nil
+		}
+		return problemError(response.HTTPResponse, response.Body)
+	})
+	return status, err
+}
+
+// WaitEnqueued polls the status of the task every interval until the broker
+// accepted it or ctx is done.
+func (s *Supplier) WaitEnqueued(ctx context.Context, id uuid.UUID, interval time.Duration) (*TaskStatus, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		status, err := s.Status(ctx, id)
+		if err != nil {
+			return nil, err
+		} else if status.Status == StatusEnqueued {
+			return status, nil
+		}
+		select {
+		case <-ctx.Done():
+			return status, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Events calls handle with every event of the task until the supplier ends
+// the stream, the task being done or enqueued without progress being
+// reported, handle fails or ctx is done. It fails with a not_found
+// ProblemError when the supplier keeps neither statuses nor progress.
+func (s *Supplier) Events(ctx context.Context, id uuid.UUID, handle func(event TaskEvent) error) error {
+	var response *http.Response
+	err := s.retry(ctx, isTransient, func() error {
+		var err error
+		if response, err = s.api.GetTaskEvents(ctx, id); err != nil {
+			return err
+		} else if response.StatusCode != http.StatusOK {
+			defer response.Body.Close()
+			body, _ := io.ReadAll(response.Body)
+			return problemError(response, body)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	// Only the events the supplier sends are understood, see
+	// https://html.spec.whatwg.org/multipage/server-sent-events.html
+	scanner := bufio.NewScanner(response.Body)
+	name, data := "", []string{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch {
+		case line == "":
+			if name == "status" && len(data) > 0 {
+				event := TaskEvent{}
+				if err := json.Unmarshal([]byte(strings.Join(data, "\n")), &event); err != nil {
+					return fmt.Errorf("could not deserialize task event: %w", err)
+				} else if err := handle(event); err != nil {
+					return err
+				}
+			}
+			name, data = "", data[:0]
+		case field == "event":
+			name = value
+		case field == "data":
+			data = append(data, value)
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("could not read task events: %w", err)
+	}
+	return ctx.Err()
+}
+
+// Workflow returns the status of the workflow that started with the task of
+// the given ID. It fails with a not_found ProblemError when that task
+// returned no tasks or the supplier doesn't track workflows.
+func (s *Supplier) Workflow(ctx context.Context, id uuid.UUID) (*Workflow, error) {
+	var workflow *Workflow
+	err := s.retry(ctx, isTransient, func() error {
+		response, err := s.api.GetWorkflowWithResponse(ctx, id)
+		if err != nil {
+			return err
+		} else if response.JSON200 != nil {
+			workflow = response.JSON200
+			return nil
+		}
+		return problemError(response.HTTPResponse, response.Body)
+	})
+	return workflow, err
+}
+
+func (s *Supplier) retry(ctx context.Context, retryable func(err error) bool, call func() error) error {
+	backoff := s.retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || attempt >= s.maxAttempts || ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+		delay := backoff
+		problemErr := &ProblemError{}
+		if errors.As(err, &problemErr) && problemErr.RetryAfter > 0 {
+			delay = problemErr.RetryAfter
+		}
+		if delay > s.maxBackoff {
+			delay = s.maxBackoff
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// isRejected errors mean the supplier certainly didn't accept the task.
+func isRejected(err error) bool {
+	problemErr := &ProblemError{}
+	return errors.As(err, &problemErr) && (problemErr.StatusCode == http.StatusServiceUnavailable || problemErr.StatusCode == http.StatusTooManyRequests)
+}
+
+// isTransient errors may go away, reads are safe to retry on them.
+func isTransient(err error) bool {
+	problemErr := &ProblemError{}
+	if errors.As(err, &problemErr) {
+		return problemErr.StatusCode >= 500 || problemErr.StatusCode == http.StatusTooManyRequests
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+func problemError(response *http.Response, body []byte) error {
+	problemErr := &ProblemError{
+		StatusCode: response.StatusCode,
+		Problem: Problem{
+			Status: response.StatusCode,
+			Title:  http.StatusText(response.StatusCode),
+		},
+	}
+	if strings.Contains(response.Header.Get("Content-Type"), "json") {
+		// Proxies in front of the supplier may answer with other bodies
+		json.Unmarshal(body, &problemErr.Problem)
+	}
+	if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		problemErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return problemErr
+}
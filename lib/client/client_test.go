@@ -0,0 +1,219 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeJSON(w http.ResponseWriter, contentType string, statusCode int, body any) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(body)
+}
+
+func testSupplier(t *testing.T, handler http.HandlerFunc) *Supplier {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	supplier, err := NewSupplier(server.URL, WithRetries(3, time.Millisecond, time.Millisecond*10))
+	require.NoError(t, err)
+	return supplier
+}
+
+func TestSubmit(t *testing.T) {
+	id := uuid.New()
+	supplier := testSupplier(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/task/greet", r.URL.Path)
+		assert.Equal(t, "first", r.URL.Query().Get("ordering_key"))
+		body, _ := io.ReadAll(r.Body)
+		assert.JSONEq(t, `{"name":"gopher"}`, string(body))
+		writeJSON(w, "application/json", http.StatusOK, SubmittedTask{Id: id, TaskName: "greet", Status: StatusEnqueued})
+	})
+	submitted, err := supplier.Submit(context.Background(), "greet", map[string]string{"name": "gopher"}, "first")
+	require.NoError(t, err)
+	assert.Equal(t, id, submitted.Id)
+	assert.Equal(t, StatusEnqueued, submitted.Status)
+}
+
+func TestSubmitBefore(t *testing.T) {
+	deadline := time.Date(2030, time.January, 2, 3, 4, 5, 0, time.UTC)
+	supplier := testSupplier(t, func(w http.ResponseWriter, r *http.Request) {
+		parsed, err := time.Parse(time.RFC3339, r.URL.Query().Get("deadline"))
+		require.NoError(t, err)
+		assert.True(t, deadline.Equal(parsed))
+		assert.NotContains(t, r.URL.RawQuery, "ordering_key")
+		writeJSON(w, "application/json", http.StatusOK, SubmittedTask{Id: uuid.New(), TaskName: "greet", Status: StatusEnqueued})
+	})
+	_, err := supplier.SubmitBefore(context.Background(), "greet", nil, "", deadline)
+	require.NoError(t, err)
+}
+
+func TestSubmitWithoutArguments(t *testing.T) {
+	supplier := testSupplier(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Empty(t, body)
+		assert.NotContains(t, r.URL.RawQuery, "ordering_key")
+		assert.NotContains(t, r.URL.RawQuery, "deadline")
+		writeJSON(w, "application/json", http.StatusAccepted, SubmittedTask{Id: uuid.New(), TaskName: "greet", Status: StatusSpooled})
+	})
+	submitted, err := supplier.Submit(context.Background(), "greet", nil, "")
+	require.NoError(t, err)
+	assert.Equal(t, StatusSpooled, submitted.Status)
+}
+
+func TestSubmitRetriesWhileUnavailable(t *testing.T) {
+	attempts := atomic.Int32{}
+	supplier := testSupplier(t, func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			w.Header().Set("Retry-After", "1")
+			writeJSON(w, "application/problem+json", http.StatusServiceUnavailable, Problem{Code: ProblemCodeUnavailable, Status: http.StatusServiceUnavailable})
+			return
+		}
+		writeJSON(w, "application/json", http.StatusOK, SubmittedTask{Id: uuid.New(), TaskName: "greet", Status: StatusEnqueued})
+	})
+	_, err := supplier.Submit(context.Background(), "greet", nil, "")
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, attempts.Load())
+}
+
+func TestSubmitGivesUp(t *testing.T) {
+	attempts := atomic.Int32{}
+	supplier := testSupplier(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		writeJSON(w, "application/problem+json", http.StatusServiceUnavailable, Problem{Code: ProblemCodeUnavailable, Status: http.StatusServiceUnavailable})
+	})
+	_, err := supplier.Submit(context.Background(), "greet", nil, "")
+	problemErr := &ProblemError{}
+	require.ErrorAs(t, err, &problemErr)
+	assert.Equal(t, ProblemCodeUnavailable, problemErr.Problem.Code)
+	assert.EqualValues(t, 3, attempts.Load())
+}
+
+func TestSubmitDoesNotRetryOtherProblems(t *testing.T) {
+	detail := "nope"
+	for _, statusCode := range []int{http.StatusBadRequest, http.StatusInternalServerError, http.StatusFailedDependency} {
+		attempts := atomic.Int32{}
+		supplier := testSupplier(t, func(w http.ResponseWriter, r *http.Request) {
+			attempts.Add(1)
+			writeJSON(w, "application/problem+json", statusCode, Problem{Code: ProblemCodeInternal, Status: statusCode, Detail: &detail})
+		})
+		_, err := supplier.Submit(context.Background(), "greet", nil, "")
+		problemErr := &ProblemError{}
+		require.ErrorAs(t, err, &problemErr)
+		assert.Equal(t, statusCode, problemErr.StatusCode)
+		assert.Equal(t, "supplier responded "+strconv.Itoa(statusCode)+" internal: nope", problemErr.Error())
+		assert.EqualValues(t, 1, attempts.Load())
+	}
+}
+
+func TestStatusRetriesServerErrors(t *testing.T) {
+	id := uuid.New()
+	attempts := atomic.Int32{}
+	supplier := testSupplier(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/task/"+id.String(), r.URL.Path)
+		if attempts.Add(1) == 1 {
+			// Not a problem, as a proxy would answer
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, "application/json", http.StatusOK, TaskStatus{Id: id, Status: StatusPending})
+	})
+	status, err := supplier.Status(context.Background(), id)
+	require.NoError(t, err)
+	assert.Equal(t, StatusPending, status.Status)
+	assert.EqualValues(t, 2, attempts.Load())
+}
+
+func TestWaitEnqueued(t *testing.T) {
+	id := uuid.New()
+	polls := atomic.Int32{}
+	supplier := testSupplier(t, func(w http.ResponseWriter, r *http.Request) {
+		status := StatusPending
+		if polls.Add(1) >= 3 {
+			status = StatusEnqueued
+		}
+		writeJSON(w, "application/json", http.StatusOK, TaskStatus{Id: id, Status: status})
+	})
+	status, err := supplier.WaitEnqueued(context.Background(), id, time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, StatusEnqueued, status.Status)
+	assert.EqualValues(t, 3, polls.Load())
+}
+
+func TestWaitEnqueuedStopsWithContext(t *testing.T) {
+	supplier := testSupplier(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, "application/json", http.StatusOK, TaskStatus{Id: uuid.New(), Status: StatusPending})
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	_, err := supplier.WaitEnqueued(ctx, uuid.New(), time.Millisecond)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "got %v", err)
+}
+
+func TestEvents(t *testing.T) {
+	id := uuid.New()
+	supplier := testSupplier(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/task/"+id.String()+"/events", r.URL.Path)
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, ": keep-alive\n\n")
+		io.WriteString(w, "event: status\ndata: {\"id\":\""+id.String()+"\",\"status\":\"running\",\"percent\":50,\"time\":\"2023-08-01T00:00:00Z\"}\n\n")
+		io.WriteString(w, "event: other\ndata: ignored\n\n")
+		io.WriteString(w, "event: status\ndata: {\"id\":\""+id.String()+"\",\"status\":\"succeeded\",\"time\":\"2023-08-01T00:00:01Z\"}\n\n")
+	})
+	events := []TaskEvent{}
+	err := supplier.Events(context.Background(), id, func(event TaskEvent) error {
+		events = append(events, event)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, TaskEventRunning, events[0].Status)
+	require.NotNil(t, events[0].Percent)
+	assert.Equal(t, 50, *events[0].Percent)
+	assert.Equal(t, TaskEventSucceeded, events[1].Status)
+}
+
+func TestEventsNotFound(t *testing.T) {
+	supplier := testSupplier(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, "application/problem+json", http.StatusNotFound, Problem{Code: ProblemCodeNotFound, Status: http.StatusNotFound})
+	})
+	err := supplier.Events(context.Background(), uuid.New(), func(event TaskEvent) error {
+		return errors.New("no event was expected")
+	})
+	problemErr := &ProblemError{}
+	require.ErrorAs(t, err, &problemErr)
+	assert.Equal(t, ProblemCodeNotFound, problemErr.Problem.Code)
+}
+
+func TestWorkflow(t *testing.T) {
+	id, stepID := uuid.New(), uuid.New()
+	supplier := testSupplier(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/workflows/"+id.String(), r.URL.Path)
+		writeJSON(w, "application/json", http.StatusOK, Workflow{
+			Id:     id,
+			Status: StepWaiting,
+			Steps: []WorkflowStep{
+				{Id: id, TaskName: "fetch", Status: StepWaiting, Children: 1, Pending: 1},
+				{Id: stepID, ParentId: &id, TaskName: "transform", Status: StepRunning},
+			},
+		})
+	})
+	workflow, err := supplier.Workflow(context.Background(), id)
+	require.NoError(t, err)
+	assert.Equal(t, StepWaiting, workflow.Status)
+	require.Len(t, workflow.Steps, 2)
+	assert.Nil(t, workflow.Steps[0].ParentId)
+	assert.Equal(t, id, *workflow.Steps[1].ParentId)
+	assert.Equal(t, StepRunning, workflow.Steps[1].Status)
+}
@@ -0,0 +1,12 @@
+package client
+
+import _ "embed"
+
+//go:generate go run github.com/deepmap/oapi-codegen/cmd/oapi-codegen@v1.13.4 -generate types,client,skip-prune -package client -o client.gen.go openapi.json
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative supplierpb/supplier.proto
+
+// Spec is the OpenAPI specification of the work-supplier, which the client
+// is generated from and the supplier serves at /openapi.json.
+//
+//go:embed openapi.json
+var Spec []byte
@@ -0,0 +1,258 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: supplierpb/supplier.proto
+
+package supplierpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Supplier_SubmitTask_FullMethodName  = "/supplier.Supplier/SubmitTask"
+	Supplier_SubmitBatch_FullMethodName = "/supplier.Supplier/SubmitBatch"
+	Supplier_GetTask_FullMethodName     = "/supplier.Supplier/GetTask"
+	Supplier_WatchTask_FullMethodName   = "/supplier.Supplier/WatchTask"
+)
+
+// SupplierClient is the client API for Supplier service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type SupplierClient interface {
+	SubmitTask(ctx context.Context, in *SubmitTaskRequest, opts ...grpc.CallOption) (*Task, error)
+	// SubmitBatch submits every task independently, one failing doesn't fail
+	// the others.
+	SubmitBatch(ctx context.Context, in *SubmitBatchRequest, opts ...grpc.CallOption) (*SubmitBatchResponse, error)
+	// GetTask needs an outbox to keep statuses, it is NOT_FOUND otherwise.
+	GetTask(ctx context.Context, in *GetTaskRequest, opts ...grpc.CallOption) (*Task, error)
+	// WatchTask sends the task whenever its status changes, until it is
+	// enqueued.
+	WatchTask(ctx context.Context, in *WatchTaskRequest, opts ...grpc.CallOption) (Supplier_WatchTaskClient, error)
+}
+
+type supplierClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSupplierClient(cc grpc.ClientConnInterface) SupplierClient {
+	return &supplierClient{cc}
+}
+
+func (c *supplierClient) SubmitTask(ctx context.Context, in *SubmitTaskRequest, opts ...grpc.CallOption) (*Task, error) {
+	out := new(Task)
+	err := c.cc.Invoke(ctx, Supplier_SubmitTask_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *supplierClient) SubmitBatch(ctx context.Context, in *SubmitBatchRequest, opts ...grpc.CallOption) (*SubmitBatchResponse, error) {
+	out := new(SubmitBatchResponse)
+	err := c.cc.Invoke(ctx, Supplier_SubmitBatch_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *supplierClient) GetTask(ctx context.Context, in *GetTaskRequest, opts ...grpc.CallOption) (*Task, error) {
+	out := new(Task)
+	err := c.cc.Invoke(ctx, Supplier_GetTask_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *supplierClient) WatchTask(ctx context.Context, in *WatchTaskRequest, opts ...grpc.CallOption) (Supplier_WatchTaskClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Supplier_ServiceDesc.Streams[0], Supplier_WatchTask_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &supplierWatchTaskClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Supplier_WatchTaskClient interface {
+	Recv() (*Task, error)
+	grpc.ClientStream
+}
+
+type supplierWatchTaskClient struct {
+	grpc.ClientStream
+}
+
+func (x *supplierWatchTaskClient) Recv() (*Task, error) {
+	m := new(Task)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SupplierServer is the server API for Supplier service.
+// All implementations must embed UnimplementedSupplierServer
+// for forward compatibility
+type SupplierServer interface {
+	SubmitTask(context.Context, *SubmitTaskRequest) (*Task, error)
+	// SubmitBatch submits every task independently, one failing doesn't fail
+	// the others.
+	SubmitBatch(context.Context, *SubmitBatchRequest) (*SubmitBatchResponse, error)
+	// GetTask needs an outbox to keep statuses, it is NOT_FOUND otherwise.
+	GetTask(context.Context, *GetTaskRequest) (*Task, error)
+	// WatchTask sends the task whenever its status changes, until it is
+	// enqueued.
+	WatchTask(*WatchTaskRequest, Supplier_WatchTaskServer) error
+	mustEmbedUnimplementedSupplierServer()
+}
+
+// UnimplementedSupplierServer must be embedded to have forward compatible implementations.
+type UnimplementedSupplierServer struct {
+}
+
+func (UnimplementedSupplierServer) SubmitTask(context.Context, *SubmitTaskRequest) (*Task, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SubmitTask not implemented")
+}
+func (UnimplementedSupplierServer) SubmitBatch(context.Context, *SubmitBatchRequest) (*SubmitBatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SubmitBatch not implemented")
+}
+func (UnimplementedSupplierServer) GetTask(context.Context, *GetTaskRequest) (*Task, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTask not implemented")
+}
+func (UnimplementedSupplierServer) WatchTask(*WatchTaskRequest, Supplier_WatchTaskServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchTask not implemented")
+}
+func (UnimplementedSupplierServer) mustEmbedUnimplementedSupplierServer() {}
+
+// UnsafeSupplierServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SupplierServer will
+// result in compilation errors.
+type UnsafeSupplierServer interface {
+	mustEmbedUnimplementedSupplierServer()
+}
+
+func RegisterSupplierServer(s grpc.ServiceRegistrar, srv SupplierServer) {
+	s.RegisterService(&Supplier_ServiceDesc, srv)
+}
+
+func _Supplier_SubmitTask_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SubmitTaskRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SupplierServer).SubmitTask(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Supplier_SubmitTask_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SupplierServer).SubmitTask(ctx, req.(*SubmitTaskRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Supplier_SubmitBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SubmitBatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SupplierServer).SubmitBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Supplier_SubmitBatch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SupplierServer).SubmitBatch(ctx, req.(*SubmitBatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Supplier_GetTask_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetTaskRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SupplierServer).GetTask(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Supplier_GetTask_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SupplierServer).GetTask(ctx, req.(*GetTaskRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Supplier_WatchTask_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchTaskRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SupplierServer).WatchTask(m, &supplierWatchTaskServer{stream})
+}
+
+type Supplier_WatchTaskServer interface {
+	Send(*Task) error
+	grpc.ServerStream
+}
+
+type supplierWatchTaskServer struct {
+	grpc.ServerStream
+}
+
+func (x *supplierWatchTaskServer) Send(m *Task) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Supplier_ServiceDesc is the grpc.ServiceDesc for Supplier service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Supplier_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "supplier.Supplier",
+	HandlerType: (*SupplierServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SubmitTask",
+			Handler:    _Supplier_SubmitTask_Handler,
+		},
+		{
+			MethodName: "SubmitBatch",
+			Handler:    _Supplier_SubmitBatch_Handler,
+		},
+		{
+			MethodName: "GetTask",
+			Handler:    _Supplier_GetTask_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchTask",
+			Handler:       _Supplier_WatchTask_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "supplierpb/supplier.proto",
+}
@@ -0,0 +1,421 @@
+// Package config loads a service's typed configuration struct from, in
+// increasing order of precedence: `default` tags, an optional YAML or TOML
+// file, environment variables and command-line flags.
+//
+// Fields are described with struct tags:
+//
+//	type Config struct {
+//		QueueURL string `env:"QUEUE_URL" required:"true" desc:"URL of the queue"`
+//		Token    string `env:"TOKEN" secret:"true" desc:"Shared secret"`
+//		Workers  int    `env:"WORKERS" default:"30" desc:"Worker count"`
+//	}
+//
+// The file key of a field is its lowercased env name (queue_url) and the
+// flag is its kebab-cased env name (--queue-url). Embedded structs are
+// flattened into their parent. Secret fields follow the envutil convention
+// of also accepting a file through TOKEN_FILE.
+package config
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/envutil"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// FileEnvKey names the environment variable that points at a config file
+	// when --config is not given.
+	FileEnvKey = "CONFIG_FILE"
+	masked     = "********"
+)
+
+// ErrPrinted is returned by Load when --print-config or
+// --print-config-reference was requested and the output has been written.
+// The caller is expected to exit successfully.
+var ErrPrinted = errors.New("configuration was printed")
+
+// SecretResolver turns a secret reference, such as
+// secretsmanager://prod/token, into its value. Values that are not a
+// reference must be returned unchanged.
+type SecretResolver interface {
+	Resolve(ctx context.Context, value string) (string, error)
+}
+
+type options struct {
+	secretResolver   SecretResolver
+	secretReferences map[string]string
+}
+
+type Option func(*options)
+
+// WithSecretResolver resolves the value of every field tagged as secret
+// through resolver once it has been loaded.
+func WithSecretResolver(resolver SecretResolver) Option {
+	return func(o *options) {
+		o.secretResolver = resolver
+	}
+}
+
+// WithSecretReferences records the value of every field tagged as secret as
+// it was before being resolved, keyed by its env. The references can then be
+// resolved again to pick up secrets that were rotated since.
+func WithSecretReferences(references map[string]string) Option {
+	return func(o *options) {
+		o.secretReferences = references
+	}
+}
+
+// Validator may be implemented by a configuration struct to report problems
+// that span several fields. Every returned error is reported.
+type Validator interface {
+	Validate() []error
+}
+
+type field struct {
+	Name     string
+	Env      string
+	Flag     string
+	FileKey  string
+	Default  string
+	Required bool
+	Secret   bool
+	Desc     string
+	value    reflect.Value
+}
+
+// Load populates cfg, which must be a pointer to a struct, and reports every
+// problem it finds at once rather than stopping at the first.
+func Load(ctx context.Context, service string, cfg any, args []string, opts ...Option) error {
+	return load(ctx, service, cfg, args, os.LookupEnv, os.Stdout, opts...)
+}
+
+func load(ctx context.Context, service string, cfg any, args []string, lookupEnv func(string) (string, bool), stdout io.Writer, opts ...Option) error {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	fields, err := fieldsOf(cfg)
+	if err != nil {
+		return err
+	}
+
+	flagSet := flag.NewFlagSet(service, flag.ContinueOnError)
+	configFile := flagSet.String("config", "", fmt.Sprintf("path to a YAML or TOML config file (or set %s)", FileEnvKey))
+	printConfig := flagSet.Bool("print-config", false, "print the resolved configuration with secrets masked and exit")
+	printReference := flagSet.Bool("print-config-reference", false, "print a markdown reference of every configuration key and exit")
+	flagValues := map[string]string{}
+	for _, f := range fields {
+		f := f
+		flagSet.Func(f.Flag, f.Desc, func(value string) error {
+			flagValues[f.Env] = value
+			return nil
+		})
+	}
+	if err := flagSet.Parse(args); err != nil {
+		return fmt.Errorf("could not parse flags: %w", err)
+	}
+
+	if *printReference {
+		return errors.Join(Reference(stdout, service, cfg), ErrPrinted)
+	}
+
+	if *configFile == "" {
+		*configFile, _ = lookupEnv(FileEnvKey)
+	}
+	fileValues := map[string]string{}
+	errs := []error{}
+	if *configFile != "" {
+		fileValues, err = readFile(*configFile)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		known := map[string]bool{}
+		for _, f := range fields {
+			known[f.FileKey] = true
+		}
+		for key := range fileValues {
+			if !known[key] {
+				errs = append(errs, fmt.Errorf("%s: unknown key %q", *configFile, key))
+			}
+		}
+	}
+
+	for _, f := range fields {
+		raw, source, isPresent := f.Default, "default", f.Default != ""
+		if value, ok := fileValues[f.FileKey]; ok {
+			raw, source, isPresent = value, *configFile, true
+		}
+		if path, ok := lookupEnv(f.Env + envutil.FileSuffix); ok && f.Secret {
+			contents, err := os.ReadFile(path)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s%s: %w", f.Env, envutil.FileSuffix, err))
+				continue
+			}
+			raw, source, isPresent = strings.TrimSpace(string(contents)), "file named by "+f.Env+envutil.FileSuffix, true
+		}
+		if value, ok := lookupEnv(f.Env); ok {
+			raw, source, isPresent = value, "environment variable "+f.Env, true
+		}
+		if value, ok := flagValues[f.Env]; ok {
+			raw, source, isPresent = value, "flag --"+f.Flag, true
+		}
+		if !isPresent {
+			if f.Required {
+				errs = append(errs, fmt.Errorf("%s is required (env %s, flag --%s, file key %s)", f.Name, f.Env, f.Flag, f.FileKey))
+			}
+			continue
+		}
+		if f.Secret && o.secretReferences != nil {
+			o.secretReferences[f.Env] = raw
+		}
+		if f.Secret && o.secretResolver != nil {
+			resolved, err := o.secretResolver.Resolve(ctx, raw)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s from %s: %w", f.Env, source, err))
+				continue
+			}
+			raw = resolved
+		}
+		if err := setValue(f.value, raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s from %s: %w", f.Env, source, err))
+		} else if f.Required && f.value.IsZero() {
+			errs = append(errs, fmt.Errorf("%s from %s must not be empty", f.Env, source))
+		}
+	}
+	if validator, ok := cfg.(Validator); ok && len(errs) == 0 {
+		errs = append(errs, validator.Validate()...)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid %s configuration:\n%w", service, err)
+	}
+
+	if *printConfig {
+		return errors.Join(Print(stdout, cfg), ErrPrinted)
+	}
+	return nil
+}
+
+// Print writes the resolved configuration as env assignments, masking every
+// field tagged as secret.
+func Print(w io.Writer, cfg any) error {
+	fields, err := fieldsOf(cfg)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		value := formatValue(f.value)
+		if f.Secret && value != "" {
+			value = masked
+		}
+		if _, err := fmt.Fprintf(w, "%s=%s\n", f.Env, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reference writes a markdown table describing every configuration key.
+func Reference(w io.Writer, service string, cfg any) error {
+	fields, err := fieldsOf(cfg)
+	if err != nil {
+		return err
+	}
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "# %s configuration\n\n", service)
+	fmt.Fprintf(&sb, "<!-- Generated by `%s --print-config-reference`, do not edit by hand. -->\n\n", service)
+	fmt.Fprintf(&sb, "Values are resolved from defaults, then the file given by `--config` or `%s`, then environment variables, then flags. ", FileEnvKey)
+	fmt.Fprintf(&sb, "Secrets may also be read from the file named by the environment variable suffixed with `%s`.\n\n", envutil.FileSuffix)
+	sb.WriteString("| Environment | Flag | File key | Type | Default | Required | Secret | Description |\n")
+	sb.WriteString("|---|---|---|---|---|---|---|---|\n")
+	for _, f := range fields {
+		fmt.Fprintf(&sb, "| `%s` | `--%s` | `%s` | %s | %s | %s | %s | %s |\n",
+			f.Env, f.Flag, f.FileKey, typeName(f.value.Type()), codeOrEmpty(f.Default),
+			yesOrEmpty(f.Required), yesOrEmpty(f.Secret), f.Desc)
+	}
+	_, err = io.WriteString(w, sb.String())
+	return err
+}
+
+func fieldsOf(cfg any) ([]field, error) {
+	value := reflect.ValueOf(cfg)
+	if value.Kind() != reflect.Pointer || value.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("configuration must be a pointer to a struct, got %T", cfg)
+	}
+	return collectFields(value.Elem())
+}
+
+func collectFields(value reflect.Value) ([]field, error) {
+	fields := []field{}
+	for i := 0; i < value.NumField(); i++ {
+		structField := value.Type().Field(i)
+		if structField.Anonymous && structField.Type.Kind() == reflect.Struct {
+			embedded, err := collectFields(value.Field(i))
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, embedded...)
+			continue
+		}
+		env, isTagged := structField.Tag.Lookup("env")
+		if !isTagged {
+			continue
+		}
+		if !structField.IsExported() {
+			return nil, fmt.Errorf("field %s is tagged but not exported", structField.Name)
+		}
+		if _, err := parserFor(structField.Type); err != nil {
+			return nil, fmt.Errorf("field %s: %w", structField.Name, err)
+		}
+		fields = append(fields, field{
+			Name:     structField.Name,
+			Env:      env,
+			Flag:     strings.ReplaceAll(strings.ToLower(env), "_", "-"),
+			FileKey:  strings.ToLower(env),
+			Default:  structField.Tag.Get("default"),
+			Required: structField.Tag.Get("required") == "true",
+			Secret:   structField.Tag.Get("secret") == "true",
+			Desc:     structField.Tag.Get("desc"),
+			value:    value.Field(i),
+		})
+	}
+	return fields, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func parserFor(t reflect.Type) (func(string) (reflect.Value, error), error) {
+	switch {
+	case t == durationType:
+		return func(raw string) (reflect.Value, error) {
+			d, err := time.ParseDuration(raw)
+			return reflect.ValueOf(d), err
+		}, nil
+	case t.Kind() == reflect.String:
+		return func(raw string) (reflect.Value, error) {
+			return reflect.ValueOf(raw).Convert(t), nil
+		}, nil
+	case t.Kind() == reflect.Int:
+		return func(raw string) (reflect.Value, error) {
+			i, err := strconv.Atoi(raw)
+			return reflect.ValueOf(i), err
+		}, nil
+	case t.Kind() == reflect.Int64:
+		return func(raw string) (reflect.Value, error) {
+			i, err := strconv.ParseInt(raw, 10, 64)
+			return reflect.ValueOf(i), err
+		}, nil
+	case t.Kind() == reflect.Float64:
+		return func(raw string) (reflect.Value, error) {
+			f, err := strconv.ParseFloat(raw, 64)
+			return reflect.ValueOf(f), err
+		}, nil
+	case t.Kind() == reflect.Bool:
+		return func(raw string) (reflect.Value, error) {
+			b, err := strconv.ParseBool(raw)
+			return reflect.ValueOf(b), err
+		}, nil
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String:
+		return func(raw string) (reflect.Value, error) {
+			items := []string{}
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			return reflect.ValueOf(items), nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported configuration type %s", t)
+}
+
+func setValue(target reflect.Value, raw string) error {
+	parse, err := parserFor(target.Type())
+	if err != nil {
+		return err
+	}
+	parsed, err := parse(strings.TrimSpace(raw))
+	if err != nil {
+		return fmt.Errorf("could not parse %q as %s: %w", raw, typeName(target.Type()), err)
+	}
+	target.Set(parsed.Convert(target.Type()))
+	return nil
+}
+
+func formatValue(value reflect.Value) string {
+	if value.Kind() == reflect.Slice {
+		items := make([]string, value.Len())
+		for i := range items {
+			items[i] = value.Index(i).String()
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(value.Interface())
+}
+
+func typeName(t reflect.Type) string {
+	switch {
+	case t == durationType:
+		return "duration"
+	case t.Kind() == reflect.Slice:
+		return "list"
+	}
+	return t.Kind().String()
+}
+
+func readFile(path string) (map[string]string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %w", err)
+	}
+	document := map[string]any{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(contents, &document)
+	case ".toml":
+		err = toml.Unmarshal(contents, &document)
+	default:
+		return nil, fmt.Errorf("config file %s must end in .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse config file %s: %w", path, err)
+	}
+	values := make(map[string]string, len(document))
+	for key, value := range document {
+		if items, ok := value.([]any); ok {
+			parts := make([]string, len(items))
+			for i, item := range items {
+				parts[i] = fmt.Sprint(item)
+			}
+			values[strings.ToLower(key)] = strings.Join(parts, ",")
+			continue
+		}
+		values[strings.ToLower(key)] = fmt.Sprint(value)
+	}
+	return values, nil
+}
+
+func codeOrEmpty(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "`" + s + "`"
+}
+
+func yesOrEmpty(b bool) string {
+	if b {
+		return "yes"
+	}
+	return ""
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type embeddedConfig struct {
+	Password string `env:"PASSWORD" secret:"true" desc:"A secret"`
+}
+
+type testConfig struct {
+	QueueURL string        `env:"QUEUE_URL" required:"true" desc:"Queue URL"`
+	Workers  int           `env:"WORKERS" default:"30" desc:"Worker count"`
+	Timeout  time.Duration `env:"TIMEOUT" default:"5s" desc:"Timeout"`
+	Enabled  bool          `env:"ENABLED" desc:"Toggle"`
+	Tags     []string      `env:"TAGS" desc:"Tags"`
+	embeddedConfig
+}
+
+func lookupFrom(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("queue_url: rabbit://from-file\nworkers: 10\ntags: [a, b]\n"), 0644))
+	cfg := testConfig{}
+	env := map[string]string{"WORKERS": "20", "PASSWORD": "hunter2"}
+	err := load(context.Background(), "test", &cfg, []string{"--config", path, "--enabled=true", "--timeout", "1m"}, lookupFrom(env), &bytes.Buffer{})
+	require.NoError(t, err)
+	assert.Equal(t, "rabbit://from-file", cfg.QueueURL, "file should override the default")
+	assert.Equal(t, 20, cfg.Workers, "environment should override the file")
+	assert.Equal(t, time.Minute, cfg.Timeout, "flags should override the default")
+	assert.True(t, cfg.Enabled)
+	assert.Equal(t, []string{"a", "b"}, cfg.Tags)
+	assert.Equal(t, "hunter2", cfg.Password, "embedded structs should be flattened")
+}
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	cfg := testConfig{}
+	env := map[string]string{"WORKERS": "many", "TIMEOUT": "soon"}
+	err := load(context.Background(), "test", &cfg, nil, lookupFrom(env), &bytes.Buffer{})
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "QUEUE_URL")
+	assert.ErrorContains(t, err, "WORKERS")
+	assert.ErrorContains(t, err, "TIMEOUT")
+}
+
+func TestPrintConfigMasksSecrets(t *testing.T) {
+	cfg := testConfig{}
+	env := map[string]string{"QUEUE_URL": "rabbit://queue", "PASSWORD": "hunter2"}
+	output := bytes.Buffer{}
+	err := load(context.Background(), "test", &cfg, []string{"--print-config"}, lookupFrom(env), &output)
+	require.ErrorIs(t, err, ErrPrinted)
+	assert.NotContains(t, output.String(), "hunter2")
+	assert.Contains(t, output.String(), "PASSWORD="+masked)
+	assert.Contains(t, output.String(), "QUEUE_URL=rabbit://queue")
+}
+
+func TestSecretFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(path, []byte("hunter2\n"), 0600))
+	cfg := testConfig{}
+	env := map[string]string{"QUEUE_URL": "rabbit://queue", "PASSWORD_FILE": path}
+	require.NoError(t, load(context.Background(), "test", &cfg, nil, lookupFrom(env), &bytes.Buffer{}))
+	assert.Equal(t, "hunter2", cfg.Password)
+}
+
+type upperResolver struct{}
+
+func (upperResolver) Resolve(ctx context.Context, value string) (string, error) {
+	return strings.ToUpper(value), nil
+}
+
+func TestSecretReferences(t *testing.T) {
+	cfg := testConfig{}
+	references := map[string]string{}
+	env := map[string]string{"QUEUE_URL": "rabbit://queue", "PASSWORD": "env://password"}
+	err := load(context.Background(), "test", &cfg, nil, lookupFrom(env), &bytes.Buffer{}, WithSecretResolver(upperResolver{}), WithSecretReferences(references))
+	require.NoError(t, err)
+	assert.Equal(t, "ENV://PASSWORD", cfg.Password)
+	assert.Equal(t, map[string]string{"PASSWORD": "env://password"}, references, "only secrets are recorded, as they were before being resolved")
+}
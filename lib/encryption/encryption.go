@@ -0,0 +1,169 @@
+// Package encryption seals the arguments of a PayloadItem, which may hold
+// customer data, so that they are not readable on the broker or in the
+// claim check bucket.
+//
+// Every message is encrypted with a data key of its own. The data key is in
+// turn encrypted by a key-encryption key of a Keyring and travels with the
+// message: KMS in aws builds, where the supplier may only generate data keys
+// and the consumer may only decrypt them, or a keyring file for development.
+package encryption
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/wire"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
+)
+
+// KeyIDMetadata holds the key-encryption key the data key of the message was
+// encrypted with. Arguments are only sealed when it is present.
+const KeyIDMetadata = "encryption-key-id"
+
+var ErrNotConfigured = errors.New("arguments are encrypted, but no keyring is configured")
+
+// Config is embedded into the configuration of each service.
+type Config struct {
+	EncryptionKeyringFile string `env:"ENCRYPTION_KEYRING_FILE" desc:"Path of a keyring file whose keys encrypt the data keys, for development. Arguments are sent in plaintext when neither this nor ENCRYPTION_KMS_KEY_ID is set"`
+	EncryptionKMSKeyID    string `env:"ENCRYPTION_KMS_KEY_ID" desc:"ID or ARN of the KMS key that encrypts the data keys. Only available in aws builds"`
+}
+
+func (c Config) Validate() []error {
+	if c.EncryptionKeyringFile != "" && c.EncryptionKMSKeyID != "" {
+		return []error{fmt.Errorf("only one of ENCRYPTION_KEYRING_FILE and ENCRYPTION_KMS_KEY_ID can be set")}
+	}
+	return validatePlatform(c)
+}
+
+// ProviderSet provides the Encrypter of ENCRYPTION_KEYRING_FILE or
+// ENCRYPTION_KMS_KEY_ID.
+var ProviderSet = wire.NewSet(OpenEncrypter)
+
+// DataKey is a key generated for a single message, both in plaintext and
+// encrypted by the key-encryption key KeyID.
+type DataKey struct {
+	KeyID     string
+	Plaintext []byte
+	Encrypted []byte
+}
+
+// Keyring holds the key-encryption keys.
+type Keyring interface {
+	GenerateDataKey(ctx context.Context) (DataKey, error)
+	DecryptDataKey(ctx context.Context, keyID string, encrypted []byte) ([]byte, error)
+}
+
+// sealedArguments replaces the arguments of a sealed payload.
+type sealedArguments struct {
+	DataKey    []byte `json:"data_key"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Encrypter seals and opens arguments. An Encrypter without a keyring leaves
+// every payload untouched.
+type Encrypter struct {
+	keyring Keyring
+}
+
+// OpenEncrypter opens the configured keyring.
+func OpenEncrypter(ctx context.Context, cfg Config) (*Encrypter, error) {
+	keyring, err := openKeyring(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not open keyring: %w", err)
+	}
+	return NewEncrypter(keyring), nil
+}
+
+func NewEncrypter(keyring Keyring) *Encrypter {
+	return &Encrypter{
+		keyring: keyring,
+	}
+}
+
+// IsEncrypted reports whether the arguments of the message described by
+// metadata are sealed.
+func IsEncrypted(metadata map[string]string) bool {
+	_, isPresent := metadata[KeyIDMetadata]
+	return isPresent
+}
+
+// Seal encrypts the arguments of payload, returning the ID of the key that
+// must be sent as KeyIDMetadata. The ID is empty when nothing was sealed.
+func (e *Encrypter) Seal(ctx context.Context, payload *lib.PayloadItem) (string, error) {
+	if e.keyring == nil || len(payload.Arguments) == 0 {
+		return "", nil
+	}
+	dataKey, err := e.keyring.GenerateDataKey(ctx)
+	if err != nil {
+		return "", fmt.Errorf("could not generate data key: %w", err)
+	}
+	aead, err := newAEAD(dataKey.Plaintext)
+	if err != nil {
+		return "", err
+	}
+	sealed := sealedArguments{
+		DataKey: dataKey.Encrypted,
+		Nonce:   make([]byte, aead.NonceSize()),
+	}
+	if _, err := rand.Read(sealed.Nonce); err != nil {
+		return "", fmt.Errorf("could not generate nonce: %w", err)
+	}
+	// Binding the ciphertext to the payload ID keeps it from being replayed
+	// as the arguments of another message
+	sealed.Ciphertext = aead.Seal(nil, sealed.Nonce, payload.Arguments, payload.ID[:])
+	arguments, err := json.Marshal(sealed)
+	if err != nil {
+		return "", fmt.Errorf("could not serialize sealed arguments: %w", err)
+	}
+	payload.Arguments = arguments
+	return dataKey.KeyID, nil
+}
+
+// Open decrypts the arguments of payload when the message described by
+// metadata was sealed.
+func (e *Encrypter) Open(ctx context.Context, payload *lib.PayloadItem, metadata map[string]string) error {
+	if !IsEncrypted(metadata) {
+		return nil
+	} else if e.keyring == nil {
+		return ErrNotConfigured
+	}
+	sealed := sealedArguments{}
+	if err := json.Unmarshal(payload.Arguments, &sealed); err != nil {
+		return fmt.Errorf("could not parse sealed arguments: %w", err)
+	}
+	plaintextKey, err := e.keyring.DecryptDataKey(ctx, metadata[KeyIDMetadata], sealed.DataKey)
+	if err != nil {
+		return fmt.Errorf("could not decrypt data key: %w", err)
+	}
+	aead, err := newAEAD(plaintextKey)
+	if err != nil {
+		return err
+	}
+	if len(sealed.Nonce) != aead.NonceSize() {
+		return fmt.Errorf("sealed arguments have a nonce of %d bytes, expected %d", len(sealed.Nonce), aead.NonceSize())
+	}
+	arguments, err := aead.Open(nil, sealed.Nonce, sealed.Ciphertext, payload.ID[:])
+	if err != nil {
+		return fmt.Errorf("could not decrypt arguments: %w", err)
+	}
+	payload.Arguments = arguments
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	return aead, nil
+}
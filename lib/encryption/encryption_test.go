@@ -0,0 +1,97 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKeyring(t *testing.T, primary string) *FileKeyring {
+	keyring, err := NewFileKeyring(primary, map[string][]byte{
+		"local-1": bytes.Repeat([]byte{1}, dataKeySize),
+		"local-2": bytes.Repeat([]byte{2}, dataKeySize),
+	})
+	require.NoError(t, err)
+	return keyring
+}
+
+func testPayload() lib.PayloadItem {
+	return lib.PayloadItem{
+		ID:        uuid.New(),
+		TaskName:  "greet",
+		Arguments: json.RawMessage(`{"email":"someone@example.com"}`),
+	}
+}
+
+func TestSealAndOpen(t *testing.T) {
+	ctx := context.Background()
+	encrypter := NewEncrypter(testKeyring(t, "local-1"))
+	payload := testPayload()
+	keyID, err := encrypter.Seal(ctx, &payload)
+	require.NoError(t, err)
+	assert.Equal(t, "local-1", keyID)
+	assert.NotContains(t, string(payload.Arguments), "someone@example.com")
+
+	metadata := map[string]string{KeyIDMetadata: keyID}
+	require.NoError(t, encrypter.Open(ctx, &payload, metadata))
+	assert.Equal(t, testPayload().Arguments, payload.Arguments)
+}
+
+func TestOpenAfterRotation(t *testing.T) {
+	ctx := context.Background()
+	payload := testPayload()
+	keyID, err := NewEncrypter(testKeyring(t, "local-1")).Seal(ctx, &payload)
+	require.NoError(t, err)
+
+	rotated := NewEncrypter(testKeyring(t, "local-2"))
+	require.NoError(t, rotated.Open(ctx, &payload, map[string]string{KeyIDMetadata: keyID}))
+	assert.Equal(t, testPayload().Arguments, payload.Arguments)
+}
+
+func TestOpenRejectsArgumentsOfAnotherMessage(t *testing.T) {
+	ctx := context.Background()
+	encrypter := NewEncrypter(testKeyring(t, "local-1"))
+	payload := testPayload()
+	keyID, err := encrypter.Seal(ctx, &payload)
+	require.NoError(t, err)
+
+	replayed := testPayload()
+	replayed.Arguments = payload.Arguments
+	err = encrypter.Open(ctx, &replayed, map[string]string{KeyIDMetadata: keyID})
+	assert.ErrorContains(t, err, "could not decrypt arguments")
+}
+
+func TestWithoutKeyring(t *testing.T) {
+	ctx := context.Background()
+	payload := testPayload()
+	keyID, err := NewEncrypter(nil).Seal(ctx, &payload)
+	require.NoError(t, err)
+	assert.Empty(t, keyID)
+	assert.Equal(t, testPayload().Arguments, payload.Arguments)
+
+	err = NewEncrypter(nil).Open(ctx, &payload, map[string]string{KeyIDMetadata: "local-1"})
+	assert.ErrorIs(t, err, ErrNotConfigured)
+}
+
+func TestLoadFileKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"primary": "local-1",
+		"keys": {"local-1": "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="}
+	}`), 0o600))
+	keyring, err := LoadFileKeyring(path)
+	require.NoError(t, err)
+	assert.Equal(t, testKeyring(t, "local-1").keys["local-1"], keyring.keys["local-1"])
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"primary": "local-1", "keys": {"local-1": "c2hvcnQ="}}`), 0o600))
+	_, err = LoadFileKeyring(path)
+	assert.ErrorContains(t, err, "expected 32")
+}
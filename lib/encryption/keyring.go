@@ -0,0 +1,95 @@
+package encryption
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+const dataKeySize = 32
+
+// keyringFile is the format of ENCRYPTION_KEYRING_FILE. Data keys are
+// encrypted with the primary key, keeping the others around lets messages
+// sent before a rotation be decrypted:
+//
+//	{"primary": "local-2", "keys": {"local-1": "<base64>", "local-2": "<base64>"}}
+//
+// Each key is 32 random bytes, e.g. from `openssl rand -base64 32`.
+type keyringFile struct {
+	Primary string            `json:"primary"`
+	Keys    map[string][]byte `json:"keys"`
+}
+
+// FileKeyring is a Keyring whose key-encryption keys are read from a file.
+// Anyone able to read the file can both seal and open arguments, so it is
+// meant for development.
+type FileKeyring struct {
+	primary string
+	keys    map[string][]byte
+}
+
+// LoadFileKeyring reads the keyring at path.
+func LoadFileKeyring(path string) (*FileKeyring, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read keyring file: %w", err)
+	}
+	file := keyringFile{}
+	if err := json.Unmarshal(contents, &file); err != nil {
+		return nil, fmt.Errorf("could not parse keyring file: %w", err)
+	}
+	return NewFileKeyring(file.Primary, file.Keys)
+}
+
+func NewFileKeyring(primary string, keys map[string][]byte) (*FileKeyring, error) {
+	if _, isPresent := keys[primary]; !isPresent {
+		return nil, fmt.Errorf("primary key %q is not in the keyring", primary)
+	}
+	for id, key := range keys {
+		if len(key) != dataKeySize {
+			return nil, fmt.Errorf("key %q is %d bytes, expected %d", id, len(key), dataKeySize)
+		}
+	}
+	return &FileKeyring{
+		primary: primary,
+		keys:    keys,
+	}, nil
+}
+
+func (k *FileKeyring) GenerateDataKey(ctx context.Context) (DataKey, error) {
+	plaintext := make([]byte, dataKeySize)
+	if _, err := rand.Read(plaintext); err != nil {
+		return DataKey{}, err
+	}
+	aead, err := newAEAD(k.keys[k.primary])
+	if err != nil {
+		return DataKey{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return DataKey{}, err
+	}
+	return DataKey{
+		KeyID:     k.primary,
+		Plaintext: plaintext,
+		Encrypted: aead.Seal(nonce, nonce, plaintext, []byte(k.primary)),
+	}, nil
+}
+
+func (k *FileKeyring) DecryptDataKey(ctx context.Context, keyID string, encrypted []byte) ([]byte, error) {
+	key, isPresent := k.keys[keyID]
+	if !isPresent {
+		return nil, fmt.Errorf("key %q is not in the keyring", keyID)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted data key is too short")
+	}
+	nonce, ciphertext := encrypted[:aead.NonceSize()], encrypted[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(keyID))
+}
@@ -0,0 +1,68 @@
+//go:build aws
+
+package encryption
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+func validatePlatform(c Config) []error {
+	return nil
+}
+
+// openKeyring returns a nil Keyring when encryption is disabled.
+func openKeyring(ctx context.Context, cfg Config) (Keyring, error) {
+	if cfg.EncryptionKeyringFile != "" {
+		return LoadFileKeyring(cfg.EncryptionKeyringFile)
+	} else if cfg.EncryptionKMSKeyID == "" {
+		return nil, nil
+	}
+	awsConfig, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not load aws configuration: %w", err)
+	}
+	return &kmsKeyring{
+		client: kms.NewFromConfig(awsConfig),
+		keyID:  cfg.EncryptionKMSKeyID,
+	}, nil
+}
+
+// kmsKeyring has KMS generate and decrypt the data keys, so the
+// key-encryption key never leaves it.
+type kmsKeyring struct {
+	client *kms.Client
+	keyID  string
+}
+
+func (k *kmsKeyring) GenerateDataKey(ctx context.Context) (DataKey, error) {
+	output, err := k.client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(k.keyID),
+		KeySpec: types.DataKeySpecAes256,
+	})
+	if err != nil {
+		return DataKey{}, err
+	}
+	return DataKey{
+		KeyID:     aws.ToString(output.KeyId),
+		Plaintext: output.Plaintext,
+		Encrypted: output.CiphertextBlob,
+	}, nil
+}
+
+func (k *kmsKeyring) DecryptDataKey(ctx context.Context, keyID string, encrypted []byte) ([]byte, error) {
+	// Naming the key makes KMS refuse data keys of any other key
+	output, err := k.client.Decrypt(ctx, &kms.DecryptInput{
+		KeyId:          aws.String(keyID),
+		CiphertextBlob: encrypted,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Plaintext, nil
+}
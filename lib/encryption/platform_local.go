@@ -0,0 +1,23 @@
+//go:build !aws
+
+package encryption
+
+import (
+	"context"
+	"fmt"
+)
+
+func validatePlatform(c Config) []error {
+	if c.EncryptionKMSKeyID != "" {
+		return []error{fmt.Errorf("ENCRYPTION_KMS_KEY_ID is only available in aws builds")}
+	}
+	return nil
+}
+
+// openKeyring returns a nil Keyring when encryption is disabled.
+func openKeyring(ctx context.Context, cfg Config) (Keyring, error) {
+	if cfg.EncryptionKeyringFile == "" {
+		return nil, nil
+	}
+	return LoadFileKeyring(cfg.EncryptionKeyringFile)
+}
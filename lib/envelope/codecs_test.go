@@ -0,0 +1,132 @@
+package envelope
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var contentTypes = []string{ContentTypeJSON, ContentTypeProtobuf, ContentTypeMessagePack}
+
+// inUTC normalizes the location of the time, which not every codec keeps.
+func inUTC(payload lib.PayloadItem) lib.PayloadItem {
+	payload.Time = payload.Time.UTC()
+	if payload.Deadline != nil {
+		deadline := payload.Deadline.UTC()
+		payload.Deadline = &deadline
+	}
+	return payload
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	withoutOptionals := testPayload()
+	withoutOptionals.Arguments = nil
+	withOrderingKey := testPayload()
+	withOrderingKey.OrderingKey = "customer-42"
+	inWorkflow := testPayload()
+	parentID, rootID := uuid.New(), uuid.New()
+	inWorkflow.ParentID, inWorkflow.RootID = &parentID, &rootID
+	withDeadline := testPayload()
+	deadline := withDeadline.Time.Add(time.Minute)
+	withDeadline.Deadline = &deadline
+	r := NewRegistry()
+	for _, contentType := range contentTypes {
+		for name, payload := range map[string]lib.PayloadItem{
+			"complete":          withOrderingKey,
+			"without optionals": withoutOptionals,
+			"in a workflow":     inWorkflow,
+			"with a deadline":   withDeadline,
+		} {
+			t.Run(contentType+"/"+name, func(t *testing.T) {
+				body, metadata, err := r.Encode(payload, contentType)
+				require.NoError(t, err)
+				assert.Equal(t, contentType, metadata[ContentTypeMetadata])
+				decoded, err := r.Decode(body, metadata)
+				require.NoError(t, err)
+				assert.Equal(t, payload, inUTC(decoded))
+			})
+		}
+	}
+}
+
+func TestCodecsAreInterchangeable(t *testing.T) {
+	// A consumer decodes whatever a producer sends as the same payload, no
+	// matter which codec either of them is configured to prefer
+	r := NewRegistry()
+	decoded := map[string]lib.PayloadItem{}
+	for _, contentType := range contentTypes {
+		body, metadata, err := r.Encode(testPayload(), contentType)
+		require.NoError(t, err)
+		payload, err := r.Decode(body, metadata)
+		require.NoError(t, err)
+		decoded[contentType] = inUTC(payload)
+	}
+	assert.Equal(t, decoded[ContentTypeJSON], decoded[ContentTypeProtobuf])
+	assert.Equal(t, decoded[ContentTypeJSON], decoded[ContentTypeMessagePack])
+}
+
+func TestBinaryCodecsAreSmallerThanJSON(t *testing.T) {
+	r := NewRegistry()
+	jsonBody, _, err := r.Encode(testPayload(), ContentTypeJSON)
+	require.NoError(t, err)
+	for _, contentType := range []string{ContentTypeProtobuf, ContentTypeMessagePack} {
+		body, _, err := r.Encode(testPayload(), contentType)
+		require.NoError(t, err)
+		assert.Less(t, len(body), len(jsonBody), contentType)
+	}
+}
+
+func TestMessagePackUpgradesOlderVersions(t *testing.T) {
+	r := NewRegistry()
+	r.current = 2
+	r.RegisterUpgrade(1, func(document map[string]any) (map[string]any, error) {
+		document["task_name"] = "upgraded-" + document["task_name"].(string)
+		return document, nil
+	})
+	body, err := messagePackCodec{}.Marshal(testPayload())
+	require.NoError(t, err)
+	decoded, err := r.Decode(body, map[string]string{
+		SchemaVersionMetadata: "1",
+		ContentTypeMetadata:   ContentTypeMessagePack,
+	})
+	require.NoError(t, err)
+	expected := testPayload()
+	expected.TaskName = "upgraded-greet"
+	assert.Equal(t, expected, inUTC(decoded))
+}
+
+func TestOlderVersionsWithoutFieldsAddedSinceDecode(t *testing.T) {
+	// Sent by producers that predate the workflow and deadline fields
+	older := NewRegistry()
+	older.current = 1
+	r := NewRegistry()
+	for _, contentType := range contentTypes {
+		t.Run(contentType, func(t *testing.T) {
+			body, metadata, err := older.Encode(testPayload(), contentType)
+			require.NoError(t, err)
+			assert.Equal(t, "1", metadata[SchemaVersionMetadata])
+			decoded, err := r.Decode(body, metadata)
+			require.NoError(t, err)
+			assert.Equal(t, testPayload(), inUTC(decoded))
+		})
+	}
+}
+
+func TestProtobufIsNotUpgraded(t *testing.T) {
+	r := NewRegistry()
+	r.current = 2
+	r.RegisterUpgrade(1, func(document map[string]any) (map[string]any, error) {
+		return document, nil
+	})
+	body, err := protobufCodec{}.Marshal(testPayload())
+	require.NoError(t, err)
+	_, err = r.Decode(body, map[string]string{
+		SchemaVersionMetadata: "1",
+		ContentTypeMetadata:   ContentTypeProtobuf,
+	})
+	assert.ErrorContains(t, err, "protobuf codec cannot unmarshal")
+}
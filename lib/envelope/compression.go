@@ -0,0 +1,150 @@
+package envelope
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// DefaultDecompressionLimit is the largest body Decode decompresses unless
+// configured otherwise.
+const DefaultDecompressionLimit = 16 << 20
+
+// DecompressionLimitErr is returned instead of decompressing a body past the
+// limit, such as a decompression bomb.
+type DecompressionLimitErr struct {
+	Limit int
+}
+
+func (dle DecompressionLimitErr) Error() string {
+	return fmt.Sprintf("decompressed body exceeds %d bytes", dle.Limit)
+}
+
+// Encoding compresses bodies on top of their codec, advertised as their
+// content-encoding.
+type Encoding interface {
+	Name() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+type Option func(*Registry)
+
+// WithCompression compresses bodies of at least threshold bytes with the
+// named encoding, keeping the original whenever compressing does not make it
+// smaller.
+func WithCompression(encoding string, threshold int) Option {
+	return func(r *Registry) {
+		r.compression = encoding
+		r.compressionThreshold = threshold
+	}
+}
+
+// WithDecompressionLimit bounds how large a body Decode decompresses.
+func WithDecompressionLimit(limit int) Option {
+	return func(r *Registry) {
+		r.decompressionLimit = limit
+	}
+}
+
+// RegisterEncoding adds or replaces the encoding of its name.
+func (r *Registry) RegisterEncoding(encoding Encoding) {
+	r.encodings[encoding.Name()] = encoding
+}
+
+// SupportsEncoding reports whether an encoding is registered for name.
+func (r *Registry) SupportsEncoding(name string) bool {
+	_, isRegistered := r.encodings[name]
+	return isRegistered
+}
+
+func (r *Registry) compress(body []byte, metadata map[string]string) ([]byte, error) {
+	if r.compression == "" || len(body) < r.compressionThreshold {
+		return body, nil
+	}
+	encoding, isRegistered := r.encodings[r.compression]
+	if !isRegistered {
+		return nil, UnsupportedEncodingErr{Encoding: r.compression}
+	}
+	buffer := bytes.Buffer{}
+	writer, err := encoding.NewWriter(&buffer)
+	if err != nil {
+		return nil, fmt.Errorf("could not compress with %s: %w", encoding.Name(), err)
+	}
+	if _, err := writer.Write(body); err != nil {
+		return nil, fmt.Errorf("could not compress with %s: %w", encoding.Name(), err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("could not compress with %s: %w", encoding.Name(), err)
+	}
+	if buffer.Len() >= len(body) {
+		return body, nil
+	}
+	metadata[ContentEncodingMetadata] = encoding.Name()
+	return buffer.Bytes(), nil
+}
+
+func (r *Registry) decompress(body []byte, metadata map[string]string) ([]byte, error) {
+	name, isPresent := metadata[ContentEncodingMetadata]
+	if !isPresent || name == identityEncoding {
+		return body, nil
+	}
+	encoding, isRegistered := r.encodings[name]
+	if !isRegistered {
+		return nil, UnsupportedEncodingErr{Encoding: name}
+	}
+	reader, err := encoding.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress %s body: %w", name, err)
+	}
+	defer reader.Close()
+	// Reading one byte past the limit tells a body of exactly the limit
+	// apart from one that exceeds it
+	decompressed, err := io.ReadAll(io.LimitReader(reader, int64(r.decompressionLimit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress %s body: %w", name, err)
+	} else if len(decompressed) > r.decompressionLimit {
+		return nil, DecompressionLimitErr{Limit: r.decompressionLimit}
+	}
+	return decompressed, nil
+}
+
+type gzipEncoding struct{}
+
+func (gzipEncoding) Name() string {
+	return EncodingGzip
+}
+
+func (gzipEncoding) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipEncoding) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type zstdEncoding struct{}
+
+func (zstdEncoding) Name() string {
+	return EncodingZstd
+}
+
+func (zstdEncoding) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+}
+
+func (zstdEncoding) NewReader(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
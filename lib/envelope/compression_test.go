@@ -0,0 +1,128 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// largePayload has arguments of roughly size bytes that compress about as
+// well as the records our high-volume tasks are submitted with.
+func largePayload(size int) lib.PayloadItem {
+	records := []map[string]any{}
+	for i := 0; len(records)*90 < size; i++ {
+		records = append(records, map[string]any{
+			"customer_id": fmt.Sprintf("customer-%06d", i),
+			"status":      []string{"active", "suspended", "closed"}[i%3],
+			"balance":     i * 37 % 10000,
+		})
+	}
+	arguments, _ := json.Marshal(map[string]any{"records": records})
+	payload := testPayload()
+	payload.Arguments = arguments
+	return payload
+}
+
+func TestCompression(t *testing.T) {
+	for _, encoding := range []string{EncodingGzip, EncodingZstd} {
+		t.Run(encoding, func(t *testing.T) {
+			r := NewRegistry(WithCompression(encoding, 1024))
+			payload := largePayload(64 << 10)
+			body, metadata, err := r.Encode(payload, ContentTypeJSON)
+			require.NoError(t, err)
+			assert.Equal(t, encoding, metadata[ContentEncodingMetadata])
+			assert.Less(t, len(body), len(payload.Arguments)/2)
+
+			decoded, err := NewRegistry().Decode(body, metadata)
+			require.NoError(t, err)
+			assert.Equal(t, payload, decoded)
+		})
+	}
+}
+
+func TestCompressionLeavesSmallAndIncompressibleBodies(t *testing.T) {
+	r := NewRegistry(WithCompression(EncodingGzip, 1024))
+	_, metadata, err := r.Encode(testPayload(), ContentTypeJSON)
+	require.NoError(t, err)
+	assert.NotContains(t, metadata, ContentEncodingMetadata, "below the threshold")
+
+	r = NewRegistry(WithCompression(EncodingGzip, 0))
+	_, metadata, err = r.Encode(testPayload(), ContentTypeProtobuf)
+	require.NoError(t, err)
+	assert.NotContains(t, metadata, ContentEncodingMetadata, "larger once compressed")
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	// A few kilobytes of zeroes that would expand to a megabyte
+	bomb := NewRegistry(WithCompression(EncodingZstd, 0))
+	payload := testPayload()
+	payload.Arguments = json.RawMessage(`"` + strings.Repeat("0", 1<<20) + `"`)
+	body, metadata, err := bomb.Encode(payload, ContentTypeJSON)
+	require.NoError(t, err)
+	require.Less(t, len(body), 4<<10)
+
+	_, err = NewRegistry(WithDecompressionLimit(64<<10)).Decode(body, metadata)
+	assert.ErrorAs(t, err, &DecompressionLimitErr{})
+
+	_, err = NewRegistry(WithDecompressionLimit(2<<20)).Decode(body, metadata)
+	assert.NoError(t, err)
+}
+
+func TestDecompressRejectsCorruptBodies(t *testing.T) {
+	for _, encoding := range []string{EncodingGzip, EncodingZstd} {
+		_, err := NewRegistry().Decode(bytes.Repeat([]byte{0xff}, 64), map[string]string{
+			ContentEncodingMetadata: encoding,
+		})
+		assert.Error(t, err, encoding)
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	payload := largePayload(128 << 10)
+	for _, encoding := range []string{"", EncodingGzip, EncodingZstd} {
+		name := encoding
+		if name == "" {
+			name = "uncompressed"
+		}
+		b.Run(name, func(b *testing.B) {
+			r := NewRegistry(WithCompression(encoding, 1024))
+			b.SetBytes(int64(len(payload.Arguments)))
+			var body []byte
+			for i := 0; i < b.N; i++ {
+				var err error
+				if body, _, err = r.Encode(payload, ContentTypeJSON); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(body)), "body-bytes")
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	payload := largePayload(128 << 10)
+	for _, encoding := range []string{"", EncodingGzip, EncodingZstd} {
+		name := encoding
+		if name == "" {
+			name = "uncompressed"
+		}
+		b.Run(name, func(b *testing.B) {
+			r := NewRegistry(WithCompression(encoding, 1024))
+			body, metadata, err := r.Encode(payload, ContentTypeJSON)
+			require.NoError(b, err)
+			b.SetBytes(int64(len(payload.Arguments)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := r.Decode(body, metadata); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+// Package envelope describes how a PayloadItem is serialized through
+// message metadata, so that producers and consumers can be rolled out
+// independently:
+//
+//	schema-version    version of the PayloadItem schema, 1 when absent
+//	content-type      codec of the body, application/json when absent
+//	content-encoding  compression applied on top of the codec, none when absent
+//
+// Messages without any of these were sent before the envelope existed and
+// decode as version 1 JSON.
+package envelope
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
+)
+
+const (
+	SchemaVersionMetadata   = "schema-version"
+	ContentTypeMetadata     = "content-type"
+	ContentEncodingMetadata = "content-encoding"
+)
+
+// CurrentSchemaVersion is the version of lib.PayloadItem. Bump it, and
+// register an Upgrade from the previous version, whenever PayloadItem changes
+// in a way older consumers or producers would not understand, including new
+// fields they would silently ignore. Version 2 added ParentID and RootID,
+// version 3 Deadline.
+const CurrentSchemaVersion = 3
+
+const (
+	legacySchemaVersion = 1
+	defaultContentType  = ContentTypeJSON
+	identityEncoding    = "identity"
+)
+
+type UnsupportedVersionErr struct {
+	Version int
+	Current int
+}
+
+func (uve UnsupportedVersionErr) Error() string {
+	return fmt.Sprintf("schema version %d is newer than the supported version %d", uve.Version, uve.Current)
+}
+
+type UnsupportedContentTypeErr struct {
+	ContentType string
+}
+
+func (ucte UnsupportedContentTypeErr) Error() string {
+	return fmt.Sprintf("content type %q is not supported", ucte.ContentType)
+}
+
+type UnsupportedEncodingErr struct {
+	Encoding string
+}
+
+func (uee UnsupportedEncodingErr) Error() string {
+	return fmt.Sprintf("content encoding %q is not supported", uee.Encoding)
+}
+
+// Codec serializes payloads of one content type. Codecs able to marshal and
+// unmarshal a map[string]any can also decode payloads of older schema
+// versions.
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// Upgrade rewrites a decoded payload of one schema version into the next. A
+// nil Upgrade stands for a version that only adds optional fields, payloads
+// of the previous version are then decoded as they are, by any codec.
+type Upgrade func(document map[string]any) (map[string]any, error)
+
+// Registry holds the codecs and upgrades a service knows about. It is not
+// safe to register codecs or upgrades concurrently with encoding or decoding.
+type Registry struct {
+	current   int
+	codecs    map[string]Codec
+	encodings map[string]Encoding
+	upgrades  map[int]Upgrade
+
+	compression          string
+	compressionThreshold int
+	decompressionLimit   int
+}
+
+// NewRegistry returns a registry that knows the JSON, protobuf and
+// MessagePack codecs and the gzip and zstd encodings. It doesn't compress
+// unless configured to.
+func NewRegistry(opts ...Option) *Registry {
+	r := &Registry{
+		current:            CurrentSchemaVersion,
+		codecs:             map[string]Codec{},
+		encodings:          map[string]Encoding{},
+		upgrades:           map[int]Upgrade{},
+		decompressionLimit: DefaultDecompressionLimit,
+	}
+	r.RegisterCodec(jsonCodec{})
+	r.RegisterCodec(protobufCodec{})
+	r.RegisterCodec(messagePackCodec{})
+	r.RegisterEncoding(gzipEncoding{})
+	r.RegisterEncoding(zstdEncoding{})
+	// ParentID and RootID
+	r.RegisterUpgrade(1, nil)
+	// Deadline
+	r.RegisterUpgrade(2, nil)
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// RegisterCodec adds or replaces the codec of its content type.
+func (r *Registry) RegisterCodec(codec Codec) {
+	r.codecs[codec.ContentType()] = codec
+}
+
+// RegisterUpgrade adds the upgrade from version from to version from+1.
+func (r *Registry) RegisterUpgrade(from int, upgrade Upgrade) {
+	r.upgrades[from] = upgrade
+}
+
+// Supports reports whether a codec is registered for contentType.
+func (r *Registry) Supports(contentType string) bool {
+	_, isRegistered := r.codecs[contentType]
+	return isRegistered
+}
+
+// Encode serializes payload with the codec of contentType, compressing it if
+// configured to, returning the body and the metadata describing it.
+func (r *Registry) Encode(payload lib.PayloadItem, contentType string) ([]byte, map[string]string, error) {
+	codec, isRegistered := r.codecs[contentType]
+	if !isRegistered {
+		return nil, nil, UnsupportedContentTypeErr{ContentType: contentType}
+	}
+	body, err := codec.Marshal(payload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not encode payload as %s: %w", contentType, err)
+	}
+	metadata := map[string]string{
+		SchemaVersionMetadata: strconv.Itoa(r.current),
+		ContentTypeMetadata:   contentType,
+	}
+	body, err = r.compress(body, metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, metadata, nil
+}
+
+// Decode deserializes body as described by metadata, upgrading payloads of
+// older schema versions to the current one.
+func (r *Registry) Decode(body []byte, metadata map[string]string) (lib.PayloadItem, error) {
+	payload := lib.PayloadItem{}
+	version := legacySchemaVersion
+	if value, isPresent := metadata[SchemaVersionMetadata]; isPresent {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < legacySchemaVersion {
+			return payload, fmt.Errorf("invalid schema version %q", value)
+		}
+		version = parsed
+	}
+	if version > r.current {
+		return payload, UnsupportedVersionErr{Version: version, Current: r.current}
+	}
+	contentType := defaultContentType
+	if value, isPresent := metadata[ContentTypeMetadata]; isPresent {
+		contentType = value
+	}
+	codec, isRegistered := r.codecs[contentType]
+	if !isRegistered {
+		return payload, UnsupportedContentTypeErr{ContentType: contentType}
+	}
+	body, err := r.decompress(body, metadata)
+	if err != nil {
+		return payload, err
+	}
+
+	additive := true
+	for from := version; from < r.current; from++ {
+		upgrade, isRegistered := r.upgrades[from]
+		if !isRegistered {
+			return payload, fmt.Errorf("no upgrade from schema version %d to %d", from, from+1)
+		}
+		additive = additive && upgrade == nil
+	}
+
+	if additive {
+		if err := codec.Unmarshal(body, &payload); err != nil {
+			return payload, fmt.Errorf("could not decode %s payload: %w", contentType, err)
+		}
+		return payload, nil
+	}
+	document := map[string]any{}
+	if err := codec.Unmarshal(body, &document); err != nil {
+		return payload, fmt.Errorf("could not decode %s payload of schema version %d: %w", contentType, version, err)
+	}
+	for ; version < r.current; version++ {
+		upgrade := r.upgrades[version]
+		if upgrade == nil {
+			continue
+		}
+		upgraded, err := upgrade(document)
+		if err != nil {
+			return payload, fmt.Errorf("could not upgrade from schema version %d to %d: %w", version, version+1, err)
+		}
+		document = upgraded
+	}
+	// The upgraded document is bound to the current PayloadItem by the codec
+	// that decoded it, which knows how it represents each field
+	upgraded, err := codec.Marshal(document)
+	if err != nil {
+		return payload, fmt.Errorf("could not bind upgraded payload: %w", err)
+	}
+	if err := codec.Unmarshal(upgraded, &payload); err != nil {
+		return payload, fmt.Errorf("could not bind upgraded payload: %w", err)
+	}
+	return payload, nil
+}
@@ -0,0 +1,80 @@
+package envelope
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testPayload() lib.PayloadItem {
+	return lib.PayloadItem{
+		ID:        uuid.MustParse("0f8fad5b-d9cb-469f-a165-70867728950e"),
+		Time:      time.Date(2023, time.August, 1, 12, 0, 0, 0, time.UTC),
+		TaskName:  "greet",
+		Arguments: json.RawMessage(`{"name":"world"}`),
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	r := NewRegistry()
+	body, metadata, err := r.Encode(testPayload(), ContentTypeJSON)
+	require.NoError(t, err)
+	assert.Equal(t, "3", metadata[SchemaVersionMetadata])
+	assert.Equal(t, ContentTypeJSON, metadata[ContentTypeMetadata])
+
+	decoded, err := r.Decode(body, metadata)
+	require.NoError(t, err)
+	assert.Equal(t, testPayload(), decoded)
+}
+
+func TestDecodeLegacyMessage(t *testing.T) {
+	// Sent before the envelope existed, without any metadata
+	body, err := json.Marshal(testPayload())
+	require.NoError(t, err)
+	decoded, err := NewRegistry().Decode(body, nil)
+	require.NoError(t, err)
+	assert.Equal(t, testPayload(), decoded)
+}
+
+func TestDecodeUpgradesOlderVersions(t *testing.T) {
+	r := NewRegistry()
+	// Pretend the task name was called "task" up to version 2
+	r.current = 3
+	r.RegisterUpgrade(1, func(document map[string]any) (map[string]any, error) {
+		document["task"] = document["name"]
+		delete(document, "name")
+		return document, nil
+	})
+	r.RegisterUpgrade(2, func(document map[string]any) (map[string]any, error) {
+		document["task_name"] = document["task"]
+		delete(document, "task")
+		return document, nil
+	})
+	decoded, err := r.Decode([]byte(`{"id":"0f8fad5b-d9cb-469f-a165-70867728950e","name":"greet"}`), map[string]string{
+		SchemaVersionMetadata: "1",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "greet", decoded.TaskName)
+	assert.Equal(t, testPayload().ID, decoded.ID)
+}
+
+func TestDecodeRejectsWhatItDoesNotUnderstand(t *testing.T) {
+	r := NewRegistry()
+	_, err := r.Decode([]byte(`{}`), map[string]string{SchemaVersionMetadata: "4"})
+	assert.ErrorAs(t, err, &UnsupportedVersionErr{})
+
+	_, err = r.Decode([]byte(`{}`), map[string]string{ContentTypeMetadata: "application/xml"})
+	assert.ErrorAs(t, err, &UnsupportedContentTypeErr{})
+
+	_, err = r.Decode([]byte(`{}`), map[string]string{ContentEncodingMetadata: "br"})
+	assert.ErrorAs(t, err, &UnsupportedEncodingErr{})
+
+	r.current = 4
+	_, err = r.Decode([]byte(`{}`), map[string]string{SchemaVersionMetadata: "1"})
+	assert.ErrorContains(t, err, "no upgrade from schema version 3 to 4")
+}
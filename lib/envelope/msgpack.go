@@ -0,0 +1,34 @@
+package envelope
+
+import (
+	"bytes"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const ContentTypeMessagePack = "application/x-msgpack"
+
+// messagePackCodec serializes payloads as MessagePack maps keyed like their
+// JSON counterparts, so upgrades see the same keys whichever of the two
+// a payload was sent with. The id and the arguments are binary, however.
+type messagePackCodec struct{}
+
+func (messagePackCodec) ContentType() string {
+	return ContentTypeMessagePack
+}
+
+func (messagePackCodec) Marshal(v any) ([]byte, error) {
+	buffer := bytes.Buffer{}
+	encoder := msgpack.NewEncoder(&buffer)
+	encoder.SetCustomStructTag("json")
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (messagePackCodec) Unmarshal(data []byte, v any) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+	return decoder.Decode(v)
+}
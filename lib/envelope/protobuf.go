@@ -0,0 +1,102 @@
+package envelope
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative envelopepb/payload.proto
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/envelope/envelopepb"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const ContentTypeProtobuf = "application/x-protobuf"
+
+// protobufCodec serializes payloads as envelopepb.PayloadItem. Protobuf
+// fields stay wire compatible as long as their numbers aren't reused, so it
+// only decodes payloads of the current schema version.
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (protobufCodec) Marshal(v any) ([]byte, error) {
+	var payload lib.PayloadItem
+	switch value := v.(type) {
+	case lib.PayloadItem:
+		payload = value
+	case *lib.PayloadItem:
+		payload = *value
+	default:
+		return nil, fmt.Errorf("protobuf codec cannot marshal %T", v)
+	}
+	message := &envelopepb.PayloadItem{
+		Id:          payload.ID[:],
+		TaskName:    payload.TaskName,
+		OrderingKey: payload.OrderingKey,
+		Arguments:   payload.Arguments,
+	}
+	if !payload.Time.IsZero() {
+		message.Time = timestamppb.New(payload.Time)
+	}
+	if payload.ParentID != nil {
+		message.ParentId = payload.ParentID[:]
+	}
+	if payload.RootID != nil {
+		message.RootId = payload.RootID[:]
+	}
+	if payload.Deadline != nil {
+		message.Deadline = timestamppb.New(*payload.Deadline)
+	}
+	return proto.Marshal(message)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v any) error {
+	payload, isPayload := v.(*lib.PayloadItem)
+	if !isPayload {
+		return fmt.Errorf("protobuf codec cannot unmarshal into %T", v)
+	}
+	message := &envelopepb.PayloadItem{}
+	if err := proto.Unmarshal(data, message); err != nil {
+		return err
+	}
+	id, err := uuid.FromBytes(message.GetId())
+	if err != nil {
+		return fmt.Errorf("invalid id: %w", err)
+	}
+	*payload = lib.PayloadItem{
+		ID:          id,
+		TaskName:    message.GetTaskName(),
+		OrderingKey: message.GetOrderingKey(),
+		Arguments:   message.GetArguments(),
+	}
+	if message.Time != nil {
+		payload.Time = message.GetTime().AsTime()
+	}
+	if payload.ParentID, err = optionalUUID(message.GetParentId()); err != nil {
+		return fmt.Errorf("invalid parent id: %w", err)
+	}
+	if payload.RootID, err = optionalUUID(message.GetRootId()); err != nil {
+		return fmt.Errorf("invalid root id: %w", err)
+	}
+	if message.Deadline != nil {
+		deadline := message.GetDeadline().AsTime()
+		payload.Deadline = &deadline
+	}
+	return nil
+}
+
+// optionalUUID parses the bytes of a UUID that's nil when empty.
+func optionalUUID(data []byte) (*uuid.UUID, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	id, err := uuid.FromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
@@ -2,15 +2,23 @@ package envutil
 
 import (
 	"context"
+	"errors"
 	"fmt"
-
+	"net/url"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"os"
 
 	"github.com/rs/zerolog"
 )
 
+// FileSuffix is appended to a key to find a file holding its value, so that
+// FOO can be provided as the contents of the file named by FOO_FILE.
+const FileSuffix = "_FILE"
+
 type AbsentKeyErr struct {
 	Key string
 }
@@ -19,6 +27,21 @@ func (ake AbsentKeyErr) Error() string {
 	return fmt.Sprintf("key was absent: %s", ake.Key)
 }
 
+// ParseErr reports a value that was present but malformed. The value itself
+// is deliberately left out since it may be a secret.
+type ParseErr struct {
+	Key string
+	Err error
+}
+
+func (pe ParseErr) Error() string {
+	return fmt.Sprintf("could not parse value of key %s: %v", pe.Key, pe.Err)
+}
+
+func (pe ParseErr) Unwrap() error {
+	return pe.Err
+}
+
 func Must(ctx context.Context, key string) string {
 	log := zerolog.Ctx(ctx)
 	value, err := GetOrErr(ctx, key)
@@ -41,6 +64,47 @@ func GetOrErr(ctx context.Context, key string) (string, error) {
 	return value, nil
 }
 
+// parseOrErr looks up key and parses it, returning AbsentKeyErr when it is
+// not set and ParseErr when it could not be parsed.
+func parseOrErr[T any](ctx context.Context, key string, parse func(string) (T, error)) (T, error) {
+	var zero T
+	value, err := GetOrErr(ctx, key)
+	if err != nil {
+		return zero, err
+	}
+	parsedValue, err := parse(strings.TrimSpace(value))
+	if err != nil {
+		zerolog.Ctx(ctx).Debug().Str("key", key).Err(err).Msg("could not parse environment variable")
+		return zero, ParseErr{Key: key, Err: err}
+	}
+	return parsedValue, nil
+}
+
+// parseOrDefault behaves like parseOrErr but falls back to defaultValue when
+// the key is absent. A malformed value is still reported as an error.
+func parseOrDefault[T any](ctx context.Context, key string, defaultValue T, parse func(string) (T, error)) (T, error) {
+	log := zerolog.Ctx(ctx).With().Str("key", key).Logger()
+	parsedValue, err := parseOrErr(ctx, key, parse)
+	if errors.As(err, &AbsentKeyErr{}) {
+		log.Debug().Msg("falling back to default value for environment variable")
+		return defaultValue, nil
+	} else if err != nil {
+		return defaultValue, err
+	}
+	log.Debug().Msg("parsed environment variable")
+	return parsedValue, nil
+}
+
+func IntOrErr(ctx context.Context, key string) (int, error) {
+	return parseOrErr(ctx, key, strconv.Atoi)
+}
+
+func IntOrDefault(ctx context.Context, key string, defaultValue int) (int, error) {
+	return parseOrDefault(ctx, key, defaultValue, strconv.Atoi)
+}
+
+// Int returns the value of key or defaultValue when it is absent, exiting
+// when it can't be parsed. Use IntOrDefault to handle that instead.
 func Int(ctx context.Context, key string, defaultValue int) int {
 	log := zerolog.Ctx(ctx).With().Str("key", key).Logger()
 	value, isPresent := os.LookupEnv(key)
@@ -56,6 +120,127 @@ func Int(ctx context.Context, key string, defaultValue int) int {
 	return parsedValue
 }
 
+func DurationOrErr(ctx context.Context, key string) (time.Duration, error) {
+	return parseOrErr(ctx, key, time.ParseDuration)
+}
+
+func Duration(ctx context.Context, key string, defaultValue time.Duration) (time.Duration, error) {
+	return parseOrDefault(ctx, key, defaultValue, time.ParseDuration)
+}
+
+func BoolOrErr(ctx context.Context, key string) (bool, error) {
+	return parseOrErr(ctx, key, strconv.ParseBool)
+}
+
+func Bool(ctx context.Context, key string, defaultValue bool) (bool, error) {
+	return parseOrDefault(ctx, key, defaultValue, strconv.ParseBool)
+}
+
+func parseFloat(value string) (float64, error) {
+	return strconv.ParseFloat(value, 64)
+}
+
+func FloatOrErr(ctx context.Context, key string) (float64, error) {
+	return parseOrErr(ctx, key, parseFloat)
+}
+
+func Float(ctx context.Context, key string, defaultValue float64) (float64, error) {
+	return parseOrDefault(ctx, key, defaultValue, parseFloat)
+}
+
+// parseStringSlice splits a comma separated list, trimming whitespace and
+// dropping empty items.
+func parseStringSlice(value string) ([]string, error) {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func StringSliceOrErr(ctx context.Context, key string) ([]string, error) {
+	return parseOrErr(ctx, key, parseStringSlice)
+}
+
+func StringSlice(ctx context.Context, key string, defaultValue []string) ([]string, error) {
+	return parseOrDefault(ctx, key, defaultValue, parseStringSlice)
+}
+
+// parseURL parses an absolute URL, a value without a scheme is rejected
+// since url.Parse would otherwise happily accept almost anything.
+func parseURL(value string) (*url.URL, error) {
+	parsedURL, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	} else if parsedURL.Scheme == "" {
+		return nil, fmt.Errorf("url has no scheme")
+	}
+	return parsedURL, nil
+}
+
+func URLOrErr(ctx context.Context, key string) (*url.URL, error) {
+	return parseOrErr(ctx, key, parseURL)
+}
+
+func URL(ctx context.Context, key string, defaultValue *url.URL) (*url.URL, error) {
+	return parseOrDefault(ctx, key, defaultValue, parseURL)
+}
+
+func parseEnum(allowed []string) func(string) (string, error) {
+	return func(value string) (string, error) {
+		if !slices.Contains(allowed, value) {
+			return "", fmt.Errorf("must be one of %s", strings.Join(allowed, ", "))
+		}
+		return value, nil
+	}
+}
+
+// EnumOrErr returns the value of key, which must be one of allowed.
+func EnumOrErr(ctx context.Context, key string, allowed ...string) (string, error) {
+	return parseOrErr(ctx, key, parseEnum(allowed))
+}
+
+// Enum returns the value of key, which must be one of allowed, or
+// defaultValue when it is absent.
+func Enum(ctx context.Context, key string, defaultValue string, allowed ...string) (string, error) {
+	return parseOrDefault(ctx, key, defaultValue, parseEnum(allowed))
+}
+
+// SecretOrErr returns the value of key or, when it is absent, the contents
+// of the file named by key+FileSuffix with surrounding whitespace removed.
+// Neither the value nor the file contents are ever logged.
+func SecretOrErr(ctx context.Context, key string) (string, error) {
+	log := zerolog.Ctx(ctx).With().Str("key", key).Logger()
+	if value, isPresent := os.LookupEnv(key); isPresent {
+		log.Debug().Msg("secret was present in environment variable")
+		return value, nil
+	}
+	fileKey := key + FileSuffix
+	path, isPresent := os.LookupEnv(fileKey)
+	if !isPresent {
+		log.Debug().Msg("secret was not present")
+		return "", AbsentKeyErr{
+			Key: key,
+		}
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", ParseErr{Key: fileKey, Err: err}
+	}
+	log.Debug().Str("file_key", fileKey).Msg("secret was read from file")
+	return strings.TrimSpace(string(contents)), nil
+}
+
+func Secret(ctx context.Context, key string, defaultValue string) (string, error) {
+	value, err := SecretOrErr(ctx, key)
+	if errors.As(err, &AbsentKeyErr{}) {
+		return defaultValue, nil
+	}
+	return value, err
+}
+
 func Has(ctx context.Context, key string) bool {
 	log := zerolog.Ctx(ctx).With().Str("key", key).Logger()
 	_, isPresent := os.LookupEnv(key)
@@ -0,0 +1,177 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	LivenessPath  = "/healthz"
+	ReadinessPath = "/readyz"
+)
+
+// Probe reports whether a dependency is usable. A nil error means healthy.
+type Probe func(ctx context.Context) error
+
+type Checker struct {
+	timeout time.Duration
+
+	mutex  sync.RWMutex
+	probes map[string]Probe
+}
+
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{
+		timeout: timeout,
+		probes:  map[string]Probe{},
+	}
+}
+
+// Add registers a readiness probe. Registering a probe with a name that
+// already exists replaces the previous one.
+func (c *Checker) Add(name string, probe Probe) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.probes[name] = probe
+}
+
+// Check runs every registered probe concurrently and reports the results.
+func (c *Checker) Check(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	c.mutex.RLock()
+	names := make([]string, 0, len(c.probes))
+	for name := range c.probes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	probes := make([]Probe, len(names))
+	for i, name := range names {
+		probes[i] = c.probes[name]
+	}
+	c.mutex.RUnlock()
+
+	errs := make([]error, len(probes))
+	wg := sync.WaitGroup{}
+	for i, probe := range probes {
+		wg.Add(1)
+		go func(i int, probe Probe) {
+			defer wg.Done()
+			errs[i] = probe(ctx)
+		}(i, probe)
+	}
+	wg.Wait()
+
+	report := Report{
+		Status: "ok",
+		Checks: make(map[string]CheckResult, len(names)),
+	}
+	for i, name := range names {
+		if errs[i] != nil {
+			report.Status = "unavailable"
+			report.Checks[name] = CheckResult{Status: "unavailable", Error: errs[i].Error()}
+			continue
+		}
+		report.Checks[name] = CheckResult{Status: "ok"}
+	}
+	return report
+}
+
+// LivenessHandler reports that the process is up and serving requests.
+// It deliberately does not consult any probes, so an unreachable broker
+// never causes the orchestrator to restart an otherwise healthy container.
+func (c *Checker) LivenessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, http.StatusOK, Report{Status: "ok"})
+	}
+}
+
+// ReadinessHandler reports whether every registered probe is passing.
+func (c *Checker) ReadinessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := zerolog.Ctx(r.Context())
+		report := c.Check(r.Context())
+		statusCode := http.StatusOK
+		if report.Status != "ok" {
+			statusCode = http.StatusServiceUnavailable
+			log.Warn().Any("report", report).Msg("readiness check failed")
+		}
+		writeReport(w, statusCode, report)
+	}
+}
+
+func writeReport(w http.ResponseWriter, statusCode int, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(report)
+}
+
+// CheckURL performs a GET against url and errors unless it answers with a
+// 2xx status. It backs the `healthcheck` subcommand of each service, since
+// the distroless images have no curl or wget for docker or ECS to call.
+func CheckURL(ctx context.Context, url string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("could not create health check request: %w", err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("could not perform health check request: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("health check responded with status code: %d", response.StatusCode)
+	}
+	return nil
+}
+
+// RunCommandIfRequested handles the `healthcheck [path]` subcommand. When
+// args request it, the path (LivenessPath by default) is checked against
+// baseURL and the process exits with a status code suitable for a docker or
+// ECS HEALTHCHECK. Otherwise it returns and normal startup continues.
+func RunCommandIfRequested(args []string, baseURL string) {
+	if exitCode, requested := runCommand(args, baseURL); requested {
+		os.Exit(exitCode)
+	}
+}
+
+// runCommand returns the exit code of the `healthcheck` subcommand, and
+// whether args requested it at all.
+func runCommand(args []string, baseURL string) (int, bool) {
+	if len(args) < 2 || args[1] != "healthcheck" {
+		return 0, false
+	}
+	path := LivenessPath
+	if len(args) > 2 {
+		path = args[2]
+	}
+	url := baseURL + path
+	log := zerolog.New(os.Stderr)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := CheckURL(ctx, url); err != nil {
+		log.Error().Err(err).Str("url", url).Msg("health check failed")
+		return 1, true
+	}
+	return 0, true
+}
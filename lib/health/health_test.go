@@ -0,0 +1,131 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testServer(t *testing.T, checker *Checker) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle(LivenessPath, checker.LivenessHandler())
+	mux.Handle(ReadinessPath, checker.ReadinessHandler())
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func get(t *testing.T, url string) (int, Report) {
+	response, err := http.Get(url)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	assert.Equal(t, "no-store", response.Header.Get("Cache-Control"))
+	report := Report{}
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&report))
+	return response.StatusCode, report
+}
+
+func TestCheckRunsProbesConcurrently(t *testing.T) {
+	checker := NewChecker(time.Second)
+	running := atomic.Int32{}
+	release := make(chan struct{})
+	for _, name := range []string{"broker", "bucket", "database"} {
+		checker.Add(name, func(ctx context.Context) error {
+			if running.Add(1) == 3 {
+				close(release)
+			}
+			select {
+			case <-release:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}
+	report := checker.Check(context.Background())
+	assert.Equal(t, "ok", report.Status, "every probe waits for the others to be running")
+	assert.Len(t, report.Checks, 3)
+}
+
+func TestCheckTimesOut(t *testing.T) {
+	checker := NewChecker(time.Millisecond * 50)
+	checker.Add("broker", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	checker.Add("bucket", func(ctx context.Context) error {
+		return nil
+	})
+	started := time.Now()
+	report := checker.Check(context.Background())
+	assert.Less(t, time.Since(started), time.Second)
+	assert.Equal(t, "unavailable", report.Status)
+	assert.Equal(t, CheckResult{Status: "unavailable", Error: context.DeadlineExceeded.Error()}, report.Checks["broker"])
+	assert.Equal(t, CheckResult{Status: "ok"}, report.Checks["bucket"])
+}
+
+func TestAddReplacesProbes(t *testing.T) {
+	checker := NewChecker(time.Second)
+	checker.Add("broker", func(ctx context.Context) error {
+		return errors.New("unreachable")
+	})
+	checker.Add("broker", func(ctx context.Context) error {
+		return nil
+	})
+	assert.Equal(t, "ok", checker.Check(context.Background()).Status)
+}
+
+func TestLivenessIgnoresProbes(t *testing.T) {
+	checker := NewChecker(time.Second)
+	checker.Add("broker", func(ctx context.Context) error {
+		return errors.New("unreachable")
+	})
+	server := testServer(t, checker)
+
+	statusCode, report := get(t, server.URL+LivenessPath)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, Report{Status: "ok"}, report)
+
+	statusCode, report = get(t, server.URL+ReadinessPath)
+	assert.Equal(t, http.StatusServiceUnavailable, statusCode)
+	assert.Equal(t, CheckResult{Status: "unavailable", Error: "unreachable"}, report.Checks["broker"])
+}
+
+func TestReadiness(t *testing.T) {
+	checker := NewChecker(time.Second)
+	checker.Add("broker", func(ctx context.Context) error {
+		return nil
+	})
+	server := testServer(t, checker)
+
+	statusCode, report := get(t, server.URL+ReadinessPath)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "ok", report.Status)
+	assert.Equal(t, CheckResult{Status: "ok"}, report.Checks["broker"])
+}
+
+func TestHealthcheckCommand(t *testing.T) {
+	checker := NewChecker(time.Second)
+	checker.Add("broker", func(ctx context.Context) error {
+		return errors.New("unreachable")
+	})
+	server := testServer(t, checker)
+
+	_, requested := runCommand([]string{"main.run"}, server.URL)
+	assert.False(t, requested, "services start normally without the subcommand")
+	exitCode, requested := runCommand([]string{"main.run", "healthcheck"}, server.URL)
+	assert.True(t, requested)
+	assert.Equal(t, 0, exitCode, "liveness is checked by default")
+	exitCode, _ = runCommand([]string{"main.run", "healthcheck", ReadinessPath}, server.URL)
+	assert.Equal(t, 1, exitCode)
+	exitCode, _ = runCommand([]string{"main.run", "healthcheck"}, "http://127.0.0.1:1")
+	assert.Equal(t, 1, exitCode, "unreachable services are unhealthy")
+}
@@ -1,13 +1,55 @@
 package lib
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// PartitionKeyMetadata is the message metadata key holding the partition key.
+// Brokers that support it, such as Kafka, deliver messages sharing a key in
+// the order they were sent.
+const PartitionKeyMetadata = "partition-key"
+
+// TaskNameMetadata is the message metadata key holding the task name, which
+// brokers that route messages, such as RabbitMQ, route by.
+const TaskNameMetadata = "task-name"
+
 type PayloadItem struct {
 	ID       uuid.UUID `json:"id"`
 	Time     time.Time `json:"time"`
 	TaskName string    `json:"task_name"`
+	// OrderingKey is supplied by clients that need tasks processed in the
+	// order they were submitted, regardless of their task name.
+	OrderingKey string `json:"ordering_key,omitempty"`
+	// Arguments are passed to the task as given by the client.
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+	// ParentID is the task that enqueued this one as part of a workflow,
+	// and RootID the task the workflow started with. Both are nil for tasks
+	// submitted by clients.
+	ParentID *uuid.UUID `json:"parent_id,omitempty"`
+	RootID   *uuid.UUID `json:"root_id,omitempty"`
+	// Deadline is supplied by clients for whom the task is pointless once
+	// it passed, the consumer gives up on it then. The tasks it returns
+	// inherit it.
+	Deadline *time.Time `json:"deadline,omitempty"`
+}
+
+// WorkflowID is the ID of the task the workflow of this one started with,
+// its own ID unless another task enqueued it.
+func (p PayloadItem) WorkflowID() uuid.UUID {
+	if p.RootID != nil {
+		return *p.RootID
+	}
+	return p.ID
+}
+
+// PartitionKey is the client's ordering key if it gave one, otherwise every
+// task of the same name is ordered relative to the others.
+func (p PayloadItem) PartitionKey() string {
+	if p.OrderingKey != "" {
+		return p.OrderingKey
+	}
+	return p.TaskName
 }
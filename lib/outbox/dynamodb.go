@@ -0,0 +1,297 @@
+//go:build aws
+
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+)
+
+func init() {
+	openers["dynamodb"] = openDynamoDB
+}
+
+const (
+	// DynamoDBDueIndex is the sparse global secondary index of the messages
+	// still to be sent, partitioned by the due attribute and sorted by
+	// next_attempt_at. Removing due once a message is sent drops it.
+	DynamoDBDueIndex = "due-index"
+	dynamoDBDue      = "due"
+	taskKeyPrefix    = "task#"
+	outboxKeyPrefix  = "outbox#"
+)
+
+// DynamoDBStore keeps tasks and the outbox as items of a single table, keyed
+// by the pk attribute. Sent messages expire through the table's TTL on
+// expires_at rather than being purged.
+type DynamoDBStore struct {
+	client    *dynamodb.Client
+	table     string
+	retention time.Duration
+}
+
+func openDynamoDB(ctx context.Context, cfg Config, outboxURL *url.URL) (Store, error) {
+	table := outboxURL.Host
+	if table == "" {
+		return nil, fmt.Errorf("dynamodb outbox url %s has no table", outboxURL.Redacted())
+	}
+	opts := []func(*config.LoadOptions) error{}
+	if region := outboxURL.Query().Get("region"); region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	awsConfig, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not load aws configuration: %w", err)
+	}
+	return &DynamoDBStore{
+		client:    dynamodb.NewFromConfig(awsConfig),
+		table:     table,
+		retention: cfg.OutboxRetention,
+	}, nil
+}
+
+func taskKey(id uuid.UUID) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"pk": &types.AttributeValueMemberS{Value: taskKeyPrefix + id.String()}}
+}
+
+func outboxKey(id uuid.UUID) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"pk": &types.AttributeValueMemberS{Value: outboxKeyPrefix + id.String()}}
+}
+
+func number(n int64) *types.AttributeValueMemberN {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(n, 10)}
+}
+
+func (s *DynamoDBStore) Add(ctx context.Context, entry Entry) error {
+	metadata := map[string]types.AttributeValue{}
+	for key, value := range entry.Metadata {
+		metadata[key] = &types.AttributeValueMemberS{Value: value}
+	}
+	_, err := s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Put: &types.Put{
+				TableName: aws.String(s.table),
+				Item: map[string]types.AttributeValue{
+					"pk":         taskKey(entry.ID)["pk"],
+					"task_name":  &types.AttributeValueMemberS{Value: entry.TaskName},
+					"status":     &types.AttributeValueMemberS{Value: string(StatusPending)},
+					"created_at": number(entry.CreatedAt.UnixNano()),
+					"updated_at": number(entry.CreatedAt.UnixNano()),
+				},
+				ConditionExpression: aws.String("attribute_not_exists(pk)"),
+			}},
+			{Put: &types.Put{
+				TableName: aws.String(s.table),
+				Item: map[string]types.AttributeValue{
+					"pk":              outboxKey(entry.ID)["pk"],
+					"task_name":       &types.AttributeValueMemberS{Value: entry.TaskName},
+					"body":            &types.AttributeValueMemberB{Value: entry.Body},
+					"metadata":        &types.AttributeValueMemberM{Value: metadata},
+					"attempts":        number(int64(entry.Attempts)),
+					"next_attempt_at": number(entry.NextAttemptAt.UnixNano()),
+					"created_at":      number(entry.CreatedAt.UnixNano()),
+					dynamoDBDue:       &types.AttributeValueMemberS{Value: dynamoDBDue},
+				},
+				ConditionExpression: aws.String("attribute_not_exists(pk)"),
+			}},
+		},
+	})
+	canceled := &types.TransactionCanceledException{}
+	if errors.As(err, &canceled) {
+		for _, reason := range canceled.CancellationReasons {
+			if aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+				return ErrDuplicate
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("could not add message to the outbox: %w", err)
+	}
+	return nil
+}
+
+func (s *DynamoDBStore) ClaimDue(ctx context.Context, now time.Time, leaseUntil time.Time, limit int) ([]Entry, error) {
+	output, err := s.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		IndexName:              aws.String(DynamoDBDueIndex),
+		KeyConditionExpression: aws.String("#due = :due AND next_attempt_at <= :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#due": dynamoDBDue,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":due": &types.AttributeValueMemberS{Value: dynamoDBDue},
+			":now": number(now.UnixNano()),
+		},
+		Limit: aws.Int32(int32(limit)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not query due messages: %w", err)
+	}
+	entries := []Entry{}
+	for _, item := range output.Items {
+		entry, err := entryFromItem(item)
+		if err != nil {
+			return nil, err
+		}
+		// The index is eventually consistent and other relays query it too,
+		// only the one whose update goes through gets the entry
+		_, err = s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:           aws.String(s.table),
+			Key:                 outboxKey(entry.ID),
+			UpdateExpression:    aws.String("SET next_attempt_at = :lease"),
+			ConditionExpression: aws.String("next_attempt_at = :seen AND attribute_exists(#due)"),
+			ExpressionAttributeNames: map[string]string{
+				"#due": dynamoDBDue,
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":lease": number(leaseUntil.UnixNano()),
+				":seen":  number(entry.NextAttemptAt.UnixNano()),
+			},
+		})
+		if conditionFailed := (&types.ConditionalCheckFailedException{}); errors.As(err, &conditionFailed) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("could not claim message %s: %w", entry.ID, err)
+		}
+		entry.NextAttemptAt = leaseUntil
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func entryFromItem(item map[string]types.AttributeValue) (Entry, error) {
+	entry := Entry{Metadata: map[string]string{}}
+	pk, _ := item["pk"].(*types.AttributeValueMemberS)
+	if pk == nil {
+		return entry, fmt.Errorf("outbox item has no pk")
+	}
+	id, err := uuid.Parse(strings.TrimPrefix(pk.Value, outboxKeyPrefix))
+	if err != nil {
+		return entry, fmt.Errorf("outbox item %s has an invalid id: %w", pk.Value, err)
+	}
+	entry.ID = id
+	if taskName, ok := item["task_name"].(*types.AttributeValueMemberS); ok {
+		entry.TaskName = taskName.Value
+	}
+	if body, ok := item["body"].(*types.AttributeValueMemberB); ok {
+		entry.Body = body.Value
+	}
+	if metadata, ok := item["metadata"].(*types.AttributeValueMemberM); ok {
+		for key, value := range metadata.Value {
+			if s, ok := value.(*types.AttributeValueMemberS); ok {
+				entry.Metadata[key] = s.Value
+			}
+		}
+	}
+	numbers := map[string]int64{}
+	for _, name := range []string{"attempts", "next_attempt_at", "created_at"} {
+		if n, ok := item[name].(*types.AttributeValueMemberN); ok {
+			if numbers[name], err = strconv.ParseInt(n.Value, 10, 64); err != nil {
+				return entry, fmt.Errorf("outbox item %s has an invalid %s: %w", pk.Value, name, err)
+			}
+		}
+	}
+	entry.Attempts = int(numbers["attempts"])
+	entry.NextAttemptAt = time.Unix(0, numbers["next_attempt_at"])
+	entry.CreatedAt = time.Unix(0, numbers["created_at"])
+	return entry, nil
+}
+
+func (s *DynamoDBStore) MarkSent(ctx context.Context, id uuid.UUID, sentAt time.Time) error {
+	_, err := s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Update: &types.Update{
+				TableName:        aws.String(s.table),
+				Key:              outboxKey(id),
+				UpdateExpression: aws.String("SET sent_at = :sent_at, expires_at = :expires_at REMOVE #due"),
+				ExpressionAttributeNames: map[string]string{
+					"#due": dynamoDBDue,
+				},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":sent_at":    number(sentAt.UnixNano()),
+					":expires_at": number(sentAt.Add(s.retention).Unix()),
+				},
+			}},
+			{Update: &types.Update{
+				TableName:        aws.String(s.table),
+				Key:              taskKey(id),
+				UpdateExpression: aws.String("SET #status = :status, updated_at = :updated_at"),
+				ExpressionAttributeNames: map[string]string{
+					"#status": "status",
+				},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":status":     &types.AttributeValueMemberS{Value: string(StatusEnqueued)},
+					":updated_at": number(sentAt.UnixNano()),
+				},
+			}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("could not mark message sent: %w", err)
+	}
+	return nil
+}
+
+func (s *DynamoDBStore) Reschedule(ctx context.Context, id uuid.UUID, attempts int, nextAttemptAt time.Time, cause string) error {
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(s.table),
+		Key:                 outboxKey(id),
+		UpdateExpression:    aws.String("SET attempts = :attempts, next_attempt_at = :next_attempt_at, last_error = :last_error"),
+		ConditionExpression: aws.String("attribute_exists(#due)"),
+		ExpressionAttributeNames: map[string]string{
+			"#due": dynamoDBDue,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":attempts":        number(int64(attempts)),
+			":next_attempt_at": number(nextAttemptAt.UnixNano()),
+			":last_error":      &types.AttributeValueMemberS{Value: cause},
+		},
+	})
+	if conditionFailed := (&types.ConditionalCheckFailedException{}); errors.As(err, &conditionFailed) {
+		// Another relay sent it in the meantime
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not reschedule message: %w", err)
+	}
+	return nil
+}
+
+// Purge does nothing, the table's TTL expires sent messages.
+func (s *DynamoDBStore) Purge(ctx context.Context, sentBefore time.Time) error {
+	return nil
+}
+
+func (s *DynamoDBStore) Status(ctx context.Context, id uuid.UUID) (Status, error) {
+	output, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:            aws.String(s.table),
+		Key:                  taskKey(id),
+		ConsistentRead:       aws.Bool(true),
+		ProjectionExpression: aws.String("#status"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not look up task: %w", err)
+	}
+	status, ok := output.Item["status"].(*types.AttributeValueMemberS)
+	if !ok {
+		return "", ErrNotFound
+	}
+	return Status(status.Value), nil
+}
+
+func (s *DynamoDBStore) Close() error {
+	return nil
+}
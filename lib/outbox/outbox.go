@@ -0,0 +1,147 @@
+// Package outbox records tasks and the messages that enqueue them in one
+// transaction, so that a crash can no longer leave a task recorded but never
+// enqueued or enqueued but never recorded. A Relay then sends the messages
+// of the outbox, retrying until the broker accepts them.
+//
+// The store is selected by the scheme of OUTBOX_URL:
+//
+//	sqlite:///path/outbox.db    a SQLite database, a single supplier only
+//	dynamodb://table?region=... a DynamoDB table, in aws builds
+//
+// Messages are delivered at least once: should a relay crash after sending
+// but before marking the message sent, it is sent again.
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/google/wire"
+)
+
+var (
+	ErrNotFound  = errors.New("task not found")
+	ErrDuplicate = errors.New("task was already added")
+)
+
+type UnsupportedSchemeErr struct {
+	Scheme string
+}
+
+func (use UnsupportedSchemeErr) Error() string {
+	return fmt.Sprintf("outbox url scheme %q is not supported", use.Scheme)
+}
+
+// Status of a task as far as the supplier knows.
+type Status string
+
+const (
+	// StatusPending tasks are in the outbox, waiting to be sent
+	StatusPending Status = "pending"
+	// StatusEnqueued tasks were accepted by the broker
+	StatusEnqueued Status = "enqueued"
+)
+
+// Config is embedded into the configuration of each service.
+type Config struct {
+	OutboxURL          string        `env:"OUTBOX_URL" desc:"Store of the transactional outbox, e.g. sqlite:///var/lib/outbox/outbox.db or dynamodb://table?region=us-east-1. Messages are sent directly when empty"`
+	OutboxPollInterval time.Duration `env:"OUTBOX_POLL_INTERVAL" default:"1s" desc:"How often the relay looks for messages to send"`
+	OutboxBatchSize    int           `env:"OUTBOX_BATCH_SIZE" default:"100" desc:"Most messages the relay claims at once"`
+	OutboxLease        time.Duration `env:"OUTBOX_LEASE" default:"30s" desc:"How long a relay has to send the messages it claimed before another may claim them"`
+	OutboxRetryBackoff time.Duration `env:"OUTBOX_RETRY_BACKOFF" default:"1s" desc:"Delay before a message that could not be sent is retried, doubled on every attempt"`
+	OutboxMaxBackoff   time.Duration `env:"OUTBOX_MAX_BACKOFF" default:"5m" desc:"Longest delay between attempts to send a message"`
+	OutboxRetention    time.Duration `env:"OUTBOX_RETENTION" default:"24h" desc:"How long sent messages are kept in the outbox"`
+}
+
+func (c Config) Validate() []error {
+	if c.OutboxURL == "" {
+		return nil
+	}
+	errs := []error{}
+	if outboxURL, err := url.Parse(c.OutboxURL); err != nil {
+		errs = append(errs, fmt.Errorf("OUTBOX_URL is not a url: %w", err))
+	} else if _, isRegistered := openers[outboxURL.Scheme]; !isRegistered {
+		errs = append(errs, fmt.Errorf("OUTBOX_URL: %w", UnsupportedSchemeErr{Scheme: outboxURL.Scheme}))
+	}
+	for name, value := range map[string]time.Duration{
+		"OUTBOX_POLL_INTERVAL": c.OutboxPollInterval,
+		"OUTBOX_LEASE":         c.OutboxLease,
+		"OUTBOX_RETRY_BACKOFF": c.OutboxRetryBackoff,
+		"OUTBOX_MAX_BACKOFF":   c.OutboxMaxBackoff,
+		"OUTBOX_RETENTION":     c.OutboxRetention,
+	} {
+		if value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %s", name, value))
+		}
+	}
+	if c.OutboxBatchSize < 1 {
+		errs = append(errs, fmt.Errorf("OUTBOX_BATCH_SIZE must be at least 1, got %d", c.OutboxBatchSize))
+	}
+	return errs
+}
+
+// ProviderSet provides the Store of OUTBOX_URL.
+var ProviderSet = wire.NewSet(OpenStore)
+
+// Entry is a message waiting in the outbox, along with the task it enqueues.
+type Entry struct {
+	ID       uuid.UUID
+	TaskName string
+	Body     []byte
+	Metadata map[string]string
+	// Attempts counts how often sending the message failed
+	Attempts int
+	// NextAttemptAt is when the message may be claimed to be sent
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
+}
+
+// Store holds the tasks and the outbox. Every method is safe for concurrent
+// use, including by relays of other processes sharing the store.
+type Store interface {
+	// Add records the task as pending and adds its message to the outbox,
+	// atomically. It returns ErrDuplicate when the task was already added.
+	Add(ctx context.Context, entry Entry) error
+	// ClaimDue returns up to limit entries whose next attempt is due, making
+	// them unavailable to other claims until leaseUntil.
+	ClaimDue(ctx context.Context, now time.Time, leaseUntil time.Time, limit int) ([]Entry, error)
+	// MarkSent removes the message from the outbox and records the task as
+	// enqueued, atomically.
+	MarkSent(ctx context.Context, id uuid.UUID, sentAt time.Time) error
+	// Reschedule records a failed attempt to send the message.
+	Reschedule(ctx context.Context, id uuid.UUID, attempts int, nextAttemptAt time.Time, cause string) error
+	// Purge deletes messages sent before the given time.
+	Purge(ctx context.Context, sentBefore time.Time) error
+	// Status returns the status of the task, or ErrNotFound.
+	Status(ctx context.Context, id uuid.UUID) (Status, error)
+	Close() error
+}
+
+type opener func(ctx context.Context, cfg Config, outboxURL *url.URL) (Store, error)
+
+var openers = map[string]opener{}
+
+// OpenStore opens the configured store, the returned function closes it. The
+// store is nil when no OUTBOX_URL is configured.
+func OpenStore(ctx context.Context, cfg Config) (Store, func(), error) {
+	if cfg.OutboxURL == "" {
+		return nil, func() {}, nil
+	}
+	outboxURL, err := url.Parse(cfg.OutboxURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse outbox url: %w", err)
+	}
+	open, isRegistered := openers[outboxURL.Scheme]
+	if !isRegistered {
+		return nil, nil, UnsupportedSchemeErr{Scheme: outboxURL.Scheme}
+	}
+	store, err := open(ctx, cfg, outboxURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open outbox: %w", err)
+	}
+	return store, func() { store.Close() }, nil
+}
@@ -0,0 +1,202 @@
+package outbox
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/mempubsub"
+)
+
+func testConfig() Config {
+	return Config{
+		OutboxPollInterval: time.Millisecond * 10,
+		OutboxBatchSize:    10,
+		OutboxLease:        time.Second * 30,
+		OutboxRetryBackoff: time.Second,
+		OutboxMaxBackoff:   time.Second * 5,
+		OutboxRetention:    time.Hour,
+	}
+}
+
+func testStore(t *testing.T) *SQLiteStore {
+	store, err := OpenSQLiteStore(context.Background(), filepath.Join(t.TempDir(), "outbox.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func testEntry(now time.Time) Entry {
+	return Entry{
+		ID:            uuid.New(),
+		TaskName:      "greet",
+		Body:          []byte(`{"task_name":"greet"}`),
+		Metadata:      map[string]string{"task-name": "greet"},
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	}
+}
+
+func TestSQLiteStore(t *testing.T) {
+	ctx := context.Background()
+	store := testStore(t)
+	now := time.Now()
+	entry := testEntry(now)
+	require.NoError(t, store.Add(ctx, entry))
+	assert.ErrorIs(t, store.Add(ctx, entry), ErrDuplicate)
+
+	status, err := store.Status(ctx, entry.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusPending, status)
+	_, err = store.Status(ctx, uuid.New())
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	claimed, err := store.ClaimDue(ctx, now, now.Add(time.Minute), 10)
+	require.NoError(t, err)
+	require.Len(t, claimed, 1)
+	assert.Equal(t, entry.ID, claimed[0].ID)
+	assert.Equal(t, entry.TaskName, claimed[0].TaskName)
+	assert.Equal(t, entry.Body, claimed[0].Body)
+	assert.Equal(t, entry.Metadata, claimed[0].Metadata)
+
+	// Leased until a minute from now
+	claimed, err = store.ClaimDue(ctx, now.Add(time.Second), now.Add(time.Minute), 10)
+	require.NoError(t, err)
+	assert.Empty(t, claimed)
+
+	require.NoError(t, store.Reschedule(ctx, entry.ID, 1, now.Add(time.Second*2), "broker unavailable"))
+	claimed, err = store.ClaimDue(ctx, now.Add(time.Second*2), now.Add(time.Minute), 10)
+	require.NoError(t, err)
+	require.Len(t, claimed, 1)
+	assert.Equal(t, 1, claimed[0].Attempts)
+
+	require.NoError(t, store.MarkSent(ctx, entry.ID, now))
+	status, err = store.Status(ctx, entry.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusEnqueued, status)
+	claimed, err = store.ClaimDue(ctx, now.Add(time.Hour), now.Add(time.Hour), 10)
+	require.NoError(t, err)
+	assert.Empty(t, claimed)
+
+	require.NoError(t, store.Purge(ctx, now.Add(time.Second)))
+	status, err = store.Status(ctx, entry.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusEnqueued, status, "tasks outlive their messages")
+}
+
+func TestRelay(t *testing.T) {
+	ctx := context.Background()
+	store := testStore(t)
+	topic := mempubsub.NewTopic()
+	defer topic.Shutdown(ctx)
+	subscription := mempubsub.NewSubscription(topic, time.Minute)
+	defer subscription.Shutdown(ctx)
+
+	now := time.Now()
+	relay := NewRelay(store, topic, testConfig(), func(message *pubsub.Message, entry Entry) {
+		message.Metadata["prepared"] = "true"
+	})
+	relay.now = func() time.Time { return now }
+
+	entry, err := relay.Add(ctx, testEntry(now))
+	require.NoError(t, err)
+	sent, err := relay.RelayDue(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, sent, "leased to whoever added it")
+
+	require.NoError(t, relay.Send(ctx, entry))
+	message, err := subscription.Receive(ctx)
+	require.NoError(t, err)
+	message.Ack()
+	assert.Equal(t, entry.Body, message.Body)
+	assert.Equal(t, "true", message.Metadata["prepared"])
+	status, err := store.Status(ctx, entry.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusEnqueued, status)
+
+	// Left behind by a supplier that crashed before sending it
+	now = now.Add(time.Minute)
+	leftBehind, err := relay.Add(ctx, testEntry(now))
+	require.NoError(t, err)
+	now = now.Add(testConfig().OutboxLease)
+	sent, err = relay.RelayDue(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	message, err = subscription.Receive(ctx)
+	require.NoError(t, err)
+	message.Ack()
+	assert.Equal(t, leftBehind.Body, message.Body)
+}
+
+func TestRelayDrainsTheBacklog(t *testing.T) {
+	ctx := context.Background()
+	store := testStore(t)
+	topic := mempubsub.NewTopic()
+	defer topic.Shutdown(ctx)
+	subscription := mempubsub.NewSubscription(topic, time.Minute)
+	defer subscription.Shutdown(ctx)
+
+	now := time.Now()
+	cfg := testConfig()
+	cfg.OutboxBatchSize = 2
+	relay := NewRelay(store, topic, cfg, func(message *pubsub.Message, entry Entry) {})
+	relay.now = func() time.Time { return now }
+	for i := 0; i < 5; i++ {
+		_, err := relay.Add(ctx, testEntry(now))
+		require.NoError(t, err)
+	}
+	now = now.Add(cfg.OutboxLease)
+
+	require.NoError(t, relay.Drain(ctx))
+	for i := 0; i < 5; i++ {
+		message, err := subscription.Receive(ctx)
+		require.NoError(t, err)
+		message.Ack()
+	}
+	sent, err := relay.RelayDue(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, sent, "every batch was relayed")
+}
+
+func TestRelayRetriesWithBackoff(t *testing.T) {
+	ctx := context.Background()
+	store := testStore(t)
+	topic := mempubsub.NewTopic()
+	// Every send fails from now on
+	require.NoError(t, topic.Shutdown(ctx))
+
+	now := time.Now()
+	relay := NewRelay(store, topic, testConfig(), nil)
+	relay.now = func() time.Time { return now }
+	entry, err := relay.Add(ctx, testEntry(now))
+	require.NoError(t, err)
+	assert.Error(t, relay.Send(ctx, entry))
+
+	for attempt, backoff := range []time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 5} {
+		claimed, err := store.ClaimDue(ctx, now.Add(backoff-time.Millisecond), now, 10)
+		require.NoError(t, err)
+		assert.Empty(t, claimed, "attempt %d retried too early", attempt+2)
+
+		now = now.Add(backoff)
+		sent, err := relay.RelayDue(ctx)
+		require.NoError(t, err)
+		assert.Zero(t, sent)
+	}
+	status, err := store.Status(ctx, entry.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusPending, status)
+}
+
+func TestValidate(t *testing.T) {
+	cfg := testConfig()
+	assert.Empty(t, cfg.Validate(), "disabled")
+	cfg.OutboxURL = "sqlite:///var/lib/outbox/outbox.db"
+	assert.Empty(t, cfg.Validate())
+	cfg.OutboxURL = "postgres://localhost/outbox"
+	assert.Len(t, cfg.Validate(), 1)
+}
@@ -0,0 +1,169 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"gocloud.dev/pubsub"
+)
+
+// purgeInterval is how often the relay deletes messages past the retention.
+const purgeInterval = time.Hour
+
+// Sender sends messages, such as a *pubsub.Topic.
+type Sender interface {
+	Send(ctx context.Context, message *pubsub.Message) error
+}
+
+// Relay sends the messages of the outbox.
+type Relay struct {
+	store   Store
+	sender  Sender
+	cfg     Config
+	prepare func(message *pubsub.Message, entry Entry)
+	now     func() time.Time
+}
+
+// NewRelay returns a relay sending through sender. When not nil, prepare is
+// called with every message before it is sent, e.g. to set BeforeSend.
+func NewRelay(store Store, sender Sender, cfg Config, prepare func(message *pubsub.Message, entry Entry)) *Relay {
+	return &Relay{
+		store:   store,
+		sender:  sender,
+		cfg:     cfg,
+		prepare: prepare,
+		now:     time.Now,
+	}
+}
+
+// Add adds entry to the outbox, leased to the caller so that it can Send it
+// right away without a relay claiming it in the meantime.
+func (r *Relay) Add(ctx context.Context, entry Entry) (Entry, error) {
+	now := r.now()
+	entry.CreatedAt = now
+	entry.NextAttemptAt = now.Add(r.cfg.OutboxLease)
+	if err := r.store.Add(ctx, entry); err != nil {
+		return entry, err
+	}
+	return entry, nil
+}
+
+// Status returns the status of the task, or ErrNotFound.
+func (r *Relay) Status(ctx context.Context, id uuid.UUID) (Status, error) {
+	return r.store.Status(ctx, id)
+}
+
+// Send sends the message of a claimed entry and marks it sent. When sending
+// fails the entry is rescheduled, and the error is returned.
+func (r *Relay) Send(ctx context.Context, entry Entry) error {
+	message := &pubsub.Message{
+		Body:     entry.Body,
+		Metadata: entry.Metadata,
+	}
+	if r.prepare != nil {
+		r.prepare(message, entry)
+	}
+	if err := r.sender.Send(ctx, message); err != nil {
+		attempts := entry.Attempts + 1
+		nextAttemptAt := r.now().Add(r.backoff(attempts))
+		if rescheduleErr := r.store.Reschedule(ctx, entry.ID, attempts, nextAttemptAt, err.Error()); rescheduleErr != nil {
+			// The lease runs out eventually, retrying it all the same
+			zerolog.Ctx(ctx).Warn().Err(rescheduleErr).Str("task_id", entry.ID.String()).Msg("could not reschedule message")
+		}
+		return fmt.Errorf("could not send message: %w", err)
+	}
+	if err := r.store.MarkSent(ctx, entry.ID, r.now()); err != nil {
+		// Sent again once the lease runs out, which consumers must tolerate
+		return fmt.Errorf("message was sent but could not be marked sent: %w", err)
+	}
+	return nil
+}
+
+// backoff returns the delay before the given attempt, doubling from
+// OUTBOX_RETRY_BACKOFF up to OUTBOX_MAX_BACKOFF.
+func (r *Relay) backoff(attempts int) time.Duration {
+	delay := r.cfg.OutboxRetryBackoff
+	for i := 1; i < attempts && delay < r.cfg.OutboxMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > r.cfg.OutboxMaxBackoff {
+		return r.cfg.OutboxMaxBackoff
+	}
+	return delay
+}
+
+// RelayDue claims the entries that are due and sends them, returning how
+// many were sent.
+func (r *Relay) RelayDue(ctx context.Context) (int, error) {
+	now := r.now()
+	entries, err := r.store.ClaimDue(ctx, now, now.Add(r.cfg.OutboxLease), r.cfg.OutboxBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, entry := range entries {
+		if err := r.Send(ctx, entry); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("task_id", entry.ID.String()).Int("attempts", entry.Attempts+1).Msg("could not relay message")
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// Run relays due entries every OUTBOX_POLL_INTERVAL until ctx is done.
+func (r *Relay) Run(ctx context.Context) error {
+	log := zerolog.Ctx(ctx)
+	log.Info().Msg("Starting loop")
+	ticker := time.NewTicker(r.cfg.OutboxPollInterval)
+	defer ticker.Stop()
+	lastPurge := time.Time{}
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("shutting down relay loop")
+			return nil
+		case <-ticker.C:
+		}
+		if err := r.relayBacklog(ctx); err != nil {
+			log.Error().Err(err).Msg("could not relay due messages")
+		}
+		if r.now().Sub(lastPurge) >= purgeInterval {
+			if err := r.store.Purge(ctx, r.now().Add(-r.cfg.OutboxRetention)); err != nil {
+				log.Warn().Err(err).Msg("could not purge sent messages")
+			}
+			lastPurge = r.now()
+		}
+	}
+}
+
+// Drain relays due entries until there is no backlog left, then purges the
+// sent ones. It does what a tick of Run does, for relays that run on a
+// schedule rather than in a loop of their own.
+func (r *Relay) Drain(ctx context.Context) error {
+	if err := r.relayBacklog(ctx); err != nil {
+		return fmt.Errorf("could not relay due messages: %w", err)
+	} else if err := r.store.Purge(ctx, r.now().Add(-r.cfg.OutboxRetention)); err != nil {
+		return fmt.Errorf("could not purge sent messages: %w", err)
+	}
+	return nil
+}
+
+// relayBacklog relays due entries a batch at a time, for as long as there
+// is a backlog.
+func (r *Relay) relayBacklog(ctx context.Context) error {
+	for {
+		sent, err := r.RelayDue(ctx)
+		if err != nil {
+			return err
+		} else if sent > 0 {
+			zerolog.Ctx(ctx).Info().Int("count", sent).Msg("relayed messages")
+		}
+		if sent < r.cfg.OutboxBatchSize || ctx.Err() != nil {
+			return nil
+		}
+	}
+}
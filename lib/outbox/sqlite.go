@@ -0,0 +1,196 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	_ "modernc.org/sqlite"
+)
+
+func init() {
+	openers["sqlite"] = openSQLite
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS tasks (
+	id         TEXT PRIMARY KEY,
+	task_name  TEXT NOT NULL,
+	status     TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS outbox (
+	id              TEXT PRIMARY KEY REFERENCES tasks (id),
+	body            BLOB NOT NULL,
+	metadata        TEXT NOT NULL,
+	attempts        INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at INTEGER NOT NULL,
+	last_error      TEXT,
+	sent_at         INTEGER
+);
+CREATE INDEX IF NOT EXISTS outbox_due ON outbox (next_attempt_at) WHERE sent_at IS NULL;
+`
+
+// SQLiteStore keeps the outbox in a SQLite database. Times are stored as
+// nanoseconds since the epoch.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func openSQLite(ctx context.Context, cfg Config, outboxURL *url.URL) (Store, error) {
+	return OpenSQLiteStore(ctx, outboxURL.Path)
+}
+
+// OpenSQLiteStore opens the database at path, creating it and its tables
+// when they don't exist yet.
+func OpenSQLiteStore(ctx context.Context, path string) (*SQLiteStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("could not create the directory of the database: %w", err)
+	}
+	// Writers wait for each other rather than failing with SQLITE_BUSY
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.ExecContext(ctx, sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not create tables: %w", err)
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Add(ctx context.Context, entry Entry) error {
+	metadata, err := json.Marshal(entry.Metadata)
+	if err != nil {
+		return fmt.Errorf("could not serialize metadata: %w", err)
+	}
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO tasks (id, task_name, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`,
+			entry.ID.String(), entry.TaskName, StatusPending, entry.CreatedAt.UnixNano(), entry.CreatedAt.UnixNano(),
+		)
+		if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return ErrDuplicate
+		} else if err != nil {
+			return fmt.Errorf("could not record task: %w", err)
+		}
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO outbox (id, body, metadata, attempts, next_attempt_at) VALUES (?, ?, ?, ?, ?)`,
+			entry.ID.String(), entry.Body, string(metadata), entry.Attempts, entry.NextAttemptAt.UnixNano(),
+		)
+		if err != nil {
+			return fmt.Errorf("could not add message to the outbox: %w", err)
+		}
+		return nil
+	})
+}
+
+func (s *SQLiteStore) ClaimDue(ctx context.Context, now time.Time, leaseUntil time.Time, limit int) ([]Entry, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE outbox SET next_attempt_at = ?
+		WHERE id IN (
+			SELECT id FROM outbox
+			WHERE sent_at IS NULL AND next_attempt_at <= ?
+			ORDER BY next_attempt_at
+			LIMIT ?
+		)
+		RETURNING id, body, metadata, attempts, next_attempt_at,
+			(SELECT task_name FROM tasks WHERE tasks.id = outbox.id),
+			(SELECT created_at FROM tasks WHERE tasks.id = outbox.id)`,
+		leaseUntil.UnixNano(), now.UnixNano(), limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not claim due messages: %w", err)
+	}
+	defer rows.Close()
+	entries := []Entry{}
+	for rows.Next() {
+		var id, metadata string
+		var nextAttemptAt, createdAt int64
+		entry := Entry{}
+		if err := rows.Scan(&id, &entry.Body, &metadata, &entry.Attempts, &nextAttemptAt, &entry.TaskName, &createdAt); err != nil {
+			return nil, fmt.Errorf("could not read claimed message: %w", err)
+		}
+		if entry.ID, err = uuid.Parse(id); err != nil {
+			return nil, fmt.Errorf("could not read claimed message: %w", err)
+		}
+		if err := json.Unmarshal([]byte(metadata), &entry.Metadata); err != nil {
+			return nil, fmt.Errorf("could not read metadata of claimed message %s: %w", id, err)
+		}
+		entry.NextAttemptAt = time.Unix(0, nextAttemptAt)
+		entry.CreatedAt = time.Unix(0, createdAt)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *SQLiteStore) MarkSent(ctx context.Context, id uuid.UUID, sentAt time.Time) error {
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `UPDATE outbox SET sent_at = ? WHERE id = ?`, sentAt.UnixNano(), id.String()); err != nil {
+			return fmt.Errorf("could not mark message sent: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE tasks SET status = ?, updated_at = ? WHERE id = ?`, StatusEnqueued, sentAt.UnixNano(), id.String()); err != nil {
+			return fmt.Errorf("could not record task as enqueued: %w", err)
+		}
+		return nil
+	})
+}
+
+func (s *SQLiteStore) Reschedule(ctx context.Context, id uuid.UUID, attempts int, nextAttemptAt time.Time, cause string) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE outbox SET attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ? AND sent_at IS NULL`,
+		attempts, nextAttemptAt.UnixNano(), cause, id.String(),
+	)
+	if err != nil {
+		return fmt.Errorf("could not reschedule message: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Purge(ctx context.Context, sentBefore time.Time) error {
+	// Tasks are kept, only their messages are no longer needed
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM outbox WHERE sent_at < ?`, sentBefore.UnixNano()); err != nil {
+		return fmt.Errorf("could not purge sent messages: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Status(ctx context.Context, id uuid.UUID) (Status, error) {
+	var status Status
+	err := s.db.QueryRowContext(ctx, `SELECT status FROM tasks WHERE id = ?`, id.String()).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	} else if err != nil {
+		return "", fmt.Errorf("could not look up task: %w", err)
+	}
+	return status, nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) inTransaction(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+	return nil
+}
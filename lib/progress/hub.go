@@ -0,0 +1,167 @@
+package progress
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"gocloud.dev/pubsub"
+)
+
+// watcherBuffer is how many events a watcher may fall behind by before it
+// is dropped.
+const watcherBuffer = 16
+
+// maxReceiveBackoff is the longest delay before a subscription that failed
+// is opened again.
+const maxReceiveBackoff = time.Minute
+
+// Hub fans the events received by a supplier out to the watchers of each
+// task. The latest event of every task is kept for a while, so watchers
+// that start late, or reconnect, are told where the task is at.
+type Hub struct {
+	retention time.Duration
+	// receiveBackoff is the delay before a subscription that failed is
+	// opened again, doubled on every failure in a row.
+	receiveBackoff time.Duration
+
+	mu       sync.Mutex
+	watchers map[uuid.UUID]map[chan Event]struct{}
+	latest   map[uuid.UUID]Event
+}
+
+// NewHub returns a hub keeping the latest event of a task for retention.
+func NewHub(retention time.Duration) *Hub {
+	return &Hub{
+		retention:      retention,
+		receiveBackoff: time.Second,
+		watchers:       map[uuid.UUID]map[chan Event]struct{}{},
+		latest:         map[uuid.UUID]Event{},
+	}
+}
+
+// Watch returns the events of the task, beginning with its latest one when
+// it is known. The channel is closed once the task is done, or when the
+// watcher fell too far behind; stop must be called once done watching.
+func (h *Hub) Watch(taskID uuid.UUID) (events <-chan Event, stop func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan Event, watcherBuffer)
+	if latest, ok := h.latest[taskID]; ok {
+		ch <- latest
+		if latest.State.Done() {
+			close(ch)
+			return ch, func() {}
+		}
+	}
+	if h.watchers[taskID] == nil {
+		h.watchers[taskID] = map[chan Event]struct{}{}
+	}
+	h.watchers[taskID][ch] = struct{}{}
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.remove(taskID, ch)
+	}
+}
+
+// remove closes the channel of a watcher, unless that was already done.
+// It expects h.mu to be held.
+func (h *Hub) remove(taskID uuid.UUID, ch chan Event) {
+	if _, ok := h.watchers[taskID][ch]; !ok {
+		return
+	}
+	delete(h.watchers[taskID], ch)
+	if len(h.watchers[taskID]) == 0 {
+		delete(h.watchers, taskID)
+	}
+	close(ch)
+}
+
+// Publish hands the event to the watchers of its task.
+func (h *Hub) Publish(event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if latest, ok := h.latest[event.TaskID]; ok && (latest.Time.After(event.Time) || latest.State.Done()) {
+		// Out of order, such as the update of a redelivered message
+		return
+	}
+	h.latest[event.TaskID] = event
+	for ch := range h.watchers[event.TaskID] {
+		select {
+		case ch <- event:
+			if event.State.Done() {
+				h.remove(event.TaskID, ch)
+			}
+		default:
+			// Its client reconnects and starts over from the latest event,
+			// which is better than holding up every other watcher
+			h.remove(event.TaskID, ch)
+		}
+	}
+}
+
+// expire forgets the tasks whose latest event is older than the retention.
+func (h *Hub) expire(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for taskID, latest := range h.latest {
+		if now.Sub(latest.Time) > h.retention {
+			delete(h.latest, taskID)
+		}
+	}
+}
+
+// Run receives events from the subscription until ctx is done. Should the
+// subscription fail, it is shut down and another one is opened with reopen,
+// backing off while that keeps failing, so watchers only miss the events
+// sent in the meantime.
+func (h *Hub) Run(ctx context.Context, subscription *pubsub.Subscription, reopen func(context.Context) (*pubsub.Subscription, error)) {
+	log := zerolog.Ctx(ctx)
+	go func() {
+		ticker := time.NewTicker(h.retention)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				h.expire(now)
+			}
+		}
+	}()
+	backoff := h.receiveBackoff
+	for {
+		message, err := subscription.Receive(ctx)
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return
+		} else if err != nil {
+			log.Error().Err(err).Msg("progress subscription failed")
+			subscription.Shutdown(ctx)
+			for subscription = nil; subscription == nil; {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				backoff = min(backoff*2, maxReceiveBackoff)
+				if subscription, err = reopen(ctx); err != nil {
+					log.Error().Err(err).Dur("backoff", backoff).Msg("could not open progress subscription again")
+				}
+			}
+			continue
+		}
+		backoff = h.receiveBackoff
+		// Nothing is gained from having it redelivered
+		message.Ack()
+		event, err := decode(message.Body)
+		if err != nil {
+			log.Warn().Err(err).Msg("dropping progress event")
+			continue
+		}
+		h.Publish(event)
+	}
+}
@@ -0,0 +1,177 @@
+// Package progress carries what becomes of tasks once they are enqueued back
+// from the consumer, so the supplier can tell its clients. The consumer
+// reports events on the topic of PROGRESS_URL and every supplier replica
+// receives all of them, which only broadcasting transports do:
+//
+//	nats://<subject>  a core NATS subject
+//	mem://<topic>     in-memory, for tests
+//
+// Events are best effort: they are not stored by the broker and nobody
+// waits for them, so a supplier that was down misses those sent meanwhile.
+package progress
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/queue"
+	"github.com/rs/zerolog"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/mempubsub"
+	"gocloud.dev/pubsub/natspubsub"
+)
+
+// State of a task as far as the consumer knows.
+type State string
+
+const (
+	// StateRunning tasks are being processed, their handler may report how
+	// far along they are
+	StateRunning State = "running"
+	// StateSucceeded tasks were processed and acknowledged
+	StateSucceeded State = "succeeded"
+	// StateFailed tasks will not be processed
+	StateFailed State = "failed"
+)
+
+// Done reports whether no event follows one of this state.
+func (s State) Done() bool {
+	return s == StateSucceeded || s == StateFailed
+}
+
+// Event is a change of state, or a progress update, of a task.
+type Event struct {
+	TaskID uuid.UUID `json:"task_id"`
+	State  State     `json:"state"`
+	// Percent is how much of the task is done, from 0 to 100, when its
+	// handler reports it
+	Percent *int      `json:"percent,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Config is embedded into the configuration of each service.
+type Config struct {
+	ProgressURL string `env:"PROGRESS_URL" desc:"Topic task progress is broadcast on from the consumer to the suppliers, nats://<subject> or mem://<topic>. Progress is not reported when empty"`
+}
+
+var schemes = map[string]bool{
+	natspubsub.Scheme: true,
+	mempubsub.Scheme:  true,
+}
+
+func (c Config) Validate() []error {
+	if c.ProgressURL == "" {
+		return nil
+	}
+	progressURL, err := url.Parse(c.ProgressURL)
+	if err != nil {
+		return []error{fmt.Errorf("PROGRESS_URL is not a url: %w", err)}
+	} else if !schemes[progressURL.Scheme] {
+		return []error{fmt.Errorf("PROGRESS_URL must be a nats:// or mem:// url, as every supplier receives every event, got %q", progressURL.Scheme)}
+	}
+	return nil
+}
+
+// queueConfig opens the progress topic with the broker settings of the
+// service's queue.
+func (c Config) queueConfig(queueCfg queue.Config) queue.Config {
+	queueCfg.QueueURL = c.ProgressURL
+	return queueCfg
+}
+
+// OpenTopic opens the topic the consumer reports on, it is nil when
+// PROGRESS_URL is empty.
+func OpenTopic(ctx context.Context, cfg Config, queueCfg queue.Config) (*pubsub.Topic, error) {
+	if cfg.ProgressURL == "" {
+		return nil, nil
+	}
+	topic, err := queue.OpenTopic(ctx, cfg.queueConfig(queueCfg))
+	if err != nil {
+		return nil, fmt.Errorf("could not open progress topic: %w", err)
+	}
+	return topic, nil
+}
+
+// OpenSubscription opens the subscription the supplier receives events on,
+// it is nil when PROGRESS_URL is empty.
+func OpenSubscription(ctx context.Context, cfg Config, queueCfg queue.Config) (*pubsub.Subscription, error) {
+	if cfg.ProgressURL == "" {
+		return nil, nil
+	}
+	subscription, err := queue.OpenSubscription(ctx, cfg.queueConfig(queueCfg))
+	if err != nil {
+		return nil, fmt.Errorf("could not open progress subscription: %w", err)
+	}
+	return subscription, nil
+}
+
+// Reporter sends the events of the tasks a consumer processes. Without a
+// topic, it drops them.
+type Reporter struct {
+	topic *pubsub.Topic
+}
+
+func NewReporter(topic *pubsub.Topic) *Reporter {
+	return &Reporter{topic: topic}
+}
+
+// Send reports the event, setting its time when it has none.
+func (r *Reporter) Send(ctx context.Context, event Event) error {
+	if r == nil || r.topic == nil {
+		return nil
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("could not serialize progress event: %w", err)
+	}
+	if err := r.topic.Send(ctx, &pubsub.Message{Body: body}); err != nil {
+		return fmt.Errorf("could not send progress event: %w", err)
+	}
+	return nil
+}
+
+type taskKey struct{}
+
+type task struct {
+	reporter *Reporter
+	id       uuid.UUID
+}
+
+// WithTask returns a context in which Report reports on the task.
+func WithTask(ctx context.Context, reporter *Reporter, taskID uuid.UUID) context.Context {
+	return context.WithValue(ctx, taskKey{}, task{reporter: reporter, id: taskID})
+}
+
+// Report lets the handler of a task tell how far along it is, percent being
+// from 0 to 100. Failing to report is logged rather than failing the task,
+// and nothing is reported outside of a task.
+func Report(ctx context.Context, percent int, message string) {
+	t, ok := ctx.Value(taskKey{}).(task)
+	if !ok {
+		return
+	}
+	percent = min(max(percent, 0), 100)
+	event := Event{TaskID: t.id, State: StateRunning, Percent: &percent, Message: message}
+	if err := t.reporter.Send(ctx, event); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("could not report progress")
+	}
+}
+
+// decode parses an event received on the progress topic.
+func decode(body []byte) (Event, error) {
+	event := Event{}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return Event{}, fmt.Errorf("could not deserialize progress event: %w", err)
+	} else if event.TaskID == uuid.Nil || event.State == "" {
+		return Event{}, fmt.Errorf("progress event has no task ID or state")
+	}
+	return event, nil
+}
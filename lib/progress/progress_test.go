@@ -0,0 +1,158 @@
+package progress
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/pubsub"
+)
+
+func receive(t *testing.T, events <-chan Event) Event {
+	select {
+	case event, isOpen := <-events:
+		require.True(t, isOpen, "events were closed")
+		return event
+	case <-time.After(time.Second * 5):
+		require.FailNow(t, "no event was received")
+		return Event{}
+	}
+}
+
+// testConfig returns a configuration with a topic of its own, as mem://
+// topics are shared by the whole process and shut down by each test.
+func testConfig(t *testing.T) Config {
+	return Config{ProgressURL: "mem://" + t.Name() + "-" + uuid.NewString()}
+}
+
+func TestReportedEventsReachWatchers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := testConfig(t)
+	require.Empty(t, cfg.Validate())
+	topic, err := OpenTopic(ctx, cfg, queue.Config{})
+	require.NoError(t, err)
+	defer topic.Shutdown(ctx)
+	subscription, err := OpenSubscription(ctx, cfg, queue.Config{})
+	require.NoError(t, err)
+	defer subscription.Shutdown(ctx)
+
+	hub := NewHub(time.Hour)
+	done := make(chan struct{})
+	go func() {
+		hub.Run(ctx, subscription, nil)
+		close(done)
+	}()
+	taskID := uuid.New()
+	events, stop := hub.Watch(taskID)
+	defer stop()
+
+	// Each is received before the next is sent, as the broker may reorder
+	// them and the hub drops those older than the latest
+	reporter := NewReporter(topic)
+	require.NoError(t, reporter.Send(ctx, Event{TaskID: taskID, State: StateRunning}))
+	event := receive(t, events)
+	assert.Equal(t, StateRunning, event.State)
+	assert.False(t, event.Time.IsZero())
+	// Only reported on from within a task
+	Report(ctx, 10, "ignored")
+	Report(WithTask(ctx, reporter, taskID), 150, "almost there")
+	event = receive(t, events)
+	require.NotNil(t, event.Percent)
+	assert.Equal(t, 100, *event.Percent)
+	assert.Equal(t, "almost there", event.Message)
+	require.NoError(t, reporter.Send(ctx, Event{TaskID: taskID, State: StateSucceeded}))
+	assert.Equal(t, StateSucceeded, receive(t, events).State)
+	_, isOpen := <-events
+	assert.False(t, isOpen, "events were not closed once the task was done")
+
+	cancel()
+	<-done
+}
+
+func TestRunOpensFailedSubscriptionsAgain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := testConfig(t)
+	topic, err := OpenTopic(ctx, cfg, queue.Config{})
+	require.NoError(t, err)
+	defer topic.Shutdown(ctx)
+	failed, err := OpenSubscription(ctx, cfg, queue.Config{})
+	require.NoError(t, err)
+	require.NoError(t, failed.Shutdown(ctx))
+
+	hub := NewHub(time.Hour)
+	hub.receiveBackoff = time.Millisecond
+	reopened := make(chan struct{})
+	attempts := 0
+	go hub.Run(ctx, failed, func(ctx context.Context) (*pubsub.Subscription, error) {
+		if attempts++; attempts == 1 {
+			return nil, errors.New("broker unavailable")
+		}
+		defer close(reopened)
+		return OpenSubscription(ctx, cfg, queue.Config{})
+	})
+	select {
+	case <-reopened:
+	case <-time.After(time.Second * 5):
+		require.FailNow(t, "the subscription was not opened again")
+	}
+	taskID := uuid.New()
+	events, stop := hub.Watch(taskID)
+	defer stop()
+	require.NoError(t, NewReporter(topic).Send(ctx, Event{TaskID: taskID, State: StateRunning}))
+	assert.Equal(t, StateRunning, receive(t, events).State)
+}
+
+func TestWatchStartsFromLatestEvent(t *testing.T) {
+	hub := NewHub(time.Hour)
+	taskID := uuid.New()
+	now := time.Now()
+	hub.Publish(Event{TaskID: taskID, State: StateRunning, Time: now})
+	// Out of order
+	hub.Publish(Event{TaskID: taskID, State: StateRunning, Message: "stale", Time: now.Add(-time.Second)})
+
+	events, stop := hub.Watch(taskID)
+	defer stop()
+	assert.Empty(t, receive(t, events).Message)
+
+	hub.Publish(Event{TaskID: taskID, State: StateFailed, Time: now.Add(time.Second)})
+	assert.Equal(t, StateFailed, receive(t, events).State)
+
+	// Done tasks are only reported once
+	events, stop = hub.Watch(taskID)
+	defer stop()
+	assert.Equal(t, StateFailed, receive(t, events).State)
+	_, isOpen := <-events
+	assert.False(t, isOpen)
+
+	hub.expire(now.Add(time.Hour * 2))
+	events, stop = hub.Watch(taskID)
+	defer stop()
+	assert.Empty(t, events)
+}
+
+func TestSlowWatchersAreDropped(t *testing.T) {
+	hub := NewHub(time.Hour)
+	taskID := uuid.New()
+	events, stop := hub.Watch(taskID)
+	now := time.Now()
+	for i := 0; i <= watcherBuffer; i++ {
+		hub.Publish(Event{TaskID: taskID, State: StateRunning, Time: now.Add(time.Duration(i))})
+	}
+	for range events {
+	}
+	// Stopping after being dropped is fine
+	stop()
+}
+
+func TestValidate(t *testing.T) {
+	assert.Empty(t, Config{}.Validate())
+	assert.Empty(t, Config{ProgressURL: "nats://task-progress"}.Validate())
+	assert.Len(t, Config{ProgressURL: "rabbit://task-progress"}.Validate(), 1)
+}
@@ -0,0 +1,282 @@
+// Package publish sends messages through a circuit breaker, so that a broker
+// that keeps failing is given time to recover rather than every request
+// waiting on it. While the breaker is open, messages can be spooled to a
+// bounded directory on local disk and flushed once the broker recovers.
+package publish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"github.com/sony/gobreaker"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub"
+)
+
+var (
+	// ErrUnavailable is returned while the breaker is open and messages can't
+	// be spooled.
+	ErrUnavailable = errors.New("the broker is unavailable")
+	// ErrSpoolFull is returned when a message would exceed SPOOL_MAX_BYTES.
+	ErrSpoolFull = errors.New("the spool is full")
+)
+
+// Outcome of publishing a message.
+type Outcome string
+
+const (
+	OutcomeSent    Outcome = "sent"
+	OutcomeSpooled Outcome = "spooled"
+)
+
+var (
+	breakerState = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "publish_breaker_state",
+		Help: "State of the circuit breaker around publishing: 0 closed, 1 half-open, 2 open.",
+	})
+	publishedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "publish_messages_total",
+		Help: "Messages published, by outcome: sent, spooled, rejected while the breaker is open or failed.",
+	}, []string{"outcome"})
+	spooledMessages = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "publish_spool_messages",
+		Help: "Messages waiting in the spool.",
+	})
+	spooledBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "publish_spool_bytes",
+		Help: "Bytes taken up by the spool.",
+	})
+	flushedMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "publish_spool_flushed_total",
+		Help: "Spooled messages that were sent once the broker recovered.",
+	})
+	quarantinedMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "publish_spool_quarantined_total",
+		Help: "Spooled messages moved to the quarantine directory, as they could not be read back or the broker rejected them.",
+	})
+)
+
+// Config is embedded into the configuration of each service.
+type Config struct {
+	BreakerFailureThreshold int           `env:"BREAKER_FAILURE_THRESHOLD" default:"5" desc:"Consecutive failures to publish after which the circuit breaker opens"`
+	BreakerOpenTimeout      time.Duration `env:"BREAKER_OPEN_TIMEOUT" default:"30s" desc:"How long the circuit breaker stays open before letting a message through to find out whether the broker recovered"`
+	SpoolDir                string        `env:"SPOOL_DIR" desc:"Directory messages are spooled to while the broker is unavailable. They're rejected instead when empty"`
+	SpoolMaxBytes           int64         `env:"SPOOL_MAX_BYTES" default:"104857600" desc:"Most bytes the spool may take up on disk"`
+	SpoolFlushInterval      time.Duration `env:"SPOOL_FLUSH_INTERVAL" default:"5s" desc:"How often spooled messages are flushed to the broker"`
+}
+
+func (c Config) Validate() []error {
+	errs := []error{}
+	if c.BreakerFailureThreshold < 1 {
+		errs = append(errs, fmt.Errorf("BREAKER_FAILURE_THRESHOLD must be at least 1, got %d", c.BreakerFailureThreshold))
+	}
+	if c.BreakerOpenTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("BREAKER_OPEN_TIMEOUT must be positive, got %s", c.BreakerOpenTimeout))
+	}
+	if c.SpoolDir != "" && c.SpoolMaxBytes < 1 {
+		errs = append(errs, fmt.Errorf("SPOOL_MAX_BYTES must be at least 1, got %d", c.SpoolMaxBytes))
+	}
+	if c.SpoolDir != "" && c.SpoolFlushInterval <= 0 {
+		errs = append(errs, fmt.Errorf("SPOOL_FLUSH_INTERVAL must be positive, got %s", c.SpoolFlushInterval))
+	}
+	return errs
+}
+
+// Publisher sends messages to a topic through a circuit breaker.
+type Publisher struct {
+	topic   *pubsub.Topic
+	breaker *gobreaker.CircuitBreaker
+	spool   *Spool
+	prepare func(message *pubsub.Message, id uuid.UUID)
+	cfg     Config
+}
+
+// NewPublisher returns a publisher sending to topic, spooling to spool when
+// it isn't nil. When not nil, prepare is called with every message before it
+// is sent, e.g. to set BeforeSend.
+func NewPublisher(topic *pubsub.Topic, spool *Spool, cfg Config, prepare func(message *pubsub.Message, id uuid.UUID)) *Publisher {
+	p := &Publisher{
+		topic:   topic,
+		spool:   spool,
+		prepare: prepare,
+		cfg:     cfg,
+	}
+	p.breaker = gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name: "publish",
+		// A single message finds out whether the broker recovered
+		MaxRequests: 1,
+		Timeout:     cfg.BreakerOpenTimeout,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= uint32(cfg.BreakerFailureThreshold)
+		},
+		IsSuccessful: func(err error) bool {
+			// Clients hanging up and messages the broker rejects say
+			// nothing about the broker
+			return err == nil || errors.Is(err, context.Canceled) || isRejected(err)
+		},
+		OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
+			breakerState.Set(float64(to))
+			zerolog.Ctx(context.Background()).Warn().Str("from", from.String()).Str("to", to.String()).Msg("publishing circuit breaker changed state")
+		},
+	})
+	return p
+}
+
+// Publish sends message, spooling it when the broker is unavailable and a
+// spool is configured. While the spool holds messages, new ones are spooled
+// behind them so that they're sent in order. Messages the broker rejects are
+// never spooled, as they would never be sent.
+func (p *Publisher) Publish(ctx context.Context, id uuid.UUID, message *pubsub.Message) (Outcome, error) {
+	if p.spool != nil && p.spool.Len() > 0 {
+		return p.spoolMessage(ctx, id, message, nil)
+	}
+	err := p.send(ctx, id, message)
+	if err == nil {
+		publishedMessages.WithLabelValues(string(OutcomeSent)).Inc()
+		return OutcomeSent, nil
+	} else if p.spool != nil && ctx.Err() == nil && !isRejected(err) {
+		return p.spoolMessage(ctx, id, message, err)
+	}
+	if errors.Is(err, ErrUnavailable) {
+		publishedMessages.WithLabelValues("rejected").Inc()
+	} else {
+		publishedMessages.WithLabelValues("failed").Inc()
+	}
+	return "", err
+}
+
+// Send sends message through the breaker without ever spooling it, for
+// callers that keep messages around themselves, such as the outbox relay.
+func (p *Publisher) Send(ctx context.Context, message *pubsub.Message) error {
+	_, err := p.breaker.Execute(func() (any, error) {
+		return nil, p.topic.Send(ctx, message)
+	})
+	if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	return err
+}
+
+func (p *Publisher) send(ctx context.Context, id uuid.UUID, message *pubsub.Message) error {
+	if p.prepare != nil {
+		p.prepare(message, id)
+	}
+	return p.Send(ctx, message)
+}
+
+func (p *Publisher) spoolMessage(ctx context.Context, id uuid.UUID, message *pubsub.Message, cause error) (Outcome, error) {
+	if err := p.spool.Put(id, message); err != nil {
+		publishedMessages.WithLabelValues("failed").Inc()
+		if cause != nil {
+			return "", fmt.Errorf("%w, and could not spool the message: %w", cause, err)
+		}
+		return "", err
+	}
+	if cause != nil {
+		zerolog.Ctx(ctx).Warn().Err(cause).Str("task_id", id.String()).Msg("could not send message, spooled it")
+	}
+	publishedMessages.WithLabelValues(string(OutcomeSpooled)).Inc()
+	return OutcomeSpooled, nil
+}
+
+// State of the circuit breaker: closed, half-open or open.
+func (p *Publisher) State() string {
+	return p.breaker.State().String()
+}
+
+// Probe fails while messages can be neither sent nor spooled.
+func (p *Publisher) Probe(ctx context.Context) error {
+	if p.spool != nil && p.spool.Full() {
+		return ErrSpoolFull
+	} else if p.spool == nil && p.breaker.State() == gobreaker.StateOpen {
+		return fmt.Errorf("%w, the circuit breaker is open", ErrUnavailable)
+	}
+	return nil
+}
+
+// Flush sends the spooled messages in order, stopping at the first that
+// can't be sent for now. Those that can never be sent, as they can't be read
+// back or the broker rejects them, are quarantined instead of holding up the
+// others. It returns how many were sent.
+func (p *Publisher) Flush(ctx context.Context) (int, error) {
+	if p.spool == nil {
+		return 0, nil
+	}
+	log := zerolog.Ctx(ctx)
+	flushed := 0
+	for ctx.Err() == nil {
+		record, ok, err := p.spool.Oldest()
+		if errors.Is(err, errUnreadable) {
+			if err := p.spool.Quarantine(record); err != nil {
+				return flushed, err
+			}
+			log.Error().Err(err).Msg("quarantined unreadable spooled message")
+			continue
+		} else if err != nil {
+			return flushed, err
+		} else if !ok {
+			return flushed, nil
+		}
+		message := &pubsub.Message{
+			Body:     record.Body,
+			Metadata: record.Metadata,
+		}
+		if err := p.send(ctx, record.ID, message); isRejected(err) {
+			if err := p.spool.Quarantine(record); err != nil {
+				return flushed, err
+			}
+			log.Error().Err(err).Str("task_id", record.ID.String()).Msg("quarantined spooled message the broker rejected")
+			continue
+		} else if err != nil {
+			return flushed, fmt.Errorf("could not flush spooled message: %w", err)
+		}
+		if err := p.spool.Remove(record); err != nil {
+			// It's sent again on the next flush, which consumers must tolerate
+			return flushed, err
+		}
+		flushedMessages.Inc()
+		flushed++
+	}
+	return flushed, ctx.Err()
+}
+
+// isRejected reports whether the broker rejected a message as invalid,
+// which sending it again won't change.
+func isRejected(err error) bool {
+	return err != nil && gcerrors.Code(err) == gcerrors.InvalidArgument
+}
+
+// Run flushes the spool every SPOOL_FLUSH_INTERVAL until ctx is done.
+func (p *Publisher) Run(ctx context.Context) error {
+	if p.spool == nil {
+		return nil
+	}
+	log := zerolog.Ctx(ctx)
+	log.Info().Msg("Starting loop")
+	ticker := time.NewTicker(p.cfg.SpoolFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("shutting down flushing loop")
+			return nil
+		case <-ticker.C:
+		}
+		if p.spool.Len() == 0 || p.breaker.State() == gobreaker.StateOpen {
+			continue
+		}
+		flushed, err := p.Flush(ctx)
+		if flushed > 0 {
+			log.Info().Int("count", flushed).Int("remaining", p.spool.Len()).Msg("flushed spooled messages")
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Warn().Err(err).Msg("could not flush the spool")
+		}
+	}
+}
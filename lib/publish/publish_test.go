@@ -0,0 +1,214 @@
+package publish
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/mempubsub"
+)
+
+func testConfig() Config {
+	return Config{
+		BreakerFailureThreshold: 3,
+		BreakerOpenTimeout:      time.Millisecond * 50,
+		SpoolMaxBytes:           1 << 20,
+		SpoolFlushInterval:      time.Millisecond * 10,
+	}
+}
+
+// unavailableTopic fails every send, like a broker that is down.
+func unavailableTopic(t *testing.T) *pubsub.Topic {
+	topic := mempubsub.NewTopic()
+	require.NoError(t, topic.Shutdown(context.Background()))
+	return topic
+}
+
+func testMessage(i int) *pubsub.Message {
+	return &pubsub.Message{
+		Body:     []byte(fmt.Sprintf(`{"i":%d}`, i)),
+		Metadata: map[string]string{"task-name": "greet"},
+	}
+}
+
+func TestBreakerTrips(t *testing.T) {
+	ctx := context.Background()
+	p := NewPublisher(unavailableTopic(t), nil, testConfig(), nil)
+	for i := 0; i < testConfig().BreakerFailureThreshold; i++ {
+		_, err := p.Publish(ctx, uuid.New(), testMessage(i))
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrUnavailable)
+	}
+	assert.Equal(t, "open", p.State())
+	assert.ErrorIs(t, p.Probe(ctx), ErrUnavailable)
+	_, err := p.Publish(ctx, uuid.New(), testMessage(0))
+	assert.ErrorIs(t, err, ErrUnavailable)
+
+	// Closes again once a message gets through after the timeout
+	healthy := mempubsub.NewTopic()
+	defer healthy.Shutdown(ctx)
+	subscription := mempubsub.NewSubscription(healthy, time.Minute)
+	defer subscription.Shutdown(ctx)
+	p.topic = healthy
+	time.Sleep(testConfig().BreakerOpenTimeout)
+	outcome, err := p.Publish(ctx, uuid.New(), testMessage(0))
+	require.NoError(t, err)
+	assert.Equal(t, OutcomeSent, outcome)
+	assert.Equal(t, "closed", p.State())
+	assert.NoError(t, p.Probe(ctx))
+}
+
+func TestSpoolAndFlush(t *testing.T) {
+	ctx := context.Background()
+	spool, err := OpenSpool(t.TempDir(), testConfig().SpoolMaxBytes)
+	require.NoError(t, err)
+	sendOrder := []uuid.UUID{}
+	p := NewPublisher(unavailableTopic(t), spool, testConfig(), func(message *pubsub.Message, id uuid.UUID) {
+		sendOrder = append(sendOrder, id)
+	})
+	ids := []uuid.UUID{}
+	for i := 0; i < 5; i++ {
+		ids = append(ids, uuid.New())
+		outcome, err := p.Publish(ctx, ids[i], testMessage(i))
+		require.NoError(t, err)
+		assert.Equal(t, OutcomeSpooled, outcome)
+	}
+	assert.Equal(t, 5, spool.Len())
+	assert.NoError(t, p.Probe(ctx), "still accepting messages")
+
+	healthy := mempubsub.NewTopic()
+	defer healthy.Shutdown(ctx)
+	subscription := mempubsub.NewSubscription(healthy, time.Minute)
+	defer subscription.Shutdown(ctx)
+	p.topic = healthy
+	// Spooled behind the others even though the broker is back
+	ids = append(ids, uuid.New())
+	outcome, err := p.Publish(ctx, ids[5], testMessage(5))
+	require.NoError(t, err)
+	assert.Equal(t, OutcomeSpooled, outcome)
+
+	time.Sleep(testConfig().BreakerOpenTimeout)
+	sendOrder = sendOrder[:0]
+	flushed, err := p.Flush(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 6, flushed)
+	assert.Zero(t, spool.Len())
+	assert.Equal(t, ids, sendOrder, "sent in the order they were spooled")
+	received := []string{}
+	for i := 0; i < 6; i++ {
+		message, err := subscription.Receive(ctx)
+		require.NoError(t, err)
+		message.Ack()
+		received = append(received, string(message.Body))
+	}
+	expected := []string{}
+	for i := 0; i < 6; i++ {
+		expected = append(expected, string(testMessage(i).Body))
+	}
+	assert.ElementsMatch(t, expected, received)
+}
+
+func TestSpoolIsBounded(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConfig()
+	spool, err := OpenSpool(t.TempDir(), 150)
+	require.NoError(t, err)
+	p := NewPublisher(unavailableTopic(t), spool, cfg, nil)
+	_, err = p.Publish(ctx, uuid.New(), testMessage(0))
+	require.NoError(t, err)
+	_, err = p.Publish(ctx, uuid.New(), testMessage(1))
+	assert.ErrorIs(t, err, ErrSpoolFull)
+	assert.Equal(t, 1, spool.Len())
+}
+
+func TestSpoolSurvivesRestarts(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := OpenSpool(dir, 1<<20)
+	require.NoError(t, err)
+	require.NoError(t, spool.Put(uuid.New(), testMessage(0)))
+	require.NoError(t, spool.Put(uuid.New(), testMessage(1)))
+	// Left behind by a crash halfway through writing
+	require.NoError(t, os.WriteFile(filepath.Join(dir, spoolTmpPrefix+"123"), []byte(`{"i"`), 0o600))
+
+	reopened, err := OpenSpool(dir, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, 2, reopened.Len())
+	assert.Equal(t, spool.bytes, reopened.bytes)
+	assert.NoFileExists(t, filepath.Join(dir, spoolTmpPrefix+"123"))
+	record, ok, err := reopened.Oldest()
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, testMessage(0).Body, record.Body)
+}
+
+func TestRejectedMessagesAreNotSpooled(t *testing.T) {
+	ctx := context.Background()
+	spool, err := OpenSpool(t.TempDir(), testConfig().SpoolMaxBytes)
+	require.NoError(t, err)
+	topic := mempubsub.NewTopic()
+	defer topic.Shutdown(ctx)
+	p := NewPublisher(topic, spool, testConfig(), func(message *pubsub.Message, id uuid.UUID) {
+		// Sending messages with a LoggableID is invalid
+		message.LoggableID = "rejected"
+	})
+	outcome, err := p.Publish(ctx, uuid.New(), testMessage(0))
+	assert.True(t, isRejected(err), "the caller is told the message was rejected")
+	assert.Empty(t, outcome)
+	assert.Zero(t, spool.Len())
+}
+
+func TestFlushQuarantinesMessagesThatCanNeverBeSent(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	spool, err := OpenSpool(dir, testConfig().SpoolMaxBytes)
+	require.NoError(t, err)
+	rejected := uuid.New()
+	require.NoError(t, spool.Put(uuid.New(), testMessage(0)))
+	require.NoError(t, spool.Put(rejected, testMessage(1)))
+	require.NoError(t, spool.Put(uuid.New(), testMessage(2)))
+	// Corrupted on disk, sorting right after the first one
+	record, _, err := spool.Oldest()
+	require.NoError(t, err)
+	corrupt := strings.Replace(record.name, spoolSuffix, "~corrupt"+spoolSuffix, 1)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, corrupt), []byte(`{"id"`), 0o600))
+	spool, err = OpenSpool(dir, testConfig().SpoolMaxBytes)
+	require.NoError(t, err)
+	require.Equal(t, 4, spool.Len())
+
+	healthy := mempubsub.NewTopic()
+	defer healthy.Shutdown(ctx)
+	subscription := mempubsub.NewSubscription(healthy, time.Minute)
+	defer subscription.Shutdown(ctx)
+	p := NewPublisher(healthy, spool, testConfig(), func(message *pubsub.Message, id uuid.UUID) {
+		if id == rejected {
+			// Sending messages with a LoggableID is invalid
+			message.LoggableID = "rejected"
+		}
+	})
+	flushed, err := p.Flush(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, flushed, "the messages behind the ones that can't be sent are flushed")
+	assert.Zero(t, spool.Len())
+	assert.Zero(t, spool.bytes)
+	assert.Equal(t, "closed", p.State(), "rejected messages say nothing about the broker")
+	quarantined, err := os.ReadDir(filepath.Join(dir, quarantineDir))
+	require.NoError(t, err)
+	assert.Len(t, quarantined, 2)
+	for i := 0; i < 2; i++ {
+		message, err := subscription.Receive(ctx)
+		require.NoError(t, err)
+		message.Ack()
+	}
+
+	reopened, err := OpenSpool(dir, testConfig().SpoolMaxBytes)
+	require.NoError(t, err)
+	assert.Zero(t, reopened.Len(), "quarantined messages are no longer spooled")
+}
@@ -0,0 +1,216 @@
+package publish
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"gocloud.dev/pubsub"
+)
+
+const (
+	spoolSuffix    = ".json"
+	spoolTmpPrefix = ".tmp-"
+	// quarantineDir holds the messages that can never be sent, for operators
+	// to inspect
+	quarantineDir = "quarantine"
+)
+
+// errUnreadable is returned along with the spooled messages that can't be
+// read back.
+var errUnreadable = errors.New("spooled message is unreadable")
+
+// spoolRecord is the file a message is spooled as.
+type spoolRecord struct {
+	ID       uuid.UUID         `json:"id"`
+	Body     []byte            `json:"body"`
+	Metadata map[string]string `json:"metadata"`
+
+	name string
+	size int64
+}
+
+// Spool keeps messages as files in a directory, named so that they sort in
+// the order they were spooled. Messages spooled before a restart are picked
+// up again.
+type Spool struct {
+	dir      string
+	maxBytes int64
+	sequence atomic.Uint64
+
+	mutex sync.Mutex
+	count int
+	bytes int64
+}
+
+// OpenSpool opens the spool in dir, creating it when it doesn't exist.
+func OpenSpool(dir string, maxBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(filepath.Join(dir, quarantineDir), 0o700); err != nil {
+		return nil, fmt.Errorf("could not create spool directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read spool directory: %w", err)
+	}
+	s := &Spool{dir: dir, maxBytes: maxBytes}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), spoolTmpPrefix) {
+			// Never completely written, nor acknowledged to the client
+			os.Remove(filepath.Join(dir, entry.Name()))
+			continue
+		} else if !strings.HasSuffix(entry.Name(), spoolSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("could not read spool directory: %w", err)
+		}
+		s.count++
+		s.bytes += info.Size()
+	}
+	s.updateMetrics()
+	return s, nil
+}
+
+// Len returns how many messages are spooled.
+func (s *Spool) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.count
+}
+
+// Full reports whether the spool reached SPOOL_MAX_BYTES.
+func (s *Spool) Full() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.bytes >= s.maxBytes
+}
+
+// Put spools message, returning ErrSpoolFull when it doesn't fit.
+func (s *Spool) Put(id uuid.UUID, message *pubsub.Message) error {
+	contents, err := json.Marshal(spoolRecord{ID: id, Body: message.Body, Metadata: message.Metadata})
+	if err != nil {
+		return fmt.Errorf("could not serialize message: %w", err)
+	}
+	size := int64(len(contents))
+	s.mutex.Lock()
+	if s.bytes+size > s.maxBytes {
+		s.mutex.Unlock()
+		return ErrSpoolFull
+	}
+	// Reserved up front so that concurrent puts can't overrun the limit
+	s.count++
+	s.bytes += size
+	s.mutex.Unlock()
+
+	name := fmt.Sprintf("%020d-%010d-%s%s", time.Now().UnixNano(), s.sequence.Add(1), id, spoolSuffix)
+	if err := s.write(name, contents); err != nil {
+		s.mutex.Lock()
+		s.count--
+		s.bytes -= size
+		s.mutex.Unlock()
+		return err
+	}
+	s.updateMetrics()
+	return nil
+}
+
+// write makes the file appear complete or not at all.
+func (s *Spool) write(name string, contents []byte) error {
+	tmp, err := os.CreateTemp(s.dir, spoolTmpPrefix)
+	if err != nil {
+		return fmt.Errorf("could not spool message: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not spool message: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not spool message: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not spool message: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.dir, name)); err != nil {
+		return fmt.Errorf("could not spool message: %w", err)
+	}
+	return nil
+}
+
+// Oldest returns the message that was spooled first, if any. Messages that
+// can't be read back fail with errUnreadable, their record can still be
+// quarantined.
+func (s *Spool) Oldest() (spoolRecord, bool, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return spoolRecord{}, false, fmt.Errorf("could not read spool directory: %w", err)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), spoolSuffix) && !strings.HasPrefix(entry.Name(), spoolTmpPrefix) {
+			names = append(names, entry.Name())
+		}
+	}
+	if len(names) == 0 {
+		return spoolRecord{}, false, nil
+	}
+	sort.Strings(names)
+	record := spoolRecord{name: names[0]}
+	contents, err := os.ReadFile(filepath.Join(s.dir, names[0]))
+	if err != nil {
+		if info, statErr := os.Stat(filepath.Join(s.dir, names[0])); statErr == nil {
+			record.size = info.Size()
+		}
+		return record, true, fmt.Errorf("%w: %s: %w", errUnreadable, names[0], err)
+	}
+	record.size = int64(len(contents))
+	if err := json.Unmarshal(contents, &record); err != nil {
+		return record, true, fmt.Errorf("%w: %s: %w", errUnreadable, names[0], err)
+	}
+	return record, true, nil
+}
+
+// Remove deletes a record returned by Oldest.
+func (s *Spool) Remove(record spoolRecord) error {
+	if err := os.Remove(filepath.Join(s.dir, record.name)); err != nil {
+		return fmt.Errorf("could not remove spooled message: %w", err)
+	}
+	s.mutex.Lock()
+	s.count--
+	s.bytes -= record.size
+	s.mutex.Unlock()
+	s.updateMetrics()
+	return nil
+}
+
+// Quarantine moves a record returned by Oldest to the quarantine directory,
+// out of the way of the messages spooled after it.
+func (s *Spool) Quarantine(record spoolRecord) error {
+	if err := os.Rename(filepath.Join(s.dir, record.name), filepath.Join(s.dir, quarantineDir, record.name)); err != nil {
+		return fmt.Errorf("could not quarantine spooled message: %w", err)
+	}
+	s.mutex.Lock()
+	s.count--
+	s.bytes -= record.size
+	s.mutex.Unlock()
+	quarantinedMessages.Inc()
+	s.updateMetrics()
+	return nil
+}
+
+func (s *Spool) updateMetrics() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	spooledMessages.Set(float64(s.count))
+	spooledBytes.Set(float64(s.bytes))
+}
@@ -0,0 +1,319 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/batcher"
+	pubsubdriver "gocloud.dev/pubsub/driver"
+)
+
+// JetStreamScheme selects NATS JetStream, which unlike plain nats:// queues
+// persists messages and redelivers them until they are acknowledged:
+//
+//	jetstream://<subject>                      publishing side
+//	jetstream://<subject>?consumer=<durable>   consuming side
+const JetStreamScheme = "jetstream"
+
+func init() {
+	register([]string{JetStreamScheme}, driver{
+		validate:         validateJetStream,
+		openTopic:        openJetStreamTopic,
+		openSubscription: openJetStreamSubscription,
+		readinessProbe:   newNATSReadinessProbe,
+	})
+}
+
+func validateJetStream(cfg Config) []error {
+	errs := requireSetting("NATS_SERVER_URL", cfg.NATSServerURL != "", JetStreamScheme)
+	errs = append(errs, requireSetting("NATS_STREAM", cfg.NATSStream != "", JetStreamScheme)...)
+	if cfg.VisibilityTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("VISIBILITY_TIMEOUT must be positive, got %s", cfg.VisibilityTimeout))
+	}
+	return errs
+}
+
+// connectJetStream connects to the server and makes sure the stream exists,
+// so that whichever service starts first declares it.
+func connectJetStream(cfg Config, subject string) (*nats.Conn, nats.JetStreamContext, error) {
+	conn, err := nats.Connect(cfg.NATSServerURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to open a JetStream context: %w", err)
+	}
+	if err := declareJetStreamStream(js, cfg.NATSStream, subject); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, js, nil
+}
+
+func declareJetStreamStream(js nats.JetStreamContext, stream string, subject string) error {
+	info, err := js.StreamInfo(stream)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:     stream,
+			Subjects: []string{subject},
+			// Messages are removed once acknowledged, like a queue
+			Retention: nats.WorkQueuePolicy,
+			Storage:   nats.FileStorage,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to declare stream %s: %w", stream, err)
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to look up stream %s: %w", stream, err)
+	}
+	for _, existing := range info.Config.Subjects {
+		if existing == subject {
+			return nil
+		}
+	}
+	updated := info.Config
+	updated.Subjects = append(updated.Subjects, subject)
+	if _, err := js.UpdateStream(&updated); err != nil {
+		return fmt.Errorf("failed to add subject %s to stream %s: %w", subject, stream, err)
+	}
+	return nil
+}
+
+func jetStreamSubject(queueURL *url.URL) (string, error) {
+	subject := strings.TrimPrefix(queueURL.Host+queueURL.Path, "/")
+	if subject == "" {
+		return "", fmt.Errorf("jetstream queue url %s has no subject", queueURL.Redacted())
+	}
+	return subject, nil
+}
+
+func openJetStreamTopic(ctx context.Context, cfg Config, queueURL *url.URL) (*pubsub.Topic, error) {
+	subject, err := jetStreamSubject(queueURL)
+	if err != nil {
+		return nil, err
+	}
+	conn, js, err := connectJetStream(cfg, subject)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize topic (producing side of queue) with jetstream: %w", err)
+	}
+	t := &jetStreamTopic{conn: conn, js: js, subject: subject}
+	return pubsub.NewTopic(t, &batcher.Options{MaxBatchSize: 1, MaxHandlers: 100}), nil
+}
+
+func openJetStreamSubscription(ctx context.Context, cfg Config, queueURL *url.URL) (*pubsub.Subscription, error) {
+	subject, err := jetStreamSubject(queueURL)
+	if err != nil {
+		return nil, err
+	}
+	consumer := queueURL.Query().Get("consumer")
+	if consumer == "" {
+		return nil, fmt.Errorf("jetstream subscription url %s requires a consumer query parameter naming the durable consumer", queueURL.Redacted())
+	}
+	conn, js, err := connectJetStream(cfg, subject)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize subscription (consuming side of queue) with jetstream: %w", err)
+	}
+	// A durable consumer keeps its position across restarts and is shared by
+	// every replica that subscribes with the same name
+	sub, err := js.PullSubscribe(subject, consumer,
+		nats.BindStream(cfg.NATSStream),
+		nats.AckExplicit(),
+		nats.AckWait(cfg.VisibilityTimeout),
+	)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not initialize subscription (consuming side of queue) with jetstream: %w", err)
+	}
+	s := &jetStreamSubscription{conn: conn, sub: sub}
+	// Pull subscriptions are not meant to be fetched from concurrently
+	recvOpts := &batcher.Options{MaxBatchSize: 100, MaxHandlers: 1}
+	ackOpts := &batcher.Options{MaxBatchSize: 100, MaxHandlers: 2}
+	return pubsub.NewSubscription(s, recvOpts, ackOpts), nil
+}
+
+type jetStreamTopic struct {
+	conn    *nats.Conn
+	js      nats.JetStreamContext
+	subject string
+}
+
+func (t *jetStreamTopic) SendBatch(ctx context.Context, ms []*pubsubdriver.Message) error {
+	for _, m := range ms {
+		msg := nats.NewMsg(t.subject)
+		msg.Data = m.Body
+		for key, value := range m.Metadata {
+			msg.Header.Set(key, value)
+		}
+		if m.BeforeSend != nil {
+			asFunc := func(i any) bool {
+				if p, ok := i.(**nats.Msg); ok {
+					*p = msg
+					return true
+				}
+				return false
+			}
+			if err := m.BeforeSend(asFunc); err != nil {
+				return err
+			}
+		}
+		ack, err := t.js.PublishMsg(msg, nats.Context(ctx))
+		if err != nil {
+			return err
+		}
+		if m.AfterSend != nil {
+			asFunc := func(i any) bool {
+				if p, ok := i.(**nats.PubAck); ok {
+					*p = ack
+					return true
+				}
+				return false
+			}
+			if err := m.AfterSend(asFunc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *jetStreamTopic) IsRetryable(err error) bool {
+	return false
+}
+
+func (t *jetStreamTopic) As(i any) bool {
+	if p, ok := i.(*nats.JetStreamContext); ok {
+		*p = t.js
+		return true
+	}
+	return false
+}
+
+func (t *jetStreamTopic) ErrorAs(err error, i any) bool {
+	return errors.As(err, i)
+}
+
+func (t *jetStreamTopic) ErrorCode(err error) gcerrors.ErrorCode {
+	return jetStreamErrorCode(err)
+}
+
+func (t *jetStreamTopic) Close() error {
+	t.conn.Close()
+	return nil
+}
+
+type jetStreamSubscription struct {
+	conn *nats.Conn
+	sub  *nats.Subscription
+}
+
+func (s *jetStreamSubscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*pubsubdriver.Message, error) {
+	// Wait at most a second so that the caller gets to check its context
+	fetchCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	msgs, err := s.sub.Fetch(maxMessages, nats.Context(fetchCtx))
+	if err != nil && ctx.Err() == nil && (errors.Is(err, context.DeadlineExceeded) || errors.Is(err, nats.ErrTimeout)) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	messages := make([]*pubsubdriver.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		msg := msg
+		metadata := map[string]string{}
+		for key := range msg.Header {
+			metadata[key] = msg.Header.Get(key)
+		}
+		loggableID := ""
+		if info, err := msg.Metadata(); err == nil {
+			loggableID = strconv.FormatUint(info.Sequence.Stream, 10)
+		}
+		messages = append(messages, &pubsubdriver.Message{
+			LoggableID: loggableID,
+			Body:       msg.Data,
+			Metadata:   metadata,
+			AckID:      msg,
+			AsFunc: func(i any) bool {
+				if p, ok := i.(**nats.Msg); ok {
+					*p = msg
+					return true
+				}
+				return false
+			},
+		})
+	}
+	return messages, nil
+}
+
+func (s *jetStreamSubscription) SendAcks(ctx context.Context, ackIDs []pubsubdriver.AckID) error {
+	for _, ackID := range ackIDs {
+		err := ackID.(*nats.Msg).Ack(nats.Context(ctx))
+		if err != nil && !errors.Is(err, nats.ErrMsgAlreadyAckd) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *jetStreamSubscription) CanNack() bool {
+	return true
+}
+
+func (s *jetStreamSubscription) SendNacks(ctx context.Context, ackIDs []pubsubdriver.AckID) error {
+	for _, ackID := range ackIDs {
+		err := ackID.(*nats.Msg).Nak(nats.Context(ctx))
+		if err != nil && !errors.Is(err, nats.ErrMsgAlreadyAckd) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *jetStreamSubscription) IsRetryable(err error) bool {
+	return false
+}
+
+func (s *jetStreamSubscription) As(i any) bool {
+	if p, ok := i.(**nats.Subscription); ok {
+		*p = s.sub
+		return true
+	}
+	return false
+}
+
+func (s *jetStreamSubscription) ErrorAs(err error, i any) bool {
+	return errors.As(err, i)
+}
+
+func (s *jetStreamSubscription) ErrorCode(err error) gcerrors.ErrorCode {
+	return jetStreamErrorCode(err)
+}
+
+func (s *jetStreamSubscription) Close() error {
+	s.conn.Close()
+	return nil
+}
+
+func jetStreamErrorCode(err error) gcerrors.ErrorCode {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, nats.ErrTimeout):
+		return gcerrors.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return gcerrors.Canceled
+	case errors.Is(err, nats.ErrStreamNotFound), errors.Is(err, nats.ErrConsumerNotFound):
+		return gcerrors.NotFound
+	case errors.Is(err, nats.ErrConnectionClosed), errors.Is(err, nats.ErrBadSubscription):
+		return gcerrors.FailedPrecondition
+	}
+	return gcerrors.Unknown
+}
@@ -0,0 +1,54 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/pubsub"
+)
+
+// Runs against the server of the nats compose profile, see `just test-nats`
+func TestJetStreamRedeliversUnacknowledgedMessages(t *testing.T) {
+	serverURL, isSet := os.LookupEnv("NATS_TEST_SERVER_URL")
+	if !isSet {
+		t.Skip("NATS_TEST_SERVER_URL is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	subject := fmt.Sprintf("queue-test-%d", time.Now().UnixNano())
+	cfg := Config{
+		NATSServerURL:     serverURL,
+		NATSStream:        "QUEUE_TEST",
+		VisibilityTimeout: time.Second * 2,
+	}
+	require.Empty(t, validateJetStream(cfg))
+
+	cfg.QueueURL = "jetstream://" + subject
+	topic, err := OpenTopic(ctx, cfg)
+	require.NoError(t, err)
+	defer topic.Shutdown(ctx)
+	cfg.QueueURL = "jetstream://" + subject + "?consumer=" + subject
+	subscription, err := OpenSubscription(ctx, cfg)
+	require.NoError(t, err)
+	defer subscription.Shutdown(ctx)
+
+	require.NoError(t, topic.Send(ctx, &pubsub.Message{
+		Body:     []byte("hello"),
+		Metadata: map[string]string{"task-name": "greet"},
+	}))
+	message, err := subscription.Receive(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(message.Body))
+	assert.Equal(t, "greet", message.Metadata["task-name"])
+	// Neither acked nor nacked, it comes back once the ack-wait has passed
+
+	redelivered, err := subscription.Receive(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(redelivered.Body))
+	redelivered.Ack()
+}
@@ -0,0 +1,96 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/health"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/kafkapubsub"
+)
+
+func init() {
+	register([]string{kafkapubsub.Scheme}, driver{
+		validate: func(cfg Config) []error {
+			return requireSetting("KAFKA_BROKERS", len(cfg.KafkaBrokers) > 0, kafkapubsub.Scheme)
+		},
+		openTopic:        openKafkaTopic,
+		openSubscription: openKafkaSubscription,
+		readinessProbe:   newKafkaReadinessProbe,
+	})
+}
+
+// kafkaOpener keys messages by their partition key, so that Kafka keeps
+// messages sharing a key on the same partition and therefore in order. The
+// key is handed back to subscribers under the same metadata key.
+//
+// Subscriptions join the consumer group named by the URL, every replica of
+// the consumer receives a share of the partitions.
+func kafkaOpener(cfg Config) *kafkapubsub.URLOpener {
+	return &kafkapubsub.URLOpener{
+		Brokers: cfg.KafkaBrokers,
+		Config:  kafkapubsub.MinimalConfig(),
+		TopicOptions: kafkapubsub.TopicOptions{
+			KeyName: lib.PartitionKeyMetadata,
+		},
+		SubscriptionOptions: kafkapubsub.SubscriptionOptions{
+			KeyName: lib.PartitionKeyMetadata,
+		},
+	}
+}
+
+func openKafkaTopic(ctx context.Context, cfg Config, queueURL *url.URL) (*pubsub.Topic, error) {
+	topic, err := kafkaOpener(cfg).OpenTopicURL(ctx, queueURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize topic (producing side of queue) with kafka: %w", err)
+	}
+	return topic, nil
+}
+
+func openKafkaSubscription(ctx context.Context, cfg Config, queueURL *url.URL) (*pubsub.Subscription, error) {
+	subscription, err := kafkaOpener(cfg).OpenSubscriptionURL(ctx, queueURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize subscription (consuming side of queue) with kafka: %w", err)
+	}
+	return subscription, nil
+}
+
+// newKafkaReadinessProbe connects to the brokers within the deadline of the
+// check, which the default timeouts of sarama would overrun by far.
+func newKafkaReadinessProbe(ctx context.Context, cfg Config, queueURL *url.URL) (health.Probe, error) {
+	return func(ctx context.Context) error {
+		config := kafkapubsub.MinimalConfig()
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout := time.Until(deadline)
+			if timeout <= 0 {
+				return fmt.Errorf("could not connect to kafka: %w", context.DeadlineExceeded)
+			}
+			config.Net.DialTimeout = timeout
+			config.Net.ReadTimeout = timeout
+			config.Net.WriteTimeout = timeout
+			config.Metadata.Retry.Max = 0
+		}
+		connected := make(chan error, 1)
+		go func() {
+			client, err := sarama.NewClient(cfg.KafkaBrokers, config)
+			if err == nil {
+				err = client.Close()
+			}
+			connected <- err
+		}()
+		select {
+		case err := <-connected:
+			if err != nil {
+				return fmt.Errorf("could not connect to kafka: %w", err)
+			}
+			return nil
+		case <-ctx.Done():
+			// The client is closed by the goroutine once it gives up
+			return fmt.Errorf("could not connect to kafka: %w", ctx.Err())
+		}
+	}, nil
+}
@@ -0,0 +1,91 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/pubsub"
+)
+
+// Runs against the broker of the kafka compose profile, see `just test-kafka`
+func TestKafkaPreservesOrderPerPartitionKey(t *testing.T) {
+	brokers, isSet := os.LookupEnv("KAFKA_TEST_BROKERS")
+	if !isSet {
+		t.Skip("KAFKA_TEST_BROKERS is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	topicName := fmt.Sprintf("queue-test-%d", time.Now().UnixNano())
+	cfg := Config{
+		QueueURL:     "kafka://" + topicName,
+		KafkaBrokers: strings.Split(brokers, ","),
+	}
+	require.Empty(t, cfg.Validate())
+	topic, err := OpenTopic(ctx, cfg)
+	require.NoError(t, err)
+	defer topic.Shutdown(ctx)
+
+	keys := []string{"alpha", "bravo", "charlie"}
+	const perKey = 20
+	for i := 0; i < perKey; i++ {
+		for _, key := range keys {
+			require.NoError(t, topic.Send(ctx, &pubsub.Message{
+				Body:     []byte(strconv.Itoa(i)),
+				Metadata: map[string]string{lib.PartitionKeyMetadata: key},
+			}))
+		}
+	}
+
+	// Reading from the oldest offset, the group sees everything sent above
+	cfg.QueueURL = "kafka://" + topicName + "?topic=" + topicName + "&offset=oldest"
+	subscription, err := OpenSubscription(ctx, cfg)
+	require.NoError(t, err)
+	defer subscription.Shutdown(ctx)
+	received := map[string][]int{}
+	for count := 0; count < perKey*len(keys); count++ {
+		message, err := subscription.Receive(ctx)
+		require.NoError(t, err)
+		message.Ack()
+		key := message.Metadata[lib.PartitionKeyMetadata]
+		require.Contains(t, keys, key, "the partition key should be handed back as metadata")
+		value, err := strconv.Atoi(string(message.Body))
+		require.NoError(t, err)
+		received[key] = append(received[key], value)
+	}
+	for _, key := range keys {
+		assert.IsIncreasing(t, received[key], "messages for %s arrived out of order", key)
+	}
+}
+
+func TestKafkaReadinessProbeHonorsItsDeadline(t *testing.T) {
+	// Accepts connections but never answers, as a broker that hangs would
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	probe, err := newKafkaReadinessProbe(context.Background(), Config{KafkaBrokers: []string{listener.Addr().String()}}, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	started := time.Now()
+	assert.Error(t, probe(ctx))
+	assert.Less(t, time.Since(started), time.Second)
+}
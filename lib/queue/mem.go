@@ -0,0 +1,40 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/health"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/mempubsub"
+)
+
+// The in-memory driver only connects topics and subscriptions opened within
+// the same process, which makes it useful for tests rather than deployments.
+func init() {
+	register([]string{mempubsub.Scheme}, driver{
+		validate: func(cfg Config) []error {
+			return nil
+		},
+		openTopic: func(ctx context.Context, cfg Config, queueURL *url.URL) (*pubsub.Topic, error) {
+			topic, err := pubsub.OpenTopic(ctx, queueURL.String())
+			if err != nil {
+				return nil, fmt.Errorf("could not initialize in-memory topic: %w", err)
+			}
+			return topic, nil
+		},
+		openSubscription: func(ctx context.Context, cfg Config, queueURL *url.URL) (*pubsub.Subscription, error) {
+			subscription, err := pubsub.OpenSubscription(ctx, queueURL.String())
+			if err != nil {
+				return nil, fmt.Errorf("could not initialize in-memory subscription: %w", err)
+			}
+			return subscription, nil
+		},
+		readinessProbe: func(ctx context.Context, cfg Config, queueURL *url.URL) (health.Probe, error) {
+			return func(ctx context.Context) error {
+				return nil
+			}, nil
+		},
+	})
+}
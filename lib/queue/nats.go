@@ -0,0 +1,86 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/health"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/natspubsub"
+)
+
+func init() {
+	register([]string{natspubsub.Scheme}, driver{
+		validate: func(cfg Config) []error {
+			return requireSetting("NATS_SERVER_URL", cfg.NATSServerURL != "", natspubsub.Scheme)
+		},
+		openTopic:        openNATSTopic,
+		openSubscription: openNATSSubscription,
+		readinessProbe:   newNATSReadinessProbe,
+	})
+}
+
+// natsConnections holds one connection per server URL, shared by the topics
+// and subscriptions opened on it. NATS connections reconnect on their own,
+// so they are kept for the life of the process: shutting down a topic or a
+// subscription doesn't close its connection, which would otherwise leak
+// whenever one is opened again.
+var natsConnections = struct {
+	sync.Mutex
+	byURL map[string]*nats.Conn
+}{byURL: map[string]*nats.Conn{}}
+
+func natsOpener(cfg Config) (*natspubsub.URLOpener, error) {
+	natsConnections.Lock()
+	defer natsConnections.Unlock()
+	conn := natsConnections.byURL[cfg.NATSServerURL]
+	if conn == nil || conn.IsClosed() {
+		var err error
+		if conn, err = nats.Connect(cfg.NATSServerURL); err != nil {
+			return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+		}
+		natsConnections.byURL[cfg.NATSServerURL] = conn
+	}
+	return &natspubsub.URLOpener{Connection: conn, UseV2: true}, nil
+}
+
+func openNATSTopic(ctx context.Context, cfg Config, queueURL *url.URL) (*pubsub.Topic, error) {
+	opener, err := natsOpener(cfg)
+	if err != nil {
+		return nil, err
+	}
+	topic, err := opener.OpenTopicURL(ctx, queueURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize topic (producing side of queue) with nats: %w", err)
+	}
+	return topic, nil
+}
+
+func openNATSSubscription(ctx context.Context, cfg Config, queueURL *url.URL) (*pubsub.Subscription, error) {
+	opener, err := natsOpener(cfg)
+	if err != nil {
+		return nil, err
+	}
+	subscription, err := opener.OpenSubscriptionURL(ctx, queueURL)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize subscription (consuming side of queue) with nats: %w", err)
+	}
+	return subscription, nil
+}
+
+func newNATSReadinessProbe(ctx context.Context, cfg Config, queueURL *url.URL) (health.Probe, error) {
+	return func(ctx context.Context) error {
+		conn, err := nats.Connect(cfg.NATSServerURL)
+		if err != nil {
+			return fmt.Errorf("could not connect to NATS: %w", err)
+		}
+		defer conn.Close()
+		if err := conn.FlushWithContext(ctx); err != nil {
+			return fmt.Errorf("could not round trip to NATS: %w", err)
+		}
+		return nil
+	}, nil
+}
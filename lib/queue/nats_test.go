@@ -0,0 +1,38 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Runs against the server of the nats compose profile, see `just test-nats`
+func TestNATSSubscriptionsShareOneConnection(t *testing.T) {
+	serverURL, isSet := os.LookupEnv("NATS_TEST_SERVER_URL")
+	if !isSet {
+		t.Skip("NATS_TEST_SERVER_URL is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	cfg := Config{
+		QueueURL:      fmt.Sprintf("nats://queue-test-%d", time.Now().UnixNano()),
+		NATSServerURL: serverURL,
+	}
+	opener, err := natsOpener(cfg)
+	require.NoError(t, err)
+	// Like a subscription that failed and is opened again
+	for i := 0; i < 3; i++ {
+		subscription, err := OpenSubscription(ctx, cfg)
+		require.NoError(t, err)
+		require.NoError(t, subscription.Shutdown(ctx))
+	}
+	reopened, err := natsOpener(cfg)
+	require.NoError(t, err)
+	assert.Same(t, opener.Connection, reopened.Connection)
+	assert.False(t, reopened.Connection.IsClosed(), "shutting down a subscription leaves the connection open")
+}
@@ -0,0 +1,116 @@
+// Package queue opens the topic and subscription of a service from the
+// scheme of its queue URL, so a single binary can target any broker:
+//
+//	https://sqs.<region>.amazonaws.com/<account>/<name>  AWS SQS (or awssqs://)
+//	rabbit://<exchange or queue>                          RabbitMQ
+//	nats://<subject>                                      NATS
+//	jetstream://<subject>[?consumer=<durable>]            NATS JetStream
+//	kafka://<topic> and kafka://<group>?topic=<topic>     Kafka
+//	mem://<topic>                                         in-memory, for tests
+package queue
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/wire"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/health"
+	"gocloud.dev/pubsub"
+)
+
+// Config is embedded into the configuration of each service.
+type Config struct {
+	QueueURL      string   `env:"QUEUE_URL" required:"true" desc:"URL of the queue, its scheme selects the broker: an SQS https:// URL, rabbit://, nats://, jetstream://, kafka:// or mem://"`
+	NATSServerURL string   `env:"NATS_SERVER_URL" secret:"true" desc:"URL of the NATS server. Required for nats:// queues"`
+	NATSStream    string   `env:"NATS_STREAM" default:"TASKS" desc:"Name of the JetStream stream the subject is stored in, it is created when missing. Used by jetstream:// queues"`
+	KafkaBrokers  []string `env:"KAFKA_BROKERS" desc:"Comma separated addresses of the Kafka brokers. Required for kafka:// queues"`
+	// The default matches the visibility timeout of the SQS queue declared
+	// by the infrastructure stack
+	VisibilityTimeout time.Duration `env:"VISIBILITY_TIMEOUT" default:"5m" desc:"How long a received message may stay unacknowledged before it is redelivered. Sets the ack-wait of jetstream:// consumers"`
+	RabbitMQConfig
+}
+
+// ProviderSet provides the topic, subscription and readiness probe of QUEUE_URL.
+var ProviderSet = wire.NewSet(OpenTopic, OpenSubscription, NewReadinessProbe)
+
+type driver struct {
+	// validate reports configuration the driver cannot work without.
+	validate         func(cfg Config) []error
+	openTopic        func(ctx context.Context, cfg Config, queueURL *url.URL) (*pubsub.Topic, error)
+	openSubscription func(ctx context.Context, cfg Config, queueURL *url.URL) (*pubsub.Subscription, error)
+	readinessProbe   func(ctx context.Context, cfg Config, queueURL *url.URL) (health.Probe, error)
+}
+
+var drivers = map[string]driver{}
+
+// register is called from the init function of each driver's file.
+func register(schemes []string, d driver) {
+	for _, scheme := range schemes {
+		drivers[scheme] = d
+	}
+}
+
+func lookupDriver(queueURL string) (driver, *url.URL, error) {
+	parsedURL, err := url.Parse(queueURL)
+	if err != nil {
+		return driver{}, nil, fmt.Errorf("could not parse queue url: %w", err)
+	}
+	d, isRegistered := drivers[parsedURL.Scheme]
+	if !isRegistered {
+		schemes := make([]string, 0, len(drivers))
+		for scheme := range drivers {
+			schemes = append(schemes, scheme+"://")
+		}
+		sort.Strings(schemes)
+		return driver{}, nil, fmt.Errorf("unsupported queue url scheme %q, expected one of %s", parsedURL.Scheme, strings.Join(schemes, ", "))
+	}
+	return d, parsedURL, nil
+}
+
+// Validate reports every problem with the configuration of the selected
+// driver. It is meant to be called from the service's own Validate.
+func (c Config) Validate() []error {
+	d, _, err := lookupDriver(c.QueueURL)
+	if err != nil {
+		return []error{err}
+	}
+	return d.validate(c)
+}
+
+// OpenTopic opens the producing side of the queue.
+func OpenTopic(ctx context.Context, cfg Config) (*pubsub.Topic, error) {
+	d, queueURL, err := lookupDriver(cfg.QueueURL)
+	if err != nil {
+		return nil, err
+	}
+	return d.openTopic(ctx, cfg, queueURL)
+}
+
+// OpenSubscription opens the consuming side of the queue.
+func OpenSubscription(ctx context.Context, cfg Config) (*pubsub.Subscription, error) {
+	d, queueURL, err := lookupDriver(cfg.QueueURL)
+	if err != nil {
+		return nil, err
+	}
+	return d.openSubscription(ctx, cfg, queueURL)
+}
+
+// NewReadinessProbe returns a probe verifying that the broker is reachable.
+func NewReadinessProbe(ctx context.Context, cfg Config) (health.Probe, error) {
+	d, queueURL, err := lookupDriver(cfg.QueueURL)
+	if err != nil {
+		return nil, err
+	}
+	return d.readinessProbe(ctx, cfg, queueURL)
+}
+
+func requireSetting(name string, isSet bool, scheme string) []error {
+	if isSet {
+		return nil
+	}
+	return []error{fmt.Errorf("%s is required for %s:// queues", name, scheme)}
+}
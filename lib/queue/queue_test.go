@@ -0,0 +1,73 @@
+package queue
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/pubsub"
+)
+
+func TestValidate(t *testing.T) {
+	errs := Config{
+		QueueURL:       "rabbit://data-ingress",
+		RabbitMQConfig: RabbitMQConfig{RabbitExchange: "data-ingress", RabbitQueue: "data-egress"},
+	}.Validate()
+	require.Len(t, errs, 1)
+	assert.ErrorContains(t, errs[0], "RABBIT_SERVER_URL")
+
+	errs = Config{QueueURL: "kafka://tasks", KafkaBrokers: []string{"localhost:9092"}}.Validate()
+	assert.Empty(t, errs)
+
+	errs = Config{QueueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/tasks"}.Validate()
+	assert.Empty(t, errs, "SQS relies on the ambient aws credentials")
+
+	errs = Config{QueueURL: "carrier-pigeon://tasks"}.Validate()
+	require.Len(t, errs, 1)
+	assert.ErrorContains(t, errs[0], "rabbit://")
+}
+
+func TestInMemoryRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{QueueURL: "mem://queue-test"}
+	topic, err := OpenTopic(ctx, cfg)
+	require.NoError(t, err)
+	defer topic.Shutdown(ctx)
+	subscription, err := OpenSubscription(ctx, cfg)
+	require.NoError(t, err)
+	defer subscription.Shutdown(ctx)
+
+	require.NoError(t, topic.Send(ctx, &pubsub.Message{Body: []byte("hello")}))
+	message, err := subscription.Receive(ctx)
+	require.NoError(t, err)
+	message.Ack()
+	assert.Equal(t, "hello", string(message.Body))
+
+	probe, err := NewReadinessProbe(ctx, cfg)
+	require.NoError(t, err)
+	assert.NoError(t, probe(ctx))
+}
+
+func TestFIFO(t *testing.T) {
+	assert.True(t, Config{QueueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/tasks.fifo"}.IsFIFO())
+	assert.False(t, Config{QueueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/tasks"}.IsFIFO())
+	assert.False(t, Config{QueueURL: "mem://tasks.fifo"}.IsFIFO())
+
+	entry := &types.SendMessageBatchRequestEntry{}
+	beforeSend := FIFOBeforeSend("greet", "0f8fad5b-d9cb-469f-a165-70867728950e")
+	require.NoError(t, beforeSend(func(i any) bool {
+		if p, ok := i.(**types.SendMessageBatchRequestEntry); ok {
+			*p = entry
+			return true
+		}
+		return false
+	}))
+	assert.Equal(t, "greet", *entry.MessageGroupId)
+	assert.Equal(t, "0f8fad5b-d9cb-469f-a165-70867728950e", *entry.MessageDeduplicationId)
+
+	_, gocloudURL := sqsURLs(&url.URL{Scheme: "https", Host: "sqs.us-east-1.amazonaws.com", Path: "/123456789012/tasks.fifo"})
+	assert.Equal(t, "v2", gocloudURL.Query().Get("awssdk"), "FIFOBeforeSend relies on the v2 types")
+}
@@ -0,0 +1,352 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/health"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/rs/zerolog"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/batcher"
+	pubsubdriver "gocloud.dev/pubsub/driver"
+	"gocloud.dev/pubsub/rabbitpubsub"
+)
+
+// RabbitMQConfig describes the topology both services declare, so that
+// either may start first. Declarations are idempotent, but RabbitMQ refuses
+// to change the settings of an existing exchange or queue; delete them (or
+// the rabbitmq-data volume locally) after changing any of these.
+type RabbitMQConfig struct {
+	RabbitServerURL     string        `env:"RABBIT_SERVER_URL" secret:"true" desc:"AMQP URL of the RabbitMQ server, including credentials. Required for rabbit:// queues"`
+	RabbitExchange      string        `env:"RABBIT_EXCHANGE" default:"data-ingress" desc:"Topic exchange tasks are published to, routed by their task name. Consumers declare it when it is missing"`
+	RabbitQueue         string        `env:"RABBIT_QUEUE" default:"data-egress" desc:"Queue bound to the exchange. Suppliers declare it when it is missing"`
+	RabbitBindingKeys   []string      `env:"RABBIT_BINDING_KEYS" default:"#" desc:"Routing keys, i.e. task names, the queue is bound with. Topic wildcards are supported"`
+	RabbitMessageTTL    time.Duration `env:"RABBIT_MESSAGE_TTL" desc:"Messages waiting longer than this are dead-lettered, unlimited when zero"`
+	RabbitMaxLength     int           `env:"RABBIT_MAX_LENGTH" desc:"Publishing is rejected while the queue holds this many messages, unlimited when zero"`
+	RabbitQuorumQueues  bool          `env:"RABBIT_QUORUM_QUEUES" desc:"Declare replicated quorum queues instead of classic queues"`
+	RabbitDeliveryLimit int           `env:"RABBIT_DELIVERY_LIMIT" desc:"Messages redelivered this many times are dead-lettered, unlimited when zero. Quorum queues only"`
+}
+
+func init() {
+	register([]string{rabbitpubsub.Scheme}, driver{
+		validate:         validateRabbitMQ,
+		openTopic:        openRabbitMQTopic,
+		openSubscription: openRabbitMQSubscription,
+		readinessProbe:   newRabbitMQReadinessProbe,
+	})
+}
+
+func validateRabbitMQ(cfg Config) []error {
+	errs := requireSetting("RABBIT_SERVER_URL", cfg.RabbitServerURL != "", rabbitpubsub.Scheme)
+	errs = append(errs, requireSetting("RABBIT_EXCHANGE", cfg.RabbitExchange != "", rabbitpubsub.Scheme)...)
+	errs = append(errs, requireSetting("RABBIT_QUEUE", cfg.RabbitQueue != "", rabbitpubsub.Scheme)...)
+	if cfg.RabbitMessageTTL < 0 {
+		errs = append(errs, fmt.Errorf("RABBIT_MESSAGE_TTL cannot be negative, got %s", cfg.RabbitMessageTTL))
+	}
+	if cfg.RabbitMaxLength < 0 {
+		errs = append(errs, fmt.Errorf("RABBIT_MAX_LENGTH cannot be negative, got %d", cfg.RabbitMaxLength))
+	}
+	if cfg.RabbitDeliveryLimit < 0 {
+		errs = append(errs, fmt.Errorf("RABBIT_DELIVERY_LIMIT cannot be negative, got %d", cfg.RabbitDeliveryLimit))
+	} else if cfg.RabbitDeliveryLimit > 0 && !cfg.RabbitQuorumQueues {
+		errs = append(errs, fmt.Errorf("RABBIT_DELIVERY_LIMIT requires RABBIT_QUORUM_QUEUES"))
+	}
+	return errs
+}
+
+// rabbitMQTopology names everything declared for a single queue. Dead
+// letters go through a fanout exchange to a queue of their own.
+type rabbitMQTopology struct {
+	RabbitMQConfig
+	DeadLetterExchange string
+	DeadLetterQueue    string
+}
+
+func newRabbitMQTopology(cfg RabbitMQConfig) rabbitMQTopology {
+	return rabbitMQTopology{
+		RabbitMQConfig:     cfg,
+		DeadLetterExchange: cfg.RabbitExchange + ".dlx",
+		DeadLetterQueue:    cfg.RabbitQueue + ".dlq",
+	}
+}
+
+func (t rabbitMQTopology) queueArguments() amqp.Table {
+	args := amqp.Table{
+		"x-dead-letter-exchange": t.DeadLetterExchange,
+	}
+	if t.RabbitMessageTTL > 0 {
+		args["x-message-ttl"] = t.RabbitMessageTTL.Milliseconds()
+	}
+	if t.RabbitMaxLength > 0 {
+		args["x-max-length"] = int64(t.RabbitMaxLength)
+		// Publishers are told rather than the oldest messages being dropped
+		args["x-overflow"] = "reject-publish"
+	}
+	if t.RabbitQuorumQueues {
+		args["x-queue-type"] = "quorum"
+	}
+	if t.RabbitDeliveryLimit > 0 {
+		args["x-delivery-limit"] = int64(t.RabbitDeliveryLimit)
+	}
+	return args
+}
+
+func (t rabbitMQTopology) declare(ctx context.Context, ch *amqp.Channel) error {
+	log := zerolog.Ctx(ctx)
+	log.Debug().Str("exchange", t.DeadLetterExchange).Str("queue", t.DeadLetterQueue).Msg("declaring RabbitMQ dead letter exchange and queue")
+	if err := ch.ExchangeDeclare(t.DeadLetterExchange, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+		return explainPreconditionFailed(fmt.Errorf("failed to declare dead letter exchange %s: %w", t.DeadLetterExchange, err))
+	}
+	deadLetterArgs := amqp.Table{}
+	if t.RabbitQuorumQueues {
+		deadLetterArgs["x-queue-type"] = "quorum"
+	}
+	if _, err := ch.QueueDeclare(t.DeadLetterQueue, true, false, false, false, deadLetterArgs); err != nil {
+		return explainPreconditionFailed(fmt.Errorf("failed to declare dead letter queue %s: %w", t.DeadLetterQueue, err))
+	}
+	if err := ch.QueueBind(t.DeadLetterQueue, "", t.DeadLetterExchange, false, nil); err != nil {
+		return fmt.Errorf("failed to bind dead letter queue to exchange: %w", err)
+	}
+
+	log.Debug().Str("exchange", t.RabbitExchange).Msg("declaring RabbitMQ exchange")
+	// Messages matching no binding are dead-lettered rather than dropped
+	exchangeArgs := amqp.Table{"alternate-exchange": t.DeadLetterExchange}
+	if err := ch.ExchangeDeclare(t.RabbitExchange, amqp.ExchangeTopic, true, false, false, false, exchangeArgs); err != nil {
+		return explainPreconditionFailed(fmt.Errorf("failed to declare exchange %s: %w", t.RabbitExchange, err))
+	}
+	log.Debug().Str("queue", t.RabbitQueue).Msg("declaring RabbitMQ queue")
+	if _, err := ch.QueueDeclare(t.RabbitQueue, true, false, false, false, t.queueArguments()); err != nil {
+		return explainPreconditionFailed(fmt.Errorf("failed to declare queue %s: %w", t.RabbitQueue, err))
+	}
+	for _, key := range t.RabbitBindingKeys {
+		log.Debug().Str("queue", t.RabbitQueue).Str("binding_key", key).Msg("binding RabbitMQ queue to exchange")
+		if err := ch.QueueBind(t.RabbitQueue, key, t.RabbitExchange, false, nil); err != nil {
+			return fmt.Errorf("failed to bind queue to exchange with %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func explainPreconditionFailed(err error) error {
+	amqpErr := &amqp.Error{}
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+		return fmt.Errorf("%w (it already exists with different settings, delete it to apply the configured topology)", err)
+	}
+	return err
+}
+
+// dialRabbitMQ connects and declares the topology, with the names given by
+// the queue URL taking precedence over the configured ones.
+func dialRabbitMQ(ctx context.Context, cfg RabbitMQConfig) (*amqp.Connection, error) {
+	conn, err := amqp.Dial(cfg.RabbitServerURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open a channel: %w", err)
+	}
+	defer ch.Close()
+	if err := newRabbitMQTopology(cfg).declare(ctx, ch); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not initialize the RabbitMQ topology: %w", err)
+	}
+	return conn, nil
+}
+
+func rabbitMQName(queueURL *url.URL) string {
+	return path.Join(queueURL.Host, queueURL.Path)
+}
+
+func openRabbitMQTopic(ctx context.Context, cfg Config, queueURL *url.URL) (*pubsub.Topic, error) {
+	rabbitCfg := cfg.RabbitMQConfig
+	rabbitCfg.RabbitExchange = rabbitMQName(queueURL)
+	conn, err := dialRabbitMQ(ctx, rabbitCfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize topic (producing side of queue) with rabbitmq: %w", err)
+	}
+	t := &rabbitMQTopic{
+		dial: func(ctx context.Context) (*amqp.Connection, error) {
+			return dialRabbitMQ(ctx, rabbitCfg)
+		},
+		conn:     conn,
+		exchange: rabbitCfg.RabbitExchange,
+	}
+	return pubsub.NewTopic(t, &batcher.Options{MaxBatchSize: 100, MaxHandlers: 1}), nil
+}
+
+func openRabbitMQSubscription(ctx context.Context, cfg Config, queueURL *url.URL) (*pubsub.Subscription, error) {
+	rabbitCfg := cfg.RabbitMQConfig
+	rabbitCfg.RabbitQueue = rabbitMQName(queueURL)
+	conn, err := dialRabbitMQ(ctx, rabbitCfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize subscription (consuming side of queue) with rabbitmq: %w", err)
+	}
+	// The connection is handed over explicitly rather than through the
+	// RABBIT_SERVER_URL environment variable, which may not be set when the
+	// configuration came from a file, a flag or a secret reference.
+	opener := &rabbitpubsub.URLOpener{Connection: conn}
+	subscription, err := opener.OpenSubscriptionURL(ctx, queueURL)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not initialize subscription (consuming side of queue) with rabbitmq: %w", err)
+	}
+	return subscription, nil
+}
+
+func newRabbitMQReadinessProbe(ctx context.Context, cfg Config, queueURL *url.URL) (health.Probe, error) {
+	return func(ctx context.Context) error {
+		conn, err := amqp.DialConfig(cfg.RabbitServerURL, amqp.Config{
+			Dial: amqp.DefaultDial(time.Second * 2),
+		})
+		if err != nil {
+			return fmt.Errorf("could not connect to RabbitMQ: %w", err)
+		}
+		return conn.Close()
+	}, nil
+}
+
+// rabbitMQTopic publishes with the task name as the routing key, which the
+// gocloud driver cannot do as it always publishes with an empty one. Messages
+// are published in confirm mode so that rejections, such as those of a full
+// queue, are reported to the sender. Headers are set the way the gocloud
+// subscription expects them.
+type rabbitMQTopic struct {
+	// dial connects again once the connection was lost, such as when the
+	// broker restarted
+	dial     func(ctx context.Context) (*amqp.Connection, error)
+	exchange string
+
+	mutex sync.Mutex
+	conn  *amqp.Connection
+	ch    *amqp.Channel
+}
+
+// channel returns the channel messages are published on, opening it again,
+// along with the connection, once they were closed. It expects t.mutex to be
+// held.
+func (t *rabbitMQTopic) channel(ctx context.Context) (*amqp.Channel, error) {
+	if t.ch != nil && !t.ch.IsClosed() {
+		return t.ch, nil
+	}
+	if t.conn.IsClosed() {
+		conn, err := t.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		t.conn = conn
+	}
+	ch, err := t.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	t.ch = ch
+	return ch, nil
+}
+
+func (t *rabbitMQTopic) SendBatch(ctx context.Context, ms []*pubsubdriver.Message) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	ch, err := t.channel(ctx)
+	if err != nil {
+		return err
+	}
+	confirmations := make([]*amqp.DeferredConfirmation, 0, len(ms))
+	for _, m := range ms {
+		publishing := amqp.Publishing{
+			Headers:      amqp.Table{},
+			Body:         m.Body,
+			DeliveryMode: amqp.Persistent,
+		}
+		for key, value := range m.Metadata {
+			publishing.Headers[key] = value
+		}
+		if m.BeforeSend != nil {
+			asFunc := func(i any) bool {
+				if p, ok := i.(**amqp.Publishing); ok {
+					*p = &publishing
+					return true
+				}
+				return false
+			}
+			if err := m.BeforeSend(asFunc); err != nil {
+				return err
+			}
+		}
+		routingKey := m.Metadata[lib.TaskNameMetadata]
+		confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, t.exchange, routingKey, false, false, publishing)
+		if err != nil {
+			return err
+		}
+		confirmations = append(confirmations, confirmation)
+	}
+	for i, confirmation := range confirmations {
+		isAcked, err := confirmation.WaitContext(ctx)
+		if err != nil {
+			return err
+		} else if !isAcked {
+			return fmt.Errorf("rabbitmq rejected message %d of the batch, the queue may be full", i)
+		}
+		if m := ms[i]; m.AfterSend != nil {
+			if err := m.AfterSend(func(i any) bool { return false }); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *rabbitMQTopic) IsRetryable(err error) bool {
+	return false
+}
+
+func (t *rabbitMQTopic) As(i any) bool {
+	if p, ok := i.(**amqp.Connection); ok {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		*p = t.conn
+		return true
+	}
+	return false
+}
+
+func (t *rabbitMQTopic) ErrorAs(err error, i any) bool {
+	return errors.As(err, i)
+}
+
+func (t *rabbitMQTopic) ErrorCode(err error) gcerrors.ErrorCode {
+	amqpErr := &amqp.Error{}
+	if errors.As(err, &amqpErr) {
+		switch amqpErr.Code {
+		case amqp.NotFound:
+			return gcerrors.NotFound
+		case amqp.PreconditionFailed, amqp.ChannelError:
+			return gcerrors.FailedPrecondition
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return gcerrors.DeadlineExceeded
+	} else if errors.Is(err, context.Canceled) {
+		return gcerrors.Canceled
+	}
+	return gcerrors.Unknown
+}
+
+func (t *rabbitMQTopic) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.conn.Close()
+}
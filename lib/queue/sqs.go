@@ -0,0 +1,110 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/health"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/awssnssqs"
+)
+
+func init() {
+	register([]string{"https", awssnssqs.SQSScheme}, driver{
+		validate: func(cfg Config) []error {
+			return nil
+		},
+		openTopic:        openSQSTopic,
+		openSubscription: openSQSSubscription,
+		readinessProbe:   newSQSReadinessProbe,
+	})
+}
+
+// sqsURLs returns both spellings of the queue: the https:// URL that AWS
+// hands out and the awssqs:// URL that gocloud expects. gocloud is asked to
+// use the v2 SDK like the rest of the repository, which also decides the
+// types BeforeSend hands out, see FIFOBeforeSend.
+// - https://gocloud.dev/howto/pubsub/publish/#sqs
+func sqsURLs(queueURL *url.URL) (httpsURL *url.URL, gocloudURL *url.URL) {
+	httpsURL, gocloudURL = &url.URL{}, &url.URL{}
+	*httpsURL, *gocloudURL = *queueURL, *queueURL
+	httpsURL.Scheme = "https"
+	gocloudURL.Scheme = awssnssqs.SQSScheme
+	query := gocloudURL.Query()
+	if !query.Has("awssdk") {
+		query.Set("awssdk", "v2")
+		gocloudURL.RawQuery = query.Encode()
+	}
+	return httpsURL, gocloudURL
+}
+
+// IsFIFO reports whether the queue is an SQS FIFO queue, which requires
+// every message to carry a message group and deduplication ID.
+func (c Config) IsFIFO() bool {
+	queueURL, err := url.Parse(c.QueueURL)
+	if err != nil {
+		return false
+	}
+	isSQS := queueURL.Scheme == "https" || queueURL.Scheme == awssnssqs.SQSScheme
+	return isSQS && strings.HasSuffix(queueURL.Path, ".fifo")
+}
+
+// FIFOBeforeSend is a pubsub.Message.BeforeSend for FIFO queues. SQS delivers
+// the messages of a group in the order they were sent, and drops messages
+// whose deduplication ID it has seen within the last five minutes.
+func FIFOBeforeSend(groupID string, deduplicationID string) func(asFunc func(any) bool) error {
+	return func(asFunc func(any) bool) error {
+		var entry *types.SendMessageBatchRequestEntry
+		if !asFunc(&entry) {
+			return fmt.Errorf("message group and deduplication IDs are only supported by aws sqs queues")
+		}
+		entry.MessageGroupId = aws.String(groupID)
+		entry.MessageDeduplicationId = aws.String(deduplicationID)
+		return nil
+	}
+}
+
+func openSQSTopic(ctx context.Context, cfg Config, queueURL *url.URL) (*pubsub.Topic, error) {
+	_, gocloudURL := sqsURLs(queueURL)
+	topic, err := pubsub.OpenTopic(ctx, gocloudURL.String())
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize topic (producing side of queue) with aws sqs: %w", err)
+	}
+	return topic, nil
+}
+
+func openSQSSubscription(ctx context.Context, cfg Config, queueURL *url.URL) (*pubsub.Subscription, error) {
+	_, gocloudURL := sqsURLs(queueURL)
+	subscription, err := pubsub.OpenSubscription(ctx, gocloudURL.String())
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize subscription (consuming side of queue) with aws sqs: %w", err)
+	}
+	return subscription, nil
+}
+
+func newSQSReadinessProbe(ctx context.Context, cfg Config, queueURL *url.URL) (health.Probe, error) {
+	awsConfig, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not load aws configuration: %w", err)
+	}
+	client := sqs.NewFromConfig(awsConfig)
+	httpsURL, _ := sqsURLs(queueURL)
+	// Query parameters only configure gocloud, they aren't part of the queue URL
+	httpsURL.RawQuery = ""
+	return func(ctx context.Context) error {
+		_, err := client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+			QueueUrl:       aws.String(httpsURL.String()),
+			AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameApproximateNumberOfMessages},
+		})
+		if err != nil {
+			return fmt.Errorf("could not get aws sqs queue attributes: %w", err)
+		}
+		return nil
+	}, nil
+}
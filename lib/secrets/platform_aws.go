@@ -0,0 +1,47 @@
+//go:build aws
+
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+func registerPlatformProviders(ctx context.Context, r *Resolver) error {
+	awsConfig, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("could not load aws configuration: %w", err)
+	}
+	secretsManagerClient := secretsmanager.NewFromConfig(awsConfig)
+	ssmClient := ssm.NewFromConfig(awsConfig)
+	r.Register(SchemeSecretsManager, func(ctx context.Context, ref *url.URL) (string, error) {
+		output, err := secretsManagerClient.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+			SecretId: aws.String(Name(ref)),
+		})
+		if err != nil {
+			return "", err
+		} else if output.SecretString == nil {
+			return "", fmt.Errorf("secret has no string value")
+		}
+		return *output.SecretString, nil
+	})
+	r.Register(SchemeSSM, func(ctx context.Context, ref *url.URL) (string, error) {
+		output, err := ssmClient.GetParameter(ctx, &ssm.GetParameterInput{
+			Name:           aws.String(Name(ref)),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return "", err
+		} else if output.Parameter == nil || output.Parameter.Value == nil {
+			return "", fmt.Errorf("parameter has no value")
+		}
+		return *output.Parameter.Value, nil
+	})
+	return nil
+}
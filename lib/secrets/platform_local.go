@@ -0,0 +1,13 @@
+//go:build !aws
+
+package secrets
+
+import (
+	"context"
+)
+
+// registerPlatformProviders registers nothing locally, references to the AWS
+// stores fail with UnsupportedSchemeErr rather than being passed through.
+func registerPlatformProviders(ctx context.Context, r *Resolver) error {
+	return nil
+}
@@ -0,0 +1,179 @@
+// Package secrets resolves secret references such as
+// secretsmanager://prod/rabbitmq#password, ssm:///prod/admin-token,
+// file:///run/secrets/token or env://OTHER_VARIABLE into their values.
+//
+// Values that are not a reference, because their scheme is not one of the
+// known secret schemes, are returned unchanged so that plain values keep
+// working in local development. The AWS backed schemes are only available
+// in binaries built with the aws tag.
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	SchemeFile           = "file"
+	SchemeEnv            = "env"
+	SchemeSecretsManager = "secretsmanager"
+	SchemeSSM            = "ssm"
+)
+
+// Provider fetches the value a reference points to.
+type Provider func(ctx context.Context, ref *url.URL) (string, error)
+
+type UnsupportedSchemeErr struct {
+	Scheme string
+}
+
+func (use UnsupportedSchemeErr) Error() string {
+	return fmt.Sprintf("secret scheme %s:// is not supported by this build", use.Scheme)
+}
+
+type cachedValue struct {
+	value     string
+	fetchedAt time.Time
+}
+
+// Resolver resolves references and caches their values. A cached value is
+// refreshed once it is older than the refresh interval; if that refresh fails
+// the stale value keeps being served so a brief outage of the secret store
+// does not take the service down with it.
+type Resolver struct {
+	refreshInterval time.Duration
+	providers       map[string]Provider
+
+	mutex sync.Mutex
+	cache map[string]cachedValue
+}
+
+func NewResolver(ctx context.Context, refreshInterval time.Duration) (*Resolver, error) {
+	r := &Resolver{
+		refreshInterval: refreshInterval,
+		providers: map[string]Provider{
+			SchemeFile: resolveFile,
+			SchemeEnv:  resolveEnv,
+		},
+		cache: map[string]cachedValue{},
+	}
+	if err := registerPlatformProviders(ctx, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Register adds or replaces the provider of a scheme.
+func (r *Resolver) Register(scheme string, provider Provider) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.providers[scheme] = provider
+}
+
+// IsReference reports whether value uses one of the secret schemes.
+func IsReference(value string) bool {
+	scheme, _, found := strings.Cut(value, "://")
+	if !found {
+		return false
+	}
+	switch scheme {
+	case SchemeFile, SchemeEnv, SchemeSecretsManager, SchemeSSM:
+		return true
+	}
+	return false
+}
+
+// Resolve returns the value value refers to, or value itself when it is not
+// a reference.
+func (r *Resolver) Resolve(ctx context.Context, value string) (string, error) {
+	if !IsReference(value) {
+		return value, nil
+	}
+	ref, err := url.Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("could not parse secret reference: %w", err)
+	}
+	// Never log the value, only where it came from
+	log := zerolog.Ctx(ctx).With().Str("secret_scheme", ref.Scheme).Str("secret_name", Name(ref)).Logger()
+
+	r.mutex.Lock()
+	provider, isSupported := r.providers[ref.Scheme]
+	cached, isCached := r.cache[value]
+	r.mutex.Unlock()
+	if !isSupported {
+		return "", UnsupportedSchemeErr{Scheme: ref.Scheme}
+	}
+	if isCached && time.Since(cached.fetchedAt) < r.refreshInterval {
+		return cached.value, nil
+	}
+
+	resolved, err := provider(ctx, ref)
+	if err != nil && isCached {
+		log.Warn().Err(err).Msg("could not refresh secret, continuing with the cached value")
+		return cached.value, nil
+	} else if err != nil {
+		return "", fmt.Errorf("could not resolve secret %s://%s: %w", ref.Scheme, Name(ref), err)
+	}
+	if ref.Fragment != "" {
+		resolved, err = jsonField(resolved, ref.Fragment)
+		if err != nil {
+			return "", fmt.Errorf("could not resolve secret %s://%s: %w", ref.Scheme, Name(ref), err)
+		}
+	}
+	log.Debug().Msg("resolved secret")
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cache[value] = cachedValue{
+		value:     resolved,
+		fetchedAt: time.Now(),
+	}
+	return resolved, nil
+}
+
+// Name is the identifier of the secret within its store, with both
+// ssm:///prod/token and ssm://prod/token naming the same parameter path.
+func Name(ref *url.URL) string {
+	return ref.Host + ref.Path
+}
+
+// jsonField extracts a single top level field, so that a JSON secret such as
+// the ones generated by Secrets Manager can be referenced as name#field.
+func jsonField(document string, field string) (string, error) {
+	fields := map[string]any{}
+	if err := json.Unmarshal([]byte(document), &fields); err != nil {
+		return "", fmt.Errorf("secret is not a JSON object, cannot select field %q", field)
+	}
+	value, isPresent := fields[field]
+	if !isPresent {
+		return "", fmt.Errorf("secret has no field %q", field)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+func resolveFile(ctx context.Context, ref *url.URL) (string, error) {
+	contents, err := os.ReadFile(Name(ref))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(contents)), nil
+}
+
+func resolveEnv(ctx context.Context, ref *url.URL) (string, error) {
+	value, isPresent := os.LookupEnv(Name(ref))
+	if !isPresent {
+		return "", fmt.Errorf("environment variable %s is not set", Name(ref))
+	}
+	return value, nil
+}
@@ -0,0 +1,258 @@
+// Package task is what the handlers of the consumer are written against. A
+// handler is given the task along with the means to report how far along
+// it is and to checkpoint what it has done, so that it resumes rather than
+// starts over should it be interrupted and the task redelivered. It returns
+// the tasks that follow it, if any, making it a step of a workflow.
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/checkpoint"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/progress"
+)
+
+// Handler processes a task, returning the tasks that follow it or nil. Should
+// it fail, the message is left unacknowledged and redelivered, with the
+// latest checkpoint of the task, unless the error is Permanent.
+type Handler func(ctx context.Context, t *Task) (*Next, error)
+
+// permanentError fails a task for good.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks err as a failure that handling the task again won't fix.
+// The message is acknowledged rather than redelivered, and the workflow of
+// the task, if any, is compensated.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err, or any error it wraps, was marked
+// Permanent.
+func IsPermanent(err error) bool {
+	permanent := &permanentError{}
+	return errors.As(err, &permanent)
+}
+
+// Child is a task enqueued once the handler of the task returning it
+// succeeded.
+type Child struct {
+	TaskName    string
+	OrderingKey string
+	Arguments   json.RawMessage
+}
+
+// Next holds the tasks that follow a task in its workflow.
+type Next struct {
+	Children []Child
+	// Join is enqueued once every child completed, along with the tasks
+	// they returned in turn
+	Join *Child
+}
+
+// Then returns children that are enqueued at once, chaining the next step
+// of a workflow or fanning out to several.
+func Then(children ...Child) *Next {
+	return &Next{Children: children}
+}
+
+// FanIn returns children that are enqueued at once, followed by join once
+// they all completed.
+func FanIn(join Child, children ...Child) *Next {
+	if len(children) == 0 {
+		return Then(join)
+	}
+	return &Next{Children: children, Join: &join}
+}
+
+// Payloads returns the payloads of the children and join of parent. Their
+// IDs derive from the ID of parent, so the same tasks are enqueued should
+// parent be redelivered, and they share its deadline.
+func (n *Next) Payloads(parent lib.PayloadItem, now time.Time) (children []lib.PayloadItem, join *lib.PayloadItem) {
+	if n == nil {
+		return nil, nil
+	}
+	rootID := parent.WorkflowID()
+	payload := func(name string, child Child) lib.PayloadItem {
+		return lib.PayloadItem{
+			ID:          uuid.NewSHA1(parent.ID, []byte(name)),
+			Time:        now,
+			TaskName:    child.TaskName,
+			OrderingKey: child.OrderingKey,
+			Arguments:   child.Arguments,
+			ParentID:    &parent.ID,
+			RootID:      &rootID,
+			Deadline:    parent.Deadline,
+		}
+	}
+	for i, child := range n.Children {
+		children = append(children, payload("child/"+strconv.Itoa(i), child))
+	}
+	if n.Join != nil {
+		joinPayload := payload("join", *n.Join)
+		join = &joinPayload
+	}
+	return children, join
+}
+
+// Task is a task being processed.
+type Task struct {
+	lib.PayloadItem
+	checkpoint  []byte
+	checkpoints *checkpoint.Store
+}
+
+// New returns the task of payload, whose latest checkpoint is given.
+func New(payload lib.PayloadItem, latestCheckpoint []byte, checkpoints *checkpoint.Store) *Task {
+	return &Task{
+		PayloadItem: payload,
+		checkpoint:  latestCheckpoint,
+		checkpoints: checkpoints,
+	}
+}
+
+// Resumed reports whether the task was interrupted after checkpointing.
+func (t *Task) Resumed() bool {
+	return t.checkpoint != nil
+}
+
+// Checkpoint deserializes the latest checkpoint of the task into v,
+// reporting whether it has one.
+func (t *Task) Checkpoint(v any) (bool, error) {
+	if t.checkpoint == nil {
+		return false, nil
+	} else if err := json.Unmarshal(t.checkpoint, v); err != nil {
+		return true, fmt.Errorf("could not deserialize checkpoint: %w", err)
+	}
+	return true, nil
+}
+
+// SaveCheckpoint replaces the checkpoint of the task with v, serialized to
+// JSON. It is deleted once the task succeeds.
+func (t *Task) SaveCheckpoint(ctx context.Context, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("could not serialize checkpoint: %w", err)
+	} else if err := t.checkpoints.Save(ctx, t.ID, data); err != nil {
+		return err
+	}
+	t.checkpoint = data
+	return nil
+}
+
+// Report tells how far along the task is, percent being from 0 to 100. See
+// progress.Report.
+func (t *Task) Report(ctx context.Context, percent int, message string) {
+	progress.Report(ctx, percent, message)
+}
+
+// Registry holds the handler of every task name, the task undoing it and
+// how long it may take.
+type Registry struct {
+	handlers      map[string]Handler
+	compensations map[string]string
+	timeouts      map[string]time.Duration
+	fallback      Handler
+}
+
+// NewRegistry returns a registry handing the tasks whose name has no
+// handler to fallback.
+func NewRegistry(fallback Handler) *Registry {
+	return &Registry{
+		handlers:      map[string]Handler{},
+		compensations: map[string]string{},
+		timeouts:      map[string]time.Duration{},
+		fallback:      fallback,
+	}
+}
+
+// Handle registers the handler of the tasks called name. Handlers are meant
+// to be registered before the consumer starts.
+func (r *Registry) Handle(name string, handler Handler) {
+	r.handlers[name] = handler
+}
+
+// Lookup returns the handler of the tasks called name.
+func (r *Registry) Lookup(name string) Handler {
+	if handler, ok := r.handlers[name]; ok {
+		return handler
+	}
+	return r.fallback
+}
+
+// Compensate registers compensation as the task undoing the tasks called
+// name. Should their workflow fail once their handler succeeded, it is
+// enqueued with the same arguments and ordering key.
+func (r *Registry) Compensate(name string, compensation string) {
+	r.compensations[name] = compensation
+}
+
+// Compensation returns the payload of the task undoing payload, nil when
+// none was registered for its name. Like children, its ID derives from the
+// ID of payload, but it has no deadline: it's never too late to undo it.
+func (r *Registry) Compensation(payload lib.PayloadItem, now time.Time) *lib.PayloadItem {
+	compensation, ok := r.compensations[payload.TaskName]
+	if !ok {
+		return nil
+	}
+	rootID := payload.WorkflowID()
+	return &lib.PayloadItem{
+		ID:          uuid.NewSHA1(payload.ID, []byte("compensation")),
+		Time:        now,
+		TaskName:    compensation,
+		OrderingKey: payload.OrderingKey,
+		Arguments:   payload.Arguments,
+		ParentID:    &payload.ID,
+		RootID:      &rootID,
+	}
+}
+
+// Timeout registers how long the handler of the tasks called name may take,
+// instead of the consumer's default. Once it passed, the context of the
+// handler is done and the task is redelivered should the handler fail.
+// Handlers that ignore their context are abandoned by the consumer after a
+// grace period, and keep running alongside the task's redelivery.
+func (r *Registry) Timeout(name string, timeout time.Duration) {
+	r.timeouts[name] = timeout
+}
+
+// Timeouts returns the timeouts that were registered, keyed by task name.
+func (r *Registry) Timeouts() map[string]time.Duration {
+	return maps.Clone(r.timeouts)
+}
+
+// Deadline returns when the handler of payload, starting at now, is given
+// up on: once the timeout of its task passed, fallback unless one was
+// registered, or at the deadline of payload if it comes first. A timeout of
+// zero is unlimited, and ok is false when neither applies.
+func (r *Registry) Deadline(payload lib.PayloadItem, now time.Time, fallback time.Duration) (deadline time.Time, ok bool) {
+	timeout, registered := r.timeouts[payload.TaskName]
+	if !registered {
+		timeout = fallback
+	}
+	if timeout > 0 {
+		deadline, ok = now.Add(timeout), true
+	}
+	if payload.Deadline != nil && (!ok || payload.Deadline.Before(deadline)) {
+		deadline, ok = *payload.Deadline, true
+	}
+	return deadline, ok
+}
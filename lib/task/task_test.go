@@ -0,0 +1,172 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/checkpoint"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob/memblob"
+)
+
+type batchCheckpoint struct {
+	Done int `json:"done"`
+}
+
+func TestCheckpointsSurviveRedelivery(t *testing.T) {
+	ctx := context.Background()
+	store := checkpoint.NewStore(memblob.OpenBucket(nil))
+	payload := lib.PayloadItem{ID: uuid.New(), TaskName: "transform"}
+
+	first := New(payload, nil, store)
+	assert.False(t, first.Resumed())
+	found, err := first.Checkpoint(&batchCheckpoint{})
+	require.NoError(t, err)
+	assert.False(t, found)
+	require.NoError(t, first.SaveCheckpoint(ctx, batchCheckpoint{Done: 40}))
+	assert.True(t, first.Resumed())
+
+	latest, err := store.Load(ctx, payload.ID)
+	require.NoError(t, err)
+	redelivered := New(payload, latest, store)
+	assert.True(t, redelivered.Resumed())
+	resumed := batchCheckpoint{}
+	found, err = redelivered.Checkpoint(&resumed)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 40, resumed.Done)
+}
+
+func TestRegistry(t *testing.T) {
+	handled := ""
+	handler := func(name string) Handler {
+		return func(ctx context.Context, t *Task) (*Next, error) {
+			handled = name
+			return nil, nil
+		}
+	}
+	registry := NewRegistry(handler("fallback"))
+	registry.Handle("transform", handler("transform"))
+
+	_, err := registry.Lookup("transform")(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "transform", handled)
+	_, err = registry.Lookup("publish")(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "fallback", handled)
+}
+
+func TestCompensation(t *testing.T) {
+	now := time.Now()
+	registry := NewRegistry(nil)
+	registry.Compensate("reserve", "release")
+	root := lib.PayloadItem{ID: uuid.New(), TaskName: "fetch"}
+	reserve := lib.PayloadItem{ID: uuid.New(), TaskName: "reserve", OrderingKey: "customer-42", Arguments: json.RawMessage(`{"seats":2}`), ParentID: &root.ID, RootID: &root.ID}
+
+	assert.Nil(t, registry.Compensation(root, now))
+	release := registry.Compensation(reserve, now)
+	require.NotNil(t, release)
+	assert.Equal(t, "release", release.TaskName)
+	assert.Equal(t, reserve.Arguments, release.Arguments)
+	assert.Equal(t, reserve.OrderingKey, release.OrderingKey)
+	assert.Equal(t, reserve.ID, *release.ParentID)
+	assert.Equal(t, root.ID, release.WorkflowID())
+	assert.Equal(t, release.ID, registry.Compensation(reserve, now).ID, "the same task undoes a redelivered task")
+}
+
+func TestDeadline(t *testing.T) {
+	now := time.Now()
+	registry := NewRegistry(nil)
+	registry.Timeout("transform", time.Minute)
+	registry.Timeout("archive", 0)
+	transform := lib.PayloadItem{ID: uuid.New(), TaskName: "transform"}
+	fetch := lib.PayloadItem{ID: uuid.New(), TaskName: "fetch"}
+
+	deadline, ok := registry.Deadline(transform, now, time.Hour)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(time.Minute), deadline)
+	deadline, ok = registry.Deadline(fetch, now, time.Hour)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(time.Hour), deadline, "the consumer's default applies")
+	_, ok = registry.Deadline(fetch, now, 0)
+	assert.False(t, ok)
+	_, ok = registry.Deadline(lib.PayloadItem{TaskName: "archive"}, now, time.Hour)
+	assert.False(t, ok, "archive has no timeout")
+
+	soon := now.Add(time.Second)
+	transform.Deadline = &soon
+	deadline, _ = registry.Deadline(transform, now, time.Hour)
+	assert.Equal(t, soon, deadline, "the deadline of the task comes first")
+	later := now.Add(time.Hour)
+	transform.Deadline = &later
+	deadline, _ = registry.Deadline(transform, now, time.Hour)
+	assert.Equal(t, now.Add(time.Minute), deadline)
+	deadline, ok = registry.Deadline(lib.PayloadItem{TaskName: "archive", Deadline: &later}, now, time.Hour)
+	assert.True(t, ok)
+	assert.Equal(t, later, deadline)
+
+	assert.Equal(t, map[string]time.Duration{"transform": time.Minute, "archive": 0}, registry.Timeouts())
+}
+
+func TestPermanent(t *testing.T) {
+	err := fmt.Errorf("could not reserve: %w", Permanent(errors.New("sold out")))
+	assert.True(t, IsPermanent(err))
+	assert.EqualError(t, err, "could not reserve: sold out")
+	assert.False(t, IsPermanent(errors.New("timeout")))
+	assert.False(t, IsPermanent(nil))
+}
+
+func TestNextPayloads(t *testing.T) {
+	now := time.Now()
+	root := lib.PayloadItem{ID: uuid.New(), TaskName: "fetch"}
+	next := FanIn(
+		Child{TaskName: "publish"},
+		Child{TaskName: "transform", Arguments: json.RawMessage(`{"part":1}`)},
+		Child{TaskName: "transform", Arguments: json.RawMessage(`{"part":2}`), OrderingKey: "customer-42"},
+	)
+	children, join := next.Payloads(root, now)
+	require.Len(t, children, 2)
+	require.NotNil(t, join)
+	for _, payload := range append(children, *join) {
+		assert.Equal(t, root.ID, *payload.ParentID)
+		assert.Equal(t, root.ID, *payload.RootID)
+		assert.Equal(t, root.ID, payload.WorkflowID())
+		assert.Equal(t, now, payload.Time)
+		assert.Nil(t, payload.Deadline)
+	}
+	assert.Equal(t, "transform", children[1].TaskName)
+	assert.Equal(t, "customer-42", children[1].OrderingKey)
+	assert.JSONEq(t, `{"part":2}`, string(children[1].Arguments))
+	assert.Equal(t, "publish", join.TaskName)
+	assert.NotEqual(t, children[0].ID, children[1].ID)
+
+	redelivered, _ := next.Payloads(root, now.Add(time.Minute))
+	assert.Equal(t, children[0].ID, redelivered[0].ID, "redelivered tasks enqueue the same children")
+
+	// Their own children belong to the same workflow
+	grandchildren, _ := Then(Child{TaskName: "validate"}).Payloads(children[0], now)
+	require.Len(t, grandchildren, 1)
+	assert.Equal(t, children[0].ID, *grandchildren[0].ParentID)
+	assert.Equal(t, root.ID, *grandchildren[0].RootID)
+
+	deadline := now.Add(time.Hour)
+	root.Deadline = &deadline
+	children, join = next.Payloads(root, now)
+	for _, payload := range append(children, *join) {
+		assert.Equal(t, deadline, *payload.Deadline, "children share the deadline of their parent")
+	}
+
+	children, join = (*Next)(nil).Payloads(root, now)
+	assert.Empty(t, children)
+	assert.Nil(t, join)
+	children, join = FanIn(Child{TaskName: "publish"}).Payloads(root, now)
+	assert.Len(t, children, 1, "joining no children is the same as chaining the join")
+	assert.Nil(t, join)
+}
@@ -0,0 +1,221 @@
+//go:build aws
+
+package workflow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+)
+
+func init() {
+	openers["dynamodb"] = openDynamoDB
+}
+
+// DynamoDBStore keeps the steps as items of a table partitioned by the pk
+// attribute, the ID of their root, and sorted by the sk attribute, their own
+// ID.
+type DynamoDBStore struct {
+	client *dynamodb.Client
+	table  string
+}
+
+func openDynamoDB(ctx context.Context, cfg Config, workflowURL *url.URL) (Store, error) {
+	table := workflowURL.Host
+	if table == "" {
+		return nil, fmt.Errorf("dynamodb workflow url %s has no table", workflowURL.Redacted())
+	}
+	opts := []func(*config.LoadOptions) error{}
+	if region := workflowURL.Query().Get("region"); region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	awsConfig, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not load aws configuration: %w", err)
+	}
+	return &DynamoDBStore{
+		client: dynamodb.NewFromConfig(awsConfig),
+		table:  table,
+	}, nil
+}
+
+func stepKey(rootID uuid.UUID, id uuid.UUID) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: rootID.String()},
+		"sk": &types.AttributeValueMemberS{Value: id.String()},
+	}
+}
+
+func number(n int64) *types.AttributeValueMemberN {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(n, 10)}
+}
+
+func stepItem(step *Step) (map[string]types.AttributeValue, error) {
+	item := stepKey(step.RootID, step.ID)
+	item["parent_id"] = &types.AttributeValueMemberS{Value: step.ParentID.String()}
+	item["task_name"] = &types.AttributeValueMemberS{Value: step.TaskName}
+	item["state"] = &types.AttributeValueMemberS{Value: string(step.State)}
+	item["children"] = number(int64(step.Children))
+	item["pending"] = number(int64(step.Pending))
+	item["join_due"] = &types.AttributeValueMemberBOOL{Value: step.JoinDue}
+	item["compensates"] = &types.AttributeValueMemberBOOL{Value: step.Compensates}
+	item["aborted"] = &types.AttributeValueMemberBOOL{Value: step.Aborted}
+	item["attempts"] = number(int64(step.Attempts))
+	item["version"] = number(int64(step.Version + 1))
+	item["created_at"] = number(step.CreatedAt.UnixNano())
+	item["updated_at"] = number(step.UpdatedAt.UnixNano())
+	for name, message := range map[string]*Message{"join_message": step.Join, "join_compensation": step.JoinCompensation, "compensation": step.Compensation} {
+		if message == nil {
+			continue
+		}
+		data, err := json.Marshal(message)
+		if err != nil {
+			return nil, fmt.Errorf("could not serialize the %s of step %s: %w", name, step.ID, err)
+		}
+		item[name] = &types.AttributeValueMemberS{Value: string(data)}
+	}
+	return item, nil
+}
+
+func stepFromItem(item map[string]types.AttributeValue) (Step, error) {
+	step := Step{}
+	texts := map[string]string{}
+	for _, name := range []string{"pk", "sk", "parent_id", "task_name", "state"} {
+		if s, ok := item[name].(*types.AttributeValueMemberS); ok {
+			texts[name] = s.Value
+		}
+	}
+	var err error
+	for target, name := range map[*uuid.UUID]string{&step.RootID: "pk", &step.ID: "sk", &step.ParentID: "parent_id"} {
+		if *target, err = uuid.Parse(texts[name]); err != nil {
+			return step, fmt.Errorf("workflow item %s has an invalid %s: %w", texts["sk"], name, err)
+		}
+	}
+	step.TaskName = texts["task_name"]
+	step.State = State(texts["state"])
+	numbers := map[string]int64{}
+	for _, name := range []string{"children", "pending", "attempts", "version", "created_at", "updated_at"} {
+		if n, ok := item[name].(*types.AttributeValueMemberN); ok {
+			if numbers[name], err = strconv.ParseInt(n.Value, 10, 64); err != nil {
+				return step, fmt.Errorf("workflow item %s has an invalid %s: %w", step.ID, name, err)
+			}
+		}
+	}
+	step.Children = int(numbers["children"])
+	step.Pending = int(numbers["pending"])
+	step.Attempts = int(numbers["attempts"])
+	step.Version = int(numbers["version"])
+	step.CreatedAt = time.Unix(0, numbers["created_at"])
+	step.UpdatedAt = time.Unix(0, numbers["updated_at"])
+	for target, name := range map[*bool]string{&step.JoinDue: "join_due", &step.Compensates: "compensates", &step.Aborted: "aborted"} {
+		if flag, ok := item[name].(*types.AttributeValueMemberBOOL); ok {
+			*target = flag.Value
+		}
+	}
+	for target, name := range map[**Message]string{&step.Join: "join_message", &step.JoinCompensation: "join_compensation", &step.Compensation: "compensation"} {
+		if message, ok := item[name].(*types.AttributeValueMemberS); ok {
+			*target = &Message{}
+			if err := json.Unmarshal([]byte(message.Value), *target); err != nil {
+				return step, fmt.Errorf("workflow item %s has an invalid %s: %w", step.ID, name, err)
+			}
+		}
+	}
+	return step, nil
+}
+
+func (s *DynamoDBStore) Get(ctx context.Context, rootID uuid.UUID, id uuid.UUID) (Step, error) {
+	output, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            stepKey(rootID, id),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return Step{}, fmt.Errorf("could not look up step: %w", err)
+	} else if output.Item == nil {
+		return Step{}, ErrNotFound
+	}
+	return stepFromItem(output.Item)
+}
+
+func (s *DynamoDBStore) Steps(ctx context.Context, rootID uuid.UUID) ([]Step, error) {
+	steps := []Step{}
+	paginator := dynamodb.NewQueryPaginator(s.client, &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		KeyConditionExpression: aws.String("pk = :pk"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pk": &types.AttributeValueMemberS{Value: rootID.String()},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not look up workflow: %w", err)
+		}
+		for _, item := range output.Items {
+			step, err := stepFromItem(item)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, step)
+		}
+	}
+	if len(steps) == 0 {
+		return nil, ErrNotFound
+	}
+	return steps, nil
+}
+
+// Save writes the steps in a single transaction, which is limited to 100
+// items.
+func (s *DynamoDBStore) Save(ctx context.Context, steps ...*Step) error {
+	items := []types.TransactWriteItem{}
+	for _, step := range steps {
+		item, err := stepItem(step)
+		if err != nil {
+			return err
+		}
+		put := &types.Put{
+			TableName:           aws.String(s.table),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(pk)"),
+		}
+		if step.Version > 0 {
+			put.ConditionExpression = aws.String("version = :version")
+			put.ExpressionAttributeValues = map[string]types.AttributeValue{
+				":version": number(int64(step.Version)),
+			}
+		}
+		items = append(items, types.TransactWriteItem{Put: put})
+	}
+	_, err := s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	canceled := &types.TransactionCanceledException{}
+	if errors.As(err, &canceled) {
+		for _, reason := range canceled.CancellationReasons {
+			if code := aws.ToString(reason.Code); code == "ConditionalCheckFailed" || code == "TransactionConflict" {
+				return ErrConflict
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("could not save steps: %w", err)
+	}
+	for _, step := range steps {
+		step.Version++
+	}
+	return nil
+}
+
+func (s *DynamoDBStore) Close() error {
+	return nil
+}
@@ -0,0 +1,210 @@
+package workflow
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	_ "modernc.org/sqlite"
+)
+
+func init() {
+	openers["sqlite"] = openSQLite
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS workflow_steps (
+	root_id           TEXT NOT NULL,
+	id                TEXT NOT NULL,
+	parent_id         TEXT NOT NULL,
+	task_name         TEXT NOT NULL,
+	state             TEXT NOT NULL,
+	children          INTEGER NOT NULL,
+	pending           INTEGER NOT NULL,
+	join_message      TEXT,
+	join_due          INTEGER NOT NULL,
+	join_compensation TEXT,
+	compensation      TEXT,
+	compensates       INTEGER NOT NULL,
+	aborted           INTEGER NOT NULL,
+	attempts          INTEGER NOT NULL,
+	version           INTEGER NOT NULL,
+	created_at        INTEGER NOT NULL,
+	updated_at        INTEGER NOT NULL,
+	PRIMARY KEY (root_id, id)
+);
+`
+
+const sqliteColumns = `root_id, id, parent_id, task_name, state, children, pending, join_message, join_due, join_compensation, compensation, compensates, aborted, attempts, version, created_at, updated_at`
+
+// SQLiteStore keeps the steps in a SQLite database. Times are stored as
+// nanoseconds since the epoch.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func openSQLite(ctx context.Context, cfg Config, workflowURL *url.URL) (Store, error) {
+	return OpenSQLiteStore(ctx, workflowURL.Path)
+}
+
+// OpenSQLiteStore opens the database at path, creating it and its table when
+// they don't exist yet.
+func OpenSQLiteStore(ctx context.Context, path string) (*SQLiteStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("could not create the directory of the database: %w", err)
+	}
+	// Writers wait for each other rather than failing with SQLITE_BUSY
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.ExecContext(ctx, sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not create tables: %w", err)
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// messageColumn is a message serialized to JSON, NULL when there's none.
+func messageColumn(message *Message) (sql.NullString, error) {
+	if message == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func scanStep(row scanner) (Step, error) {
+	var rootID, id, parentID string
+	var join, joinCompensation, compensation sql.NullString
+	var createdAt, updatedAt int64
+	step := Step{}
+	err := row.Scan(
+		&rootID, &id, &parentID, &step.TaskName, &step.State, &step.Children, &step.Pending, &join, &step.JoinDue,
+		&joinCompensation, &compensation, &step.Compensates, &step.Aborted, &step.Attempts, &step.Version, &createdAt, &updatedAt,
+	)
+	if err != nil {
+		return step, err
+	}
+	for target, value := range map[*uuid.UUID]string{&step.RootID: rootID, &step.ID: id, &step.ParentID: parentID} {
+		if *target, err = uuid.Parse(value); err != nil {
+			return step, fmt.Errorf("could not read step %s: %w", id, err)
+		}
+	}
+	for target, column := range map[**Message]sql.NullString{&step.Join: join, &step.JoinCompensation: joinCompensation, &step.Compensation: compensation} {
+		if !column.Valid {
+			continue
+		}
+		*target = &Message{}
+		if err := json.Unmarshal([]byte(column.String), *target); err != nil {
+			return step, fmt.Errorf("could not read the messages of step %s: %w", id, err)
+		}
+	}
+	step.CreatedAt = time.Unix(0, createdAt)
+	step.UpdatedAt = time.Unix(0, updatedAt)
+	return step, nil
+}
+
+func (s *SQLiteStore) Get(ctx context.Context, rootID uuid.UUID, id uuid.UUID) (Step, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+sqliteColumns+` FROM workflow_steps WHERE root_id = ? AND id = ?`, rootID.String(), id.String())
+	step, err := scanStep(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Step{}, ErrNotFound
+	} else if err != nil {
+		return Step{}, fmt.Errorf("could not look up step: %w", err)
+	}
+	return step, nil
+}
+
+func (s *SQLiteStore) Steps(ctx context.Context, rootID uuid.UUID) ([]Step, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+sqliteColumns+` FROM workflow_steps WHERE root_id = ? ORDER BY rowid`, rootID.String())
+	if err != nil {
+		return nil, fmt.Errorf("could not look up workflow: %w", err)
+	}
+	defer rows.Close()
+	steps := []Step{}
+	for rows.Next() {
+		step, err := scanStep(rows)
+		if err != nil {
+			return nil, fmt.Errorf("could not read step: %w", err)
+		}
+		steps = append(steps, step)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not look up workflow: %w", err)
+	} else if len(steps) == 0 {
+		return nil, ErrNotFound
+	}
+	return steps, nil
+}
+
+func (s *SQLiteStore) Save(ctx context.Context, steps ...*Step) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	for _, step := range steps {
+		messages := []sql.NullString{}
+		for _, message := range []*Message{step.Join, step.JoinCompensation, step.Compensation} {
+			column, err := messageColumn(message)
+			if err != nil {
+				return fmt.Errorf("could not serialize the messages of step %s: %w", step.ID, err)
+			}
+			messages = append(messages, column)
+		}
+		values := []any{
+			step.ParentID.String(), step.TaskName, step.State, step.Children, step.Pending, messages[0], step.JoinDue,
+			messages[1], messages[2], step.Compensates, step.Aborted, step.Attempts,
+			step.Version + 1, step.UpdatedAt.UnixNano(), step.RootID.String(), step.ID.String(),
+		}
+		var result sql.Result
+		if step.Version == 0 {
+			result, err = tx.ExecContext(ctx,
+				`INSERT INTO workflow_steps (parent_id, task_name, state, children, pending, join_message, join_due, join_compensation, compensation, compensates, aborted, attempts, version, updated_at, root_id, id, created_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+				append(values, step.CreatedAt.UnixNano())...,
+			)
+		} else {
+			result, err = tx.ExecContext(ctx,
+				`UPDATE workflow_steps SET parent_id = ?, task_name = ?, state = ?, children = ?, pending = ?, join_message = ?, join_due = ?,
+				join_compensation = ?, compensation = ?, compensates = ?, aborted = ?, attempts = ?, version = ?, updated_at = ?
+				WHERE root_id = ? AND id = ? AND version = ?`,
+				append(values, step.Version)...,
+			)
+		}
+		if err != nil {
+			return fmt.Errorf("could not save step %s: %w", step.ID, err)
+		} else if saved, err := result.RowsAffected(); err != nil {
+			return fmt.Errorf("could not save step %s: %w", step.ID, err)
+		} else if saved == 0 {
+			return ErrConflict
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+	for _, step := range steps {
+		step.Version++
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,402 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
+)
+
+// maxAttempts bounds how often a change is retried when steps it reads are
+// changed concurrently, by the tasks of sibling steps completing.
+const maxAttempts = 10
+
+// Workflow is the state of a workflow and of each of its steps.
+type Workflow struct {
+	ID uuid.UUID
+	// State of the root, which succeeds last. Once aborted, the workflow
+	// is compensating until every step that was handled is compensated,
+	// and failed when none had a compensation or one of them failed.
+	State State
+	// Steps starting with the root, then in the order they were returned
+	Steps []Step
+}
+
+// Tracker records the steps of workflows as their tasks are handled.
+type Tracker struct {
+	store Store
+}
+
+// NewTracker returns a tracker recording to store, nil when store is nil.
+func NewTracker(store Store) *Tracker {
+	if store == nil {
+		return nil
+	}
+	return &Tracker{store: store}
+}
+
+// retry calls change until none of the steps it read were changed
+// concurrently.
+func retry(change func() error) error {
+	for attempt := 1; ; attempt++ {
+		if err := change(); !errors.Is(err, ErrConflict) || attempt == maxAttempts {
+			return err
+		}
+	}
+}
+
+// Start records that the handler of payload started, if it's a step,
+// returning how many times it did. It returns 0 for tasks that aren't
+// steps.
+func (t *Tracker) Start(ctx context.Context, payload lib.PayloadItem) (int, error) {
+	if payload.RootID == nil {
+		// Roots are recorded once they return tasks
+		return 0, nil
+	}
+	attempts := 0
+	err := retry(func() error {
+		step, err := t.store.Get(ctx, *payload.RootID, payload.ID)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		} else if attempts = step.Attempts; step.State != StatePending && step.State != StateRunning {
+			// Redelivered once handled
+			return nil
+		}
+		step.State = StateRunning
+		step.Attempts++
+		step.UpdatedAt = time.Now()
+		if err := t.store.Save(ctx, &step); err != nil {
+			return err
+		}
+		attempts = step.Attempts
+		return nil
+	})
+	return attempts, err
+}
+
+// Spawn records the children that the handler of parent returned, and the
+// message enqueueing the task that joins them once they complete.
+// compensations holds the messages undoing parent, its children and its
+// join, keyed by the ID of their task, for those that have one. It does
+// nothing when they were recorded on a previous delivery of parent, and
+// returns ErrAborted, recording nothing, once the workflow was aborted.
+func (t *Tracker) Spawn(ctx context.Context, parent lib.PayloadItem, children []lib.PayloadItem, join *Message, compensations map[uuid.UUID]*Message) error {
+	rootID := parent.WorkflowID()
+	if parent.ID != rootID {
+		if root, err := t.store.Get(ctx, rootID, rootID); err != nil {
+			return err
+		} else if root.Aborted {
+			return ErrAborted
+		}
+	}
+	now := time.Now()
+	for _, child := range children {
+		step := &Step{
+			ID:           child.ID,
+			ParentID:     parent.ID,
+			RootID:       rootID,
+			TaskName:     child.TaskName,
+			State:        StatePending,
+			Compensation: compensations[child.ID],
+			CreatedAt:    now,
+			UpdatedAt:    now,
+		}
+		// Steps that exist were saved by a previous delivery
+		if err := t.store.Save(ctx, step); err != nil && !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+	return retry(func() error {
+		step, err := t.store.Get(ctx, rootID, parent.ID)
+		if errors.Is(err, ErrNotFound) {
+			step = Step{ID: parent.ID, RootID: rootID, TaskName: parent.TaskName, State: StateRunning, Compensation: compensations[parent.ID], CreatedAt: now}
+			if parent.ParentID != nil {
+				step.ParentID = *parent.ParentID
+			}
+		} else if err != nil {
+			return err
+		} else if step.Aborted {
+			return ErrAborted
+		} else if step.Children > 0 {
+			return nil
+		}
+		step.Children = len(children)
+		step.Pending = len(children)
+		step.Join = join
+		if join != nil {
+			step.JoinCompensation = compensations[join.ID]
+		}
+		step.UpdatedAt = now
+		return t.store.Save(ctx, &step)
+	})
+}
+
+// Complete records that the handler of payload succeeded, completing the
+// step along with its ancestors whose children all completed. It returns the
+// steps whose join is due as a result, or was due but wasn't sent, which
+// the caller sends then marks with MarkJoined. Once the workflow was
+// aborted, it returns the step whose compensation is due instead, see Fail.
+func (t *Tracker) Complete(ctx context.Context, payload lib.PayloadItem) ([]Step, error) {
+	var due []Step
+	aborted := false
+	err := retry(func() error {
+		var err error
+		due, aborted, err = t.complete(ctx, payload)
+		return err
+	})
+	if err != nil || !aborted {
+		return due, err
+	}
+	return t.compensations(ctx, payload.WorkflowID())
+}
+
+func (t *Tracker) complete(ctx context.Context, payload lib.PayloadItem) ([]Step, bool, error) {
+	rootID := payload.WorkflowID()
+	// The step, followed by its parent, up to the root
+	ancestry := []Step{}
+	for id := payload.ID; id != uuid.Nil; {
+		step, err := t.store.Get(ctx, rootID, id)
+		if errors.Is(err, ErrNotFound) && len(ancestry) == 0 {
+			// Not a step, a task that returned no tasks
+			return nil, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+		ancestry = append(ancestry, step)
+		id = step.ParentID
+	}
+	now := time.Now()
+	aborted := ancestry[len(ancestry)-1].Aborted
+	if step := &ancestry[0]; step.Compensates {
+		// The step it undid was compensated, the next one is due
+		if step.State == StateSucceeded {
+			return nil, aborted, nil
+		}
+		step.State = StateSucceeded
+		step.UpdatedAt = now
+		undone := &ancestry[1]
+		undone.State = StateCompensated
+		undone.UpdatedAt = now
+		return nil, aborted, t.store.Save(ctx, step, undone)
+	}
+	changed := map[int]bool{}
+	created := []*Step{}
+	if step := &ancestry[0]; step.State == StatePending || step.State == StateRunning {
+		step.State = StateWaiting
+		changed[0] = true
+	}
+	for i := 0; i < len(ancestry) && ancestry[i].State == StateWaiting && ancestry[i].Pending == 0; i++ {
+		ancestry[i].State = StateSucceeded
+		changed[i] = true
+		if i+1 == len(ancestry) {
+			break
+		}
+		parent := &ancestry[i+1]
+		parent.Pending--
+		changed[i+1] = true
+		if parent.Pending == 0 && parent.Join != nil && !parent.JoinDue && !aborted {
+			// The join is a child like any other, the parent completes
+			// with it
+			parent.JoinDue = true
+			parent.Children++
+			parent.Pending++
+			created = append(created, &Step{
+				ID:           parent.Join.ID,
+				ParentID:     parent.ID,
+				RootID:       rootID,
+				TaskName:     parent.Join.TaskName,
+				State:        StatePending,
+				Compensation: parent.JoinCompensation,
+				CreatedAt:    now,
+				UpdatedAt:    now,
+			})
+		}
+	}
+	if len(changed) > 0 {
+		steps := created
+		for i := range changed {
+			ancestry[i].UpdatedAt = now
+			steps = append(steps, &ancestry[i])
+		}
+		if err := t.store.Save(ctx, steps...); err != nil {
+			return nil, false, err
+		}
+	}
+	due := []Step{}
+	for _, step := range ancestry {
+		if step.JoinDue && step.Join != nil && !aborted {
+			due = append(due, step)
+		}
+	}
+	return due, aborted, nil
+}
+
+// MarkJoined records that the join of the step was sent.
+func (t *Tracker) MarkJoined(ctx context.Context, step Step) error {
+	return retry(func() error {
+		step, err := t.store.Get(ctx, step.RootID, step.ID)
+		if err != nil || !step.JoinDue {
+			return err
+		}
+		step.Join = nil
+		step.JoinDue = false
+		step.UpdatedAt = time.Now()
+		return t.store.Save(ctx, &step)
+	})
+}
+
+// Fail records that the handler of payload failed for good, aborting its
+// workflow. It returns the step whose compensation is due as a result, which
+// the caller sends then marks with MarkCompensationSent. It does nothing for
+// tasks that aren't steps.
+func (t *Tracker) Fail(ctx context.Context, payload lib.PayloadItem) ([]Step, error) {
+	rootID := payload.WorkflowID()
+	isStep := true
+	err := retry(func() error {
+		step, err := t.store.Get(ctx, rootID, payload.ID)
+		if errors.Is(err, ErrNotFound) {
+			isStep = false
+			return nil
+		} else if err != nil {
+			return err
+		}
+		steps := []*Step{&step}
+		root := &step
+		if step.ID != rootID {
+			found, err := t.store.Get(ctx, rootID, rootID)
+			if err != nil {
+				return err
+			}
+			root = &found
+			steps = append(steps, root)
+		}
+		handling := step.State == StatePending || step.State == StateRunning
+		if root.Aborted && !handling {
+			// Recorded on a previous delivery
+			return nil
+		} else if handling {
+			step.State = StateFailed
+		}
+		root.Aborted = true
+		for _, step := range steps {
+			step.UpdatedAt = time.Now()
+		}
+		return t.store.Save(ctx, steps...)
+	})
+	if err != nil || !isStep {
+		return nil, err
+	}
+	return t.compensations(ctx, rootID)
+}
+
+// compensations returns the step of an aborted workflow whose compensation
+// is due: the one being compensated until its compensation was sent,
+// otherwise the step created last among those that were handled and not
+// compensated yet, which is then recorded as being compensated. None is due
+// while a compensation is being handled, nor once one failed.
+func (t *Tracker) compensations(ctx context.Context, rootID uuid.UUID) ([]Step, error) {
+	var due []Step
+	err := retry(func() error {
+		due = nil
+		steps, err := t.store.Steps(ctx, rootID)
+		if err != nil {
+			return err
+		}
+		var next *Step
+		for i := range steps {
+			step := &steps[i]
+			if step.State == StateCompensating && step.Compensation != nil {
+				due = []Step{*step}
+				return nil
+			} else if step.State == StateCompensating || (step.Compensates && step.State == StateFailed) {
+				return nil
+			} else if step.Compensation != nil && !step.Compensates && (step.State == StateWaiting || step.State == StateSucceeded) {
+				if next == nil || !step.CreatedAt.Before(next.CreatedAt) {
+					next = step
+				}
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		now := time.Now()
+		next.State = StateCompensating
+		next.UpdatedAt = now
+		compensation := &Step{
+			ID:          next.Compensation.ID,
+			ParentID:    next.ID,
+			RootID:      rootID,
+			TaskName:    next.Compensation.TaskName,
+			State:       StatePending,
+			Compensates: true,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+		if err := t.store.Save(ctx, next, compensation); err != nil {
+			return err
+		}
+		due = []Step{*next}
+		return nil
+	})
+	return due, err
+}
+
+// MarkCompensationSent records that the compensation of the step was sent.
+func (t *Tracker) MarkCompensationSent(ctx context.Context, step Step) error {
+	return retry(func() error {
+		step, err := t.store.Get(ctx, step.RootID, step.ID)
+		if err != nil || step.State != StateCompensating || step.Compensation == nil {
+			return err
+		}
+		step.Compensation = nil
+		step.UpdatedAt = time.Now()
+		return t.store.Save(ctx, &step)
+	})
+}
+
+// Workflow returns the workflow that started with the task of id, or
+// ErrNotFound when that task returned no tasks.
+func (t *Tracker) Workflow(ctx context.Context, id uuid.UUID) (Workflow, error) {
+	steps, err := t.store.Steps(ctx, id)
+	if err != nil {
+		return Workflow{}, err
+	}
+	sort.SliceStable(steps, func(i, j int) bool {
+		if steps[i].ID == id || steps[j].ID == id {
+			return steps[i].ID == id
+		}
+		return steps[i].CreatedAt.Before(steps[j].CreatedAt)
+	})
+	workflow := Workflow{ID: id, Steps: steps}
+	aborted, compensating, compensated, stuck := false, false, false, false
+	for _, step := range steps {
+		if step.ID == id {
+			workflow.State = step.State
+			aborted = step.Aborted
+		}
+		switch {
+		case step.Compensates && step.State == StateFailed:
+			stuck = true
+		case step.State == StateCompensating, step.Compensation != nil && step.State != StateFailed:
+			compensating = true
+		case step.State == StateCompensated:
+			compensated = true
+		}
+	}
+	if aborted {
+		switch {
+		case stuck || (!compensating && !compensated):
+			workflow.State = StateFailed
+		case compensating:
+			workflow.State = StateCompensating
+		default:
+			workflow.State = StateCompensated
+		}
+	}
+	return workflow, nil
+}
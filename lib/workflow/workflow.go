@@ -0,0 +1,174 @@
+// Package workflow tracks tasks that enqueue others. A handler returning
+// tasks, see task.Next, makes its task the step of a workflow whose children
+// are those tasks; a child may return tasks in turn. A step completes once
+// its handler and every one of its children did, which is when the task
+// joining its children, if it has one, is enqueued. The workflow completes
+// with the task it started with, its root.
+//
+// Should a step fail for good, the workflow is aborted: joins are no longer
+// enqueued, and the steps whose handler succeeded are compensated one at a
+// time, the ones created last first, by the task registered to undo them,
+// see task.Registry.Compensate. Compensations are steps too, children of
+// the step they undo.
+//
+// The store is selected by the scheme of WORKFLOW_URL:
+//
+//	sqlite:///path/workflows.db a SQLite database, a single host only
+//	dynamodb://table?region=... a DynamoDB table, in aws builds
+//
+// Like tasks, steps complete at least once: a join or compensation may be
+// enqueued again should the consumer crash before recording that it was.
+package workflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/google/wire"
+)
+
+var (
+	ErrNotFound = errors.New("workflow step not found")
+	// ErrConflict is returned by Store.Save when a step changed since it was
+	// read.
+	ErrConflict = errors.New("workflow step was changed concurrently")
+	// ErrAborted is returned by Tracker.Spawn once a step of the workflow
+	// failed.
+	ErrAborted = errors.New("workflow was aborted")
+)
+
+type UnsupportedSchemeErr struct {
+	Scheme string
+}
+
+func (use UnsupportedSchemeErr) Error() string {
+	return fmt.Sprintf("workflow url scheme %q is not supported", use.Scheme)
+}
+
+// State of a step.
+type State string
+
+const (
+	// StatePending steps are enqueued, waiting for a consumer
+	StatePending State = "pending"
+	// StateRunning steps are being handled, or will be again once their
+	// task is redelivered
+	StateRunning State = "running"
+	// StateWaiting steps were handled, some of their children weren't yet
+	StateWaiting State = "waiting"
+	// StateSucceeded steps were handled, as were all of their children
+	StateSucceeded State = "succeeded"
+	// StateFailed steps failed for good, aborting their workflow
+	StateFailed State = "failed"
+	// StateCompensating steps are being undone by their compensation
+	StateCompensating State = "compensating"
+	// StateCompensated steps were undone
+	StateCompensated State = "compensated"
+)
+
+// Config is embedded into the configuration of each service.
+type Config struct {
+	WorkflowURL string `env:"WORKFLOW_URL" desc:"Store of the steps of workflows, e.g. sqlite:///var/lib/workflows/workflows.db or dynamodb://table?region=us-east-1. Workflows are not tracked when empty, so their tasks can't be joined"`
+}
+
+func (c Config) Validate() []error {
+	if c.WorkflowURL == "" {
+		return nil
+	}
+	if workflowURL, err := url.Parse(c.WorkflowURL); err != nil {
+		return []error{fmt.Errorf("WORKFLOW_URL is not a url: %w", err)}
+	} else if _, isRegistered := openers[workflowURL.Scheme]; !isRegistered {
+		return []error{fmt.Errorf("WORKFLOW_URL: %w", UnsupportedSchemeErr{Scheme: workflowURL.Scheme})}
+	}
+	return nil
+}
+
+// ProviderSet provides the Store of WORKFLOW_URL and its Tracker.
+var ProviderSet = wire.NewSet(OpenStore, NewTracker)
+
+// Message is a message ready to be sent, its body encoded, sealed and
+// offloaded as needed.
+type Message struct {
+	ID       uuid.UUID         `json:"id"`
+	TaskName string            `json:"task_name"`
+	Body     []byte            `json:"body"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// Step is a task of a workflow.
+type Step struct {
+	ID uuid.UUID
+	// ParentID is uuid.Nil for the root of the workflow
+	ParentID uuid.UUID
+	RootID   uuid.UUID
+	TaskName string
+	State    State
+	// Children counts the tasks the handler returned, its join included
+	// once it is enqueued
+	Children int
+	// Pending counts the children that haven't completed yet
+	Pending int
+	// Join enqueues the task joining the children, until it was sent
+	Join *Message
+	// JoinDue is set once every child completed, until Join was sent
+	JoinDue bool
+	// JoinCompensation undoes the join, becoming the Compensation of its
+	// step
+	JoinCompensation *Message
+	// Compensation enqueues the task undoing the step, until it was sent
+	Compensation *Message
+	// Compensates is set on the steps of compensations
+	Compensates bool
+	// Aborted is set on the root once a step failed
+	Aborted bool
+	// Attempts counts the times the handler started
+	Attempts int
+	// Version is incremented every time the step is saved, see Store.Save
+	Version   int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Store holds the steps of workflows. Every method is safe for concurrent
+// use, including by other processes sharing the store.
+type Store interface {
+	// Get returns a step of the workflow, or ErrNotFound.
+	Get(ctx context.Context, rootID uuid.UUID, id uuid.UUID) (Step, error)
+	// Steps returns every step of the workflow, or ErrNotFound.
+	Steps(ctx context.Context, rootID uuid.UUID) ([]Step, error)
+	// Save writes the steps atomically provided none changed since they
+	// were read: steps whose Version is 0 are created, the others updated
+	// if their Version is the one stored. It returns ErrConflict otherwise,
+	// and increments the Version of every step once they are saved.
+	Save(ctx context.Context, steps ...*Step) error
+	Close() error
+}
+
+type opener func(ctx context.Context, cfg Config, workflowURL *url.URL) (Store, error)
+
+var openers = map[string]opener{}
+
+// OpenStore opens the configured store, the returned function closes it. The
+// store is nil when no WORKFLOW_URL is configured.
+func OpenStore(ctx context.Context, cfg Config) (Store, func(), error) {
+	if cfg.WorkflowURL == "" {
+		return nil, func() {}, nil
+	}
+	workflowURL, err := url.Parse(cfg.WorkflowURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse workflow url: %w", err)
+	}
+	open, isRegistered := openers[workflowURL.Scheme]
+	if !isRegistered {
+		return nil, nil, UnsupportedSchemeErr{Scheme: workflowURL.Scheme}
+	}
+	store, err := open(ctx, cfg, workflowURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open workflow store: %w", err)
+	}
+	return store, func() { store.Close() }, nil
+}
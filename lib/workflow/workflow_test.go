@@ -0,0 +1,359 @@
+package workflow
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStore(t *testing.T) *SQLiteStore {
+	store, err := OpenSQLiteStore(context.Background(), filepath.Join(t.TempDir(), "workflows.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// child returns the payload of a task enqueued by parent.
+func child(parent lib.PayloadItem, taskName string) lib.PayloadItem {
+	rootID := parent.WorkflowID()
+	return lib.PayloadItem{ID: uuid.New(), TaskName: taskName, ParentID: &parent.ID, RootID: &rootID}
+}
+
+// joinOf returns the message enqueueing the task that joins the children of
+// parent, along with its payload.
+func joinOf(parent lib.PayloadItem, taskName string) (*Message, lib.PayloadItem) {
+	payload := child(parent, taskName)
+	return &Message{ID: payload.ID, TaskName: taskName, Body: []byte(`{}`), Metadata: map[string]string{"task-name": taskName}}, payload
+}
+
+// compensationOf returns the message enqueueing the task that undoes
+// payload, along with its payload.
+func compensationOf(payload lib.PayloadItem, taskName string) (*Message, lib.PayloadItem) {
+	rootID := payload.WorkflowID()
+	compensation := lib.PayloadItem{ID: uuid.NewSHA1(payload.ID, []byte("compensation")), TaskName: taskName, ParentID: &payload.ID, RootID: &rootID}
+	return &Message{ID: compensation.ID, TaskName: taskName, Body: []byte(`{}`)}, compensation
+}
+
+func states(t *testing.T, tracker *Tracker, rootID uuid.UUID) map[string]State {
+	workflow, err := tracker.Workflow(context.Background(), rootID)
+	require.NoError(t, err)
+	states := map[string]State{"workflow": workflow.State}
+	for _, step := range workflow.Steps {
+		states[step.TaskName] = step.State
+	}
+	return states
+}
+
+func TestSQLiteStore(t *testing.T) {
+	ctx := context.Background()
+	store := testStore(t)
+	now := time.Now()
+	rootID := uuid.New()
+	step := &Step{ID: rootID, RootID: rootID, TaskName: "fetch", State: StateRunning, CreatedAt: now, UpdatedAt: now}
+	require.NoError(t, store.Save(ctx, step))
+	assert.Equal(t, 1, step.Version)
+	assert.ErrorIs(t, store.Save(ctx, &Step{ID: rootID, RootID: rootID, TaskName: "fetch"}), ErrConflict)
+
+	saved, err := store.Get(ctx, rootID, rootID)
+	require.NoError(t, err)
+	assert.Equal(t, "fetch", saved.TaskName)
+	assert.Equal(t, StateRunning, saved.State)
+	assert.Equal(t, uuid.Nil, saved.ParentID)
+	assert.Nil(t, saved.Join)
+	_, err = store.Get(ctx, rootID, uuid.New())
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// Whoever saves first wins, the other reads the step again
+	stale := saved
+	saved.Join = &Message{ID: uuid.New(), TaskName: "publish", Body: []byte{0x1f, 0x8b}, Metadata: map[string]string{"content-encoding": "gzip"}}
+	saved.Pending = 2
+	require.NoError(t, store.Save(ctx, &saved))
+	stale.State = StateSucceeded
+	assert.ErrorIs(t, store.Save(ctx, &stale), ErrConflict)
+	child := &Step{ID: uuid.New(), ParentID: rootID, RootID: rootID, TaskName: "transform", State: StatePending, CreatedAt: now}
+	assert.ErrorIs(t, store.Save(ctx, child, &stale), ErrConflict)
+	_, err = store.Get(ctx, rootID, child.ID)
+	assert.ErrorIs(t, err, ErrNotFound, "nothing is saved when a step conflicts")
+
+	child.Compensation = &Message{ID: uuid.New(), TaskName: "revert", Body: []byte(`{}`)}
+	child.Compensates, child.Attempts = true, 3
+	require.NoError(t, store.Save(ctx, child))
+	steps, err := store.Steps(ctx, rootID)
+	require.NoError(t, err)
+	require.Len(t, steps, 2)
+	assert.Equal(t, saved.Join, steps[0].Join)
+	assert.Equal(t, 2, steps[0].Pending)
+	assert.Equal(t, rootID, steps[1].ParentID)
+	assert.Equal(t, child.Compensation, steps[1].Compensation)
+	assert.True(t, steps[1].Compensates)
+	assert.Equal(t, 3, steps[1].Attempts)
+	_, err = store.Steps(ctx, uuid.New())
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestChainedTasks(t *testing.T) {
+	ctx := context.Background()
+	tracker := NewTracker(testStore(t))
+	fetch := lib.PayloadItem{ID: uuid.New(), TaskName: "fetch"}
+	attempts, err := tracker.Start(ctx, fetch)
+	require.NoError(t, err)
+	assert.Zero(t, attempts, "roots aren't steps yet")
+	_, err = tracker.Workflow(ctx, fetch.ID)
+	assert.ErrorIs(t, err, ErrNotFound, "tasks are only recorded once they return tasks")
+
+	transform := child(fetch, "transform")
+	require.NoError(t, tracker.Spawn(ctx, fetch, []lib.PayloadItem{transform}, nil, nil))
+	due, err := tracker.Complete(ctx, fetch)
+	require.NoError(t, err)
+	assert.Empty(t, due)
+	assert.Equal(t, map[string]State{"workflow": StateWaiting, "fetch": StateWaiting, "transform": StatePending}, states(t, tracker, fetch.ID))
+
+	attempts, err = tracker.Start(ctx, transform)
+	require.NoError(t, err)
+	assert.Equal(t, 1, attempts)
+	publish := child(transform, "publish")
+	require.NoError(t, tracker.Spawn(ctx, transform, []lib.PayloadItem{publish}, nil, nil))
+	_, err = tracker.Complete(ctx, transform)
+	require.NoError(t, err)
+	_, err = tracker.Start(ctx, publish)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]State{"workflow": StateWaiting, "fetch": StateWaiting, "transform": StateWaiting, "publish": StateRunning}, states(t, tracker, fetch.ID))
+
+	_, err = tracker.Complete(ctx, publish)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]State{"workflow": StateSucceeded, "fetch": StateSucceeded, "transform": StateSucceeded, "publish": StateSucceeded}, states(t, tracker, fetch.ID))
+
+	// Redelivered tasks change nothing
+	require.NoError(t, tracker.Spawn(ctx, transform, []lib.PayloadItem{publish}, nil, nil))
+	_, err = tracker.Complete(ctx, publish)
+	require.NoError(t, err)
+	workflow, err := tracker.Workflow(ctx, fetch.ID)
+	require.NoError(t, err)
+	assert.Len(t, workflow.Steps, 3)
+	assert.Equal(t, StateSucceeded, workflow.State)
+}
+
+func TestJoinFiresOnceEveryChildCompleted(t *testing.T) {
+	ctx := context.Background()
+	tracker := NewTracker(testStore(t))
+	fetch := lib.PayloadItem{ID: uuid.New(), TaskName: "fetch"}
+	parts := []lib.PayloadItem{child(fetch, "part-1"), child(fetch, "part-2"), child(fetch, "part-3")}
+	join, publish := joinOf(fetch, "publish")
+	require.NoError(t, tracker.Spawn(ctx, fetch, parts, join, nil))
+	due, err := tracker.Complete(ctx, fetch)
+	require.NoError(t, err)
+	assert.Empty(t, due)
+
+	// The children of a part complete before it does
+	part := child(parts[0], "validate")
+	require.NoError(t, tracker.Spawn(ctx, parts[0], []lib.PayloadItem{part}, nil, nil))
+	due, err = tracker.Complete(ctx, parts[0])
+	require.NoError(t, err)
+	assert.Empty(t, due)
+	due, err = tracker.Complete(ctx, parts[1])
+	require.NoError(t, err)
+	assert.Empty(t, due)
+	due, err = tracker.Complete(ctx, parts[2])
+	require.NoError(t, err)
+	assert.Empty(t, due, "part-1 is waiting for its child")
+
+	due, err = tracker.Complete(ctx, part)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	assert.Equal(t, fetch.ID, due[0].ID)
+	assert.Equal(t, *join, *due[0].Join)
+	assert.Equal(t, StatePending, states(t, tracker, fetch.ID)["publish"])
+
+	// Until it's marked joined, the join is due again should the last child
+	// be redelivered
+	due, err = tracker.Complete(ctx, part)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	require.NoError(t, tracker.MarkJoined(ctx, due[0]))
+	due, err = tracker.Complete(ctx, part)
+	require.NoError(t, err)
+	assert.Empty(t, due)
+
+	assert.Equal(t, StateWaiting, states(t, tracker, fetch.ID)["workflow"], "the workflow completes with its join")
+	_, err = tracker.Start(ctx, publish)
+	require.NoError(t, err)
+	_, err = tracker.Complete(ctx, publish)
+	require.NoError(t, err)
+	workflow, err := tracker.Workflow(ctx, fetch.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StateSucceeded, workflow.State)
+	assert.Len(t, workflow.Steps, 6)
+	for _, step := range workflow.Steps {
+		assert.Equal(t, StateSucceeded, step.State, step.TaskName)
+		assert.Zero(t, step.Pending, step.TaskName)
+	}
+	assert.Equal(t, 4, workflow.Steps[0].Children, "the join is a child of fetch")
+}
+
+func TestSiblingsCompletingConcurrently(t *testing.T) {
+	ctx := context.Background()
+	tracker := NewTracker(testStore(t))
+	fetch := lib.PayloadItem{ID: uuid.New(), TaskName: "fetch"}
+	parts := []lib.PayloadItem{}
+	for i := 0; i < 5; i++ {
+		parts = append(parts, child(fetch, "part"))
+	}
+	join, _ := joinOf(fetch, "publish")
+	require.NoError(t, tracker.Spawn(ctx, fetch, parts, join, nil))
+	_, err := tracker.Complete(ctx, fetch)
+	require.NoError(t, err)
+
+	wg := sync.WaitGroup{}
+	mutex := sync.Mutex{}
+	joins := 0
+	for _, part := range parts {
+		wg.Add(1)
+		go func(part lib.PayloadItem) {
+			defer wg.Done()
+			due, err := tracker.Complete(ctx, part)
+			assert.NoError(t, err)
+			mutex.Lock()
+			defer mutex.Unlock()
+			joins += len(due)
+		}(part)
+	}
+	wg.Wait()
+	assert.GreaterOrEqual(t, joins, 1, "the join is due once every part completed")
+	workflow, err := tracker.Workflow(ctx, fetch.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, workflow.Steps[0].Pending, "only the join is pending")
+}
+
+func TestFailedWorkflowIsCompensatedInReverse(t *testing.T) {
+	ctx := context.Background()
+	tracker := NewTracker(testStore(t))
+	book := lib.PayloadItem{ID: uuid.New(), TaskName: "book"}
+	reserve := child(book, "reserve")
+	release, releasePayload := compensationOf(reserve, "release")
+	require.NoError(t, tracker.Spawn(ctx, book, []lib.PayloadItem{reserve}, nil, map[uuid.UUID]*Message{reserve.ID: release}))
+	_, err := tracker.Complete(ctx, book)
+	require.NoError(t, err)
+	charge := child(reserve, "charge")
+	refund, refundPayload := compensationOf(charge, "refund")
+	require.NoError(t, tracker.Spawn(ctx, reserve, []lib.PayloadItem{charge}, nil, map[uuid.UUID]*Message{charge.ID: refund}))
+	_, err = tracker.Complete(ctx, reserve)
+	require.NoError(t, err)
+	ship := child(charge, "ship")
+	require.NoError(t, tracker.Spawn(ctx, charge, []lib.PayloadItem{ship}, nil, nil))
+	_, err = tracker.Complete(ctx, charge)
+	require.NoError(t, err)
+
+	_, err = tracker.Start(ctx, ship)
+	require.NoError(t, err)
+	due, err := tracker.Fail(ctx, ship)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	assert.Equal(t, *refund, *due[0].Compensation, "the step created last is undone first")
+	assert.Equal(t, map[string]State{"workflow": StateCompensating, "book": StateWaiting, "reserve": StateWaiting, "charge": StateCompensating, "ship": StateFailed, "refund": StatePending}, states(t, tracker, book.ID))
+
+	// Until it's marked sent, the compensation is due again should the
+	// failed task be redelivered
+	due, err = tracker.Fail(ctx, ship)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	require.NoError(t, tracker.MarkCompensationSent(ctx, due[0]))
+	due, err = tracker.Fail(ctx, ship)
+	require.NoError(t, err)
+	assert.Empty(t, due, "one compensation at a time")
+
+	attempts, err := tracker.Start(ctx, refundPayload)
+	require.NoError(t, err)
+	assert.Equal(t, 1, attempts)
+	due, err = tracker.Complete(ctx, refundPayload)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	assert.Equal(t, *release, *due[0].Compensation)
+	require.NoError(t, tracker.MarkCompensationSent(ctx, due[0]))
+
+	due, err = tracker.Complete(ctx, releasePayload)
+	require.NoError(t, err)
+	assert.Empty(t, due)
+	assert.Equal(t, map[string]State{
+		"workflow": StateCompensated, "book": StateWaiting, "reserve": StateCompensated, "charge": StateCompensated,
+		"ship": StateFailed, "refund": StateSucceeded, "release": StateSucceeded,
+	}, states(t, tracker, book.ID))
+}
+
+func TestAbortedWorkflowStopsAndCompensatesLateSteps(t *testing.T) {
+	ctx := context.Background()
+	tracker := NewTracker(testStore(t))
+	fetch := lib.PayloadItem{ID: uuid.New(), TaskName: "fetch"}
+	parts := []lib.PayloadItem{child(fetch, "part-1"), child(fetch, "part-2")}
+	undo, undoPayload := compensationOf(parts[1], "undo")
+	join, _ := joinOf(fetch, "publish")
+	require.NoError(t, tracker.Spawn(ctx, fetch, parts, join, map[uuid.UUID]*Message{parts[1].ID: undo}))
+	_, err := tracker.Complete(ctx, fetch)
+	require.NoError(t, err)
+
+	due, err := tracker.Fail(ctx, parts[0])
+	require.NoError(t, err)
+	assert.Empty(t, due, "part-2 is still being handled")
+	assert.Equal(t, StateCompensating, states(t, tracker, fetch.ID)["workflow"])
+
+	err = tracker.Spawn(ctx, parts[1], []lib.PayloadItem{child(parts[1], "validate")}, nil, nil)
+	assert.ErrorIs(t, err, ErrAborted)
+	due, err = tracker.Complete(ctx, parts[1])
+	require.NoError(t, err)
+	require.Len(t, due, 1, "part-2 is undone rather than joined")
+	assert.Equal(t, *undo, *due[0].Compensation)
+	require.NoError(t, tracker.MarkCompensationSent(ctx, due[0]))
+	_, err = tracker.Complete(ctx, undoPayload)
+	require.NoError(t, err)
+
+	workflow, err := tracker.Workflow(ctx, fetch.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StateCompensated, workflow.State)
+	assert.Len(t, workflow.Steps, 4, "neither validate nor the join were recorded")
+}
+
+func TestFailingCompensationFailsWorkflow(t *testing.T) {
+	ctx := context.Background()
+	tracker := NewTracker(testStore(t))
+	fetch := lib.PayloadItem{ID: uuid.New(), TaskName: "fetch"}
+	transform := child(fetch, "transform")
+	revert, revertPayload := compensationOf(fetch, "revert")
+	require.NoError(t, tracker.Spawn(ctx, fetch, []lib.PayloadItem{transform}, nil, map[uuid.UUID]*Message{fetch.ID: revert}))
+	_, err := tracker.Complete(ctx, fetch)
+	require.NoError(t, err)
+
+	due, err := tracker.Fail(ctx, transform)
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	assert.Equal(t, fetch.ID, due[0].ID, "the root is compensated too")
+	require.NoError(t, tracker.MarkCompensationSent(ctx, due[0]))
+	due, err = tracker.Fail(ctx, revertPayload)
+	require.NoError(t, err)
+	assert.Empty(t, due)
+	assert.Equal(t, StateFailed, states(t, tracker, fetch.ID)["workflow"])
+
+	// Tasks that aren't steps have no workflow to abort
+	due, err = tracker.Fail(ctx, lib.PayloadItem{ID: uuid.New(), TaskName: "fetch"})
+	require.NoError(t, err)
+	assert.Empty(t, due)
+}
+
+func TestNewTrackerWithoutStore(t *testing.T) {
+	assert.Nil(t, NewTracker(nil))
+	store, closeStore, err := OpenStore(context.Background(), Config{})
+	require.NoError(t, err)
+	defer closeStore()
+	assert.Nil(t, store)
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.Empty(t, Config{}.Validate())
+	assert.Empty(t, Config{WorkflowURL: "sqlite:///var/lib/workflows/workflows.db"}.Validate())
+	assert.NotEmpty(t, Config{WorkflowURL: "postgres://workflows"}.Validate())
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+)
+
+type inflightMessageView struct {
+	inflightMessage
+	AgeSeconds float64 `json:"age_seconds"`
+}
+
+type concurrencyRequest struct {
+	Concurrency int `json:"concurrency"`
+}
+
+// adminLoop serves the operator API used to steer a running consumer. Every
+// route requires the shared secret as a bearer token, which token returns.
+func adminLoop(ctx context.Context, addr string, token func(context.Context) (string, error), ctrl *controller) error {
+	log := zerolog.Ctx(ctx)
+	r := chi.NewRouter()
+	r.Use(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := zerolog.Ctx(r.Context()).WithContext(r.Context())
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}, requireBearerToken(token))
+	r.Route("/admin", func(r chi.Router) {
+		r.Get("/status", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, ctrl.status())
+		})
+		r.Post("/pause", func(w http.ResponseWriter, r *http.Request) {
+			zerolog.Ctx(r.Context()).Info().Msg("pausing receiving loop")
+			ctrl.pause()
+			writeJSON(w, http.StatusOK, ctrl.status())
+		})
+		r.Post("/resume", func(w http.ResponseWriter, r *http.Request) {
+			zerolog.Ctx(r.Context()).Info().Msg("resuming receiving loop")
+			ctrl.resume()
+			writeJSON(w, http.StatusOK, ctrl.status())
+		})
+		r.Post("/drain", func(w http.ResponseWriter, r *http.Request) {
+			zerolog.Ctx(r.Context()).Info().Msg("draining consumer")
+			ctrl.drain()
+			writeJSON(w, http.StatusAccepted, ctrl.status())
+		})
+		r.Put("/concurrency", func(w http.ResponseWriter, r *http.Request) {
+			request := concurrencyRequest{}
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]any{
+					"error": "body must be a JSON object with an integer concurrency",
+				})
+				return
+			} else if request.Concurrency < 1 {
+				writeJSON(w, http.StatusBadRequest, map[string]any{
+					"error": "concurrency must be at least 1",
+				})
+				return
+			}
+			zerolog.Ctx(r.Context()).Info().Int("concurrency", request.Concurrency).Msg("changing concurrency")
+			ctrl.setConcurrency(request.Concurrency)
+			writeJSON(w, http.StatusOK, ctrl.status())
+		})
+		r.Get("/inflight", func(w http.ResponseWriter, r *http.Request) {
+			now := time.Now()
+			messages := ctrl.inflightMessages()
+			views := make([]inflightMessageView, 0, len(messages))
+			for _, message := range messages {
+				views = append(views, inflightMessageView{
+					inflightMessage: message,
+					AgeSeconds:      now.Sub(message.StartedAt).Seconds(),
+				})
+			}
+			writeJSON(w, http.StatusOK, views)
+		})
+	})
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           r,
+		ReadHeaderTimeout: time.Second * 5,
+		BaseContext: func(_ net.Listener) context.Context {
+			return ctx
+		},
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Error().Err(err).Msg("could not gracefully shutdown admin server")
+		}
+	}()
+	log.Info().Str("addr", addr).Msg("Starting admin server")
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("admin server stopped unexpectedly: %w", err)
+	}
+	return nil
+}
+
+// requireBearerToken looks the token up on every request, so that a rotated
+// secret is picked up without a restart.
+func requireBearerToken(token func(context.Context) (string, error)) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			current, err := token(r.Context())
+			if err != nil {
+				zerolog.Ctx(r.Context()).Error().Err(err).Msg("could not resolve the admin token")
+				writeJSON(w, http.StatusServiceUnavailable, map[string]any{
+					"error": "unavailable",
+				})
+				return
+			}
+			expected := []byte("Bearer " + current)
+			provided := []byte(strings.TrimSpace(r.Header.Get("Authorization")))
+			if subtle.ConstantTimeCompare(provided, expected) != 1 {
+				zerolog.Ctx(r.Context()).Warn().Str("path", r.URL.Path).Msg("rejected unauthenticated admin request")
+				writeJSON(w, http.StatusUnauthorized, map[string]any{
+					"error": "unauthorized",
+				})
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(data)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminTokenIsLookedUpOnEveryRequest(t *testing.T) {
+	token := "first"
+	var lookupErr error
+	handler := requireBearerToken(func(ctx context.Context) (string, error) {
+		return token, lookupErr
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	request := func(authorization string) int {
+		r := httptest.NewRequest(http.MethodGet, "/admin/status", nil)
+		r.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusNoContent, request("Bearer first"))
+	assert.Equal(t, http.StatusUnauthorized, request("Bearer second"))
+	token = "second"
+	assert.Equal(t, http.StatusNoContent, request("Bearer second"), "rotated tokens are picked up")
+	assert.Equal(t, http.StatusUnauthorized, request("Bearer first"))
+	lookupErr = errors.New("secret store unreachable")
+	assert.Equal(t, http.StatusServiceUnavailable, request("Bearer second"))
+}
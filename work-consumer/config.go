@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/checkpoint"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/claimcheck"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/encryption"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/progress"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/queue"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/workflow"
+)
+
+// Config is the complete configuration of the work-consumer. See CONFIG.md
+// for the generated reference of every key.
+type Config struct {
+	MaxConcurrentCount   int           `env:"MAX_CONCURRENT_COUNT" default:"30" desc:"Number of messages processed concurrently, can be changed at runtime through the admin API"`
+	PreserveOrder        bool          `env:"PRESERVE_ORDER" desc:"Process messages sharing a partition key one at a time, in the order they were received, holding back those following a failed one until it is redelivered. Use with brokers that deliver in order, such as kafka:// and SQS FIFO queues"`
+	MaxDecompressedBytes int           `env:"MAX_DECOMPRESSED_BYTES" default:"16777216" desc:"Largest message body, in bytes, that is decompressed. Larger ones, such as decompression bombs, are left unacknowledged"`
+	LogRedactedFields    []string      `env:"LOG_REDACTED_FIELDS" default:"arguments" desc:"Comma separated payload fields whose values are replaced when the payload is logged. Dotted paths reach into the arguments, e.g. arguments.customer.email"`
+	AdminAddr            string        `env:"ADMIN_ADDR" desc:"Listen address of the admin API, it is disabled when empty"`
+	AdminToken           string        `env:"ADMIN_TOKEN" secret:"true" desc:"Shared secret required as a bearer token by the admin API"`
+	TaskTimeout          time.Duration `env:"TASK_TIMEOUT" default:"4m" desc:"How long handlers may take before their context is done, unless their task registered its own timeout. Must be below VISIBILITY_TIMEOUT, or tasks are redelivered while they still run. Unlimited when zero"`
+	TaskGracePeriod      time.Duration `env:"TASK_GRACE_PERIOD" default:"30s" desc:"How long a handler is waited for once its context is done. Handlers that ignore their context are then abandoned, left running while their worker takes on another task"`
+	MaxAbandonedHandlers int           `env:"MAX_ABANDONED_HANDLERS" default:"10" desc:"Number of abandoned handlers still running at which the consumer reports itself not ready, as they pile up when a dependency is stuck. Unlimited when zero"`
+	WorkflowQueueURL     string        `env:"WORKFLOW_QUEUE_URL" desc:"Queue the tasks returned by handlers are enqueued on, usually the QUEUE_URL of the supplier. Handlers can't return tasks when empty"`
+	WorkflowMaxAttempts  int           `env:"WORKFLOW_MAX_ATTEMPTS" default:"5" desc:"Steps of workflows whose handler failed this many times fail for good, and their workflow is compensated. Steps that are dead-lettered are never compensated, so it cannot exceed RABBIT_DELIVERY_LIMIT and must stay below the maxReceiveCount of an SQS redrive policy. On kafka:// queues, steps are only attempted again once their partition is assigned again. Unlimited when zero"`
+	QueueConfig
+	ClaimCheckConfig
+	EncryptionConfig
+	ProgressConfig
+	CheckpointConfig
+	WorkflowConfig
+}
+
+// The configuration of each lib package is embedded under an alias, as
+// they're all named Config.
+type (
+	QueueConfig      = queue.Config
+	ClaimCheckConfig = claimcheck.Config
+	EncryptionConfig = encryption.Config
+	ProgressConfig   = progress.Config
+	CheckpointConfig = checkpoint.Config
+	WorkflowConfig   = workflow.Config
+)
+
+func (c *Config) Validate() []error {
+	errs := append(c.QueueConfig.Validate(), c.ClaimCheckConfig.Validate()...)
+	errs = append(errs, c.EncryptionConfig.Validate()...)
+	errs = append(errs, c.ProgressConfig.Validate()...)
+	errs = append(errs, c.WorkflowConfig.Validate()...)
+	if c.WorkflowQueueURL != "" {
+		for _, err := range c.workflowQueueConfig().Validate() {
+			errs = append(errs, fmt.Errorf("WORKFLOW_QUEUE_URL: %w", err))
+		}
+	}
+	if c.TaskTimeout < 0 {
+		errs = append(errs, fmt.Errorf("TASK_TIMEOUT cannot be negative, got %s", c.TaskTimeout))
+	} else if c.TaskTimeout > 0 && c.TaskTimeout >= c.VisibilityTimeout {
+		errs = append(errs, fmt.Errorf("TASK_TIMEOUT must be below VISIBILITY_TIMEOUT (%s), or tasks are redelivered while they still run, got %s", c.VisibilityTimeout, c.TaskTimeout))
+	}
+	if c.TaskGracePeriod < 0 {
+		errs = append(errs, fmt.Errorf("TASK_GRACE_PERIOD cannot be negative, got %s", c.TaskGracePeriod))
+	}
+	if c.MaxAbandonedHandlers < 0 {
+		errs = append(errs, fmt.Errorf("MAX_ABANDONED_HANDLERS cannot be negative, got %d", c.MaxAbandonedHandlers))
+	}
+	if c.WorkflowMaxAttempts < 0 {
+		errs = append(errs, fmt.Errorf("WORKFLOW_MAX_ATTEMPTS cannot be negative, got %d", c.WorkflowMaxAttempts))
+	} else if c.RabbitDeliveryLimit > 0 && (c.WorkflowMaxAttempts == 0 || c.WorkflowMaxAttempts > c.RabbitDeliveryLimit) {
+		errs = append(errs, fmt.Errorf("WORKFLOW_MAX_ATTEMPTS must be between 1 and RABBIT_DELIVERY_LIMIT (%d), or steps are dead-lettered before their workflow is compensated, got %d", c.RabbitDeliveryLimit, c.WorkflowMaxAttempts))
+	}
+	if c.MaxConcurrentCount < 1 {
+		errs = append(errs, fmt.Errorf("MAX_CONCURRENT_COUNT must be at least 1, got %d", c.MaxConcurrentCount))
+	}
+	if c.MaxDecompressedBytes < 1 {
+		errs = append(errs, fmt.Errorf("MAX_DECOMPRESSED_BYTES must be at least 1, got %d", c.MaxDecompressedBytes))
+	}
+	if c.AdminAddr != "" && c.AdminToken == "" {
+		errs = append(errs, fmt.Errorf("ADMIN_TOKEN is required when ADMIN_ADDR is set"))
+	}
+	return errs
+}
+
+// validateTimeouts checks the timeouts registered for tasks, keyed by their
+// name, the way Validate checks TASK_TIMEOUT.
+func (c *Config) validateTimeouts(timeouts map[string]time.Duration) error {
+	names := make([]string, 0, len(timeouts))
+	for name := range timeouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	errs := []error{}
+	for _, name := range names {
+		if timeout := timeouts[name]; timeout > 0 && timeout >= c.VisibilityTimeout {
+			errs = append(errs, fmt.Errorf("the timeout of %s must be below VISIBILITY_TIMEOUT (%s), or its tasks are redelivered while they still run, got %s", name, c.VisibilityTimeout, timeout))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// workflowQueueConfig opens the queue of WORKFLOW_QUEUE_URL with the broker
+// settings of the consumer's own.
+func (c *Config) workflowQueueConfig() queue.Config {
+	queueCfg := c.QueueConfig
+	queueCfg.QueueURL = c.WorkflowQueueURL
+	return queueCfg
+}
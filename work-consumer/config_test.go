@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// loadConfig loads the configuration of a consumer of a RabbitMQ quorum
+// queue, with the defaults of every other key.
+func loadConfig(args ...string) error {
+	args = append([]string{
+		"--queue-url=rabbit://data-egress",
+		"--rabbit-server-url=amqp://localhost:5672",
+		"--rabbit-quorum-queues=true",
+	}, args...)
+	return config.Load(context.Background(), "work-consumer", &Config{}, args)
+}
+
+func TestValidateWorkflowMaxAttempts(t *testing.T) {
+	assert.NoError(t, loadConfig())
+	assert.NoError(t, loadConfig("--rabbit-delivery-limit=5"))
+	assert.ErrorContains(t, loadConfig("--rabbit-delivery-limit=4"), "WORKFLOW_MAX_ATTEMPTS", "dead-lettered before it fails for good")
+	assert.ErrorContains(t, loadConfig("--rabbit-delivery-limit=4", "--workflow-max-attempts=0"), "WORKFLOW_MAX_ATTEMPTS", "never fails for good")
+	assert.NoError(t, loadConfig("--rabbit-delivery-limit=4", "--workflow-max-attempts=4"))
+}
+
+func TestValidateTaskTimeout(t *testing.T) {
+	assert.ErrorContains(t, loadConfig("--task-timeout=5m", "--visibility-timeout=5m"), "TASK_TIMEOUT")
+	assert.NoError(t, loadConfig("--task-timeout=4m", "--visibility-timeout=5m"))
+	assert.NoError(t, loadConfig("--task-timeout=0", "--visibility-timeout=5m"), "unlimited")
+}
+
+func TestValidateTimeouts(t *testing.T) {
+	cfg := Config{}
+	cfg.VisibilityTimeout = time.Minute * 5
+	assert.NoError(t, cfg.validateTimeouts(map[string]time.Duration{"fetch": time.Minute * 4, "archive": 0}))
+	err := cfg.validateTimeouts(map[string]time.Duration{"fetch": time.Minute * 5, "transform": time.Hour})
+	assert.ErrorContains(t, err, "the timeout of fetch")
+	assert.ErrorContains(t, err, "the timeout of transform")
+}
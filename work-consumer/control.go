@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"gocloud.dev/pubsub"
+)
+
+var errDraining = errors.New("consumer is draining")
+
+type inflightMessage struct {
+	MessageID string    `json:"message_id"`
+	TaskName  string    `json:"task_name,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+type controllerStatus struct {
+	Paused        bool `json:"paused"`
+	Draining      bool `json:"draining"`
+	Drained       bool `json:"drained"`
+	Concurrency   int  `json:"concurrency"`
+	InflightCount int  `json:"inflight_count"`
+}
+
+// controller coordinates the receiving and processing loops so they can be
+// steered at runtime: receiving can be paused, resumed or drained and the
+// number of concurrently processed messages can be changed.
+type controller struct {
+	mutex          sync.Mutex
+	changed        chan struct{}
+	drainRequested chan struct{}
+	paused         bool
+	draining       bool
+	drained        bool
+	concurrency    int
+	nextID         uint64
+	inflight       map[uint64]*inflightMessage
+}
+
+func newController(concurrency int) *controller {
+	return &controller{
+		changed:        make(chan struct{}),
+		drainRequested: make(chan struct{}),
+		concurrency:    concurrency,
+		inflight:       map[uint64]*inflightMessage{},
+	}
+}
+
+// notify wakes up everything waiting on a state change. The mutex must be held.
+func (c *controller) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// waitFor blocks until condition holds, re-evaluating it on every state
+// change. The condition is evaluated with the mutex held and the mutex is
+// still held when waitFor returns without error.
+func (c *controller) waitFor(ctx context.Context, condition func() bool) error {
+	c.mutex.Lock()
+	for !condition() {
+		changed := c.changed
+		c.mutex.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+		c.mutex.Lock()
+	}
+	return nil
+}
+
+// awaitReceiving blocks while receiving is paused. It returns errDraining
+// once a drain has been requested, signalling the receiving loop to stop.
+func (c *controller) awaitReceiving(ctx context.Context) error {
+	if err := c.waitFor(ctx, func() bool { return !c.paused || c.draining }); err != nil {
+		return err
+	}
+	defer c.mutex.Unlock()
+	if c.draining {
+		return errDraining
+	}
+	return nil
+}
+
+// acquire blocks until there is room for another in-flight message and
+// returns an identifier that must be handed back to release.
+func (c *controller) acquire(ctx context.Context, message *pubsub.Message) (uint64, error) {
+	if err := c.waitFor(ctx, func() bool { return len(c.inflight) < c.concurrency }); err != nil {
+		return 0, err
+	}
+	defer c.mutex.Unlock()
+	c.nextID += 1
+	c.inflight[c.nextID] = &inflightMessage{
+		MessageID: message.LoggableID,
+		StartedAt: time.Now(),
+	}
+	return c.nextID, nil
+}
+
+func (c *controller) setTaskName(id uint64, taskName string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if message, isPresent := c.inflight[id]; isPresent {
+		message.TaskName = taskName
+	}
+}
+
+func (c *controller) release(id uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.inflight, id)
+	c.notify()
+}
+
+func (c *controller) pause() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.paused = true
+	c.notify()
+}
+
+func (c *controller) resume() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.paused = false
+	c.notify()
+}
+
+func (c *controller) drain() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.draining {
+		return
+	}
+	c.draining = true
+	close(c.drainRequested)
+	c.notify()
+}
+
+// receivingContext derives a context that is canceled as soon as a drain is
+// requested, so that a receive blocked on an idle queue gives up promptly.
+func (c *controller) receivingContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-c.drainRequested:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (c *controller) setConcurrency(concurrency int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.concurrency = concurrency
+	c.notify()
+}
+
+func (c *controller) markDrained() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.drained = true
+	c.notify()
+}
+
+func (c *controller) status() controllerStatus {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return controllerStatus{
+		Paused:        c.paused,
+		Draining:      c.draining,
+		Drained:       c.drained,
+		Concurrency:   c.concurrency,
+		InflightCount: len(c.inflight),
+	}
+}
+
+// inflightMessages lists the messages currently being processed, oldest first.
+func (c *controller) inflightMessages() []inflightMessage {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	messages := make([]inflightMessage, 0, len(c.inflight))
+	for _, message := range c.inflight {
+		messages = append(messages, *message)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].StartedAt.Before(messages[j].StartedAt)
+	})
+	return messages
+}
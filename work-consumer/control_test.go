@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/pubsub"
+)
+
+func TestControllerConcurrency(t *testing.T) {
+	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer ctxCancel()
+	ctrl := newController(1)
+
+	first, err := ctrl.acquire(ctx, &pubsub.Message{LoggableID: "first"})
+	require.NoError(t, err)
+	ctrl.setTaskName(first, "foobar")
+
+	blockedCtx, blockedCancel := context.WithTimeout(ctx, time.Millisecond*50)
+	defer blockedCancel()
+	_, err = ctrl.acquire(blockedCtx, &pubsub.Message{LoggableID: "second"})
+	require.ErrorIs(t, err, context.DeadlineExceeded, "second acquire should block at concurrency 1")
+
+	inflight := ctrl.inflightMessages()
+	require.Len(t, inflight, 1)
+	assert.Equal(t, "first", inflight[0].MessageID)
+	assert.Equal(t, "foobar", inflight[0].TaskName)
+
+	ctrl.setConcurrency(2)
+	second, err := ctrl.acquire(ctx, &pubsub.Message{LoggableID: "second"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, ctrl.status().InflightCount)
+
+	ctrl.release(first)
+	ctrl.release(second)
+	assert.Equal(t, 0, ctrl.status().InflightCount)
+}
+
+func TestControllerPauseAndDrain(t *testing.T) {
+	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer ctxCancel()
+	ctrl := newController(1)
+	require.NoError(t, ctrl.awaitReceiving(ctx))
+
+	ctrl.pause()
+	resumed := make(chan error)
+	go func() {
+		resumed <- ctrl.awaitReceiving(ctx)
+	}()
+	select {
+	case <-resumed:
+		t.Fatal("receiving should block while paused")
+	case <-time.After(time.Millisecond * 50):
+	}
+	ctrl.resume()
+	require.NoError(t, <-resumed)
+
+	ctrl.pause()
+	receivingCtx, receivingCancel := ctrl.receivingContext(ctx)
+	defer receivingCancel()
+	ctrl.drain()
+	assert.ErrorIs(t, ctrl.awaitReceiving(ctx), errDraining, "draining should release a paused receiver")
+	<-receivingCtx.Done()
+	assert.True(t, ctrl.status().Draining)
+}
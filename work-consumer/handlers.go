@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/task"
+)
+
+// newHandlers returns the handler of every task the consumer knows. Tasks
+// without a handler of their own are acknowledged once logged.
+func newHandlers() *task.Registry {
+	handlers := task.NewRegistry(func(ctx context.Context, t *task.Task) (*task.Next, error) {
+		return nil, nil
+	})
+	// Register the handlers of your tasks here, the tasks undoing them
+	// should their workflow fail and how long they may take, e.g.
+	//
+	//	handlers.Handle("transform", transform)
+	//	handlers.Compensate("transform", "discard")
+	//	handlers.Timeout("transform", 10*time.Minute)
+	return handlers
+}
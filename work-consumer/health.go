@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/health"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+)
+
+const (
+	loopStarting = "starting"
+	loopRunning  = "running"
+	loopStopped  = "stopped"
+)
+
+// loopStatus tracks the lifecycle of one of the consumer loops so that it
+// can be reported through the readiness endpoint.
+type loopStatus struct {
+	name  string
+	state atomic.Value
+}
+
+func newLoopStatus(name string) *loopStatus {
+	ls := &loopStatus{name: name}
+	ls.Set(loopStarting)
+	return ls
+}
+
+func (ls *loopStatus) Set(state string) {
+	ls.state.Store(state)
+}
+
+func (ls *loopStatus) Get() string {
+	return ls.state.Load().(string)
+}
+
+func (ls *loopStatus) Probe(ctx context.Context) error {
+	if state := ls.Get(); state != loopRunning {
+		return fmt.Errorf("%s loop is %s", ls.name, state)
+	}
+	return nil
+}
+
+func healthLoop(ctx context.Context, addr string, checker *health.Checker) error {
+	log := zerolog.Ctx(ctx)
+	mux := http.NewServeMux()
+	mux.Handle(health.LivenessPath, checker.LivenessHandler())
+	mux.Handle(health.ReadinessPath, checker.ReadinessHandler())
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * 5,
+		BaseContext: func(_ net.Listener) context.Context {
+			return ctx
+		},
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Error().Err(err).Msg("could not gracefully shutdown health server")
+		}
+	}()
+	log.Info().Str("addr", addr).Msg("Starting health server")
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("health server stopped unexpectedly: %w", err)
+	}
+	return nil
+}
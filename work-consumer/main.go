@@ -2,41 +2,124 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
-	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/envutil"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/checkpoint"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/claimcheck"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/config"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/encryption"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/envelope"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/health"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/progress"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/secrets"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/task"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/workflow"
 	_ "github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/zerologutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/rs/zerolog"
 	"gocloud.dev/pubsub"
 	"golang.org/x/sync/errgroup"
 )
 
 func main() {
+	health.RunCommandIfRequested(os.Args, "http://127.0.0.1:8080")
+
 	initCtx, cancel := context.WithTimeout(context.Background(), time.Second*15)
 	initCtx = zerolog.Ctx(initCtx).With().Str("scope", "initialization").Logger().WithContext(initCtx)
 	defer cancel()
 	initLog := zerolog.Ctx(initCtx)
 
-	maxConcurrentCount := envutil.Int(initCtx, "MAX_CONCURRENT_COUNT", 30)
-	queueURL := envutil.Must(initCtx, "QUEUE_URL")
-	queue, err := InitializeQueueSubscription(initCtx, queueURL)
+	resolver, err := secrets.NewResolver(initCtx, time.Minute*5)
+	if err != nil {
+		initLog.Fatal().Err(err).Msg("could not initialize secrets resolver")
+	}
+	cfg := Config{}
+	references := map[string]string{}
+	if err := config.Load(initCtx, "work-consumer", &cfg, os.Args[1:], config.WithSecretResolver(resolver), config.WithSecretReferences(references)); errors.Is(err, config.ErrPrinted) {
+		return
+	} else if err != nil {
+		initLog.Fatal().Err(err).Msg("could not load configuration")
+	}
+	queue, err := InitializeQueueSubscription(initCtx, cfg)
 	if err != nil {
 		initLog.Fatal().Err(err).Msg("failed to initialize queue client")
 	}
+	claims, closeClaims, err := InitializeClaimCheckStore(initCtx, cfg)
+	if err != nil {
+		initLog.Fatal().Err(err).Msg("failed to initialize claim check store")
+	}
+	defer closeClaims()
+	encrypter, err := InitializeEncrypter(initCtx, cfg)
+	if err != nil {
+		initLog.Fatal().Err(err).Msg("failed to initialize encryption")
+	}
+	brokerProbe, err := InitializeReadinessProbe(initCtx, cfg)
+	if err != nil {
+		initLog.Fatal().Err(err).Msg("failed to initialize readiness probe")
+	}
+	checkpoints, closeCheckpoints, err := InitializeCheckpointStore(initCtx, cfg)
+	if err != nil {
+		initLog.Fatal().Err(err).Msg("failed to initialize checkpoint store")
+	}
+	defer closeCheckpoints()
+	progressTopic, err := progress.OpenTopic(initCtx, cfg.ProgressConfig, cfg.QueueConfig)
+	if err != nil {
+		initLog.Fatal().Err(err).Msg("failed to initialize progress reporting")
+	}
+	workflows, closeWorkflows, err := InitializeWorkflowTracker(initCtx, cfg)
+	if err != nil {
+		initLog.Fatal().Err(err).Msg("failed to initialize workflow store")
+	}
+	defer closeWorkflows()
+	codecs := envelope.NewRegistry(envelope.WithDecompressionLimit(cfg.MaxDecompressedBytes))
+	followUps, err := newEnqueuer(initCtx, cfg, codecs, encrypter, claims)
+	if err != nil {
+		initLog.Fatal().Err(err).Msg("failed to initialize workflow queue")
+	}
+	handlers := newHandlers()
+	if err := cfg.validateTimeouts(handlers.Timeouts()); err != nil {
+		initLog.Fatal().Err(err).Msg("invalid task timeouts")
+	}
+	proc := &processor{
+		claims:       claims,
+		codecs:       codecs,
+		encrypter:    encrypter,
+		handlers:     handlers,
+		checkpoints:  checkpoints,
+		progress:     progress.NewReporter(progressTopic),
+		enqueuer:     followUps,
+		workflows:    workflows,
+		maxAttempts:  cfg.WorkflowMaxAttempts,
+		timeout:      cfg.TaskTimeout,
+		gracePeriod:  cfg.TaskGracePeriod,
+		maxAbandoned: cfg.MaxAbandonedHandlers,
+		redacted:     cfg.LogRedactedFields,
+	}
+	receivingStatus := newLoopStatus("receiving")
+	processingStatus := newLoopStatus("processing")
+	checker := health.NewChecker(time.Second * 5)
+	checker.Add("broker", brokerProbe)
+	checker.Add("receiving_loop", receivingStatus.Probe)
+	checker.Add("processing_loop", processingStatus.Probe)
+	checker.Add("abandoned_handlers", proc.abandonedProbe)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	ctx = zerolog.Ctx(context.Background()).With().Str("scope", "working").Logger().WithContext(ctx)
 	defer cancel()
 
-	messagesChannel := make(chan *pubsub.Message, maxConcurrentCount)
-	defer close(messagesChannel)
+	messagesChannel := make(chan *pubsub.Message, cfg.MaxConcurrentCount)
+	ctrl := newController(cfg.MaxConcurrentCount)
+	ordering := newKeyedSerializer(cfg.VisibilityTimeout)
 
 	signals := make(chan os.Signal, 1)
 	defer close(signals)
@@ -56,19 +139,41 @@ func main() {
 	}()
 
 	eg, ctx := errgroup.WithContext(ctx)
-	eg.SetLimit(2)
+	eg.SetLimit(4)
+	eg.Go(func() error {
+		ctx := zerolog.Ctx(ctx).With().Str("loop", "health").Logger().WithContext(ctx)
+		return healthLoop(ctx, ":8080", checker)
+	})
+	if cfg.AdminAddr != "" {
+		eg.Go(func() error {
+			ctx := zerolog.Ctx(ctx).With().Str("loop", "admin").Logger().WithContext(ctx)
+			// Resolved again once the cached value is older than the
+			// refresh interval of the resolver
+			token := func(ctx context.Context) (string, error) {
+				return resolver.Resolve(ctx, references["ADMIN_TOKEN"])
+			}
+			return adminLoop(ctx, cfg.AdminAddr, token, ctrl)
+		})
+	}
 	eg.Go(func() error {
 		ctx := zerolog.Ctx(ctx).With().Str("loop", "receiving").Logger().WithContext(ctx)
-		if err := receivingLoop(ctx, queue, messagesChannel); err != nil {
+		if err := receivingLoop(ctx, queue, messagesChannel, ctrl, receivingStatus); err != nil {
 			return fmt.Errorf("a problem occurred in the recieving loop: %v", err)
 		}
 		return nil
 	})
 	eg.Go(func() error {
 		ctx := zerolog.Ctx(ctx).With().Str("loop", "processing").Logger().WithContext(ctx)
-		if err := processingLoop(ctx, messagesChannel); err != nil {
+		if err := processingLoop(ctx, messagesChannel, ctrl, ordering, cfg.PreserveOrder, proc, processingStatus); err != nil {
 			return fmt.Errorf("a problem occurred in the proccessing loop")
 		}
+		if ctrl.status().Draining {
+			// Everything that was received has been processed, take the
+			// remaining servers down with us.
+			zerolog.Ctx(ctx).Info().Msg("drain complete, initiating shutdown")
+			ctrl.markDrained()
+			cancel()
+		}
 		return nil
 	})
 
@@ -77,17 +182,49 @@ func main() {
 		log := zerolog.Ctx(ctx)
 		log.Fatal().Err(err).Msg("a problem occurred and we will now exit")
 	}
+	// Flushes outstanding acknowledgements and, for Kafka, leaves the
+	// consumer group so the partitions are rebalanced to the other replicas
+	// right away rather than after the session times out.
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer shutdownCancel()
+	if err := queue.Shutdown(shutdownCtx); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("could not shut down the subscription cleanly")
+	}
+	if progressTopic != nil {
+		if err := progressTopic.Shutdown(shutdownCtx); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("could not send the remaining progress events")
+		}
+	}
+	if followUps != nil {
+		if err := followUps.topic.Shutdown(shutdownCtx); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("could not shut down the workflow queue cleanly")
+		}
+	}
 	initLog.Info().Msg("Exiting")
 }
 
-func receivingLoop(ctx context.Context, queue *pubsub.Subscription, messagesChannel chan<- *pubsub.Message) error {
+// receivingLoop owns messagesChannel and closes it once it stops receiving,
+// either because of shutdown or because a drain was requested.
+func receivingLoop(ctx context.Context, queue *pubsub.Subscription, messagesChannel chan<- *pubsub.Message, ctrl *controller, status *loopStatus) error {
 	log := zerolog.Ctx(ctx)
 	log.Info().Msg("Starting loop")
+	status.Set(loopRunning)
+	defer status.Set(loopStopped)
+	defer close(messagesChannel)
+	ctx, cancel := ctrl.receivingContext(ctx)
+	defer cancel()
 	for {
+		if err := ctrl.awaitReceiving(ctx); errors.Is(err, errDraining) {
+			log.Info().Msg("drain requested, no longer receiving")
+			return nil
+		}
 		select {
 		case <-ctx.Done():
 			err := ctx.Err()
-			if errors.Is(err, context.Canceled) {
+			if ctrl.status().Draining {
+				log.Info().Msg("drain requested, no longer receiving")
+				return nil
+			} else if errors.Is(err, context.Canceled) {
 				log.Info().Msg("shutting down receiving loop")
 				return nil
 			} else if err != nil {
@@ -99,15 +236,25 @@ func receivingLoop(ctx context.Context, queue *pubsub.Subscription, messagesChan
 			message, err := queue.Receive(ctx)
 			if err != nil {
 				log.Error().Err(err).Msg("could not read from subscription")
+				continue
 			}
 			messagesChannel <- message
 		}
 	}
 }
 
-func processingLoop(ctx context.Context, messagesChannel <-chan *pubsub.Message) error {
+// processingLoop processes every message in its own goroutine. When
+// preserveOrder is set, messages sharing a partition key are processed one
+// at a time in the order they were received; they still count against the
+// concurrency limit while they wait for their turn.
+func processingLoop(ctx context.Context, messagesChannel <-chan *pubsub.Message, ctrl *controller, ordering *keyedSerializer, preserveOrder bool, proc *processor, status *loopStatus) error {
 	log := zerolog.Ctx(ctx)
 	log.Info().Msg("Starting loop")
+	status.Set(loopRunning)
+	defer status.Set(loopStopped)
+	// Let in-flight messages finish before reporting that we've stopped
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
 	for {
 		select {
 		case <-ctx.Done():
@@ -119,30 +266,224 @@ func processingLoop(ctx context.Context, messagesChannel <-chan *pubsub.Message)
 				return fmt.Errorf("something caused the context to err out: %v", err)
 			}
 			return nil
-		case message := <-messagesChannel:
-			msgCtx := log.With().Str("message_id", message.LoggableID).Logger().WithContext(ctx)
-			if err := processMessage(msgCtx, message); err != nil {
-				log.Error().Err(err).Msg("could not process message")
+		case message, isOpen := <-messagesChannel:
+			if !isOpen {
+				log.Info().Msg("receiving has stopped and every message was handed off, shutting down processing loop")
+				return nil
+			}
+			id, err := ctrl.acquire(ctx, message)
+			if err != nil {
+				log.Info().Msg("shutting down processing loop")
+				return nil
+			}
+			key := ""
+			if preserveOrder {
+				key = message.Metadata[lib.PartitionKeyMetadata]
 			}
+			msgCtx := log.With().Str("message_id", message.LoggableID).Logger().WithContext(ctx)
+			wg.Add(1)
+			ordering.Go(key, orderedWork{
+				fingerprint: sha256.Sum256(message.Body),
+				nackable:    message.Nackable(),
+				run: func() bool {
+					defer wg.Done()
+					defer ctrl.release(id)
+					err := proc.processMessage(msgCtx, message, func(taskName string) {
+						ctrl.setTaskName(id, taskName)
+					})
+					if err != nil {
+						zerolog.Ctx(msgCtx).Error().Err(err).Msg("could not process message")
+					}
+					return err == nil || errors.Is(err, errFailedForGood)
+				},
+				skip: func() {
+					defer wg.Done()
+					defer ctrl.release(id)
+					zerolog.Ctx(msgCtx).Info().Msg("holding back message until the failed one before it is redelivered")
+					if message.Nackable() {
+						message.Nack()
+					}
+				},
+			})
 		}
 	}
 }
 
-func processMessage(ctx context.Context, message *pubsub.Message) error {
+// processor holds what processing a message depends on.
+type processor struct {
+	claims      *claimcheck.Store
+	codecs      *envelope.Registry
+	encrypter   *encryption.Encrypter
+	handlers    *task.Registry
+	checkpoints *checkpoint.Store
+	progress    *progress.Reporter
+	// enqueuer is nil without WORKFLOW_QUEUE_URL, and workflows without
+	// WORKFLOW_URL
+	enqueuer  *enqueuer
+	workflows *workflow.Tracker
+	// maxAttempts fails the steps of workflows for good once reached,
+	// unlimited when zero
+	maxAttempts int
+	// timeout is how long handlers may take unless their task registered
+	// its own, unlimited when zero
+	timeout time.Duration
+	// gracePeriod is how long a handler is waited for once its context is
+	// done, before it is abandoned
+	gracePeriod time.Duration
+	// abandoned counts the handlers that were abandoned and still run, the
+	// consumer isn't ready once there are maxAbandoned of them
+	abandoned    atomic.Int64
+	maxAbandoned int
+	// redacted are the payload fields left out of the logs
+	redacted []string
+}
+
+func (p *processor) processMessage(ctx context.Context, message *pubsub.Message, onDecoded func(taskName string)) error {
 	log := zerolog.Ctx(ctx)
-	body := message.Body
-	if body == nil {
+	body, err := p.claims.Body(ctx, message)
+	if err != nil {
+		return p.retry(message, fmt.Errorf("could not retrieve message body: %w", err))
+	} else if body == nil {
 		return fmt.Errorf("mesage body was nil")
 	} else if len(body) == 0 {
 		return fmt.Errorf("message body was length zero")
 	}
-	payload := lib.PayloadItem{}
-	if err := json.Unmarshal(body, &payload); err != nil {
-		return fmt.Errorf("could not parse JSON from message body: %w", err)
+	// Left unacknowledged when it can't be decoded, as it may have been sent
+	// by a newer producer that a replica rolled out after us understands
+	payload, err := p.codecs.Decode(body, message.Metadata)
+	if err != nil {
+		return fmt.Errorf("could not decode message body: %w", err)
+	}
+	if err := p.encrypter.Open(ctx, &payload, message.Metadata); err != nil {
+		return fmt.Errorf("could not decrypt arguments: %w", err)
 	}
+	onDecoded(payload.TaskName)
+	// Handlers report how far along they are through progress.Report
+	ctx = progress.WithTask(ctx, p.progress, payload.ID)
+	if payload.Deadline != nil && !time.Now().Before(*payload.Deadline) {
+		return p.fail(ctx, message, payload, fmt.Errorf("its deadline %s passed before it started", payload.Deadline.Format(time.RFC3339)))
+	}
+	// Retried when it can't be loaded, rather than starting over
+	latest, err := p.checkpoints.Load(ctx, payload.ID)
+	if err != nil {
+		return p.retry(message, err)
+	} else if latest != nil {
+		log.Info().Msg("resuming task from its checkpoint")
+	}
+	p.report(ctx, progress.Event{TaskID: payload.ID, State: progress.StateRunning})
+	attempts := p.startStep(ctx, payload)
+	next, err := p.handle(ctx, payload, latest)
+	if err != nil && (task.IsPermanent(err) || (p.maxAttempts > 0 && attempts >= p.maxAttempts)) {
+		return p.fail(ctx, message, payload, err)
+	} else if err != nil {
+		return p.retry(message, fmt.Errorf("task %s failed: %w", payload.TaskName, err))
+	}
+	// Retried when they can't be enqueued, the handler runs again and
+	// returns the same tasks, which keep their IDs
+	contentType := message.Metadata[envelope.ContentTypeMetadata]
+	if contentType == "" {
+		contentType = envelope.ContentTypeJSON
+	}
+	if err := p.followUp(ctx, payload, next, contentType); err != nil {
+		return p.retry(message, fmt.Errorf("could not enqueue the tasks following %s: %w", payload.TaskName, err))
+	}
+	log.Info().Any("payload", redact(payload, p.redacted)).Msg("successfully processed")
 	// All work now done, be sure to acknoledge the message so that it
 	// is removed from the queue
-	defer message.Ack()
-	log.Info().Any("payload", payload).Msg("successfully processed")
+	message.Ack()
+	p.report(ctx, progress.Event{TaskID: payload.ID, State: progress.StateSucceeded})
+	p.cleanUp(ctx, payload)
+	return nil
+}
+
+// abandonedHandlers mirrors processor.abandoned for the metrics.
+var abandonedHandlers = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "consumer_abandoned_handlers",
+	Help: "Handlers that were abandoned as they ignored their context and are still running",
+})
+
+// abandonedProbe fails once maxAbandoned handlers were abandoned and still
+// run, which they may do for good when a dependency is stuck.
+func (p *processor) abandonedProbe(ctx context.Context) error {
+	if running := p.abandoned.Load(); p.maxAbandoned > 0 && running >= int64(p.maxAbandoned) {
+		return fmt.Errorf("%d abandoned handlers are still running", running)
+	}
 	return nil
 }
+
+// retry has the broker redeliver the message right away when it can. Left
+// unacknowledged, RabbitMQ only redelivers it once the channel closes, so its
+// delivery count wouldn't go up. Kafka can't, the message is only redelivered
+// once its partition is assigned again.
+func (p *processor) retry(message *pubsub.Message, err error) error {
+	if message.Nackable() {
+		message.Nack()
+	}
+	return err
+}
+
+// handle runs the handler of payload until its deadline, resuming from the
+// latest checkpoint. Handlers that overran the deadline of their task failed
+// for good, while those that timed out may succeed once redelivered.
+func (p *processor) handle(ctx context.Context, payload lib.PayloadItem, latest []byte) (*task.Next, error) {
+	started := time.Now()
+	deadline, ok := p.handlers.Deadline(payload, started, p.timeout)
+	if !ok {
+		return p.handlers.Lookup(payload.TaskName)(ctx, task.New(payload, latest, p.checkpoints))
+	}
+	handlerCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	// Run aside, so that a handler ignoring its context doesn't hold on to
+	// its worker for good
+	type result struct {
+		next *task.Next
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		next, err := p.handlers.Lookup(payload.TaskName)(handlerCtx, task.New(payload, latest, p.checkpoints))
+		done <- result{next: next, err: err}
+	}()
+	var handled result
+	select {
+	case handled = <-done:
+	case <-handlerCtx.Done():
+		select {
+		case handled = <-done:
+		case <-time.After(p.gracePeriod):
+			running := p.abandoned.Add(1)
+			abandonedHandlers.Inc()
+			zerolog.Ctx(ctx).Error().Dur("grace_period", p.gracePeriod).Int64("abandoned_handlers", running).Msg("abandoning handler that ignores its context, it is left running")
+			go func() {
+				<-done
+				p.abandoned.Add(-1)
+				abandonedHandlers.Dec()
+				zerolog.Ctx(ctx).Warn().Dur("took", time.Since(started).Round(time.Millisecond)).Msg("abandoned handler returned")
+			}()
+			handled.err = fmt.Errorf("abandoned its handler %s after its context was done: %w", p.gracePeriod, handlerCtx.Err())
+		}
+	}
+	next, err := handled.next, handled.err
+	if err == nil || !errors.Is(handlerCtx.Err(), context.DeadlineExceeded) {
+		return next, err
+	} else if payload.Deadline != nil && !time.Now().Before(*payload.Deadline) {
+		return nil, task.Permanent(fmt.Errorf("deadline %s passed: %w", payload.Deadline.Format(time.RFC3339), err))
+	}
+	return nil, fmt.Errorf("timed out after %s: %w", time.Since(started).Round(time.Millisecond), err)
+}
+
+// cleanUp deletes what was kept for the task of an acknowledged message.
+func (p *processor) cleanUp(ctx context.Context, payload lib.PayloadItem) {
+	log := zerolog.Ctx(ctx)
+	if err := p.checkpoints.Delete(ctx, payload.ID); err != nil {
+		// The bucket's lifecycle rules take care of it eventually
+		log.Warn().Err(err).Msg("could not clean up checkpoint")
+	}
+}
+
+// report sends a progress event, which is not worth failing the task over.
+func (p *processor) report(ctx context.Context, event progress.Event) {
+	if err := p.progress.Send(ctx, event); err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("state", string(event.State)).Msg("could not report progress")
+	}
+}
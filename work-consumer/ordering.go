@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// orderedWork is the processing of one message by a keyedSerializer.
+type orderedWork struct {
+	// fingerprint identifies the message across redeliveries
+	fingerprint [32]byte
+	// run processes the message, reporting whether it was settled: acked
+	// because it succeeded or failed for good
+	run func() (settled bool)
+	// skip hands the message back to the broker unprocessed, as the work
+	// before it failed and is yet to be redelivered
+	skip func()
+	// nackable is whether the broker redelivers the message of run right
+	// away when it isn't settled
+	nackable bool
+}
+
+// blockage is the message whose failure holds back the later work of a key.
+type blockage struct {
+	fingerprint [32]byte
+	// until is when the key is let go, should the message not come back by
+	// then. It is zero for messages redelivered only once the broker assigns
+	// them again, which the key waits for however long it takes.
+	until time.Time
+}
+
+// keyedSerializer runs work sharing a key one at a time, in the order it was
+// submitted, while work with different keys runs concurrently. Work without a
+// key is never held back. Once work fails, the later work of its key is
+// skipped until the failed message is redelivered and settled, or holdFor
+// passed and another replica may have taken it.
+type keyedSerializer struct {
+	holdFor time.Duration
+	now     func() time.Time
+
+	mutex sync.Mutex
+	// tails holds, per key, a channel closed once the most recently
+	// submitted work for that key has finished
+	tails   map[string]chan struct{}
+	blocked map[string]blockage
+}
+
+func newKeyedSerializer(holdFor time.Duration) *keyedSerializer {
+	return &keyedSerializer{
+		holdFor: holdFor,
+		now:     time.Now,
+		tails:   map[string]chan struct{}{},
+		blocked: map[string]blockage{},
+	}
+}
+
+// Go runs the work in its own goroutine once the work submitted before it
+// with the same key has finished.
+func (ks *keyedSerializer) Go(key string, work orderedWork) {
+	if key == "" {
+		go work.run()
+		return
+	}
+	ks.mutex.Lock()
+	previous := ks.tails[key]
+	done := make(chan struct{})
+	ks.tails[key] = done
+	ks.mutex.Unlock()
+	go func() {
+		defer func() {
+			ks.mutex.Lock()
+			defer ks.mutex.Unlock()
+			close(done)
+			if ks.tails[key] == done {
+				delete(ks.tails, key)
+			}
+		}()
+		if previous != nil {
+			<-previous
+		}
+		if !ks.admits(key, work.fingerprint) {
+			work.skip()
+			return
+		}
+		settled := work.run()
+		ks.mutex.Lock()
+		defer ks.mutex.Unlock()
+		if settled {
+			delete(ks.blocked, key)
+			return
+		}
+		blocked := blockage{fingerprint: work.fingerprint}
+		if work.nackable {
+			blocked.until = ks.now().Add(ks.holdFor)
+		}
+		ks.blocked[key] = blocked
+	}()
+}
+
+// admits reports whether the work of the message with fingerprint may run,
+// which it may unless an earlier message of its key failed.
+func (ks *keyedSerializer) admits(key string, fingerprint [32]byte) bool {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	blocked, isBlocked := ks.blocked[key]
+	if isBlocked && !blocked.until.IsZero() && ks.now().After(blocked.until) {
+		delete(ks.blocked, key)
+		return true
+	}
+	return !isBlocked || blocked.fingerprint == fingerprint
+}
+
+// pending is the number of keys with work submitted or running.
+func (ks *keyedSerializer) pending() int {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	return len(ks.tails)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha256"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// succeeding is work whose message is always settled.
+func succeeding(fn func()) orderedWork {
+	return orderedWork{run: func() bool {
+		fn()
+		return true
+	}}
+}
+
+func TestKeyedSerializerPreservesOrderPerKey(t *testing.T) {
+	ks := newKeyedSerializer(time.Minute)
+	mutex := sync.Mutex{}
+	order := map[string][]int{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		i := i
+		for _, key := range []string{"a", "b"} {
+			key := key
+			wg.Add(1)
+			ks.Go(key, succeeding(func() {
+				defer wg.Done()
+				// Later work finishing sooner would reveal reordering
+				time.Sleep(time.Duration(50-i) * time.Microsecond * 10)
+				mutex.Lock()
+				defer mutex.Unlock()
+				order[key] = append(order[key], i)
+			}))
+		}
+	}
+	wg.Wait()
+	for _, key := range []string{"a", "b"} {
+		assert.IsIncreasing(t, order[key], "work for key %s ran out of order", key)
+		assert.Len(t, order[key], 50)
+	}
+	assert.Eventually(t, func() bool { return ks.pending() == 0 }, time.Second, time.Millisecond)
+}
+
+func TestKeyedSerializerRunsDifferentKeysConcurrently(t *testing.T) {
+	ks := newKeyedSerializer(time.Minute)
+	release := make(chan struct{})
+	started := make(chan string, 2)
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	for _, key := range []string{"a", "b"} {
+		key := key
+		ks.Go(key, succeeding(func() {
+			defer wg.Done()
+			started <- key
+			<-release
+		}))
+	}
+	// Both start even though neither has finished
+	<-started
+	<-started
+	close(release)
+	wg.Wait()
+}
+
+func TestKeyedSerializerHoldsBackWorkBehindFailures(t *testing.T) {
+	for name, nackable := range map[string]bool{"nackable": true, "not nackable": false} {
+		t.Run(name, func(t *testing.T) {
+			ks := newKeyedSerializer(time.Minute)
+			now := time.Now()
+			ks.now = func() time.Time { return now }
+			events := make(chan string, 10)
+			message := func(name string, settles bool) orderedWork {
+				return orderedWork{
+					fingerprint: sha256.Sum256([]byte(name)),
+					nackable:    nackable,
+					run: func() bool {
+						events <- "ran " + name
+						return settles
+					},
+					skip: func() { events <- "skipped " + name },
+				}
+			}
+			next := func() string {
+				select {
+				case event := <-events:
+					return event
+				case <-time.After(time.Second * 5):
+					require.FailNow(t, "no work finished")
+					return ""
+				}
+			}
+
+			ks.Go("a", message("1", false))
+			ks.Go("a", message("2", true))
+			ks.Go("b", message("3", true))
+			received := []string{next(), next(), next()}
+			assert.Subset(t, received, []string{"ran 1", "skipped 2", "ran 3"}, "other keys aren't held back")
+			assert.Less(t, slices.Index(received, "ran 1"), slices.Index(received, "skipped 2"))
+
+			// Still held back once 1 fails again when redelivered
+			ks.Go("a", message("1", false))
+			assert.Equal(t, "ran 1", next())
+			ks.Go("a", message("2", true))
+			assert.Equal(t, "skipped 2", next())
+			ks.Go("a", message("1", true))
+			assert.Equal(t, "ran 1", next())
+			ks.Go("a", message("2", true))
+			assert.Equal(t, "ran 2", next())
+
+			// Messages that aren't redelivered right away are waited for
+			// however long it takes, the others only as long as it may
+			ks.Go("a", message("4", false))
+			assert.Equal(t, "ran 4", next())
+			require.Eventually(t, func() bool { return ks.pending() == 0 }, time.Second, time.Millisecond)
+			now = now.Add(time.Hour)
+			ks.Go("a", message("5", true))
+			if nackable {
+				assert.Equal(t, "ran 5", next())
+			} else {
+				assert.Equal(t, "skipped 5", next())
+			}
+		})
+	}
+}
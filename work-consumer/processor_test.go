@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/checkpoint"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/claimcheck"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/encryption"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/envelope"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/progress"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/task"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/workflow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob/memblob"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/mempubsub"
+)
+
+func testProcessor(handlers *task.Registry, checkpoints *checkpoint.Store) *processor {
+	return &processor{
+		claims:      &claimcheck.Store{},
+		codecs:      envelope.NewRegistry(),
+		encrypter:   encryption.NewEncrypter(nil),
+		handlers:    handlers,
+		checkpoints: checkpoints,
+		progress:    progress.NewReporter(nil),
+		gracePeriod: time.Second,
+	}
+}
+
+// redeliveringSubscription returns a subscription that redelivers the
+// messages left unacknowledged after ackDeadline, along with its topic.
+func redeliveringSubscription(t *testing.T, ackDeadline time.Duration) (*pubsub.Topic, *pubsub.Subscription) {
+	ctx := context.Background()
+	topic := mempubsub.NewTopic()
+	subscription := mempubsub.NewSubscription(topic, ackDeadline)
+	t.Cleanup(func() {
+		subscription.Shutdown(ctx)
+		topic.Shutdown(ctx)
+	})
+	return topic, subscription
+}
+
+func sendPayload(t *testing.T, topic *pubsub.Topic, payload lib.PayloadItem) {
+	body, metadata, err := envelope.NewRegistry().Encode(payload, envelope.ContentTypeJSON)
+	require.NoError(t, err)
+	require.NoError(t, topic.Send(context.Background(), &pubsub.Message{Body: body, Metadata: metadata}))
+}
+
+type transformCheckpoint struct {
+	Done int `json:"done"`
+}
+
+func TestTasksResumeFromTheirCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	bucket := memblob.OpenBucket(nil)
+	checkpoints := checkpoint.NewStore(bucket)
+	attempts := 0
+	handlers := newHandlers()
+	handlers.Handle("transform", func(ctx context.Context, t *task.Task) (*task.Next, error) {
+		attempts++
+		state := transformCheckpoint{}
+		if _, err := t.Checkpoint(&state); err != nil {
+			return nil, err
+		}
+		for ; state.Done < 4; state.Done++ {
+			if attempts == 1 && state.Done == 2 {
+				return nil, errors.New("interrupted")
+			} else if err := t.SaveCheckpoint(ctx, state); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	proc := testProcessor(handlers, checkpoints)
+	topic, subscription := redeliveringSubscription(t, time.Millisecond*50)
+	payload := lib.PayloadItem{ID: uuid.New(), TaskName: "transform"}
+	sendPayload(t, topic, payload)
+
+	message, err := subscription.Receive(ctx)
+	require.NoError(t, err)
+	err = proc.processMessage(ctx, message, func(string) {})
+	assert.ErrorContains(t, err, "interrupted")
+	saved, err := checkpoints.Load(ctx, payload.ID)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"done":1}`, string(saved))
+
+	redelivered, err := subscription.Receive(ctx)
+	require.NoError(t, err)
+	require.NoError(t, proc.processMessage(ctx, redelivered, func(string) {}))
+	assert.Equal(t, 2, attempts)
+	saved, err = checkpoints.Load(ctx, payload.ID)
+	require.NoError(t, err)
+	assert.Nil(t, saved, "checkpoints are deleted once their task succeeds")
+}
+
+func TestTasksWithoutHandlerAreAcknowledged(t *testing.T) {
+	ctx := context.Background()
+	proc := testProcessor(newHandlers(), &checkpoint.Store{})
+	topic, subscription := redeliveringSubscription(t, time.Millisecond*50)
+	sendPayload(t, topic, lib.PayloadItem{ID: uuid.New(), TaskName: "greet"})
+
+	message, err := subscription.Receive(ctx)
+	require.NoError(t, err)
+	taskName := ""
+	require.NoError(t, proc.processMessage(ctx, message, func(name string) { taskName = name }))
+	assert.Equal(t, "greet", taskName)
+
+	receiveCtx, cancel := context.WithTimeout(ctx, time.Millisecond*200)
+	defer cancel()
+	_, err = subscription.Receive(receiveCtx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "acknowledged messages are not redelivered")
+}
+
+func TestWorkflowsFanOutAndJoin(t *testing.T) {
+	ctx := context.Background()
+	store, err := workflow.OpenSQLiteStore(ctx, filepath.Join(t.TempDir(), "workflows.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	handled := []string{}
+	handlers := newHandlers()
+	handlers.Handle("fetch", func(ctx context.Context, t *task.Task) (*task.Next, error) {
+		return task.FanIn(
+			task.Child{TaskName: "publish"},
+			task.Child{TaskName: "transform", Arguments: json.RawMessage(`{"part":1}`)},
+			task.Child{TaskName: "transform", Arguments: json.RawMessage(`{"part":2}`)},
+		), nil
+	})
+	topic, subscription := redeliveringSubscription(t, time.Minute)
+	proc := testProcessor(handlers, &checkpoint.Store{})
+	proc.enqueuer = &enqueuer{topic: topic, codecs: proc.codecs, encrypter: proc.encrypter, claims: proc.claims}
+	proc.workflows = workflow.NewTracker(store)
+	fetch := lib.PayloadItem{ID: uuid.New(), TaskName: "fetch"}
+	sendPayload(t, topic, fetch)
+
+	// fetch, then both parts, then the join once they completed
+	for i := 0; i < 4; i++ {
+		message, err := subscription.Receive(ctx)
+		require.NoError(t, err)
+		require.NoError(t, proc.processMessage(ctx, message, func(name string) { handled = append(handled, name) }))
+	}
+	assert.Equal(t, []string{"fetch", "transform", "transform", "publish"}, handled)
+	status, err := proc.workflows.Workflow(ctx, fetch.ID)
+	require.NoError(t, err)
+	assert.Equal(t, workflow.StateSucceeded, status.State)
+	require.Len(t, status.Steps, 4)
+	for _, step := range status.Steps[1:] {
+		assert.Equal(t, fetch.ID, step.ParentID)
+		assert.Equal(t, workflow.StateSucceeded, step.State)
+	}
+
+	receiveCtx, cancel := context.WithTimeout(ctx, time.Millisecond*200)
+	defer cancel()
+	_, err = subscription.Receive(receiveCtx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "the join is enqueued once")
+}
+
+func TestFailedWorkflowsAreCompensated(t *testing.T) {
+	ctx := context.Background()
+	store, err := workflow.OpenSQLiteStore(ctx, filepath.Join(t.TempDir(), "workflows.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	handled := []string{}
+	handlers := newHandlers()
+	then := func(taskName string) task.Handler {
+		return func(ctx context.Context, t *task.Task) (*task.Next, error) {
+			return task.Then(task.Child{TaskName: taskName, Arguments: t.Arguments}), nil
+		}
+	}
+	handlers.Handle("book", then("reserve"))
+	handlers.Handle("reserve", then("charge"))
+	handlers.Handle("charge", then("ship"))
+	handlers.Handle("ship", func(ctx context.Context, t *task.Task) (*task.Next, error) {
+		return nil, errors.New("carrier unavailable")
+	})
+	handlers.Compensate("reserve", "release")
+	handlers.Compensate("charge", "refund")
+	topic, subscription := redeliveringSubscription(t, time.Millisecond*50)
+	proc := testProcessor(handlers, &checkpoint.Store{})
+	proc.enqueuer = &enqueuer{topic: topic, codecs: proc.codecs, encrypter: proc.encrypter, claims: proc.claims}
+	proc.workflows = workflow.NewTracker(store)
+	proc.maxAttempts = 2
+	book := lib.PayloadItem{ID: uuid.New(), TaskName: "book", Arguments: json.RawMessage(`{"order":42}`)}
+	sendPayload(t, topic, book)
+
+	// ship fails twice, the second time for good, then charge and reserve
+	// are undone in turn
+	errs := []error{}
+	for i := 0; i < 7; i++ {
+		message, err := subscription.Receive(ctx)
+		require.NoError(t, err)
+		errs = append(errs, proc.processMessage(ctx, message, func(name string) { handled = append(handled, name) }))
+	}
+	assert.Equal(t, []string{"book", "reserve", "charge", "ship", "ship", "refund", "release"}, handled)
+	assert.ErrorContains(t, errs[3], "carrier unavailable")
+	assert.ErrorContains(t, errs[4], "failed for good")
+	status, err := proc.workflows.Workflow(ctx, book.ID)
+	require.NoError(t, err)
+	assert.Equal(t, workflow.StateCompensated, status.State)
+
+	receiveCtx, cancel := context.WithTimeout(ctx, time.Millisecond*200)
+	defer cancel()
+	_, err = subscription.Receive(receiveCtx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "the failed task is acknowledged")
+}
+
+func TestFailedStepsAreRedeliveredUntilTheirLastAttempt(t *testing.T) {
+	ctx := context.Background()
+	store, err := workflow.OpenSQLiteStore(ctx, filepath.Join(t.TempDir(), "workflows.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	handlers := newHandlers()
+	handlers.Handle("book", func(ctx context.Context, t *task.Task) (*task.Next, error) {
+		return task.Then(task.Child{TaskName: "ship"}), nil
+	})
+	handlers.Handle("ship", func(ctx context.Context, t *task.Task) (*task.Next, error) {
+		return nil, errors.New("carrier unavailable")
+	})
+	// Only redelivered when nacked
+	topic, subscription := redeliveringSubscription(t, time.Hour)
+	proc := testProcessor(handlers, &checkpoint.Store{})
+	proc.enqueuer = &enqueuer{topic: topic, codecs: proc.codecs, encrypter: proc.encrypter, claims: proc.claims}
+	proc.workflows = workflow.NewTracker(store)
+	proc.maxAttempts = 3
+	book := lib.PayloadItem{ID: uuid.New(), TaskName: "book"}
+	sendPayload(t, topic, book)
+	message, err := subscription.Receive(ctx)
+	require.NoError(t, err)
+	require.NoError(t, proc.processMessage(ctx, message, func(string) {}))
+
+	for attempt := 1; attempt <= proc.maxAttempts; attempt++ {
+		receiveCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+		message, err := subscription.Receive(receiveCtx)
+		cancel()
+		require.NoError(t, err, "attempt %d was not delivered", attempt)
+		err = proc.processMessage(ctx, message, func(string) {})
+		status, statusErr := proc.workflows.Workflow(ctx, book.ID)
+		require.NoError(t, statusErr)
+		require.Len(t, status.Steps, 2)
+		assert.Equal(t, attempt, status.Steps[1].Attempts)
+		if attempt < proc.maxAttempts {
+			assert.ErrorContains(t, err, "carrier unavailable")
+		} else {
+			assert.ErrorContains(t, err, "failed for good")
+		}
+	}
+	receiveCtx, cancel := context.WithTimeout(ctx, time.Millisecond*200)
+	defer cancel()
+	_, err = subscription.Receive(receiveCtx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "the last attempt is acknowledged")
+}
+
+func TestPermanentFailuresAreAcknowledged(t *testing.T) {
+	ctx := context.Background()
+	handlers := newHandlers()
+	handlers.Handle("fetch", func(ctx context.Context, t *task.Task) (*task.Next, error) {
+		return nil, task.Permanent(errors.New("no such file"))
+	})
+	proc := testProcessor(handlers, &checkpoint.Store{})
+	topic, subscription := redeliveringSubscription(t, time.Millisecond*50)
+	sendPayload(t, topic, lib.PayloadItem{ID: uuid.New(), TaskName: "fetch"})
+
+	message, err := subscription.Receive(ctx)
+	require.NoError(t, err)
+	assert.ErrorContains(t, proc.processMessage(ctx, message, func(string) {}), "no such file")
+	receiveCtx, cancel := context.WithTimeout(ctx, time.Millisecond*200)
+	defer cancel()
+	_, err = subscription.Receive(receiveCtx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded, "tasks that failed for good are not redelivered")
+}
+
+func TestHandlersAreGivenUpOnAtTheirDeadline(t *testing.T) {
+	ctx := context.Background()
+	handlers := newHandlers()
+	started := 0
+	handlers.Handle("fetch", func(ctx context.Context, t *task.Task) (*task.Next, error) {
+		started++
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	handlers.Timeout("fetch", time.Millisecond*20)
+	proc := testProcessor(handlers, &checkpoint.Store{})
+	process := func(payload lib.PayloadItem) (*pubsub.Subscription, error) {
+		topic, subscription := redeliveringSubscription(t, time.Millisecond*50)
+		sendPayload(t, topic, payload)
+		message, err := subscription.Receive(ctx)
+		require.NoError(t, err)
+		return subscription, proc.processMessage(ctx, message, func(string) {})
+	}
+	redelivered := func(subscription *pubsub.Subscription) bool {
+		receiveCtx, cancel := context.WithTimeout(ctx, time.Millisecond*200)
+		defer cancel()
+		_, err := subscription.Receive(receiveCtx)
+		return !errors.Is(err, context.DeadlineExceeded)
+	}
+
+	subscription, err := process(lib.PayloadItem{ID: uuid.New(), TaskName: "fetch"})
+	assert.ErrorContains(t, err, "timed out")
+	_, err = subscription.Receive(ctx)
+	assert.NoError(t, err, "tasks that timed out are retried")
+
+	deadline := time.Now().Add(time.Millisecond * 10)
+	subscription, err = process(lib.PayloadItem{ID: uuid.New(), TaskName: "fetch", Deadline: &deadline})
+	assert.ErrorContains(t, err, "deadline")
+	assert.False(t, redelivered(subscription), "tasks that overran their deadline failed for good")
+
+	passed := time.Now().Add(-time.Second)
+	subscription, err = process(lib.PayloadItem{ID: uuid.New(), TaskName: "fetch", Deadline: &passed})
+	assert.ErrorContains(t, err, "passed before it started")
+	assert.False(t, redelivered(subscription))
+	assert.Equal(t, 2, started, "tasks past their deadline are not handled")
+}
+
+func TestHandlersIgnoringTheirContextAreAbandoned(t *testing.T) {
+	ctx := context.Background()
+	handlers := newHandlers()
+	stuck := make(chan struct{})
+	handlers.Handle("fetch", func(ctx context.Context, t *task.Task) (*task.Next, error) {
+		<-stuck
+		return nil, nil
+	})
+	handlers.Timeout("fetch", time.Millisecond*20)
+	proc := testProcessor(handlers, &checkpoint.Store{})
+	proc.gracePeriod = time.Millisecond * 20
+	proc.maxAbandoned = 1
+	require.NoError(t, proc.abandonedProbe(ctx))
+	topic, subscription := redeliveringSubscription(t, time.Millisecond*50)
+	sendPayload(t, topic, lib.PayloadItem{ID: uuid.New(), TaskName: "fetch"})
+
+	message, err := subscription.Receive(ctx)
+	require.NoError(t, err)
+	returned := make(chan error)
+	go func() { returned <- proc.processMessage(ctx, message, func(string) {}) }()
+	select {
+	case err := <-returned:
+		assert.ErrorContains(t, err, "abandoned its handler")
+	case <-time.After(time.Second * 5):
+		require.FailNow(t, "the worker was held by the handler")
+	}
+	_, err = subscription.Receive(ctx)
+	assert.NoError(t, err, "tasks whose handler was abandoned are retried")
+	assert.Error(t, proc.abandonedProbe(ctx), "not ready while too many abandoned handlers run")
+
+	close(stuck)
+	assert.Eventually(t, func() bool { return proc.abandonedProbe(ctx) == nil }, time.Second*5, time.Millisecond*10, "ready once they returned")
+}
+
+func TestReturningTasksRequiresAWorkflowQueue(t *testing.T) {
+	ctx := context.Background()
+	handlers := newHandlers()
+	handlers.Handle("fetch", func(ctx context.Context, t *task.Task) (*task.Next, error) {
+		return task.Then(task.Child{TaskName: "transform"}), nil
+	})
+	proc := testProcessor(handlers, &checkpoint.Store{})
+	topic, subscription := redeliveringSubscription(t, time.Minute)
+	sendPayload(t, topic, lib.PayloadItem{ID: uuid.New(), TaskName: "fetch"})
+
+	message, err := subscription.Receive(ctx)
+	require.NoError(t, err)
+	assert.ErrorContains(t, proc.processMessage(ctx, message, func(string) {}), "WORKFLOW_QUEUE_URL")
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
+)
+
+const redactedValue = "[REDACTED]"
+
+// redact returns payload as it is logged, with the values at paths
+// replaced. Paths are dotted JSON keys, such as arguments or
+// arguments.customer.email; they don't reach into arrays.
+func redact(payload lib.PayloadItem, paths []string) any {
+	if len(paths) == 0 {
+		return payload
+	}
+	loggable := map[string]any{}
+	encoded, err := json.Marshal(payload)
+	if err == nil {
+		err = json.Unmarshal(encoded, &loggable)
+	}
+	if err != nil {
+		// Better to log too little than too much
+		return map[string]any{
+			"id":        payload.ID,
+			"task_name": payload.TaskName,
+		}
+	}
+	for _, path := range paths {
+		redactPath(loggable, strings.Split(path, "."))
+	}
+	return loggable
+}
+
+func redactPath(document map[string]any, keys []string) {
+	value, isPresent := document[keys[0]]
+	if !isPresent {
+		return
+	} else if len(keys) == 1 {
+		document[keys[0]] = redactedValue
+	} else if nested, isObject := value.(map[string]any); isObject {
+		redactPath(nested, keys[1:])
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedact(t *testing.T) {
+	payload := lib.PayloadItem{
+		ID:        uuid.New(),
+		TaskName:  "greet",
+		Arguments: json.RawMessage(`{"customer":{"email":"someone@example.com","tier":"gold"},"tags":["a"]}`),
+	}
+	asLogged := func(paths ...string) string {
+		loggable, err := json.Marshal(redact(payload, paths))
+		assert.NoError(t, err)
+		return string(loggable)
+	}
+
+	assert.Contains(t, asLogged(), "someone@example.com")
+
+	everything := asLogged("arguments")
+	assert.NotContains(t, everything, "someone@example.com")
+	assert.Contains(t, everything, `"arguments":"[REDACTED]"`)
+	assert.Contains(t, everything, `"task_name":"greet"`)
+
+	email := asLogged("arguments.customer.email")
+	assert.NotContains(t, email, "someone@example.com")
+	assert.Contains(t, email, `"tier":"gold"`)
+
+	// Paths that don't exist leave the payload as it is
+	assert.Contains(t, asLogged("arguments.customer.phone", "arguments.tags.0", "nothing"), "someone@example.com")
+}
@@ -0,0 +1,48 @@
+//go:build wireinject
+
+package main
+
+import (
+	"context"
+
+	"github.com/google/wire"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/checkpoint"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/claimcheck"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/encryption"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/health"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/queue"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/workflow"
+	"gocloud.dev/pubsub"
+)
+
+var queueSet = wire.NewSet(queue.ProviderSet, wire.FieldsOf(new(Config), "QueueConfig"))
+
+func InitializeQueueSubscription(ctx context.Context, cfg Config) (*pubsub.Subscription, error) {
+	wire.Build(queueSet)
+	return &pubsub.Subscription{}, nil
+}
+
+func InitializeReadinessProbe(ctx context.Context, cfg Config) (health.Probe, error) {
+	wire.Build(queueSet)
+	return nil, nil
+}
+
+func InitializeClaimCheckStore(ctx context.Context, cfg Config) (*claimcheck.Store, func(), error) {
+	wire.Build(claimcheck.ProviderSet, wire.FieldsOf(new(Config), "ClaimCheckConfig"))
+	return nil, nil, nil
+}
+
+func InitializeEncrypter(ctx context.Context, cfg Config) (*encryption.Encrypter, error) {
+	wire.Build(encryption.ProviderSet, wire.FieldsOf(new(Config), "EncryptionConfig"))
+	return nil, nil
+}
+
+func InitializeCheckpointStore(ctx context.Context, cfg Config) (*checkpoint.Store, func(), error) {
+	wire.Build(checkpoint.ProviderSet, wire.FieldsOf(new(Config), "CheckpointConfig"))
+	return nil, nil, nil
+}
+
+func InitializeWorkflowTracker(ctx context.Context, cfg Config) (*workflow.Tracker, func(), error) {
+	wire.Build(workflow.ProviderSet, wire.FieldsOf(new(Config), "WorkflowConfig"))
+	return nil, nil, nil
+}
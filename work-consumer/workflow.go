@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/claimcheck"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/encryption"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/envelope"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/progress"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/queue"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/task"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/workflow"
+	"github.com/rs/zerolog"
+	"gocloud.dev/pubsub"
+)
+
+// enqueuer sends the tasks that handlers return to the queue of the
+// supplier, the way the supplier would have.
+type enqueuer struct {
+	topic     *pubsub.Topic
+	codecs    *envelope.Registry
+	encrypter *encryption.Encrypter
+	claims    *claimcheck.Store
+	// fifo queues require a message group and deduplication ID
+	fifo bool
+}
+
+// newEnqueuer opens the queue of WORKFLOW_QUEUE_URL, it is nil when unset.
+func newEnqueuer(ctx context.Context, cfg Config, codecs *envelope.Registry, encrypter *encryption.Encrypter, claims *claimcheck.Store) (*enqueuer, error) {
+	if cfg.WorkflowQueueURL == "" {
+		return nil, nil
+	}
+	topic, err := queue.OpenTopic(ctx, cfg.workflowQueueConfig())
+	if err != nil {
+		return nil, fmt.Errorf("could not open workflow queue: %w", err)
+	}
+	return &enqueuer{
+		topic:     topic,
+		codecs:    codecs,
+		encrypter: encrypter,
+		claims:    claims,
+		fifo:      cfg.workflowQueueConfig().IsFIFO(),
+	}, nil
+}
+
+// prepare encodes the message of payload as contentType, sealing its
+// arguments and offloading its body as configured.
+func (e *enqueuer) prepare(ctx context.Context, payload lib.PayloadItem, contentType string) (workflow.Message, error) {
+	keyID, err := e.encrypter.Seal(ctx, &payload)
+	if err != nil {
+		return workflow.Message{}, fmt.Errorf("could not encrypt the arguments of %s: %w", payload.TaskName, err)
+	}
+	body, metadata, err := e.codecs.Encode(payload, contentType)
+	if err != nil {
+		return workflow.Message{}, fmt.Errorf("could not serialize %s: %w", payload.TaskName, err)
+	}
+	metadata[lib.PartitionKeyMetadata] = payload.PartitionKey()
+	metadata[lib.TaskNameMetadata] = payload.TaskName
+	if keyID != "" {
+		metadata[encryption.KeyIDMetadata] = keyID
+	}
+	message := &pubsub.Message{Body: body, Metadata: metadata}
+	if err := e.claims.Offload(ctx, message); err != nil {
+		return workflow.Message{}, err
+	}
+	return workflow.Message{ID: payload.ID, TaskName: payload.TaskName, Body: message.Body, Metadata: message.Metadata}, nil
+}
+
+func (e *enqueuer) send(ctx context.Context, prepared workflow.Message) error {
+	message := &pubsub.Message{Body: prepared.Body, Metadata: prepared.Metadata}
+	if e.fifo {
+		message.BeforeSend = queue.FIFOBeforeSend(prepared.Metadata[lib.PartitionKeyMetadata], prepared.ID.String())
+	}
+	if err := e.topic.Send(ctx, message); err != nil {
+		return fmt.Errorf("could not enqueue %s: %w", prepared.TaskName, err)
+	}
+	return nil
+}
+
+// startStep records that the task is running when it's the step of a
+// workflow, which is not worth failing the task over. It returns how many
+// times the step started, 0 for tasks that aren't steps.
+func (p *processor) startStep(ctx context.Context, payload lib.PayloadItem) int {
+	if p.workflows == nil {
+		return 0
+	}
+	attempts, err := p.workflows.Start(ctx, payload)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("could not record workflow step as running")
+	}
+	return attempts
+}
+
+// compensations prepares the messages undoing the payloads whose task has a
+// compensation registered, keyed by their ID.
+func (p *processor) compensations(ctx context.Context, payloads []lib.PayloadItem, contentType string) (map[uuid.UUID]*workflow.Message, error) {
+	compensations := map[uuid.UUID]*workflow.Message{}
+	now := time.Now()
+	for _, payload := range payloads {
+		compensation := p.handlers.Compensation(payload, now)
+		if compensation == nil {
+			continue
+		}
+		message, err := p.enqueuer.prepare(ctx, *compensation, contentType)
+		if err != nil {
+			return nil, err
+		}
+		compensations[payload.ID] = &message
+	}
+	return compensations, nil
+}
+
+// followUp enqueues the tasks the handler of payload returned, in the
+// content type the task was received as, then records that its step
+// completed and enqueues the joins that were waiting on it.
+func (p *processor) followUp(ctx context.Context, payload lib.PayloadItem, next *task.Next, contentType string) error {
+	children, join := next.Payloads(payload, time.Now())
+	if len(children) > 0 && p.enqueuer == nil {
+		return fmt.Errorf("handlers can only return tasks when WORKFLOW_QUEUE_URL is set")
+	} else if join != nil && p.workflows == nil {
+		return fmt.Errorf("handlers can only join tasks when WORKFLOW_URL is set")
+	}
+	messages := []workflow.Message{}
+	for _, child := range children {
+		message, err := p.enqueuer.prepare(ctx, child, contentType)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, message)
+	}
+	if p.workflows != nil && len(children) > 0 {
+		var joinMessage *workflow.Message
+		undoable := append([]lib.PayloadItem{}, children...)
+		if join != nil {
+			message, err := p.enqueuer.prepare(ctx, *join, contentType)
+			if err != nil {
+				return err
+			}
+			joinMessage = &message
+			undoable = append(undoable, *join)
+		}
+		if payload.RootID == nil {
+			// The other steps were recorded along with their compensation
+			undoable = append(undoable, payload)
+		}
+		compensations, err := p.compensations(ctx, undoable, contentType)
+		if err != nil {
+			return err
+		}
+		// Recorded before the children are sent, so that their steps
+		// exist by the time they complete
+		if err := p.workflows.Spawn(ctx, payload, children, joinMessage, compensations); errors.Is(err, workflow.ErrAborted) {
+			zerolog.Ctx(ctx).Info().Str("workflow_id", payload.WorkflowID().String()).Msg("workflow was aborted, dropping the tasks the handler returned")
+			messages = nil
+		} else if err != nil {
+			return err
+		}
+	}
+	for _, message := range messages {
+		if err := p.enqueuer.send(ctx, message); err != nil {
+			return err
+		}
+	}
+	if p.workflows == nil || (len(children) == 0 && payload.RootID == nil) {
+		return nil
+	}
+	due, err := p.workflows.Complete(ctx, payload)
+	if err != nil {
+		return err
+	}
+	return p.dispatch(ctx, due)
+}
+
+// dispatch enqueues the joins and compensations that are due, recording
+// that they were sent.
+func (p *processor) dispatch(ctx context.Context, due []workflow.Step) error {
+	for _, step := range due {
+		log := zerolog.Ctx(ctx).With().Str("workflow_id", step.RootID.String()).Logger()
+		if p.enqueuer == nil {
+			return fmt.Errorf("workflows can only be joined or compensated when WORKFLOW_QUEUE_URL is set")
+		} else if step.State == workflow.StateCompensating && step.Compensation != nil {
+			if err := p.enqueuer.send(ctx, *step.Compensation); err != nil {
+				return err
+			} else if err := p.workflows.MarkCompensationSent(ctx, step); err != nil {
+				// Sent again should this task be redelivered
+				return err
+			}
+			log.Info().Str("compensation_task_name", step.Compensation.TaskName).Str("step_id", step.ID.String()).Msg("workflow was aborted, enqueued the compensation of a step")
+		} else if err := p.enqueuer.send(ctx, *step.Join); err != nil {
+			return err
+		} else if err := p.workflows.MarkJoined(ctx, step); err != nil {
+			// Sent again should this task be redelivered
+			return err
+		} else {
+			log.Info().Str("join_task_name", step.Join.TaskName).Msg("every child completed, enqueued their join")
+		}
+	}
+	return nil
+}
+
+// errFailedForGood is returned for messages that were acknowledged although
+// their task failed.
+var errFailedForGood = errors.New("failed for good")
+
+// fail gives up on the task of message once its handler failed for good,
+// cause being the error it returned. The message is acknowledged rather than
+// redelivered, and the workflow of the task is compensated.
+func (p *processor) fail(ctx context.Context, message *pubsub.Message, payload lib.PayloadItem, cause error) error {
+	if p.workflows != nil {
+		// Retried when the workflow can't be compensated, the handler fails
+		// again once redelivered
+		due, err := p.workflows.Fail(ctx, payload)
+		if err != nil {
+			return p.retry(message, fmt.Errorf("could not record that %s failed: %w", payload.TaskName, err))
+		} else if err := p.dispatch(ctx, due); err != nil {
+			return p.retry(message, fmt.Errorf("could not compensate the workflow of %s: %w", payload.TaskName, err))
+		}
+	}
+	message.Ack()
+	p.report(ctx, progress.Event{TaskID: payload.ID, State: progress.StateFailed})
+	p.cleanUp(ctx, payload)
+	return fmt.Errorf("task %s %w, giving up on it: %w", payload.TaskName, errFailedForGood, cause)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/claimcheck"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/encryption"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/envelope"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/outbox"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/progress"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/publish"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/queue"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/workflow"
+)
+
+const (
+	partitionByOrderingKey = "ordering_key"
+	partitionByTaskName    = "task_name"
+)
+
+// Config is the complete configuration of the work-supplier. See CONFIG.md
+// for the generated reference of every key.
+type Config struct {
+	MaxArgumentsBytes    int           `env:"MAX_ARGUMENTS_BYTES" default:"10485760" desc:"Largest request body, the task arguments, accepted by POST /task/{name}"`
+	ContentType          string        `env:"CONTENT_TYPE" default:"application/json" desc:"Codec messages are serialized with: application/json, application/x-protobuf or application/x-msgpack. Consumers pick theirs from the message metadata so they must know it before it is rolled out here"`
+	Compression          string        `env:"COMPRESSION" desc:"Compress message bodies of at least COMPRESSION_THRESHOLD bytes with gzip or zstd, they are sent uncompressed when empty"`
+	CompressionThreshold int           `env:"COMPRESSION_THRESHOLD" default:"1024" desc:"Smallest message body, in bytes, that is compressed"`
+	PartitionBy          string        `env:"PARTITION_BY" default:"ordering_key" desc:"What messages are partitioned by, which is also the message group of SQS FIFO queues: ordering_key uses the client's ordering_key and falls back to the task name, task_name always uses the task name"`
+	GRPCAddr             string        `env:"GRPC_ADDR" desc:"Listen address of the gRPC API, it is disabled when empty"`
+	GRPCMaxBatchSize     int           `env:"GRPC_MAX_BATCH_SIZE" default:"100" desc:"Most tasks SubmitBatch accepts at once"`
+	WatchInterval        time.Duration `env:"WATCH_INTERVAL" default:"1s" desc:"How often WatchTask and GET /task/{id}/events look up the status of the task in the outbox"`
+	OutboxRelayLoop      bool          `env:"OUTBOX_RELAY_LOOP" default:"true" desc:"Relay the messages of the outbox that could not be sent right away from a loop of the supplier. Disable it where the supplier is frozen between requests, as on Lambda, and run the relay subcommand on a schedule instead"`
+	ProgressRetention    time.Duration `env:"PROGRESS_RETENTION" default:"1h" desc:"How long the latest progress of a task is kept for the clients that start watching it late"`
+	QueueConfig
+	ClaimCheckConfig
+	EncryptionConfig
+	OutboxConfig
+	PublishConfig
+	ProgressConfig
+	WorkflowConfig
+}
+
+// The configuration of each lib package is embedded under an alias, as
+// they're all named Config.
+type (
+	QueueConfig      = queue.Config
+	ClaimCheckConfig = claimcheck.Config
+	EncryptionConfig = encryption.Config
+	OutboxConfig     = outbox.Config
+	PublishConfig    = publish.Config
+	ProgressConfig   = progress.Config
+	WorkflowConfig   = workflow.Config
+)
+
+func (c *Config) Validate() []error {
+	errs := append(c.QueueConfig.Validate(), c.ClaimCheckConfig.Validate()...)
+	errs = append(errs, c.EncryptionConfig.Validate()...)
+	errs = append(errs, c.OutboxConfig.Validate()...)
+	errs = append(errs, c.PublishConfig.Validate()...)
+	errs = append(errs, c.ProgressConfig.Validate()...)
+	errs = append(errs, c.WorkflowConfig.Validate()...)
+	if c.MaxArgumentsBytes < 1 {
+		errs = append(errs, fmt.Errorf("MAX_ARGUMENTS_BYTES must be at least 1, got %d", c.MaxArgumentsBytes))
+	}
+	if !envelope.NewRegistry().Supports(c.ContentType) {
+		errs = append(errs, fmt.Errorf("CONTENT_TYPE %q is not supported", c.ContentType))
+	}
+	if c.Compression != "" && !envelope.NewRegistry().SupportsEncoding(c.Compression) {
+		errs = append(errs, fmt.Errorf("COMPRESSION must be %s or %s, got %q", envelope.EncodingGzip, envelope.EncodingZstd, c.Compression))
+	}
+	if c.CompressionThreshold < 0 {
+		errs = append(errs, fmt.Errorf("COMPRESSION_THRESHOLD cannot be negative, got %d", c.CompressionThreshold))
+	}
+	if c.GRPCMaxBatchSize < 1 {
+		errs = append(errs, fmt.Errorf("GRPC_MAX_BATCH_SIZE must be at least 1, got %d", c.GRPCMaxBatchSize))
+	}
+	if c.WatchInterval <= 0 {
+		errs = append(errs, fmt.Errorf("WATCH_INTERVAL must be positive, got %s", c.WatchInterval))
+	}
+	if c.ProgressRetention <= 0 {
+		errs = append(errs, fmt.Errorf("PROGRESS_RETENTION must be positive, got %s", c.ProgressRetention))
+	}
+	if c.PartitionBy != partitionByOrderingKey && c.PartitionBy != partitionByTaskName {
+		errs = append(errs, fmt.Errorf("PARTITION_BY must be %s or %s, got %q", partitionByOrderingKey, partitionByTaskName, c.PartitionBy))
+	}
+	return errs
+}
+
+func (c *Config) partitionKey(payload lib.PayloadItem) string {
+	if c.PartitionBy == partitionByTaskName {
+		return payload.TaskName
+	}
+	return payload.PartitionKey()
+}
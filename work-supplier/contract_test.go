@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers/legacy"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/claimcheck"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/client"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/config"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/encryption"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/envelope"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/health"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/outbox"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/progress"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/publish"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/task"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/workflow"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/mempubsub"
+)
+
+func loadSpec(t *testing.T) *openapi3.T {
+	spec, err := openapi3.NewLoader().LoadFromData(client.Spec)
+	require.NoError(t, err)
+	require.NoError(t, spec.Validate(context.Background()))
+	return spec
+}
+
+func testConfig(t *testing.T) Config {
+	cfg := Config{}
+	require.NoError(t, config.Load(context.Background(), "work-supplier", &cfg, []string{"--queue-url=mem://contract", "--max-arguments-bytes=64"}))
+	cfg.BreakerFailureThreshold = 1
+	return cfg
+}
+
+// testServer returns a supplier sending to topic, with an outbox when
+// withOutbox is set and a spool when spool isn't nil.
+func testServer(t *testing.T, topic *pubsub.Topic, withOutbox bool, spool *publish.Spool) *server {
+	cfg := testConfig(t)
+	publisher := publish.NewPublisher(topic, spool, cfg.PublishConfig, nil)
+	s := &server{
+		cfg:       cfg,
+		codecs:    envelope.NewRegistry(),
+		claims:    &claimcheck.Store{},
+		encrypter: encryption.NewEncrypter(nil),
+		publisher: publisher,
+		checker:   health.NewChecker(time.Second),
+	}
+	if withOutbox {
+		store, err := outbox.OpenSQLiteStore(context.Background(), filepath.Join(t.TempDir(), "outbox.db"))
+		require.NoError(t, err)
+		t.Cleanup(func() { store.Close() })
+		s.relay = outbox.NewRelay(store, publisher, cfg.OutboxConfig, nil)
+	}
+	return s
+}
+
+// decodeEventStream lets responses of server-sent events be validated, each
+// of their events against the TaskEvent schema.
+func decodeEventStream(spec *openapi3.T) openapi3filter.BodyDecoder {
+	taskEvent := spec.Components.Schemas["TaskEvent"].Value
+	return func(body io.Reader, header http.Header, schema *openapi3.SchemaRef, encFn openapi3filter.EncodingFn) (any, error) {
+		stream, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(stream), "\n") {
+			data, isData := strings.CutPrefix(line, "data: ")
+			if !isData {
+				continue
+			}
+			var event any
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				return nil, err
+			} else if err := taskEvent.VisitJSON(event); err != nil {
+				return nil, err
+			}
+		}
+		return string(stream), nil
+	}
+}
+
+// validatingServer serves s, failing the test whenever a request or its
+// response doesn't match the specification.
+func validatingServer(t *testing.T, s *server) *httptest.Server {
+	spec := loadSpec(t)
+	router, err := legacy.NewRouter(spec)
+	require.NoError(t, err)
+	openapi3filter.RegisterBodyDecoder("text/event-stream", decodeEventStream(spec))
+	handler := s.routes()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		route, pathParams, err := router.FindRoute(r)
+		if !assert.NoError(t, err, "%s %s is not in the specification", r.Method, r.URL.Path) {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		}
+		requestInput := &openapi3filter.RequestValidationInput{
+			Request:    r.Clone(r.Context()),
+			PathParams: pathParams,
+			Route:      route,
+		}
+		requestInput.Request.Body = io.NopCloser(bytes.NewReader(body))
+		requestErr := openapi3filter.ValidateRequest(r.Context(), requestInput)
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		responseInput := &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: requestInput,
+			Status:                 recorder.Code,
+			Header:                 recorder.Header(),
+			Body:                   io.NopCloser(bytes.NewReader(recorder.Body.Bytes())),
+			Options:                &openapi3filter.Options{IncludeResponseStatus: true},
+		}
+		// Invalid requests are sent on purpose, their responses must still
+		// be described
+		if requestErr == nil || recorder.Code < 500 {
+			assert.NoError(t, openapi3filter.ValidateResponse(r.Context(), responseInput), "%s %s responded %d: %s", r.Method, r.URL.Path, recorder.Code, recorder.Body.String())
+		}
+		for key, values := range recorder.Header() {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(recorder.Code)
+		w.Write(recorder.Body.Bytes())
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testSupplier(t *testing.T, server *httptest.Server) *client.Supplier {
+	supplier, err := client.NewSupplier(server.URL, client.WithRetries(1, time.Millisecond, time.Millisecond))
+	require.NoError(t, err)
+	return supplier
+}
+
+func TestRoutesMatchSpecification(t *testing.T) {
+	spec := loadSpec(t)
+	specified := map[string]bool{}
+	for path, item := range spec.Paths {
+		for method := range item.Operations() {
+			specified[method+" "+path] = true
+		}
+	}
+	served := map[string]bool{}
+	routes := testServer(t, mempubsub.NewTopic(), false, nil).routes()
+	err := chi.Walk(routes, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		served[method+" "+route] = true
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, specified, served)
+}
+
+func TestSubmitTaskContract(t *testing.T) {
+	ctx := context.Background()
+	server := validatingServer(t, testServer(t, mempubsub.NewTopic(), false, nil))
+	supplier := testSupplier(t, server)
+
+	submitted, err := supplier.Submit(ctx, "greet", map[string]string{"name": "gopher"}, "first")
+	require.NoError(t, err)
+	assert.Equal(t, "greet", submitted.TaskName)
+	assert.Equal(t, client.StatusEnqueued, submitted.Status)
+	assert.NotEqual(t, uuid.Nil, submitted.Id)
+
+	_, err = supplier.Submit(ctx, "greet", nil, "")
+	require.NoError(t, err)
+	_, err = supplier.SubmitBefore(ctx, "greet", nil, "", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	for name, submit := range map[string]func() error{
+		"invalid ordering key": func() error {
+			_, err := supplier.Submit(ctx, "greet", nil, "has spaces")
+			return err
+		},
+		"too large": func() error {
+			_, err := supplier.Submit(ctx, "greet", strings.Repeat("a", 128), "")
+			return err
+		},
+		"passed deadline": func() error {
+			_, err := supplier.SubmitBefore(ctx, "greet", nil, "", time.Now().Add(-time.Second))
+			return err
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := submit()
+			problemErr := &client.ProblemError{}
+			require.ErrorAs(t, err, &problemErr)
+			assert.Less(t, problemErr.StatusCode, 500)
+			require.NotNil(t, problemErr.Problem.RequestId)
+			assert.NotEmpty(t, *problemErr.Problem.RequestId)
+		})
+	}
+
+	response, err := http.Post(server.URL+"/task/greet", "application/json", strings.NewReader("{"))
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+}
+
+func TestSubmitTaskUnavailableContract(t *testing.T) {
+	topic := mempubsub.NewTopic()
+	require.NoError(t, topic.Shutdown(context.Background()))
+	supplier := testSupplier(t, validatingServer(t, testServer(t, topic, false, nil)))
+
+	_, err := supplier.Submit(context.Background(), "greet", nil, "")
+	problemErr := &client.ProblemError{}
+	require.ErrorAs(t, err, &problemErr)
+	assert.Equal(t, http.StatusFailedDependency, problemErr.StatusCode)
+	assert.NotContains(t, problemErr.Error(), "Shutdown")
+
+	// The breaker opened after the first failure
+	_, err = supplier.Submit(context.Background(), "greet", nil, "")
+	require.ErrorAs(t, err, &problemErr)
+	assert.Equal(t, http.StatusServiceUnavailable, problemErr.StatusCode)
+	assert.Equal(t, client.ProblemCodeUnavailable, problemErr.Problem.Code)
+	assert.Positive(t, problemErr.RetryAfter)
+}
+
+func TestSubmitTaskSpooledContract(t *testing.T) {
+	topic := mempubsub.NewTopic()
+	require.NoError(t, topic.Shutdown(context.Background()))
+	spool, err := publish.OpenSpool(t.TempDir(), 1<<20)
+	require.NoError(t, err)
+	supplier := testSupplier(t, validatingServer(t, testServer(t, topic, false, spool)))
+
+	submitted, err := supplier.Submit(context.Background(), "greet", nil, "")
+	require.NoError(t, err)
+	assert.Equal(t, client.StatusSpooled, submitted.Status)
+}
+
+func TestTaskStatusContract(t *testing.T) {
+	ctx := context.Background()
+	supplier := testSupplier(t, validatingServer(t, testServer(t, mempubsub.NewTopic(), true, nil)))
+
+	submitted, err := supplier.Submit(ctx, "greet", nil, "")
+	require.NoError(t, err)
+	status, err := supplier.WaitEnqueued(ctx, submitted.Id, time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, submitted.Id, status.Id)
+
+	_, err = supplier.Status(ctx, uuid.New())
+	problemErr := &client.ProblemError{}
+	require.ErrorAs(t, err, &problemErr)
+	assert.Equal(t, client.ProblemCodeNotFound, problemErr.Problem.Code)
+}
+
+func TestTaskStatusWithoutOutboxContract(t *testing.T) {
+	supplier := testSupplier(t, validatingServer(t, testServer(t, mempubsub.NewTopic(), false, nil)))
+	_, err := supplier.Status(context.Background(), uuid.New())
+	problemErr := &client.ProblemError{}
+	require.ErrorAs(t, err, &problemErr)
+	assert.Equal(t, http.StatusNotFound, problemErr.StatusCode)
+}
+
+func TestTaskEventsContract(t *testing.T) {
+	ctx := context.Background()
+	s := testServer(t, mempubsub.NewTopic(), true, nil)
+	s.progress = progress.NewHub(time.Hour)
+	supplier := testSupplier(t, validatingServer(t, s))
+
+	submitted, err := supplier.Submit(ctx, "greet", nil, "")
+	require.NoError(t, err)
+	percent := 100
+	s.progress.Publish(progress.Event{TaskID: submitted.Id, State: progress.StateSucceeded, Percent: &percent, Time: time.Now()})
+	statuses := []client.TaskEventStatus{}
+	err = supplier.Events(ctx, submitted.Id, func(event client.TaskEvent) error {
+		assert.Equal(t, submitted.Id, event.Id)
+		statuses = append(statuses, event.Status)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []client.TaskEventStatus{client.TaskEventEnqueued, client.TaskEventSucceeded}, statuses)
+
+	err = supplier.Events(ctx, uuid.New(), func(event client.TaskEvent) error { return nil })
+	problemErr := &client.ProblemError{}
+	require.ErrorAs(t, err, &problemErr)
+	assert.Equal(t, client.ProblemCodeNotFound, problemErr.Problem.Code)
+}
+
+func TestTaskEventsWithoutOutboxOrProgressContract(t *testing.T) {
+	supplier := testSupplier(t, validatingServer(t, testServer(t, mempubsub.NewTopic(), false, nil)))
+	err := supplier.Events(context.Background(), uuid.New(), func(event client.TaskEvent) error { return nil })
+	problemErr := &client.ProblemError{}
+	require.ErrorAs(t, err, &problemErr)
+	assert.Equal(t, http.StatusNotFound, problemErr.StatusCode)
+}
+
+func TestWorkflowContract(t *testing.T) {
+	ctx := context.Background()
+	store, err := workflow.OpenSQLiteStore(ctx, filepath.Join(t.TempDir(), "workflows.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	s := testServer(t, mempubsub.NewTopic(), false, nil)
+	s.workflows = workflow.NewTracker(store)
+	supplier := testSupplier(t, validatingServer(t, s))
+
+	fetch := lib.PayloadItem{ID: uuid.New(), TaskName: "fetch"}
+	children, _ := task.Then(task.Child{TaskName: "transform"}).Payloads(fetch, time.Now())
+	require.NoError(t, s.workflows.Spawn(ctx, fetch, children, nil, nil))
+	_, err = s.workflows.Complete(ctx, fetch)
+	require.NoError(t, err)
+
+	found, err := supplier.Workflow(ctx, fetch.ID)
+	require.NoError(t, err)
+	assert.Equal(t, fetch.ID, found.Id)
+	assert.Equal(t, client.StepWaiting, found.Status)
+	require.Len(t, found.Steps, 2)
+	assert.Nil(t, found.Steps[0].ParentId)
+	assert.Equal(t, 1, found.Steps[0].Pending)
+	assert.Equal(t, fetch.ID, *found.Steps[1].ParentId)
+	assert.Equal(t, client.StepPending, found.Steps[1].Status)
+
+	// Failing for good, transform is the only step and has nothing to undo
+	_, err = s.workflows.Fail(ctx, children[0])
+	require.NoError(t, err)
+	found, err = supplier.Workflow(ctx, fetch.ID)
+	require.NoError(t, err)
+	assert.Equal(t, client.StepFailed, found.Status)
+	assert.Equal(t, client.StepFailed, found.Steps[1].Status)
+	assert.False(t, found.Steps[1].Compensation)
+
+	_, err = supplier.Workflow(ctx, uuid.New())
+	problemErr := &client.ProblemError{}
+	require.ErrorAs(t, err, &problemErr)
+	assert.Equal(t, client.ProblemCodeNotFound, problemErr.Problem.Code)
+}
+
+func TestWorkflowWithoutStoreContract(t *testing.T) {
+	supplier := testSupplier(t, validatingServer(t, testServer(t, mempubsub.NewTopic(), false, nil)))
+	_, err := supplier.Workflow(context.Background(), uuid.New())
+	problemErr := &client.ProblemError{}
+	require.ErrorAs(t, err, &problemErr)
+	assert.Equal(t, http.StatusNotFound, problemErr.StatusCode)
+}
+
+func TestOperationalRoutesContract(t *testing.T) {
+	server := validatingServer(t, testServer(t, mempubsub.NewTopic(), false, nil))
+	api, err := client.NewClientWithResponses(server.URL)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	root, err := api.GetRootWithResponse(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, root.JSON200)
+	assert.NotEmpty(t, root.JSON200.YourIp)
+
+	liveness, err := api.GetLivenessWithResponse(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, liveness.StatusCode())
+
+	readiness, err := api.GetReadinessWithResponse(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, readiness.StatusCode())
+
+	metrics, err := api.GetMetricsWithResponse(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, string(metrics.Body), "publish_breaker_state")
+
+	spec, err := api.GetOpenAPIWithResponse(ctx)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(client.Spec), string(spec.Body))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/apierror"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/outbox"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/progress"
+	"github.com/rs/zerolog"
+)
+
+// eventsHeartbeat is how often a comment is sent on a quiet event stream, so
+// that proxies and load balancers don't time it out.
+const eventsHeartbeat = time.Second * 15
+
+// taskEvent is the data of the events of GET /task/{id}/events, the
+// statuses of the outbox followed by the progress the consumer reports.
+type taskEvent struct {
+	ID      uuid.UUID `json:"id"`
+	Status  string    `json:"status"`
+	Percent *int      `json:"percent,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// handleTaskEvents streams the events of a task as server-sent events until
+// the task is done, or enqueued when the supplier receives no progress.
+func (s *server) handleTaskEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := zerolog.Ctx(ctx)
+	id, err := uuid.Parse(chi.URLParam(r, "task"))
+	if err != nil {
+		apierror.Write(w, r, apierror.InvalidArgument("the task ID must be a UUID"))
+		return
+	} else if s.relay == nil && s.progress == nil {
+		apierror.Write(w, r, apierror.ResourceNotFound("task events are only reported when OUTBOX_URL or PROGRESS_URL is set"))
+		return
+	}
+	// Watched before the status is looked up, so that nothing reported in
+	// between is missed
+	var events <-chan progress.Event
+	if s.progress != nil {
+		var stop func()
+		events, stop = s.progress.Watch(id)
+		defer stop()
+	}
+	var status outbox.Status
+	if s.relay != nil {
+		if status, err = s.taskStatus(ctx, id); err != nil {
+			apierror.Write(w, r, err)
+			return
+		}
+	}
+
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	send := func(event taskEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("could not serialize task event: %w", err)
+		} else if _, err := fmt.Fprintf(w, "event: status\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		return controller.Flush()
+	}
+	if status != "" {
+		if err := send(taskEvent{ID: id, Status: string(status), Time: time.Now()}); err != nil {
+			log.Debug().Err(err).Msg("could not send task event")
+			return
+		}
+	} else if err := controller.Flush(); err != nil {
+		log.Debug().Err(err).Msg("could not send task events")
+		return
+	}
+
+	polling := time.NewTicker(s.cfg.WatchInterval)
+	defer polling.Stop()
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var polls <-chan time.Time
+		if status == outbox.StatusPending {
+			polls = polling.C
+		} else if events == nil {
+			// Enqueued, and the consumer's progress isn't received
+			return
+		}
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			if _, err = io.WriteString(w, ": keep-alive\n\n"); err == nil {
+				err = controller.Flush()
+			}
+		case <-polls:
+			var next outbox.Status
+			if next, err = s.taskStatus(ctx, id); err == nil && next != status {
+				status = next
+				err = send(taskEvent{ID: id, Status: string(status), Time: time.Now()})
+			}
+		case event, isOpen := <-events:
+			if !isOpen {
+				// The task is done, or the client fell too far behind and
+				// starts over once it reconnects
+				return
+			} else if status == outbox.StatusPending {
+				// The consumer got it, the relay marks it enqueued eventually
+				status = outbox.StatusEnqueued
+			}
+			err = send(taskEvent{
+				ID:      id,
+				Status:  string(event.State),
+				Percent: event.Percent,
+				Message: event.Message,
+				Time:    event.Time,
+			})
+		}
+		if err != nil {
+			log.Debug().Err(err).Msg("could not send task events")
+			return
+		}
+	}
+}
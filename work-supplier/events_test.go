@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/client"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/outbox"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/progress"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/pubsub/mempubsub"
+)
+
+// streamingSupplier serves s without buffering its responses, unlike the
+// validating server of the contract tests.
+func streamingSupplier(t *testing.T, s *server) *client.Supplier {
+	server := httptest.NewServer(s.routes())
+	t.Cleanup(server.Close)
+	return testSupplier(t, server)
+}
+
+func TestTaskEventsStreamProgress(t *testing.T) {
+	s := testServer(t, mempubsub.NewTopic(), false, nil)
+	s.progress = progress.NewHub(time.Hour)
+	supplier := streamingSupplier(t, s)
+	taskID := uuid.New()
+	percent := 10
+	s.progress.Publish(progress.Event{TaskID: taskID, State: progress.StateRunning, Percent: &percent, Message: "fetching", Time: time.Now()})
+
+	events := []client.TaskEvent{}
+	err := supplier.Events(context.Background(), taskID, func(event client.TaskEvent) error {
+		events = append(events, event)
+		if event.Status == client.TaskEventRunning {
+			// Only sent once the stream started
+			s.progress.Publish(progress.Event{TaskID: taskID, State: progress.StateSucceeded, Time: time.Now()})
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.NotNil(t, events[0].Percent)
+	assert.Equal(t, 10, *events[0].Percent)
+	require.NotNil(t, events[0].Message)
+	assert.Equal(t, "fetching", *events[0].Message)
+	assert.Equal(t, client.TaskEventSucceeded, events[1].Status)
+}
+
+func TestTaskEventsStreamOutboxStatuses(t *testing.T) {
+	ctx := context.Background()
+	topic := mempubsub.NewTopic()
+	require.NoError(t, topic.Shutdown(ctx))
+	store, err := outbox.OpenSQLiteStore(ctx, filepath.Join(t.TempDir(), "outbox.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	s := testServer(t, topic, false, nil)
+	s.cfg.WatchInterval = time.Millisecond * 5
+	s.relay = outbox.NewRelay(store, s.publisher, s.cfg.OutboxConfig, nil)
+	supplier := streamingSupplier(t, s)
+
+	// Left to the relay, as the broker is down
+	submitted, err := supplier.Submit(ctx, "greet", nil, "")
+	require.NoError(t, err)
+	statuses := []client.TaskEventStatus{}
+	err = supplier.Events(ctx, submitted.Id, func(event client.TaskEvent) error {
+		statuses = append(statuses, event.Status)
+		if event.Status == client.TaskEventPending {
+			return store.MarkSent(ctx, submitted.Id, time.Now())
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	// Without progress, there is nothing to report once it is enqueued
+	assert.Equal(t, []client.TaskEventStatus{client.TaskEventPending, client.TaskEventEnqueued}, statuses)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/apierror"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/client/supplierpb"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/outbox"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/publish"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var statusesPB = map[string]supplierpb.Status{
+	string(outbox.StatusPending):   supplierpb.Status_STATUS_PENDING,
+	string(publish.OutcomeSpooled): supplierpb.Status_STATUS_SPOOLED,
+	string(outbox.StatusEnqueued):  supplierpb.Status_STATUS_ENQUEUED,
+}
+
+// grpcSupplier serves the gRPC API through the same core as the HTTP
+// handlers.
+type grpcSupplier struct {
+	supplierpb.UnimplementedSupplierServer
+	server *server
+}
+
+// grpcServer returns the gRPC server of the supplier, errors are sent the
+// way apierror sends them over HTTP.
+func (s *server) grpcServer() *grpc.Server {
+	g := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(apierror.UnaryServerInterceptor),
+		grpc.ChainStreamInterceptor(apierror.StreamServerInterceptor),
+	)
+	supplierpb.RegisterSupplierServer(g, &grpcSupplier{server: s})
+	return g
+}
+
+// grpcLoop serves the gRPC API on addr until ctx is done.
+func grpcLoop(ctx context.Context, addr string, g *grpc.Server) error {
+	log := zerolog.Ctx(ctx)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("could not listen for gRPC: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		log.Info().Msg("shutting down gRPC server")
+		g.GracefulStop()
+	}()
+	log.Info().Str("addr", addr).Msg("Starting gRPC server")
+	return g.Serve(listener)
+}
+
+func (g *grpcSupplier) SubmitTask(ctx context.Context, request *supplierpb.SubmitTaskRequest) (*supplierpb.Task, error) {
+	deadline, err := deadlinePB(request.Deadline)
+	if err != nil {
+		return nil, err
+	}
+	submitted, err := g.server.submit(ctx, request.TaskName, request.OrderingKey, request.Arguments, deadline)
+	if err != nil {
+		return nil, err
+	}
+	return submissionPB(submitted), nil
+}
+
+func (g *grpcSupplier) SubmitBatch(ctx context.Context, request *supplierpb.SubmitBatchRequest) (*supplierpb.SubmitBatchResponse, error) {
+	if len(request.Tasks) > g.server.cfg.GRPCMaxBatchSize {
+		return nil, apierror.InvalidArgument(fmt.Sprintf("a batch cannot hold more than %d tasks", g.server.cfg.GRPCMaxBatchSize))
+	}
+	response := &supplierpb.SubmitBatchResponse{
+		Results: make([]*supplierpb.SubmitBatchResult, len(request.Tasks)),
+	}
+	for i, task := range request.Tasks {
+		var submitted submission
+		deadline, err := deadlinePB(task.Deadline)
+		if err == nil {
+			submitted, err = g.server.submit(ctx, task.TaskName, task.OrderingKey, task.Arguments, deadline)
+		}
+		if err != nil {
+			apiErr := apierror.From(err)
+			zerolog.Ctx(ctx).Warn().Err(apiErr).Int("index", i).Msg("could not submit task of batch")
+			response.Results[i] = &supplierpb.SubmitBatchResult{
+				Result: &supplierpb.SubmitBatchResult_Error{
+					Error: &supplierpb.Error{Code: string(apiErr.Code), Detail: apiErr.Detail},
+				},
+			}
+			continue
+		}
+		response.Results[i] = &supplierpb.SubmitBatchResult{
+			Result: &supplierpb.SubmitBatchResult_Task{Task: submissionPB(submitted)},
+		}
+	}
+	return response, nil
+}
+
+func (g *grpcSupplier) GetTask(ctx context.Context, request *supplierpb.GetTaskRequest) (*supplierpb.Task, error) {
+	id, err := uuid.Parse(request.Id)
+	if err != nil {
+		return nil, apierror.InvalidArgument("the task ID must be a UUID")
+	}
+	status, err := g.server.taskStatus(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &supplierpb.Task{Id: id.String(), Status: statusesPB[string(status)]}, nil
+}
+
+// WatchTask polls the status of the task every WATCH_INTERVAL.
+func (g *grpcSupplier) WatchTask(request *supplierpb.WatchTaskRequest, stream supplierpb.Supplier_WatchTaskServer) error {
+	ctx := stream.Context()
+	id, err := uuid.Parse(request.Id)
+	if err != nil {
+		return apierror.InvalidArgument("the task ID must be a UUID")
+	}
+	ticker := time.NewTicker(g.server.cfg.WatchInterval)
+	defer ticker.Stop()
+	var last outbox.Status
+	for {
+		status, err := g.server.taskStatus(ctx, id)
+		if err != nil {
+			return err
+		}
+		if status != last {
+			if err := stream.Send(&supplierpb.Task{Id: id.String(), Status: statusesPB[string(status)]}); err != nil {
+				return err
+			}
+			last = status
+		}
+		if status == outbox.StatusEnqueued {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// deadlinePB is the deadline of a request, nil when unset.
+func deadlinePB(deadline *timestamppb.Timestamp) (*time.Time, error) {
+	if deadline == nil {
+		return nil, nil
+	} else if err := deadline.CheckValid(); err != nil {
+		return nil, apierror.InvalidArgument("the deadline is not a valid timestamp")
+	}
+	t := deadline.AsTime()
+	return &t, nil
+}
+
+func submissionPB(submitted submission) *supplierpb.Task {
+	return &supplierpb.Task{
+		Id:       submitted.ID.String(),
+		TaskName: submitted.TaskName,
+		Status:   statusesPB[submitted.Status],
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/apierror"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/client/supplierpb"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/envelope"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/outbox"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/pubsub/mempubsub"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcClient serves s over an in-memory connection.
+func grpcClient(t *testing.T, s *server) supplierpb.SupplierClient {
+	s.cfg.WatchInterval = time.Millisecond * 5
+	listener := bufconn.Listen(1 << 20)
+	g := s.grpcServer()
+	go g.Serve(listener)
+	t.Cleanup(g.Stop)
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return supplierpb.NewSupplierClient(conn)
+}
+
+func TestGRPCSubmitTask(t *testing.T) {
+	supplier := grpcClient(t, testServer(t, mempubsub.NewTopic(), false, nil))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), apierror.RequestIDMetadata, "test-request")
+
+	header := metadata.MD{}
+	task, err := supplier.SubmitTask(ctx, &supplierpb.SubmitTaskRequest{TaskName: "greet", Arguments: []byte(`{"name":"gopher"}`)}, grpc.Header(&header))
+	require.NoError(t, err)
+	assert.Equal(t, "greet", task.TaskName)
+	assert.Equal(t, supplierpb.Status_STATUS_ENQUEUED, task.Status)
+	_, err = uuid.Parse(task.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test-request"}, header.Get(apierror.RequestIDMetadata))
+
+	for name, c := range map[string]struct {
+		request *supplierpb.SubmitTaskRequest
+		code    codes.Code
+	}{
+		"no task name":         {&supplierpb.SubmitTaskRequest{}, codes.InvalidArgument},
+		"invalid ordering key": {&supplierpb.SubmitTaskRequest{TaskName: "greet", OrderingKey: "has spaces"}, codes.InvalidArgument},
+		"invalid arguments":    {&supplierpb.SubmitTaskRequest{TaskName: "greet", Arguments: []byte("{")}, codes.InvalidArgument},
+		"passed deadline":      {&supplierpb.SubmitTaskRequest{TaskName: "greet", Deadline: timestamppb.New(time.Now().Add(-time.Second))}, codes.InvalidArgument},
+		"invalid deadline":     {&supplierpb.SubmitTaskRequest{TaskName: "greet", Deadline: &timestamppb.Timestamp{Nanos: -1}}, codes.InvalidArgument},
+		"too large":            {&supplierpb.SubmitTaskRequest{TaskName: "greet", Arguments: []byte(`"` + strings.Repeat("a", 128) + `"`)}, codes.ResourceExhausted},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := supplier.SubmitTask(ctx, c.request)
+			assert.Equal(t, c.code, status.Code(err), "got %v", err)
+		})
+	}
+}
+
+func TestGRPCSubmitTaskWithDeadline(t *testing.T) {
+	ctx := context.Background()
+	topic := mempubsub.NewTopic()
+	subscription := mempubsub.NewSubscription(topic, time.Minute)
+	defer subscription.Shutdown(ctx)
+	supplier := grpcClient(t, testServer(t, topic, false, nil))
+
+	deadline := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	_, err := supplier.SubmitTask(ctx, &supplierpb.SubmitTaskRequest{TaskName: "greet", Deadline: timestamppb.New(deadline)})
+	require.NoError(t, err)
+	message, err := subscription.Receive(ctx)
+	require.NoError(t, err)
+	message.Ack()
+	payload, err := envelope.NewRegistry().Decode(message.Body, message.Metadata)
+	require.NoError(t, err)
+	require.NotNil(t, payload.Deadline)
+	assert.True(t, deadline.Equal(*payload.Deadline))
+}
+
+func TestGRPCSubmitTaskUnavailable(t *testing.T) {
+	topic := mempubsub.NewTopic()
+	require.NoError(t, topic.Shutdown(context.Background()))
+	supplier := grpcClient(t, testServer(t, topic, false, nil))
+	ctx := context.Background()
+
+	_, err := supplier.SubmitTask(ctx, &supplierpb.SubmitTaskRequest{TaskName: "greet"})
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.NotContains(t, err.Error(), "Shutdown")
+
+	trailer := metadata.MD{}
+	_, err = supplier.SubmitTask(ctx, &supplierpb.SubmitTaskRequest{TaskName: "greet"}, grpc.Trailer(&trailer))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.NotEmpty(t, trailer.Get(apierror.RetryAfterMetadata))
+}
+
+func TestGRPCSubmitBatch(t *testing.T) {
+	supplier := grpcClient(t, testServer(t, mempubsub.NewTopic(), false, nil))
+	response, err := supplier.SubmitBatch(context.Background(), &supplierpb.SubmitBatchRequest{
+		Tasks: []*supplierpb.SubmitTaskRequest{
+			{TaskName: "greet"},
+			{TaskName: "greet", Arguments: []byte("{")},
+			{TaskName: "farewell", OrderingKey: "first"},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, response.Results, 3)
+	assert.Equal(t, "greet", response.Results[0].GetTask().TaskName)
+	assert.Equal(t, string(apierror.CodeInvalidArgument), response.Results[1].GetError().Code)
+	assert.Nil(t, response.Results[1].GetTask())
+	assert.Equal(t, "farewell", response.Results[2].GetTask().TaskName)
+}
+
+func TestGRPCSubmitBatchTooLarge(t *testing.T) {
+	s := testServer(t, mempubsub.NewTopic(), false, nil)
+	s.cfg.GRPCMaxBatchSize = 1
+	supplier := grpcClient(t, s)
+	_, err := supplier.SubmitBatch(context.Background(), &supplierpb.SubmitBatchRequest{
+		Tasks: []*supplierpb.SubmitTaskRequest{{TaskName: "greet"}, {TaskName: "greet"}},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestGRPCGetTask(t *testing.T) {
+	supplier := grpcClient(t, testServer(t, mempubsub.NewTopic(), true, nil))
+	ctx := context.Background()
+	submitted, err := supplier.SubmitTask(ctx, &supplierpb.SubmitTaskRequest{TaskName: "greet"})
+	require.NoError(t, err)
+
+	task, err := supplier.GetTask(ctx, &supplierpb.GetTaskRequest{Id: submitted.Id})
+	require.NoError(t, err)
+	assert.Equal(t, supplierpb.Status_STATUS_ENQUEUED, task.Status)
+
+	_, err = supplier.GetTask(ctx, &supplierpb.GetTaskRequest{Id: uuid.NewString()})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = supplier.GetTask(ctx, &supplierpb.GetTaskRequest{Id: "nope"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestGRPCGetTaskWithoutOutbox(t *testing.T) {
+	supplier := grpcClient(t, testServer(t, mempubsub.NewTopic(), false, nil))
+	_, err := supplier.GetTask(context.Background(), &supplierpb.GetTaskRequest{Id: uuid.NewString()})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestGRPCWatchTask(t *testing.T) {
+	ctx := context.Background()
+	topic := mempubsub.NewTopic()
+	require.NoError(t, topic.Shutdown(ctx))
+	store, err := outbox.OpenSQLiteStore(ctx, filepath.Join(t.TempDir(), "outbox.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	s := testServer(t, topic, false, nil)
+	s.relay = outbox.NewRelay(store, s.publisher, s.cfg.OutboxConfig, nil)
+	supplier := grpcClient(t, s)
+
+	// Left to the relay, as the broker is down
+	submitted, err := supplier.SubmitTask(ctx, &supplierpb.SubmitTaskRequest{TaskName: "greet"})
+	require.NoError(t, err)
+	assert.Equal(t, supplierpb.Status_STATUS_PENDING, submitted.Status)
+
+	stream, err := supplier.WatchTask(ctx, &supplierpb.WatchTaskRequest{Id: submitted.Id})
+	require.NoError(t, err)
+	task, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, supplierpb.Status_STATUS_PENDING, task.Status)
+
+	require.NoError(t, store.MarkSent(ctx, uuid.MustParse(submitted.Id), time.Now()))
+	task, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, supplierpb.Status_STATUS_ENQUEUED, task.Status)
+	_, err = stream.Recv()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestGRPCWatchTaskNotFound(t *testing.T) {
+	supplier := grpcClient(t, testServer(t, mempubsub.NewTopic(), true, nil))
+	stream, err := supplier.WatchTask(context.Background(), &supplierpb.WatchTaskRequest{Id: uuid.NewString()})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
@@ -2,92 +2,159 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"net/http"
+	"os"
 	"time"
 
-	"github.com/gin-gonic/gin/render"
-	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
 	"github.com/google/uuid"
 	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
-	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/envutil"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/config"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/envelope"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/health"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/outbox"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/progress"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/publish"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/queue"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/secrets"
 	_ "github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/zerologutil"
 	"github.com/rs/zerolog"
 	"gocloud.dev/pubsub"
 )
 
 func main() {
+	health.RunCommandIfRequested(os.Args, "http://127.0.0.1:8080")
+
 	initCtx, initCtxCancel := context.WithTimeout(context.Background(), time.Second*15)
 	initCtx = zerolog.Ctx(initCtx).With().Str("scope", "initialization").Logger().WithContext(initCtx)
 	defer initCtxCancel()
 	initLog := zerolog.Ctx(initCtx)
-	queueURL := envutil.Must(initCtx, "QUEUE_URL")
-	topic, err := InitializeQueueSink(initCtx, queueURL)
+	resolver, err := secrets.NewResolver(initCtx, time.Minute*5)
+	if err != nil {
+		initLog.Fatal().Err(err).Msg("could not initialize secrets resolver")
+	}
+	// The relay subcommand relays the outbox once and exits, for where the
+	// supplier is frozen between requests and can't do it in a loop
+	args := os.Args[1:]
+	relayOnce := len(args) > 0 && args[0] == "relay"
+	if relayOnce {
+		args = args[1:]
+	}
+	cfg := Config{}
+	if err := config.Load(initCtx, "work-supplier", &cfg, args, config.WithSecretResolver(resolver)); errors.Is(err, config.ErrPrinted) {
+		return
+	} else if err != nil {
+		initLog.Fatal().Err(err).Msg("could not load configuration")
+	}
+	topic, err := InitializeQueueSink(initCtx, cfg)
 	if err != nil {
 		initLog.Fatal().Err(err).Msg("could not initialize topic")
 	}
-
-	r := chi.NewRouter()
-
-	zerologMiddleware := func(h http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ctx := zerolog.Ctx(r.Context()).WithContext(r.Context())
-			r = r.WithContext(ctx)
-			h.ServeHTTP(w, r)
-		})
+	claims, closeClaims, err := InitializeClaimCheckStore(initCtx, cfg)
+	if err != nil {
+		initLog.Fatal().Err(err).Msg("could not initialize claim check store")
+	}
+	defer closeClaims()
+	encrypter, err := InitializeEncrypter(initCtx, cfg)
+	if err != nil {
+		initLog.Fatal().Err(err).Msg("could not initialize encryption")
+	}
+	outboxStore, closeOutbox, err := InitializeOutboxStore(initCtx, cfg)
+	if err != nil {
+		initLog.Fatal().Err(err).Msg("could not initialize outbox")
+	}
+	defer closeOutbox()
+	workflows, closeWorkflows, err := InitializeWorkflowTracker(initCtx, cfg)
+	if err != nil {
+		initLog.Fatal().Err(err).Msg("could not initialize workflow tracker")
 	}
-	r.Use(zerologMiddleware, middleware.RealIP)
-	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		render.JSON{
-			Data: map[string]any{
-				"your_ip": r.RemoteAddr,
-			},
-		}.Render(w)
-	})
-	r.Post("/task/{name}", func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		log := zerolog.Ctx(ctx)
-		taskName := chi.URLParam(r, "name")
-		payload := lib.PayloadItem{
-			ID:       uuid.New(),
-			Time:     time.Now(),
-			TaskName: taskName,
+	defer closeWorkflows()
+	brokerProbe, err := InitializeReadinessProbe(initCtx, cfg)
+	if err != nil {
+		initLog.Fatal().Err(err).Msg("could not initialize readiness probe")
+	}
+	codecs := envelope.NewRegistry(envelope.WithCompression(cfg.Compression, cfg.CompressionThreshold))
+	// Should sending be retried, SQS FIFO queues drop the duplicate
+	prepareMessage := func(message *pubsub.Message, id uuid.UUID) {
+		if cfg.IsFIFO() {
+			message.BeforeSend = queue.FIFOBeforeSend(message.Metadata[lib.PartitionKeyMetadata], id.String())
 		}
-		jsonBytes, err := json.Marshal(payload)
-		if err != nil {
-			// This should never happen. If it does, something has gone wrong.
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("500"))
-			log.Panic().Err(err).Msg("could not serialize json")
-			return
+	}
+	var spool *publish.Spool
+	if cfg.SpoolDir != "" {
+		if spool, err = publish.OpenSpool(cfg.SpoolDir, cfg.SpoolMaxBytes); err != nil {
+			initLog.Fatal().Err(err).Msg("could not open spool")
 		}
-
-		err = topic.Send(ctx, &pubsub.Message{
-			Body: jsonBytes,
+	}
+	publisher := publish.NewPublisher(topic, spool, cfg.PublishConfig, prepareMessage)
+	var relay *outbox.Relay
+	if outboxStore != nil {
+		relay = outbox.NewRelay(outboxStore, publisher, cfg.OutboxConfig, func(message *pubsub.Message, entry outbox.Entry) {
+			prepareMessage(message, entry.ID)
 		})
-		if err != nil {
-			w.WriteHeader(http.StatusFailedDependency)
-			render.JSON{
-				Data: map[string]any{
-					"error": err.Error(),
-				},
-			}.Render(w)
-			return
+	}
+	if relayOnce {
+		relayCtx := zerolog.Ctx(context.Background()).With().Str("scope", "relay").Logger().WithContext(context.Background())
+		if relay == nil {
+			initLog.Fatal().Msg("the relay subcommand requires OUTBOX_URL")
+		} else if err := relay.Drain(relayCtx); err != nil {
+			initLog.Fatal().Err(err).Msg("could not relay the outbox")
 		}
-
-		response := map[string]any{
-			"task_name": taskName,
+		return
+	}
+	go func() {
+		ctx := zerolog.Ctx(context.Background()).With().Str("loop", "flushing").Logger().WithContext(context.Background())
+		if err := publisher.Run(ctx); err != nil {
+			zerolog.Ctx(ctx).Error().Err(err).Msg("spool flusher stopped")
 		}
+	}()
+	if relay != nil && cfg.OutboxRelayLoop {
+		relayCtx := zerolog.Ctx(context.Background()).With().Str("loop", "relay").Logger().WithContext(context.Background())
+		go func() {
+			if err := relay.Run(relayCtx); err != nil {
+				zerolog.Ctx(relayCtx).Error().Err(err).Msg("outbox relay stopped")
+			}
+		}()
+	}
+	var hub *progress.Hub
+	progressSubscription, err := progress.OpenSubscription(initCtx, cfg.ProgressConfig, cfg.QueueConfig)
+	if err != nil {
+		initLog.Fatal().Err(err).Msg("could not initialize progress subscription")
+	} else if progressSubscription != nil {
+		hub = progress.NewHub(cfg.ProgressRetention)
+		progressCtx := zerolog.Ctx(context.Background()).With().Str("loop", "progress").Logger().WithContext(context.Background())
+		go hub.Run(progressCtx, progressSubscription, func(ctx context.Context) (*pubsub.Subscription, error) {
+			return progress.OpenSubscription(ctx, cfg.ProgressConfig, cfg.QueueConfig)
+		})
+	}
+	checker := health.NewChecker(time.Second * 5)
+	// With a spool, tasks are still accepted while the broker is down
+	if spool == nil {
+		checker.Add("broker", brokerProbe)
+	}
+	checker.Add("publishing", publisher.Probe)
 
-		log.Info().Any("task_name", taskName).Msg("responding to client for task")
-		render.JSON{
-			Data: response,
-		}.Render(w)
-	})
+	s := &server{
+		cfg:       cfg,
+		codecs:    codecs,
+		claims:    claims,
+		encrypter: encrypter,
+		publisher: publisher,
+		relay:     relay,
+		progress:  hub,
+		workflows: workflows,
+		checker:   checker,
+	}
+	if cfg.GRPCAddr != "" {
+		grpcCtx := zerolog.Ctx(context.Background()).With().Str("loop", "grpc").Logger().WithContext(context.Background())
+		go func() {
+			if err := grpcLoop(grpcCtx, cfg.GRPCAddr, s.grpcServer()); err != nil {
+				zerolog.Ctx(grpcCtx).Fatal().Err(err).Msg("gRPC server stopped")
+			}
+		}()
+	}
 	initLog.Info().Msg("Starting")
-	if err := http.ListenAndServe(":8080", r); errors.Is(err, http.ErrServerClosed) {
+	if err := http.ListenAndServe(":8080", s.routes()); errors.Is(err, http.ErrServerClosed) {
 		initLog.Info().Msg("Gracefullly shutdown")
 	} else if err != nil {
 		initLog.Fatal().Err(err).Msg("an error occurred and we abruptly shutdown")
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin/render"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/apierror"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/claimcheck"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/client"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/encryption"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/envelope"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/health"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/outbox"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/progress"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/publish"
+	"github.com/niko-dunixi/golang-simple-ingestion-pipeline-template/lib/workflow"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+	"gocloud.dev/pubsub"
+)
+
+// orderingKeyPattern matches the characters SQS accepts in a message group ID,
+// the strictest of the brokers.
+var orderingKeyPattern = regexp.MustCompile(`^[\x21-\x7E]{1,128}$`)
+
+// server holds what the handlers of the supplier need. Its routes are
+// described by the OpenAPI specification in lib/client, which the contract
+// tests hold them to.
+type server struct {
+	cfg       Config
+	codecs    *envelope.Registry
+	claims    *claimcheck.Store
+	encrypter *encryption.Encrypter
+	publisher *publish.Publisher
+	// relay is nil without an outbox
+	relay *outbox.Relay
+	// progress is nil without PROGRESS_URL
+	progress *progress.Hub
+	// workflows is nil without WORKFLOW_URL
+	workflows *workflow.Tracker
+	checker   *health.Checker
+}
+
+func (s *server) routes() chi.Router {
+	r := chi.NewRouter()
+
+	zerologMiddleware := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := zerolog.Ctx(r.Context()).WithContext(r.Context())
+			r = r.WithContext(ctx)
+			h.ServeHTTP(w, r)
+		})
+	}
+	// Every response carries the ID of its request, and errors never tell
+	// clients more than their problem details
+	r.Use(zerologMiddleware, middleware.RequestID, apierror.EchoRequestID, middleware.RealIP, apierror.Recoverer)
+	r.NotFound(apierror.NotFound)
+	r.MethodNotAllowed(apierror.MethodNotAllowed)
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		render.JSON{
+			Data: map[string]any{
+				"your_ip": r.RemoteAddr,
+			},
+		}.Render(w)
+	})
+	r.Get(health.LivenessPath, s.checker.LivenessHandler())
+	r.Get(health.ReadinessPath, s.checker.ReadinessHandler())
+	r.Get("/metrics", promhttp.Handler().ServeHTTP)
+	r.Get("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(client.Spec)
+	})
+	r.Post("/task/{task}", s.handleSubmitTask)
+	r.Get("/task/{task}", s.handleTaskStatus)
+	r.Get("/task/{task}/events", s.handleTaskEvents)
+	r.Get("/workflows/{id}", s.handleWorkflow)
+	return r
+}
+
+// submission is a task accepted by the supplier.
+type submission struct {
+	ID       uuid.UUID
+	TaskName string
+	// Status is an outbox.Status or, when the broker is down, spooled
+	Status string
+}
+
+// submit enqueues a task, failing with an *apierror.Error. It is the core
+// shared by the HTTP and gRPC APIs. The deadline is nil when the client
+// didn't set one.
+func (s *server) submit(ctx context.Context, taskName string, orderingKey string, arguments []byte, deadline *time.Time) (submission, error) {
+	log := zerolog.Ctx(ctx)
+	if taskName == "" {
+		return submission{}, apierror.InvalidArgument("the task name is required")
+	} else if orderingKey != "" && !orderingKeyPattern.MatchString(orderingKey) {
+		return submission{}, apierror.InvalidArgument("ordering_key must be 1 to 128 printable ASCII characters without spaces")
+	} else if len(arguments) > s.cfg.MaxArgumentsBytes {
+		return submission{}, apierror.PayloadTooLarge(fmt.Sprintf("arguments cannot exceed %d bytes", s.cfg.MaxArgumentsBytes))
+	} else if len(arguments) > 0 && !json.Valid(arguments) {
+		return submission{}, apierror.InvalidArgument("arguments must be JSON")
+	} else if deadline != nil && !deadline.After(time.Now()) {
+		return submission{}, apierror.InvalidArgument("the deadline already passed")
+	}
+	payload := lib.PayloadItem{
+		ID:       uuid.New(),
+		Time:     time.Now(),
+		TaskName: taskName,
+		// Tasks sharing an ordering key are processed in the order they
+		// were submitted, on brokers that can preserve it
+		OrderingKey: orderingKey,
+		Arguments:   arguments,
+		// The consumer gives up on the task once it passed
+		Deadline: deadline,
+	}
+	partitionKey := s.cfg.partitionKey(payload)
+	// Only the consumer is able to decrypt them again
+	keyID, err := s.encrypter.Seal(ctx, &payload)
+	if err != nil {
+		return submission{}, apierror.DependencyFailed("could not encrypt the task arguments", err)
+	}
+	body, metadata, err := s.codecs.Encode(payload, s.cfg.ContentType)
+	if err != nil {
+		// This should never happen. If it does, something has gone wrong.
+		return submission{}, apierror.Internal(fmt.Errorf("could not serialize payload: %w", err))
+	}
+
+	metadata[lib.PartitionKeyMetadata] = partitionKey
+	metadata[lib.TaskNameMetadata] = taskName
+	if keyID != "" {
+		metadata[encryption.KeyIDMetadata] = keyID
+	}
+	message := &pubsub.Message{
+		Body:     body,
+		Metadata: metadata,
+	}
+	if s.cfg.IsFIFO() && !orderingKeyPattern.MatchString(partitionKey) {
+		return submission{}, apierror.InvalidArgument("the task name cannot be used as a message group, pass an ordering_key")
+	}
+	// Bodies too large for the broker are sent by reference
+	status := string(outbox.StatusEnqueued)
+	err = s.claims.Offload(ctx, message)
+	if err == nil && s.relay != nil {
+		// Recorded before anything is sent, should sending fail or we
+		// crash in between, the relay sends it later on
+		var entry outbox.Entry
+		entry, err = s.relay.Add(ctx, outbox.Entry{
+			ID:       payload.ID,
+			TaskName: taskName,
+			Body:     message.Body,
+			Metadata: message.Metadata,
+		})
+		if err == nil {
+			if sendErr := s.relay.Send(ctx, entry); sendErr != nil {
+				log.Warn().Err(sendErr).Msg("could not send message, leaving it to the relay")
+				status = string(outbox.StatusPending)
+			}
+		}
+	} else if err == nil {
+		var outcome publish.Outcome
+		if outcome, err = s.publisher.Publish(ctx, payload.ID, message); outcome == publish.OutcomeSpooled {
+			status = string(outcome)
+		}
+	}
+	if errors.Is(err, publish.ErrUnavailable) || errors.Is(err, publish.ErrSpoolFull) {
+		return submission{}, apierror.Unavailable("the queue is unavailable, try again later", s.cfg.BreakerOpenTimeout, err)
+	} else if err != nil {
+		return submission{}, apierror.DependencyFailed("could not enqueue the task", err)
+	}
+	log.Info().Any("task_name", taskName).Str("task_id", payload.ID.String()).Msg("accepted task")
+	return submission{ID: payload.ID, TaskName: taskName, Status: status}, nil
+}
+
+// taskStatus returns the status of the task, failing with an
+// *apierror.Error.
+func (s *server) taskStatus(ctx context.Context, id uuid.UUID) (outbox.Status, error) {
+	if s.relay == nil {
+		return "", apierror.ResourceNotFound("task statuses are only kept when OUTBOX_URL is set")
+	}
+	status, err := s.relay.Status(ctx, id)
+	if errors.Is(err, outbox.ErrNotFound) {
+		return "", apierror.ResourceNotFound(fmt.Sprintf("task %s was not found", id))
+	} else if err != nil {
+		return "", apierror.DependencyFailed("could not look up the task", err)
+	}
+	return status, nil
+}
+
+func (s *server) handleSubmitTask(w http.ResponseWriter, r *http.Request) {
+	arguments, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(s.cfg.MaxArgumentsBytes)))
+	if err != nil {
+		apierror.Write(w, r, apierror.PayloadTooLarge(fmt.Sprintf("arguments cannot exceed %d bytes", s.cfg.MaxArgumentsBytes)))
+		return
+	}
+	var deadline *time.Time
+	if value := r.URL.Query().Get("deadline"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			apierror.Write(w, r, apierror.InvalidArgument("deadline must be an RFC 3339 date-time"))
+			return
+		}
+		deadline = &parsed
+	}
+	submitted, err := s.submit(r.Context(), chi.URLParam(r, "task"), r.URL.Query().Get("ordering_key"), arguments, deadline)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+	response := render.JSON{
+		Data: map[string]any{
+			"id":        submitted.ID,
+			"task_name": submitted.TaskName,
+			"status":    submitted.Status,
+		},
+	}
+	if submitted.Status == string(publish.OutcomeSpooled) {
+		// Sent once the broker recovers
+		response.WriteContentType(w)
+		w.WriteHeader(http.StatusAccepted)
+	}
+	response.Render(w)
+}
+
+func (s *server) handleTaskStatus(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "task"))
+	if err != nil {
+		apierror.Write(w, r, apierror.InvalidArgument("the task ID must be a UUID"))
+		return
+	}
+	status, err := s.taskStatus(r.Context(), id)
+	if err != nil {
+		apierror.Write(w, r, err)
+		return
+	}
+	render.JSON{
+		Data: map[string]any{
+			"id":     id,
+			"status": status,
+		},
+	}.Render(w)
+}
+
+func (s *server) handleWorkflow(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		apierror.Write(w, r, apierror.InvalidArgument("the workflow ID must be a UUID"))
+		return
+	} else if s.workflows == nil {
+		apierror.Write(w, r, apierror.ResourceNotFound("workflows are only tracked when WORKFLOW_URL is set"))
+		return
+	}
+	found, err := s.workflows.Workflow(r.Context(), id)
+	if errors.Is(err, workflow.ErrNotFound) {
+		apierror.Write(w, r, apierror.ResourceNotFound(fmt.Sprintf("workflow %s was not found", id)))
+		return
+	} else if err != nil {
+		apierror.Write(w, r, apierror.DependencyFailed("could not look up the workflow", err))
+		return
+	}
+	steps := []map[string]any{}
+	for _, step := range found.Steps {
+		data := map[string]any{
+			"id":           step.ID,
+			"task_name":    step.TaskName,
+			"status":       step.State,
+			"children":     step.Children,
+			"pending":      step.Pending,
+			"compensation": step.Compensates,
+		}
+		// The root has no parent
+		if step.ParentID != uuid.Nil {
+			data["parent_id"] = step.ParentID
+		}
+		steps = append(steps, data)
+	}
+	render.JSON{
+		Data: map[string]any{
+			"id":     found.ID,
+			"status": found.State,
+			"steps":  steps,
+		},
+	}.Render(w)
+}